@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// a single entry in the append-only audit log
+type auditEntry struct {
+	ID        int64    `json:"id"`
+	Timestamp string   `json:"timestamp"`
+	Principal string   `json:"principal"`
+	SourceIP  string   `json:"source_ip"`
+	RequestID string   `json:"request_id"`
+	Method    string   `json:"method"`
+	Path      string   `json:"path"`
+	Action    string   `json:"action"`
+	IDs       []string `json:"ids"`
+	Created   int      `json:"created"`
+	Updated   int      `json:"updated"`
+	Deleted   int      `json:"deleted"`
+	Message   string   `json:"message,omitempty"`
+}
+
+type getAuditResponse struct {
+	Count     int          `json:"count"`
+	QueryTime string       `json:"query_time"`
+	Entries   []auditEntry `json:"entries"`
+}
+
+// records an action in the audit log, on behalf of whoever asked for it
+type auditFunc func(action string, ids []string, created int, updated int, deleted int, message string)
+
+// record a write or admin action in the audit log
+// failing to write the audit log is logged, but won't fail the request
+func auditLog(c *gin.Context, action string, ids []string, created int, updated int, deleted int, message string) {
+
+	writeAuditEntry(auditEntry{
+		Timestamp: time.Now().UTC().Format("2006-01-02 15:04:05"),
+		Principal: getPrincipal(c),
+		SourceIP:  c.ClientIP(),
+		RequestID: c.GetString(requestIDKey),
+		Method:    c.Request.Method,
+		Path:      c.Request.URL.RequestURI(),
+		Action:    action,
+		IDs:       ids,
+		Created:   created,
+		Updated:   updated,
+		Deleted:   deleted,
+		Message:   message,
+	})
+
+}
+
+// an auditFunc for actions taken while handling the request
+func requestAuditor(c *gin.Context) auditFunc {
+
+	return func(action string, ids []string, created int, updated int, deleted int, message string) {
+		auditLog(c, action, ids, created, updated, deleted, message)
+	}
+
+}
+
+func writeAuditEntry(entry auditEntry) {
+
+	debugMessage(entry)
+
+	if err := saveMariadbAuditEntry(entry); err != nil {
+		log.Println(err.Error())
+	}
+
+}
+
+// the authenticated principal making the request, if any
+func getPrincipal(c *gin.Context) string {
+
+	if user := c.GetString(gin.AuthUserKey); user != "" {
+		return user
+	}
+
+	return "anonymous"
+
+}
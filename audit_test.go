@@ -0,0 +1,21 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetPrincipal(t *testing.T) {
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+
+	assert.Equal(t, "anonymous", getPrincipal(c), "no authenticated user")
+
+	c.Set(gin.AuthUserKey, "writer")
+
+	assert.Equal(t, "writer", getPrincipal(c), "basic auth user")
+
+}
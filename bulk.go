@@ -0,0 +1,1252 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pdxfixit/hostdb"
+)
+
+// what a bulk request changed, or would change during a dry run
+type bulkResult struct {
+	OK        bool              `json:"ok"`
+	DryRun    bool              `json:"dry_run,omitempty"`
+	Partial   bool              `json:"partial,omitempty"`
+	Message   string            `json:"message,omitempty"`
+	Error     string            `json:"error,omitempty"`
+	IDs       []string          `json:"ids"` // the id of each incoming record, by its position in the request
+	Created   []bulkResultEntry `json:"created"`
+	Updated   []bulkResultEntry `json:"updated"`
+	Unchanged []bulkResultEntry `json:"unchanged"`
+	Deleted   []string          `json:"deleted"`
+	Errors    []bulkRecordError `json:"errors"`
+	Warnings  []bulkRecordError `json:"warnings,omitempty"` // records saved despite not matching the schema for their type, in warn mode
+}
+
+// an incoming record, by its position in the request
+type bulkResultEntry struct {
+	Index       int               `json:"index"`
+	ID          string            `json:"id,omitempty"`
+	Differences []fieldDifference `json:"differences,omitempty"`
+}
+
+// an incoming record which failed validation, or was saved with a warning
+type bulkRecordError struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// a single changed value within an updated record
+type fieldDifference struct {
+	Path string      `json:"path"`
+	Old  interface{} `json:"old"`
+	New  interface{} `json:"new"`
+}
+
+// the default number of records written per statement
+const defaultBulkBatchSize = 500
+
+// reconciles the incoming records of a bulk request against the existing records in scope, one record at a time
+// so that very large record sets can be streamed, the existing records are held without their data,
+// and the records to be written can be spooled to a file rather than kept in memory
+type bulkReconciler struct {
+	bulk       hostdb.RecordSet
+	dryRun     bool
+	result     bulkResult
+	started    time.Time                // when reconciling began, i.e. the start of the run
+	collection map[string]hostdb.Record // existing records in scope which haven't been matched yet
+	identities map[string]string        // map[identity]id
+	existing   int                      // how many records were in scope before the request
+	keepAll    bool                     // an invalid record couldn't be matched, so nothing can safely be deleted
+	minted     []int                    // the indexes of the incoming records which were given new ids
+	saved      int                      // how many of the records to be written have been, in the order they were received
+
+	replacements []hostdb.Record
+	spool        *os.File // when set, records to be written are encoded here instead of kept in replacements
+
+	progress func(received int) // when set, called as each incoming record is reconciled
+}
+
+// prepare to reconcile a bulk request, by indexing the existing records in scope
+// nothing is written; during a dry run no ids are generated, and the differences of each update are included
+func newBulkReconciler(bulk hostdb.RecordSet, dryRun bool) (*bulkReconciler, error) {
+
+	r := &bulkReconciler{
+		bulk:    bulk,
+		dryRun:  dryRun,
+		started: time.Now(),
+		result: bulkResult{
+			IDs:       []string{},
+			Created:   []bulkResultEntry{},
+			Updated:   []bulkResultEntry{},
+			Unchanged: []bulkResultEntry{},
+			Deleted:   []string{},
+			Errors:    []bulkRecordError{},
+		},
+		collection: map[string]hostdb.Record{},
+		identities: map[string]string{},
+	}
+
+	// prepare a collection of existing records, based on type and bulk.Context
+	where := hostdb.MariadbWhereClauses{
+		Groups: []hostdb.MariadbWhereGrouping{
+			{
+				Clauses: []hostdb.MariadbWhereClause{bulkTypeClause(bulk.Type)},
+			},
+		},
+	}
+
+	// limit the existing records to those owned by this collector
+	scope, err := bulkScope(bulk)
+	if err != nil {
+		return nil, hostdb.ErrorResponse{
+			Code:    http.StatusBadRequest,
+			Message: err.Error(),
+		}
+	}
+
+	where.Groups = append(where.Groups, scope...)
+
+	// index the existing records by their identity, so that incoming records can be matched
+	err = eachMariadbRow(where, func(record hostdb.Record) error {
+
+		key, ok, err := recordIdentity(bulk.Type, record)
+		if err != nil {
+			log.Println(fmt.Sprintf("could not determine the identity of record %s: %v", record.ID, err))
+		} else if _, found := r.identities[key]; ok && !found {
+			r.identities[key] = record.ID
+		}
+
+		// only the hash and context are needed to tell whether a record has changed
+		record.Data = nil
+		r.collection[record.ID] = record
+
+		return nil
+
+	})
+	if err != nil {
+		log.Println(err.Error())
+		return nil, hostdb.ErrorResponse{
+			Code:    http.StatusInternalServerError,
+			Message: "Couldn't get existing records before applying bulk record request.",
+		}
+	}
+
+	r.existing = len(r.collection)
+
+	return r, nil
+
+}
+
+// reconcile the next incoming record
+func (r *bulkReconciler) add(record hostdb.Record) (err error) {
+
+	index := len(r.result.IDs)
+	r.result.IDs = append(r.result.IDs, "")
+
+	if r.progress != nil {
+		r.progress(len(r.result.IDs))
+	}
+
+	if err := prepareBulkRecord(r.bulk, &record); err != nil {
+		r.invalid(index, record, err.Error())
+		return nil
+	}
+
+	// validate the data against the schema for its type
+	warnings, err := checkRecordSchema(record)
+	if response, ok := err.(hostdb.ErrorResponse); ok {
+		r.invalid(index, record, response.Message)
+		return nil
+	} else if err != nil {
+		log.Println(err.Error())
+		return hostdb.ErrorResponse{
+			Code:    http.StatusInternalServerError,
+			Message: "validating the data against its schema failed",
+		}
+	}
+
+	for _, warning := range warnings {
+		r.result.Warnings = append(r.result.Warnings, bulkRecordError{
+			Index: index,
+			Error: warning,
+		})
+	}
+
+	existing := hostdb.Record{}
+	if record.ID == "" {
+
+		// attempt to match an existing record, using the identity configured for this type
+		key, ok, err := recordIdentity(r.bulk.Type, record)
+		if err != nil {
+			log.Println(err.Error())
+			return hostdb.ErrorResponse{
+				Code:    http.StatusInternalServerError,
+				Message: "failed to unmarshal record data",
+			}
+		}
+
+		if id, found := r.identities[key]; ok && found {
+			// since we've found a match in the database, give record the id
+			record.ID = id
+			existing = r.collection[id]
+
+			// an existing record which has already been matched is no longer in the collection
+			if existing.ID == "" {
+				if existing, err = getMariadbRow(id); err != nil {
+					log.Println(err.Error())
+					return hostdb.ErrorResponse{
+						Code:    http.StatusInternalServerError,
+						Message: fmt.Sprintf("failed to get database record, id = %v", id),
+					}
+				}
+			}
+		}
+
+	} else { // if id is present, attempt match to existing
+
+		existing, err = getMariadbRow(record.ID)
+		if err != nil {
+			log.Println(err.Error())
+			return hostdb.ErrorResponse{
+				Code:    http.StatusInternalServerError,
+				Message: fmt.Sprintf("failed to get database record, id = %v", record.ID),
+			}
+		}
+
+	}
+
+	// if we don't have a record id by now, generate a new one
+	if record.ID == "" && !r.dryRun {
+		record.ID = getUUID("hdb")
+		r.minted = append(r.minted, index)
+	}
+
+	r.result.IDs[index] = record.ID
+
+	entry := bulkResultEntry{
+		Index: index,
+		ID:    record.ID,
+	}
+
+	// if the record has changed, replace it in the database
+	if anythingChanged(record, existing) {
+		if existing.ID == "" {
+			r.result.Created = append(r.result.Created, entry)
+		} else {
+			if r.dryRun {
+				if entry.Differences, err = r.differences(existing, record); err != nil {
+					log.Println(err.Error())
+					return hostdb.ErrorResponse{
+						Code:    http.StatusInternalServerError,
+						Message: "failed to compare record data",
+					}
+				}
+			}
+
+			r.result.Updated = append(r.result.Updated, entry)
+		}
+
+		if err := r.replace(record); err != nil {
+			log.Println(err.Error())
+			return hostdb.ErrorResponse{
+				Code:    http.StatusInternalServerError,
+				Message: "failed to spool record",
+			}
+		}
+	} else {
+		r.result.Unchanged = append(r.result.Unchanged, entry)
+	}
+
+	// remove this id from the records to be deleted
+	delete(r.collection, record.ID)
+
+	return nil
+
+}
+
+// note an incoming record which failed validation
+func (r *bulkReconciler) invalid(index int, record hostdb.Record, message string) {
+
+	r.result.Errors = append(r.result.Errors, bulkRecordError{
+		Index: index,
+		Error: message,
+	})
+
+	// an invalid record shouldn't cause the record it would have replaced to be deleted
+	if id, ok := invalidRecordMatch(r.bulk.Type, record, r.identities); ok {
+		delete(r.collection, id)
+	} else {
+		r.keepAll = true
+	}
+
+}
+
+// note an incoming record which couldn't even be decoded
+func (r *bulkReconciler) reject(message string) {
+
+	r.result.Errors = append(r.result.Errors, bulkRecordError{
+		Index: len(r.result.IDs),
+		Error: message,
+	})
+	r.result.IDs = append(r.result.IDs, "")
+
+	if r.progress != nil {
+		r.progress(len(r.result.IDs))
+	}
+
+	// without a record, there's no telling which existing record it would have replaced
+	r.keepAll = true
+
+}
+
+// compare an existing record with its replacement, fetching the existing data if it wasn't kept
+func (r *bulkReconciler) differences(existing hostdb.Record, replacement hostdb.Record) ([]fieldDifference, error) {
+
+	if existing.Data == nil {
+		var err error
+		if existing, err = getMariadbRow(existing.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	return recordDifferences(existing, replacement)
+
+}
+
+// keep a record which needs to be written; during a dry run, nothing is kept
+func (r *bulkReconciler) replace(record hostdb.Record) error {
+
+	if r.dryRun {
+		return nil
+	}
+
+	if r.spool != nil {
+		return json.NewEncoder(r.spool).Encode(record)
+	}
+
+	r.replacements = append(r.replacements, record)
+
+	return nil
+
+}
+
+// the result of a bulk request which failed before all of its records were written: nothing was deleted,
+// only the records saved before the failure were created or updated, and the ids given to the other new records were never stored
+func (r *bulkReconciler) unapplied(result bulkResult) bulkResult {
+
+	// the records are written in the order they were received, so those saved are the first of the created and updated records
+	indexes := make([]int, 0, len(result.Created)+len(result.Updated))
+	for _, entry := range append(append([]bulkResultEntry{}, result.Created...), result.Updated...) {
+		indexes = append(indexes, entry.Index)
+	}
+	sort.Ints(indexes)
+
+	last := -1
+	if r.saved > 0 && r.saved <= len(indexes) {
+		last = indexes[r.saved-1]
+	}
+
+	saved := func(entries []bulkResultEntry) []bulkResultEntry {
+		kept := []bulkResultEntry{}
+		for _, entry := range entries {
+			if entry.Index <= last {
+				kept = append(kept, entry)
+			}
+		}
+		return kept
+	}
+
+	result.IDs = append([]string{}, result.IDs...)
+	for _, index := range r.minted {
+		if index > last {
+			result.IDs[index] = ""
+		}
+	}
+
+	result.Created = saved(result.Created)
+	result.Updated = saved(result.Updated)
+	result.Deleted = []string{}
+
+	return result
+
+}
+
+// the existing records in scope which weren't matched, and are to be deleted
+func (r *bulkReconciler) deletions() []string {
+
+	deleted := []string{}
+
+	if r.keepAll {
+		return deleted
+	}
+
+	for id := range r.collection {
+		deleted = append(deleted, id)
+	}
+	sort.Strings(deleted)
+
+	return deleted
+
+}
+
+// write the created and updated records, in batches
+func (r *bulkReconciler) save() error {
+
+	batchSize := serverConfig.API.V0.BulkBatchSize
+	if batchSize < 1 {
+		batchSize = defaultBulkBatchSize
+	}
+
+	created := map[string]bool{}
+	for _, entry := range r.result.Created {
+		created[entry.ID] = true
+	}
+
+	// each batch is added to the change feed as it's written
+	saveBatch := func(batch []hostdb.Record) error {
+		changes := newChangeEntries(recordEventUpdate, batch)
+		for i := range changes {
+			if created[changes[i].ID] {
+				changes[i].Event = recordEventCreate
+			}
+		}
+
+		return saveMariadbRows(batch, changes)
+	}
+
+	if r.spool == nil {
+		for start := 0; start < len(r.replacements); start += batchSize {
+			end := start + batchSize
+			if end > len(r.replacements) {
+				end = len(r.replacements)
+			}
+
+			if err := saveBatch(r.replacements[start:end]); err != nil {
+				return err
+			}
+
+			r.saved = end
+		}
+
+		return nil
+	}
+
+	if _, err := r.spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bufio.NewReader(r.spool))
+	batch := make([]hostdb.Record, 0, batchSize)
+
+	for {
+		var record hostdb.Record
+		if err := decoder.Decode(&record); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		batch = append(batch, record)
+
+		if len(batch) >= batchSize {
+			if err := saveBatch(batch); err != nil {
+				return err
+			}
+
+			r.saved += len(batch)
+			batch = batch[:0]
+		}
+	}
+
+	if err := saveBatch(batch); err != nil {
+		return err
+	}
+
+	r.saved += len(batch)
+
+	return nil
+
+}
+
+// ensure a bulk record set is complete, normalising its timestamp, and filling in the given committer if it has none
+func validateRecordSet(bulk *hostdb.RecordSet, committer string) error {
+
+	invalid := func(message string) error {
+		return hostdb.ErrorResponse{
+			Code:    http.StatusBadRequest,
+			Message: message,
+		}
+	}
+
+	// ensure we have a type, and that it contains no spaces
+	if bulk.Type == "" {
+		return invalid("no type provided")
+	} else if strings.Contains(bulk.Type, " ") {
+		return invalid("type cannot contain a space character")
+	}
+
+	// ensure we have a timestamp
+	if bulk.Timestamp == "" {
+		return invalid("no timestamp provided")
+	}
+
+	// is the timestamp valid
+	timestamp, err := parseTimestamp(bulk.Timestamp)
+	if err != nil {
+		return invalid(err.Error())
+	}
+	bulk.Timestamp = timestamp.Format(storedTimestampFormat)
+
+	// ensure we have context
+	if bulk.Context == nil {
+		return invalid("no context provided")
+	}
+
+	// ensure we have a committer
+	if bulk.Committer == "" {
+		bulk.Committer = committer
+	}
+
+	// ensure each of the required context fields are present for this type of record
+	for recordType := range config.API.V0.ContextFields {
+		if strings.Contains(bulk.Type, recordType) {
+			for _, k := range config.API.V0.ContextFields[bulk.Type] {
+				if _, ok := bulk.Context[k]; !ok {
+					return invalid(fmt.Sprintf("missing context value for %s", k))
+				}
+			}
+			break
+		}
+	}
+
+	return nil
+
+}
+
+// reconcile a bulk request sent as a json record set
+// records failing validation are listed in the result's errors, and the records they would replace are kept
+func reconcileJSON(body []byte, dryRun bool, committer string, progress func(received int)) (*bulkReconciler, error) {
+
+	var bulk hostdb.RecordSet
+
+	// marshal the []bytes into our struct
+	if err := json.Unmarshal(body, &bulk); err != nil {
+		log.Println(err.Error())
+		return nil, hostdb.ErrorResponse{
+			Code:    http.StatusBadRequest,
+			Message: "did not conform to expected standards",
+		}
+	}
+
+	if err := validateRecordSet(&bulk, committer); err != nil {
+		return nil, err
+	}
+
+	// work out what needs to change
+	r, err := newBulkReconciler(bulk, dryRun)
+	if err != nil {
+		return nil, err
+	}
+
+	r.progress = progress
+
+	for _, record := range bulk.Records {
+		if err := r.add(record); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+
+}
+
+// reads newline delimited json, one line at a time, skipping blank lines
+type ndjsonReader struct {
+	reader *bufio.Reader
+	line   int
+}
+
+func newNDJSONReader(body io.Reader) *ndjsonReader {
+
+	return &ndjsonReader{reader: bufio.NewReader(body)}
+
+}
+
+// the next non-blank line, or io.EOF
+func (r *ndjsonReader) next() ([]byte, error) {
+
+	for {
+		line, err := r.reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		r.line++
+
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			return line, nil
+		}
+
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+	}
+
+}
+
+// the header line; the record set without any records (type, timestamp, committer, context)
+func (r *ndjsonReader) header() (bulk hostdb.RecordSet, line []byte, err error) {
+
+	line, err = r.next()
+	if err == io.EOF {
+		return bulk, nil, hostdb.ErrorResponse{
+			Code:    http.StatusBadRequest,
+			Message: "no header line provided",
+		}
+	} else if err != nil {
+		return bulk, nil, err
+	}
+
+	if err = json.Unmarshal(line, &bulk); err != nil || len(bulk.Records) > 0 {
+		return bulk, nil, hostdb.ErrorResponse{
+			Code:    http.StatusBadRequest,
+			Message: "the header line did not conform to expected standards",
+		}
+	}
+
+	return bulk, line, nil
+
+}
+
+// reconcile a bulk request sent as newline delimited json
+// the first line is the record set without any records (type, timestamp, committer, context), then one record per line
+// records are reconciled as they're read, and those to be written are spooled to disk, so the whole set is never held in memory
+func reconcileNDJSON(body io.Reader, dryRun bool, committer string, progress func(received int)) (*bulkReconciler, error) {
+
+	reader := newNDJSONReader(body)
+
+	bulk, _, err := reader.header()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateRecordSet(&bulk, committer); err != nil {
+		return nil, err
+	}
+
+	r, err := newBulkReconciler(bulk, dryRun)
+	if err != nil {
+		return nil, err
+	}
+
+	r.progress = progress
+
+	// spool the records to be written to disk, until we know the request can be applied
+	if !dryRun {
+		if r.spool, err = ioutil.TempFile("", "hostdb-bulk-"); err != nil {
+			return nil, err
+		}
+	}
+
+	// the records
+	for {
+		line, err := reader.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			r.close()
+			return nil, err
+		}
+
+		var record hostdb.Record
+		if err := json.Unmarshal(line, &record); err != nil {
+			r.reject(fmt.Sprintf("line %d did not conform to expected standards: %v", reader.line, err))
+			continue
+		}
+
+		if err := r.add(record); err != nil {
+			r.close()
+			return nil, err
+		}
+	}
+
+	return r, nil
+
+}
+
+// remove the spool file, if any
+func (r *bulkReconciler) close() {
+
+	if r.spool == nil {
+		return
+	}
+
+	if err := r.spool.Close(); err != nil {
+		log.Println(err.Error())
+	}
+
+	if err := os.Remove(r.spool.Name()); err != nil {
+		log.Println(err.Error())
+	}
+
+	r.spool = nil
+
+}
+
+// write the changes worked out by a reconciler, and describe the outcome with an http status and a result
+func applyBulk(r *bulkReconciler, partial bool, force bool, audit auditFunc) (status int, result bulkResult) {
+
+	var deletedIDs []string
+	applied := false
+
+	// the request is kept in the run ledger, and is a run of any collector registered for its type and scope
+	if !r.dryRun {
+		defer func() {
+			counts := countRun(result, applied)
+			recordRun(r, status, result, counts)
+			recordCollectorRun(r.bulk, status, result, counts)
+		}()
+	}
+
+	result = r.result
+	result.Deleted = r.deletions()
+	received := len(result.IDs)
+
+	failed := func(status int, message string) (int, bulkResult) {
+		result.OK = false
+		result.Error = message
+
+		// only a dry run describes what would have changed
+		if !r.dryRun && !applied {
+			result = r.unapplied(result)
+		}
+
+		return status, result
+	}
+
+	// unless the client accepts partial success, any invalid record fails the whole request
+	if len(result.Errors) > 0 && !partial {
+		result.DryRun = r.dryRun
+		return failed(http.StatusBadRequest, fmt.Sprintf("%d of %d record(s) failed validation", len(result.Errors), received))
+	}
+
+	if len(result.Errors) > 0 {
+		result.Partial = true
+		result.Error = fmt.Sprintf("%d of %d record(s) failed validation", len(result.Errors), received)
+
+		if r.keepAll {
+			result.Error += "; no records were deleted, as not every invalid record could be matched"
+		}
+	}
+
+	// refuse to delete more of the existing records than the type allows, unless forced
+	exceeded, threshold, err := exceedsDeleteThreshold(r.bulk.Type, len(result.Deleted), r.existing)
+	if err != nil {
+		log.Println(err.Error())
+		return failed(http.StatusInternalServerError, "checking the delete threshold failed")
+	}
+
+	forced := ""
+	if exceeded {
+		refusal := fmt.Sprintf("%d of %d existing record(s) would be deleted, which exceeds the delete threshold of %s for type %s",
+			len(result.Deleted), r.existing, threshold, r.bulk.Type)
+
+		if force {
+			forced = "; delete threshold overridden"
+		} else if r.dryRun {
+			result.Error = strings.TrimPrefix(result.Error+"; "+refusal, "; ")
+		} else {
+			audit("bulk_refused", result.Deleted, 0, 0, 0, refusal)
+			return failed(http.StatusConflict, refusal+"; if this is intended, resend the request with ?_force=true")
+		}
+	}
+
+	// a dry run stops here, and only describes what would have changed
+	if r.dryRun {
+		result.OK = result.Error == ""
+		result.DryRun = true
+		result.Message = fmt.Sprintf("%d record(s) would be processed", received-len(result.Errors))
+		return http.StatusOK, result
+	}
+
+	// save all the records
+	if err := r.save(); err != nil {
+		log.Println(err.Error())
+		status, result = failed(http.StatusInternalServerError,
+			fmt.Sprintf("failed to insert/replace records; %d record(s) were saved before the failure, and nothing was deleted", r.saved))
+
+		// the batches saved before the failure stay saved, so they're counted, announced and audited like any other change
+		if r.saved > 0 {
+			applied = true
+
+			createdIDs, updatedIDs := bulkResultIDs(result.Created), bulkResultIDs(result.Updated)
+			announceRecordChanges(recordEventCreate, createdIDs)
+			announceRecordChanges(recordEventUpdate, updatedIDs)
+
+			audit("post_bulk",
+				append(createdIDs, updatedIDs...),
+				len(createdIDs), len(updatedIDs), 0,
+				fmt.Sprintf("type %s, %d record(s) received, %d rejected%s; saving failed after %d record(s)", r.bulk.Type, received, len(result.Errors), forced, r.saved),
+			)
+		}
+
+		return status, result
+	}
+
+	applied = true
+
+	// the records are read while they still exist, to announce their deletion
+	changes := gatherRecordChanges(recordEventDelete, result.Deleted)
+
+	// delete all ids that remain in the collection
+	deleteFail := false
+	for _, id := range result.Deleted {
+		if err = deleteMariadbRow(id, ""); err != nil {
+			log.Println(err.Error())
+			deleteFail = true // keep trying
+			continue
+		}
+
+		deletedIDs = append(deletedIDs, id)
+	}
+
+	result.Deleted = append([]string{}, deletedIDs...)
+
+	var ids []string
+	createdIDs, updatedIDs := bulkResultIDs(result.Created), bulkResultIDs(result.Updated)
+	ids = append(append(ids, createdIDs...), updatedIDs...)
+
+	announceRecordChanges(recordEventCreate, createdIDs)
+	announceRecordChanges(recordEventUpdate, updatedIDs)
+	changes.announce(deletedIDs)
+
+	audit("post_bulk",
+		append(ids, deletedIDs...),
+		len(result.Created), len(result.Updated), len(deletedIDs),
+		fmt.Sprintf("type %s, %d record(s) received, %d rejected%s", r.bulk.Type, received, len(result.Errors), forced),
+	)
+
+	result.Message = fmt.Sprintf("%d record(s) processed", received-len(result.Errors))
+
+	if deleteFail {
+		return failed(http.StatusInternalServerError, "Deleting one or more records failed. Please check the HostDB server logs.")
+	}
+
+	// a partial success is reported as such
+	if result.Partial {
+		return http.StatusMultiStatus, result
+	}
+
+	result.OK = true
+
+	return http.StatusOK, result
+
+}
+
+// the ids of the incoming records in a bulk result
+func bulkResultIDs(entries []bulkResultEntry) (ids []string) {
+
+	for _, entry := range entries {
+		ids = append(ids, entry.ID)
+	}
+
+	return ids
+
+}
+
+// fill in a bulk record from its record set, hash it, and ensure it's complete
+func prepareBulkRecord(bulk hostdb.RecordSet, record *hostdb.Record) (err error) {
+
+	if record.Data == nil {
+		return errors.New("data payload/element is missing")
+	}
+
+	// get any missing data from the bulk record set
+	if record.Type == "" {
+		record.Type = bulk.Type
+	}
+
+	if record.Timestamp == "" {
+		record.Timestamp = bulk.Timestamp
+	}
+
+	if record.Committer == "" {
+		record.Committer = bulk.Committer
+	}
+
+	// smoosh context
+	for key, val := range bulk.Context {
+		if record.Context == nil {
+			record.Context = map[string]interface{}{}
+		}
+
+		if _, ok := record.Context[key]; ok {
+			if record.Context[key] == "" {
+				// if the context key is present, but empty
+				record.Context[key] = val
+			}
+		} else {
+			// if the context key is absent
+			record.Context[key] = val
+		}
+	}
+
+	// hash data payload
+	if record.Hash, err = hashPayload(record.Data); err != nil {
+		return fmt.Errorf("hashing the data failed: %v", err)
+	}
+
+	// ensure data consistency before finding a match
+	return ensureDataIsComplete(record)
+
+}
+
+// find the existing record an invalid incoming record would have replaced
+// ok is false if that can't be determined, in which case no existing record is safe to delete
+func invalidRecordMatch(recordType string, record hostdb.Record, identities map[string]string) (id string, ok bool) {
+
+	if record.ID != "" {
+		return record.ID, true
+	}
+
+	key, ok, err := recordIdentity(recordType, record)
+	if err != nil || !ok || key == "" {
+		return "", false
+	}
+
+	// an identity without an existing record has nothing to protect
+	return identities[key], true
+
+}
+
+// list the differences in context and data between an existing record and its replacement
+func recordDifferences(existing hostdb.Record, replacement hostdb.Record) (differences []fieldDifference, err error) {
+
+	oldData, err := decodeJSON(existing.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	newData, err := decodeJSON(replacement.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	// round trip the contexts, so that values compare consistently
+	oldContextBytes, err := json.Marshal(existing.Context)
+	if err != nil {
+		return nil, err
+	}
+
+	oldContext, err := decodeJSON(oldContextBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	newContextBytes, err := json.Marshal(replacement.Context)
+	if err != nil {
+		return nil, err
+	}
+
+	newContext, err := decodeJSON(newContextBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	differences = diffJSON("context", oldContext, newContext, differences)
+	differences = diffJSON("data", oldData, newData, differences)
+
+	return differences, nil
+
+}
+
+// decode json, keeping numbers as they were written
+func decodeJSON(b []byte) (value interface{}, err error) {
+
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+
+	if err = decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	return value, nil
+
+}
+
+// recursively compare two decoded json values, appending any differences
+func diffJSON(path string, oldValue interface{}, newValue interface{}, differences []fieldDifference) []fieldDifference {
+
+	oldObject, oldIsObject := oldValue.(map[string]interface{})
+	newObject, newIsObject := newValue.(map[string]interface{})
+
+	if oldIsObject && newIsObject {
+		keys := make([]string, 0, len(oldObject)+len(newObject))
+		for k := range oldObject {
+			keys = append(keys, k)
+		}
+		for k := range newObject {
+			if _, ok := oldObject[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			keyPath := path + "." + k
+			if !isBareJSONPathKey(k) {
+				keyPath = fmt.Sprintf("%s.\"%s\"", path, k)
+			}
+
+			differences = diffJSON(keyPath, oldObject[k], newObject[k], differences)
+		}
+
+		return differences
+	}
+
+	oldArray, oldIsArray := oldValue.([]interface{})
+	newArray, newIsArray := newValue.([]interface{})
+
+	if oldIsArray && newIsArray && len(oldArray) == len(newArray) {
+		for i := range oldArray {
+			differences = diffJSON(fmt.Sprintf("%s[%d]", path, i), oldArray[i], newArray[i], differences)
+		}
+
+		return differences
+	}
+
+	if !reflect.DeepEqual(oldValue, newValue) {
+		differences = append(differences, fieldDifference{
+			Path: path,
+			Old:  oldValue,
+			New:  newValue,
+		})
+	}
+
+	return differences
+
+}
+
+// find the most specific pattern matching a record type
+// an exact match wins, otherwise the longest matching wildcard pattern (e.g. ucs-* over *)
+func matchRecordType(recordType string, patterns []string) (match string, ok bool) {
+
+	for _, pattern := range patterns {
+		if pattern == recordType {
+			return pattern, true
+		}
+
+		if !strings.Contains(pattern, "*") {
+			continue
+		}
+
+		if matched, err := path.Match(pattern, recordType); err != nil || !matched {
+			continue
+		}
+
+		if len(pattern) > len(match) {
+			match = pattern
+			ok = true
+		}
+	}
+
+	return match, ok
+
+}
+
+// check whether deleting this many of the existing records in scope would exceed the threshold configured for the type
+// a threshold is either a percentage of the existing records (e.g. 25%), or a number of records
+func exceedsDeleteThreshold(recordType string, deleting int, existing int) (exceeded bool, threshold string, err error) {
+
+	patterns := make([]string, 0, len(serverConfig.API.V0.DeleteThreshold))
+	for pattern := range serverConfig.API.V0.DeleteThreshold {
+		patterns = append(patterns, pattern)
+	}
+
+	pattern, ok := matchRecordType(recordType, patterns)
+	if !ok || deleting < 1 {
+		return false, "", nil
+	}
+
+	threshold = strings.TrimSpace(serverConfig.API.V0.DeleteThreshold[pattern])
+
+	if strings.HasSuffix(threshold, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(threshold, "%"), 64)
+		if err != nil || percent < 0 {
+			return false, threshold, fmt.Errorf("invalid delete_threshold for %s: %s", pattern, threshold)
+		}
+
+		return float64(deleting)*100 > percent*float64(existing), threshold, nil
+	}
+
+	count, err := strconv.Atoi(threshold)
+	if err != nil || count < 0 {
+		return false, threshold, fmt.Errorf("invalid delete_threshold for %s: %s", pattern, threshold)
+	}
+
+	return deleting > count, threshold, nil
+
+}
+
+// look up the config for a record type, from a map keyed by type patterns
+func typeSettings(recordType string, settings map[string][]string) []string {
+
+	patterns := make([]string, 0, len(settings))
+	for pattern := range settings {
+		patterns = append(patterns, pattern)
+	}
+
+	if pattern, ok := matchRecordType(recordType, patterns); ok {
+		return settings[pattern]
+	}
+
+	return nil
+
+}
+
+// the WHERE clause matching the types of the existing records a bulk request may replace or delete
+// usually just its own type, unless the bulk_scope_types config widens it to a pattern, e.g. vrops-vmware*
+func bulkTypeClause(recordType string) hostdb.MariadbWhereClause {
+
+	patterns := make([]string, 0, len(serverConfig.API.V0.BulkScopeTypes))
+	for pattern := range serverConfig.API.V0.BulkScopeTypes {
+		patterns = append(patterns, pattern)
+	}
+
+	typePattern := recordType
+	if pattern, ok := matchRecordType(recordType, patterns); ok && serverConfig.API.V0.BulkScopeTypes[pattern] != "" {
+		typePattern = serverConfig.API.V0.BulkScopeTypes[pattern]
+	}
+
+	if !strings.Contains(typePattern, "*") {
+		return hostdb.MariadbWhereClause{
+			Relativity: "AND",
+			Key:        []string{"type"},
+			Operator:   "=",
+			Value:      []string{typePattern},
+		}
+	}
+
+	// the wildcards become LIKE's, and anything LIKE would otherwise treat specially is escaped
+	like := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`, "*", "%").Replace(typePattern)
+
+	return hostdb.MariadbWhereClause{
+		Relativity: "AND",
+		Key:        []string{"type"},
+		Operator:   "LIKE",
+		Value:      []string{like},
+	}
+
+}
+
+// the WHERE clauses limiting a bulk request to the records owned by a single collector
+// as described by the context keys in the bulk_scope config; every one of those keys must be present
+func bulkScope(bulk hostdb.RecordSet) (groups []hostdb.MariadbWhereGrouping, err error) {
+
+	for _, key := range typeSettings(bulk.Type, serverConfig.API.V0.BulkScope) {
+		value, ok := bulk.Context[key]
+		if !ok || value == nil || value == "" {
+			return nil, fmt.Errorf("missing context value for %s, which is required to scope a bulk request of type %s", key, bulk.Type)
+		}
+
+		s, ok := scopeValue(value)
+		if !ok {
+			return nil, fmt.Errorf("the context value for %s, which scopes a bulk request of type %s, must be a string, number or boolean", key, bulk.Type)
+		}
+
+		groups = append(groups, hostdb.MariadbWhereGrouping{
+			Clauses: []hostdb.MariadbWhereClause{
+				{
+					Relativity: "AND",
+					Key:        []string{fmt.Sprintf("json_value(context, '$.\"%s\"')", key)},
+					Operator:   "=",
+					Value:      []string{s},
+				},
+			},
+		})
+	}
+
+	return groups, nil
+
+}
+
+// a scope value as json_value() shows it, so that it can be compared with the context of stored records
+// numbers are written out in full, e.g. an account id decoded as a float isn't 1.23456789012e+11; ok is false for objects and arrays
+func scopeValue(value interface{}) (s string, ok bool) {
+
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case json.Number:
+		return v.String(), true
+	case int:
+		return strconv.Itoa(v), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+
+	return "", false
+
+}
+
+// build a key from a record which can be compared against the keys of other records of the same type
+// types without configured identity paths fall back to the hostname
+// ok is false if the record lacks any part of its identity, and therefore can't be matched
+func recordIdentity(recordType string, record hostdb.Record) (key string, ok bool, err error) {
+
+	paths := typeSettings(recordType, serverConfig.API.V0.Identity)
+
+	if len(paths) < 1 {
+		// if we don't have a better way of identifying existing records, fall back on hostname
+		return record.Hostname, true, nil
+	}
+
+	data, err := decodeJSON(record.Data)
+	if err != nil {
+		return "", false, err
+	}
+
+	values := make([]interface{}, 0, len(paths))
+
+	for _, p := range paths {
+		segments, err := parseJSONPath(p)
+		if err != nil {
+			return "", false, err
+		}
+
+		value, found := lookupJSONPath(data, segments)
+		if !found || value == nil || value == "" {
+			return "", false, nil
+		}
+
+		values = append(values, value)
+	}
+
+	// a composite key is the json array of each of the values
+	b, err := json.Marshal(values)
+	if err != nil {
+		return "", false, err
+	}
+
+	return string(b), true, nil
+
+}
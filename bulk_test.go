@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/pdxfixit/hostdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchRecordType(t *testing.T) {
+
+	patterns := []string{"*", "ucs-*", "ucs-disk", "oneview-*"}
+
+	tests := map[string]string{
+		"ucs-disk":          "ucs-disk",
+		"ucs-cpu":           "ucs-*",
+		"oneview-enclosure": "oneview-*",
+		"openstack":         "*",
+	}
+
+	for recordType, expected := range tests {
+		match, ok := matchRecordType(recordType, patterns)
+		assert.True(t, ok, recordType)
+		assert.Equal(t, expected, match, recordType)
+	}
+
+	_, ok := matchRecordType("openstack", []string{"aws-*", "ucs-disk"})
+	assert.False(t, ok, "no match")
+
+}
+
+func TestRecordIdentity(t *testing.T) {
+
+	saved := serverConfig.API.V0.Identity
+	defer func() { serverConfig.API.V0.Identity = saved }()
+
+	serverConfig.API.V0.Identity = map[string][]string{
+		"openstack":  {".id"},
+		"ucs-*":      {".dn"},
+		"composite":  {".region", ".number"},
+		"vrops-*":    {".resourceId"},
+		"vrops-test": {},
+	}
+
+	record := func(hostname string, data string) hostdb.Record {
+		return hostdb.Record{Hostname: hostname, Data: json.RawMessage(data)}
+	}
+
+	tests := []struct {
+		recordType string
+		record     hostdb.Record
+		key        string
+		ok         bool
+	}{
+		{"openstack", record("foo", `{"id":"abc123"}`), `["abc123"]`, true},
+		{"openstack", record("foo", `{"name":"foo"}`), "", false},
+		{"openstack", record("foo", `{"id":""}`), "", false},
+		{"ucs-cpu", record("", `{"dn":"sys/rack-unit-1/cpu-1"}`), `["sys/rack-unit-1/cpu-1"]`, true},
+		{"composite", record("", `{"region":"us-west-2","number":12345678901234567890}`), `["us-west-2",12345678901234567890]`, true},
+		{"composite", record("", `{"region":"us-west-2"}`), "", false},
+		{"vrops-test", record("bar", `{"resourceId":"r-1"}`), "bar", true},
+		{"unconfigured", record("baz", `{"id":"abc123"}`), "baz", true},
+	}
+
+	for _, test := range tests {
+		key, ok, err := recordIdentity(test.recordType, test.record)
+		if err != nil {
+			t.Errorf("%s: %v", test.recordType, err)
+			continue
+		}
+
+		assert.Equalf(t, test.ok, ok, "%s %s", test.recordType, test.record.Data)
+		assert.Equalf(t, test.key, key, "%s %s", test.recordType, test.record.Data)
+	}
+
+}
+
+func TestBulkScope(t *testing.T) {
+
+	saved := serverConfig.API.V0.BulkScope
+	defer func() { serverConfig.API.V0.BulkScope = saved }()
+
+	serverConfig.API.V0.BulkScope = map[string][]string{
+		"aws*":      {"aws-account-id", "aws-region"},
+		"openstack": {"tenant_name"},
+	}
+
+	// a fully scoped request
+	groups, err := bulkScope(hostdb.RecordSet{
+		Type:    "aws-vpc",
+		Context: map[string]interface{}{"aws-account-id": "123456789012", "aws-region": "us-west-2", "other": "ignored"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Len(t, groups, 2, "one group per scope key")
+	for _, group := range groups {
+		assert.Len(t, group.Clauses, 1)
+		assert.Equal(t, "=", group.Clauses[0].Operator)
+	}
+
+	// missing a scope key
+	_, err = bulkScope(hostdb.RecordSet{
+		Type:    "aws",
+		Context: map[string]interface{}{"aws-account-id": "123456789012"},
+	})
+	assert.Error(t, err, "missing aws-region")
+
+	// empty scope value
+	_, err = bulkScope(hostdb.RecordSet{
+		Type:    "openstack",
+		Context: map[string]interface{}{"tenant_name": ""},
+	})
+	assert.Error(t, err, "empty tenant_name")
+
+	// numbers are compared as json_value() shows them, not in exponent form
+	groups, err = bulkScope(hostdb.RecordSet{
+		Type:    "aws-vpc",
+		Context: map[string]interface{}{"aws-account-id": float64(123456789012), "aws-region": "us-west-2"},
+	})
+	assert.NoError(t, err, "numeric account id")
+	assert.Equal(t, []string{"123456789012"}, groups[0].Clauses[0].Value, "numeric account id")
+
+	// objects and arrays can't scope a request
+	_, err = bulkScope(hostdb.RecordSet{
+		Type:    "openstack",
+		Context: map[string]interface{}{"tenant_name": []interface{}{"a"}},
+	})
+	assert.Error(t, err, "array tenant_name")
+
+	// types without a scope are limited by type alone
+	groups, err = bulkScope(hostdb.RecordSet{
+		Type:    "test",
+		Context: map[string]interface{}{"test": true},
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, groups)
+
+}
+
+func TestBulkTypeClause(t *testing.T) {
+
+	saved := serverConfig.API.V0.BulkScopeTypes
+	defer func() { serverConfig.API.V0.BulkScopeTypes = saved }()
+
+	serverConfig.API.V0.BulkScopeTypes = map[string]string{
+		"vrops-vmware": "vrops-vmware*",
+		"odd_type":     "odd_type*",
+	}
+
+	assert.Equal(t, hostdb.MariadbWhereClause{Relativity: "AND", Key: []string{"type"}, Operator: "=", Value: []string{"openstack"}},
+		bulkTypeClause("openstack"), "only its own type")
+	assert.Equal(t, hostdb.MariadbWhereClause{Relativity: "AND", Key: []string{"type"}, Operator: "LIKE", Value: []string{"vrops-vmware%"}},
+		bulkTypeClause("vrops-vmware"), "widened to its subtypes")
+	assert.Equal(t, `odd\_type%`, bulkTypeClause("odd_type").Value[0], "LIKE's own wildcards are escaped")
+
+	// the subtypes themselves aren't widened
+	assert.Equal(t, "=", bulkTypeClause("vrops-vmware-host").Operator, "subtype")
+
+}
+
+func TestBulkUnapplied(t *testing.T) {
+
+	r := &bulkReconciler{minted: []int{2}}
+
+	result := r.unapplied(bulkResult{
+		IDs:       []string{"abc", "", "hdb-new", "def"},
+		Created:   []bulkResultEntry{{Index: 2, ID: "hdb-new"}},
+		Updated:   []bulkResultEntry{{Index: 0, ID: "abc"}},
+		Unchanged: []bulkResultEntry{{Index: 3, ID: "def"}},
+		Deleted:   []string{"ghi"},
+		Errors:    []bulkRecordError{{Index: 1, Error: "data payload/element is missing"}},
+	})
+
+	assert.Equal(t, []string{"abc", "", "", "def"}, result.IDs, "minted ids were never stored")
+	assert.Empty(t, result.Created, "created")
+	assert.Empty(t, result.Updated, "updated")
+	assert.Empty(t, result.Deleted, "deleted")
+	assert.Len(t, result.Unchanged, 1, "unchanged")
+	assert.Len(t, result.Errors, 1, "errors")
+
+	// records saved before a failure were written, in the order they were received
+	r = &bulkReconciler{minted: []int{1, 3}, saved: 2}
+
+	result = r.unapplied(bulkResult{
+		IDs:     []string{"abc", "hdb-one", "def", "hdb-two"},
+		Created: []bulkResultEntry{{Index: 1, ID: "hdb-one"}, {Index: 3, ID: "hdb-two"}},
+		Updated: []bulkResultEntry{{Index: 0, ID: "abc"}, {Index: 2, ID: "def"}},
+		Deleted: []string{"ghi"},
+	})
+
+	assert.Equal(t, []string{"abc", "hdb-one", "def", ""}, result.IDs, "ids of the saved records")
+	assert.Equal(t, []bulkResultEntry{{Index: 1, ID: "hdb-one"}}, result.Created, "saved created")
+	assert.Equal(t, []bulkResultEntry{{Index: 0, ID: "abc"}}, result.Updated, "saved updated")
+	assert.Empty(t, result.Deleted, "nothing is deleted after a failure")
+
+}
+
+func TestRecordDifferences(t *testing.T) {
+
+	existing := hostdb.Record{
+		Context: map[string]interface{}{"tenant_name": "foo", "datacenter": "va2"},
+		Data:    json.RawMessage(`{"id":"abc","status":"ACTIVE","metadata":{"app.list":"web","env":"prod"},"ram":16384,"tags":["a","b"]}`),
+	}
+
+	replacement := hostdb.Record{
+		Context: map[string]interface{}{"tenant_name": "foo", "datacenter": "va3"},
+		Data:    json.RawMessage(`{"id":"abc","status":"SHUTOFF","metadata":{"app.list":"api","env":"prod"},"ram":16384,"tags":["a","b","c"],"new":true}`),
+	}
+
+	differences, err := recordDifferences(existing, replacement)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []fieldDifference{
+		{Path: "context.datacenter", Old: "va2", New: "va3"},
+		{Path: "data.metadata.\"app.list\"", Old: "web", New: "api"},
+		{Path: "data.new", Old: nil, New: true},
+		{Path: "data.status", Old: "ACTIVE", New: "SHUTOFF"},
+		{Path: "data.tags", Old: []interface{}{"a", "b"}, New: []interface{}{"a", "b", "c"}},
+	}, differences)
+
+	// nothing changed
+	differences, err = recordDifferences(existing, existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Empty(t, differences)
+
+}
+
+func TestExceedsDeleteThreshold(t *testing.T) {
+
+	saved := serverConfig.API.V0.DeleteThreshold
+	defer func() { serverConfig.API.V0.DeleteThreshold = saved }()
+
+	serverConfig.API.V0.DeleteThreshold = map[string]string{
+		"openstack": "25%",
+		"ucs-*":     "10",
+		"broken":    "lots",
+	}
+
+	tests := []struct {
+		recordType string
+		deleting   int
+		existing   int
+		exceeded   bool
+	}{
+		{"openstack", 25, 100, false},
+		{"openstack", 26, 100, true},
+		{"openstack", 0, 0, false},
+		{"ucs-cpu", 10, 1000, false},
+		{"ucs-cpu", 11, 1000, true},
+		{"aws-vpc", 100, 100, false},
+	}
+
+	for _, test := range tests {
+		exceeded, _, err := exceedsDeleteThreshold(test.recordType, test.deleting, test.existing)
+		assert.NoError(t, err, test.recordType)
+		assert.Equalf(t, test.exceeded, exceeded, "%s: %d of %d", test.recordType, test.deleting, test.existing)
+	}
+
+	_, _, err := exceedsDeleteThreshold("broken", 1, 1)
+	assert.Error(t, err, "invalid threshold")
+
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pdxfixit/hostdb"
+)
+
+const (
+	defaultChangesLimit     = 1000
+	maxChangesLimit         = 10000
+	defaultChangesRetention = 30 * 24 * time.Hour
+)
+
+// an entry in the change feed
+type changeEntry struct {
+	Seq       string `json:"seq"`
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	Event     string `json:"event"`
+	Hash      string `json:"hash"` // of the record's data after the change, or before a delete
+	Timestamp string `json:"timestamp"`
+	Deleted   bool   `json:"deleted,omitempty"`
+	Origin    string `json:"-"` // the server which made the change
+}
+
+// a page of the change feed
+type changesResponse struct {
+	Changes []changeEntry `json:"changes"`
+	LastSeq string        `json:"last_seq"` // the since token for the next page
+	Pending int           `json:"pending"`  // how many more changes there are after last_seq
+}
+
+// how long entries are kept in the change feed
+func changesRetention() time.Duration {
+
+	if retention := serverConfig.API.V0.ChangesRetention; retention > 0 {
+		return retention
+	}
+
+	return defaultChangesRetention
+
+}
+
+// the change feed entries for changes to some records, which are written along with the records themselves
+// the janitor forgets about changes older than the retention
+func newChangeEntries(event string, records []hostdb.Record) (changes []changeEntry) {
+
+	timestamp := time.Now().UTC().Format(storedTimestampFormat)
+
+	for _, record := range records {
+		changes = append(changes, changeEntry{
+			ID:        record.ID,
+			Type:      record.Type,
+			Event:     event,
+			Hash:      record.Hash,
+			Timestamp: timestamp,
+			Origin:    eventOrigin,
+		})
+	}
+
+	return changes
+
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/newrelic/go-agent"
+	"github.com/pdxfixit/hostdb"
+)
+
+// the health of a collector
+const (
+	collectorHealthy = "healthy"
+	collectorStale   = "stale"
+)
+
+const (
+	collectorStaleFactor     = 2 // a collector is stale once it hasn't succeeded for this many of its intervals
+	collectorMinInterval     = time.Minute
+	collectorMetricsInterval = time.Minute
+)
+
+var collectorName = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// a named source of records, which posts the records of one type and scope in bulk, at an expected interval
+type collector struct {
+	Name          string            `json:"name"`
+	Type          string            `json:"type"`
+	Scope         map[string]string `json:"scope"`    // the values of the type's bulk_scope context keys
+	Interval      string            `json:"interval"` // how often it's expected to run, e.g. 1h
+	Description   string            `json:"description,omitempty"`
+	Created       string            `json:"created"`
+	Updated       string            `json:"updated"`
+	Principal     string            `json:"principal"`
+	LastRun       string            `json:"last_run,omitempty"`
+	LastSuccess   string            `json:"last_success,omitempty"`
+	LastError     string            `json:"last_error,omitempty"` // of the last run; a partial success has one too
+	LastRunCounts runCounts         `json:"last_run_counts"`
+	Records       int               `json:"records"` // in its scope now
+	Status        string            `json:"status"`
+}
+
+// the collectors' part of the health check
+type collectorHealth struct {
+	Healthy int      `json:"healthy"`
+	Stale   []string `json:"stale"`
+}
+
+// check that a collector can be registered
+func validateCollector(c *collector) error {
+
+	if !collectorName.MatchString(c.Name) {
+		return fmt.Errorf("the name must be 1 to 128 letters, digits, dots, dashes or underscores")
+	}
+
+	if c.Type == "" {
+		return fmt.Errorf("a type is required")
+	}
+
+	interval, err := time.ParseDuration(c.Interval)
+	if err != nil || interval < collectorMinInterval {
+		return fmt.Errorf("interval must be a duration of at least %s, e.g. 1h", collectorMinInterval)
+	}
+	c.Interval = interval.String()
+
+	if c.Scope == nil {
+		c.Scope = map[string]string{}
+	}
+
+	// the scope is the same as that of the collector's bulk requests
+	keys := typeSettings(c.Type, serverConfig.API.V0.BulkScope)
+	for _, key := range keys {
+		if c.Scope[key] == "" {
+			return fmt.Errorf("scope must have a value for %s, which scopes the bulk requests of type %s", key, c.Type)
+		}
+	}
+
+	if len(c.Scope) != len(keys) {
+		return fmt.Errorf("scope may only have values for %v, which scope the bulk requests of type %s", keys, c.Type)
+	}
+
+	return nil
+
+}
+
+// how often the collector is expected to run
+func (c collector) interval() time.Duration {
+
+	interval, err := time.ParseDuration(c.Interval)
+	if err != nil {
+		return collectorMinInterval
+	}
+
+	return interval
+
+}
+
+// whether a bulk request of the collector's type, with the context, is one of its runs
+func (c collector) covers(context map[string]interface{}) bool {
+
+	for key, value := range c.Scope {
+		found, ok := context[key]
+		if !ok {
+			return false
+		}
+
+		if s, ok := scopeValue(found); !ok || s != value {
+			return false
+		}
+	}
+
+	return true
+
+}
+
+// how long it's been since the collector last succeeded; or, if it hasn't yet, since it was registered
+func (c collector) sinceSuccess(now time.Time) time.Duration {
+
+	since := c.LastSuccess
+	if since == "" {
+		since = c.Created
+	}
+
+	t, err := parseTimestamp(since)
+	if err != nil {
+		return 0
+	}
+
+	return now.Sub(t)
+
+}
+
+// whether the collector is healthy or stale
+func (c collector) health(now time.Time) string {
+
+	if c.sinceSuccess(now) > collectorStaleFactor*c.interval() {
+		return collectorStale
+	}
+
+	return collectorHealthy
+
+}
+
+// the WHERE clauses for the records in the collector's scope
+func (c collector) where() hostdb.MariadbWhereClauses {
+
+	where := hostdb.MariadbWhereClauses{
+		Groups: []hostdb.MariadbWhereGrouping{{
+			Clauses: []hostdb.MariadbWhereClause{{
+				Relativity: "AND",
+				Key:        []string{"type"},
+				Operator:   "=",
+				Value:      []string{c.Type},
+			}},
+		}},
+	}
+
+	keys := make([]string, 0, len(c.Scope))
+	for key := range c.Scope {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		where.Groups = append(where.Groups, hostdb.MariadbWhereGrouping{
+			Clauses: []hostdb.MariadbWhereClause{{
+				Relativity: "AND",
+				Key:        []string{fmt.Sprintf("json_value(context, '$.\"%s\"')", key)},
+				Operator:   "=",
+				Value:      []string{c.Scope[key]},
+			}},
+		})
+	}
+
+	return where
+
+}
+
+// get the registered collectors, with their health
+func loadCollectors(now time.Time) ([]collector, error) {
+
+	collectors, err := getMariadbCollectors()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range collectors {
+		collectors[i].Status = collectors[i].health(now)
+	}
+
+	return collectors, nil
+
+}
+
+// summarise the health of the collectors
+func summariseCollectors(collectors []collector) collectorHealth {
+
+	summary := collectorHealth{
+		Stale: []string{},
+	}
+
+	for _, c := range collectors {
+		if c.Status == collectorStale {
+			summary.Stale = append(summary.Stale, c.Name)
+		} else {
+			summary.Healthy++
+		}
+	}
+
+	return summary
+
+}
+
+// note a bulk request as a run of the collectors whose type and scope it has
+func recordCollectorRun(bulk hostdb.RecordSet, status int, result bulkResult, counts runCounts) {
+
+	collectors, err := getMariadbCollectors()
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+
+	now := time.Now().UTC().Format(storedTimestampFormat)
+
+	for _, c := range collectors {
+		if c.Type != bulk.Type || !c.covers(bulk.Context) {
+			continue
+		}
+
+		c.LastRun = now
+		c.LastError = result.Error
+		c.LastRunCounts = counts
+
+		if status < 300 {
+			c.LastSuccess = now
+		}
+
+		if err := saveMariadbCollectorRun(c); err != nil {
+			log.Println(err.Error())
+		}
+	}
+
+}
+
+// the metrics reported for the collectors' health
+func collectorMetrics(collectors []collector, now time.Time) map[string]float64 {
+
+	summary := summariseCollectors(collectors)
+
+	metrics := map[string]float64{
+		"Collectors/Healthy": float64(summary.Healthy),
+		"Collectors/Stale":   float64(len(summary.Stale)),
+	}
+
+	for _, c := range collectors {
+		stale := 0.0
+		if c.Status == collectorStale {
+			stale = 1
+		}
+
+		metrics[fmt.Sprintf("Collector/%s/Stale", c.Name)] = stale
+		metrics[fmt.Sprintf("Collector/%s/SecondsSinceSuccess", c.Name)] = c.sinceSuccess(now).Seconds()
+	}
+
+	return metrics
+
+}
+
+// report the collectors' health to New Relic, every collectorMetricsInterval
+func startCollectorMetrics(app newrelic.Application) {
+
+	go func() {
+		ticker := time.NewTicker(collectorMetricsInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			now := time.Now().UTC()
+
+			collectors, err := loadCollectors(now)
+			if err != nil {
+				log.Println(err.Error())
+				continue
+			}
+
+			for name, value := range collectorMetrics(collectors, now) {
+				if err := app.RecordCustomMetric(name, value); err != nil {
+					log.Println(err.Error())
+				}
+			}
+		}
+	}()
+
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateCollector(t *testing.T) {
+
+	saved := serverConfig.API.V0.BulkScope
+	defer func() { serverConfig.API.V0.BulkScope = saved }()
+	serverConfig.API.V0.BulkScope = map[string][]string{"openstack": {"tenant_name"}}
+
+	c := collector{Name: "openstack-prod", Type: "openstack", Scope: map[string]string{"tenant_name": "prod"}, Interval: "60m"}
+	if assert.NoError(t, validateCollector(&c)) {
+		assert.Equal(t, "1h0m0s", c.Interval, "normalised interval")
+	}
+
+	c = collector{Name: "vrops", Type: "vrops-vmware", Interval: "15m"}
+	if assert.NoError(t, validateCollector(&c), "a type without a bulk scope") {
+		assert.NotNil(t, c.Scope, "empty scope")
+	}
+
+	for name, invalid := range map[string]collector{
+		"bad name":      {Name: "openstack/prod", Type: "openstack", Scope: map[string]string{"tenant_name": "prod"}, Interval: "1h"},
+		"no type":       {Name: "openstack-prod", Scope: map[string]string{"tenant_name": "prod"}, Interval: "1h"},
+		"bad interval":  {Name: "openstack-prod", Type: "openstack", Scope: map[string]string{"tenant_name": "prod"}, Interval: "hourly"},
+		"short":         {Name: "openstack-prod", Type: "openstack", Scope: map[string]string{"tenant_name": "prod"}, Interval: "10s"},
+		"missing scope": {Name: "openstack-prod", Type: "openstack", Interval: "1h"},
+		"extra scope":   {Name: "openstack-prod", Type: "openstack", Scope: map[string]string{"tenant_name": "prod", "region": "west"}, Interval: "1h"},
+	} {
+		invalid := invalid
+		assert.Error(t, validateCollector(&invalid), name)
+	}
+
+}
+
+func TestCollectorCovers(t *testing.T) {
+
+	c := collector{Type: "openstack", Scope: map[string]string{"tenant_name": "prod"}}
+
+	assert.True(t, c.covers(map[string]interface{}{"tenant_name": "prod", "region": "west"}), "in scope")
+	assert.False(t, c.covers(map[string]interface{}{"tenant_name": "stage"}), "another scope")
+	assert.False(t, c.covers(map[string]interface{}{}), "no scope")
+
+	numeric := collector{Type: "aws", Scope: map[string]string{"aws-account-id": "1234"}}
+	assert.True(t, numeric.covers(map[string]interface{}{"aws-account-id": 1234}), "compared as strings")
+
+	account := collector{Type: "aws", Scope: map[string]string{"aws-account-id": "123456789012"}}
+	assert.True(t, account.covers(map[string]interface{}{"aws-account-id": float64(123456789012)}), "a decoded json number")
+	assert.False(t, account.covers(map[string]interface{}{"aws-account-id": map[string]interface{}{}}), "an object")
+
+}
+
+func TestCollectorHealth(t *testing.T) {
+
+	now := time.Date(2020, 5, 2, 20, 0, 0, 0, time.UTC)
+
+	c := collector{Name: "openstack-prod", Interval: "1h0m0s", Created: "2020-05-01 00:00:00", LastSuccess: "2020-05-02 19:00:00"}
+	assert.Equal(t, time.Hour, c.sinceSuccess(now), "since the last success")
+	assert.Equal(t, collectorHealthy, c.health(now), "healthy")
+
+	c.LastSuccess = "2020-05-02 17:30:00"
+	assert.Equal(t, collectorStale, c.health(now), "missed two runs")
+
+	c = collector{Name: "new", Interval: "1h0m0s", Created: "2020-05-02 19:30:00"}
+	assert.Equal(t, collectorHealthy, c.health(now), "recently registered")
+
+	c.Created = "2020-05-02 10:00:00"
+	assert.Equal(t, collectorStale, c.health(now), "never succeeded")
+
+}
+
+func TestCollectorMetrics(t *testing.T) {
+
+	now := time.Date(2020, 5, 2, 20, 0, 0, 0, time.UTC)
+
+	collectors := []collector{
+		{Name: "openstack-prod", Interval: "1h0m0s", LastSuccess: "2020-05-02 19:00:00", Status: collectorHealthy},
+		{Name: "vrops", Interval: "15m0s", LastSuccess: "2020-05-02 12:00:00", Status: collectorStale},
+	}
+
+	assert.Equal(t, collectorHealth{Healthy: 1, Stale: []string{"vrops"}}, summariseCollectors(collectors), "summary")
+
+	metrics := collectorMetrics(collectors, now)
+	assert.Equal(t, 1.0, metrics["Collectors/Healthy"], "healthy")
+	assert.Equal(t, 1.0, metrics["Collectors/Stale"], "stale")
+	assert.Equal(t, 0.0, metrics["Collector/openstack-prod/Stale"], "healthy collector")
+	assert.Equal(t, 1.0, metrics["Collector/vrops/Stale"], "stale collector")
+	assert.Equal(t, 8*time.Hour.Seconds(), metrics["Collector/vrops/SecondsSinceSuccess"], "since success")
+
+}
@@ -6,10 +6,88 @@ import (
 	"os"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
+// settings which are specific to the server, and aren't part of the shared hostdb.GlobalConfig
+var serverConfig hostdbServerConfig
+
+type hostdbServerConfig struct {
+	Hostdb hostdbServerSettings `mapstructure:"hostdb"`
+	API    apiServerSettings    `mapstructure:"api"`
+}
+
+type hostdbServerSettings struct {
+	AdminPass string      `mapstructure:"admin_pass"` // for the admin user; when empty, the writer may use admin routes
+	TLS       tlsSettings `mapstructure:"tls"`
+}
+
+type apiServerSettings struct {
+	V0 apiV0ServerSettings `mapstructure:"v0"`
+}
+
+type apiV0ServerSettings struct {
+	BulkBatchSize     int                 `mapstructure:"bulk_batch_size"`   // records written per statement
+	BulkScope         map[string][]string `mapstructure:"bulk_scope"`        // map[type][]context_key
+	BulkScopeTypes    map[string]string   `mapstructure:"bulk_scope_types"`  // map[type]type_pattern, e.g. vrops-vmware*
+	ChangesRetention  time.Duration       `mapstructure:"changes_retention"` // how long entries are kept in the change feed
+	DeleteThreshold   map[string]string   `mapstructure:"delete_threshold"`  // map[type]threshold, e.g. 25% or 100
+	EventBuffer       int                 `mapstructure:"event_buffer"`      // how many recent record changes are kept, for event streams to resume from
+	Extract           extractSettings     `mapstructure:"extract"`
+	IdempotencyWindow time.Duration       `mapstructure:"idempotency_window"` // how long responses are kept for Idempotency-Key replays
+	Identity          map[string][]string `mapstructure:"identity"`           // map[type][]path
+	Jobs              jobSettings         `mapstructure:"jobs"`
+	RunsRetention     time.Duration       `mapstructure:"runs_retention"` // how long bulk POSTs are kept in the run ledger
+	Schemas           schemaSettings      `mapstructure:"schemas"`
+	TimestampFormat   string              `mapstructure:"timestamp_format"` // rfc3339 or legacy; the default is rfc3339
+	Webhooks          webhookSettings     `mapstructure:"webhooks"`
+}
+
+// json paths into the data payload, used to fill in a record's hostname and ip when they're absent
+type extractSettings struct {
+	Hostname map[string][]string `mapstructure:"hostname"` // map[type][]path, tried in order
+	IP       map[string][]string `mapstructure:"ip"`       // map[type][]path, tried in order
+	IPs      map[string][]string `mapstructure:"ips"`      // map[type][]path; every address found is added to the record's ip addresses
+}
+
+// settings for queued bulk requests
+type jobSettings struct {
+	Workers   int           `mapstructure:"workers"`   // how many jobs may run at once; jobs in the same scope always run one at a time
+	Retention time.Duration `mapstructure:"retention"` // how long finished jobs are kept
+}
+
+// settings for sending webhook deliveries; the subscriptions themselves are managed at /admin/webhooks
+type webhookSettings struct {
+	MaxAttempts int           `mapstructure:"max_attempts"` // a delivery which fails this many times is given up on
+	Timeout     time.Duration `mapstructure:"timeout"`      // for each attempt
+	Retention   time.Duration `mapstructure:"retention"`    // how long the history of finished deliveries is kept
+}
+
+// settings for validating record data against json schemas
+type schemaSettings struct {
+	Directory string            `mapstructure:"directory"` // holds a <type>.json schema for each type
+	Mode      string            `mapstructure:"mode"`      // enforce or warn; the default is enforce
+	Modes     map[string]string `mapstructure:"modes"`     // map[type]mode, overriding mode for particular types
+}
+
+type tlsSettings struct {
+	Enabled          bool                `mapstructure:"enabled"`
+	CertFile         string              `mapstructure:"cert_file"`
+	KeyFile          string              `mapstructure:"key_file"`
+	ClientAuth       string              `mapstructure:"client_auth"` // none, optional or require
+	ClientCAFile     string              `mapstructure:"client_ca_file"`
+	ClientIdentities []tlsClientIdentity `mapstructure:"client_identities"`
+	AdminIdentities  []tlsClientIdentity `mapstructure:"admin_identities"`
+}
+
+// maps a client certificate subject to a writer (or admin) identity
+type tlsClientIdentity struct {
+	Subject  string `mapstructure:"subject"` // either the full subject DN, or just the common name
+	Identity string `mapstructure:"identity"`
+}
+
 func loadConfig() {
 
 	// load the config
@@ -44,6 +122,9 @@ func loadConfig() {
 	if err := viper.Unmarshal(&config); err != nil {
 		log.Fatal(fmt.Errorf("unable to decode into struct, %v", err))
 	}
+	if err := viper.Unmarshal(&serverConfig); err != nil {
+		log.Fatal(fmt.Errorf("unable to decode into struct, %v", err))
+	}
 
 	if config.Hostdb.Debug {
 		// log the env vars
@@ -25,6 +25,9 @@ func TestLoadConfig(t *testing.T) {
 	assert.Equal(t, "badpassword", config.Mariadb.Pass, "Configuration - Mariadb.Pass")
 	assert.GreaterOrEqual(t, len(config.Mariadb.Params), 1, "Configuration - Mariadb.Params")
 
+	assert.Equal(t, []string{".id"}, serverConfig.API.V0.Identity["openstack"], "Configuration - API.V0.Identity")
+	assert.Equal(t, []string{".uri"}, serverConfig.API.V0.Identity["oneview-*"], "Configuration - API.V0.Identity (wildcard)")
+
 	// test the ability to override k8s specific stuff
 	if err := os.Setenv("HOSTDB_HOSTDB_SERVER_SERVICE_PORT", "1234"); err != nil {
 		t.Errorf("%v", err)
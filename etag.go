@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pdxfixit/hostdb"
+)
+
+// a conditional write found the record no longer matches its If-Match header, once the row was locked
+var errPreconditionFailed = errors.New("the record has changed since it was read (If-Match)")
+
+// the entity tag of a record; it changes whenever the record's data (via its hash) or context changes
+func recordETag(record hostdb.Record) (string, error) {
+
+	// json.Marshal sorts map keys, so the context always encodes the same way
+	context, err := json.Marshal(record.Context)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(append([]byte(record.Hash+"\n"), context...))
+
+	return fmt.Sprintf(`"%x"`, sum), nil
+
+}
+
+// whether an If-Match or If-None-Match header value matches an entity tag
+// the header may be *, or a comma separated list of tags; weak tags are compared by their value
+func etagMatches(header string, etag string) bool {
+
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+
+	for _, candidate := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+
+}
+
+// check the If-Match precondition of a write against the existing record (which has no ID if there isn't one)
+// responds with a 412, and returns false, if the precondition fails
+// the write itself checks the header again, with the row locked, in case the record changes in the meantime
+func checkIfMatch(c *gin.Context, existing hostdb.Record) bool {
+
+	header := c.GetHeader("If-Match")
+	if header == "" {
+		return true
+	}
+
+	if existing.ID != "" {
+		etag, err := recordETag(existing)
+		if err != nil {
+			log.Println(err.Error())
+			c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
+				Error: "could not compute the etag of the record",
+			})
+			return false
+		}
+
+		if etagMatches(header, etag) {
+			return true
+		}
+	}
+
+	c.AbortWithStatusJSON(http.StatusPreconditionFailed, hostdb.GenericError{
+		Error: errPreconditionFailed.Error(),
+	})
+
+	return false
+
+}
+
+// set the ETag header for a record; a failure is logged, since the response is still good without it
+func setETag(c *gin.Context, record hostdb.Record) string {
+
+	etag, err := recordETag(record)
+	if err != nil {
+		log.Println(err.Error())
+		return ""
+	}
+
+	c.Header("ETag", etag)
+
+	return etag
+
+}
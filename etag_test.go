@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pdxfixit/hostdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordETag(t *testing.T) {
+
+	record := hostdb.Record{
+		Hash:    "abc123",
+		Context: map[string]interface{}{"tenant": "foo", "region": "bar"},
+	}
+
+	etag, err := recordETag(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Regexp(t, `^"[0-9a-f]{64}"$`, etag, "quoted sha256")
+
+	again, _ := recordETag(record)
+	assert.Equal(t, etag, again, "stable")
+
+	changed := record
+	changed.Context = map[string]interface{}{"tenant": "foo", "region": "baz"}
+	contextETag, _ := recordETag(changed)
+	assert.NotEqual(t, etag, contextETag, "context changes the etag")
+
+	changed = record
+	changed.Hash = "def456"
+	hashETag, _ := recordETag(changed)
+	assert.NotEqual(t, etag, hashETag, "data changes the etag")
+
+	// the timestamp and committer don't matter
+	changed = record
+	changed.Timestamp = "2020-01-01 00:00:00"
+	changed.Committer = "someone else"
+	otherETag, _ := recordETag(changed)
+	assert.Equal(t, etag, otherETag, "metadata doesn't change the etag")
+
+}
+
+func TestETagMatches(t *testing.T) {
+
+	etag := `"abc"`
+
+	assert.True(t, etagMatches(`"abc"`, etag))
+	assert.True(t, etagMatches(`*`, etag))
+	assert.True(t, etagMatches(`"xyz", "abc"`, etag))
+	assert.True(t, etagMatches(`W/"abc"`, etag))
+	assert.False(t, etagMatches(`"xyz"`, etag))
+	assert.False(t, etagMatches(`abc`, etag))
+	assert.False(t, etagMatches(``, etag))
+
+}
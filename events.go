@@ -0,0 +1,501 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pdxfixit/hostdb"
+)
+
+// the record changes which are announced, to the change feed, webhooks and event streams
+const (
+	recordEventCreate = "create"
+	recordEventUpdate = "update"
+	recordEventDelete = "delete"
+)
+
+// sent to an event stream instead of events which are no longer buffered
+const recordEventReset = "reset"
+
+const (
+	defaultEventBuffer     = 1000
+	eventKeepAlive         = 15 * time.Second // idle streams are sent a comment this often, so that proxies don't close them
+	eventSubscriberBacklog = 64               // batches of events a stream may fall behind by, before it's disconnected
+	eventOriginCheck       = 5 * time.Second  // how often the change feed is checked for changes made by other servers
+)
+
+var recordEventTypes = []string{recordEventCreate, recordEventUpdate, recordEventDelete}
+
+// the live record changes, for event streams
+// only the changes made by this server are published; changes made by other servers sharing the database get a reset instead
+var recordEvents = newEventBroker()
+
+// identifies the changes this server adds to the change feed, so that those made by other servers can be noticed
+var eventOrigin = newEventOrigin()
+
+// a change to a record, as sent to event streams
+type recordEvent struct {
+	ID        int64         `json:"id,string"`
+	Event     string        `json:"event"`
+	Timestamp string        `json:"timestamp"`
+	Record    hostdb.Record `json:"record"`
+}
+
+// keeps the most recent events, so that streams can resume, and passes new events on to the streams
+type eventBroker struct {
+	sync.Mutex
+	lastID      int64         // event ids are sequential, starting from the time the broker was made, so they only ever increase
+	buffer      []recordEvent // oldest first
+	subscribers map[*eventSubscriber]struct{}
+}
+
+type eventSubscriber struct {
+	events chan *eventBatch // closed if the subscriber falls too far behind, or unsubscribes
+}
+
+// some events, as passed to each of the subscribers
+// which of them match a stream's query params is worked out once for each distinct filter, however many streams share it,
+// so that the queries made don't grow with the number of streams
+type eventBatch struct {
+	sync.Mutex
+	events  []recordEvent
+	matches map[string]*eventMatch // by filter
+}
+
+// which of a batch's records match a filter; done is closed once it's known
+type eventMatch struct {
+	done    chan struct{}
+	matched []bool
+	err     error
+}
+
+// changes to records, with the records as they are now (or were, before being deleted)
+type recordChanges struct {
+	event   string
+	records map[string]hostdb.Record
+}
+
+// what an event stream is interested in, and how far it has got
+type eventStream struct {
+	where  hostdb.MariadbWhereClauses
+	legacy bool  // whether timestamps are shown in the legacy format
+	lastID int64 // of the last event considered, whether it matched or not
+	sentID int64 // the last id sent to the client
+}
+
+func newEventBroker() *eventBroker {
+
+	return &eventBroker{
+		lastID:      time.Now().UnixNano(),
+		subscribers: map[*eventSubscriber]struct{}{},
+	}
+
+}
+
+func newEventBatch(events []recordEvent) *eventBatch {
+
+	return &eventBatch{
+		events:  events,
+		matches: map[string]*eventMatch{},
+	}
+
+}
+
+func newEventOrigin() string {
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal(err)
+	}
+
+	return hex.EncodeToString(b)
+
+}
+
+// buffer the events for some records, and pass them on to the subscribers
+func (b *eventBroker) publish(event string, records []hostdb.Record) {
+
+	if len(records) < 1 {
+		return
+	}
+
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+
+	b.Lock()
+	defer b.Unlock()
+
+	events := make([]recordEvent, 0, len(records))
+	for _, record := range records {
+		b.lastID++
+		events = append(events, recordEvent{
+			ID:        b.lastID,
+			Event:     event,
+			Timestamp: timestamp,
+			Record:    record,
+		})
+	}
+
+	b.send(events)
+
+}
+
+// tell the subscribers, and those which resume from before now, that they've missed some changes
+func (b *eventBroker) reset() {
+
+	b.Lock()
+	defer b.Unlock()
+
+	b.lastID++
+
+	b.send([]recordEvent{{
+		ID:        b.lastID,
+		Event:     recordEventReset,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+	}})
+
+}
+
+// buffer some events, and pass them on to the subscribers; the broker must be locked
+func (b *eventBroker) send(events []recordEvent) {
+
+	size := serverConfig.API.V0.EventBuffer
+	if size < 1 {
+		size = defaultEventBuffer
+	}
+
+	b.buffer = append(b.buffer, events...)
+	if len(b.buffer) > size {
+		b.buffer = append([]recordEvent{}, b.buffer[len(b.buffer)-size:]...)
+	}
+
+	batch := newEventBatch(events)
+
+	for subscriber := range b.subscribers {
+		select {
+		case subscriber.events <- batch:
+		default:
+			// it can resume from the buffer when it reconnects, if it does so soon enough
+			delete(b.subscribers, subscriber)
+			close(subscriber.events)
+		}
+	}
+
+}
+
+// subscribe to the events after lastEventID; or, if it's empty, to events from now on
+// the buffered events since lastEventID are returned, unless some have been missed (they're no longer buffered, or the id is unknown)
+// lastID is the id of the last event published before subscribing
+func (b *eventBroker) subscribe(lastEventID string) (subscriber *eventSubscriber, backlog []recordEvent, missed bool, lastID int64) {
+
+	b.Lock()
+	defer b.Unlock()
+
+	if lastEventID != "" {
+		id, err := strconv.ParseInt(lastEventID, 10, 64)
+
+		switch {
+		case err != nil || id > b.lastID:
+			missed = true
+		case id < b.lastID:
+			// the event after the last one seen must still be buffered
+			if len(b.buffer) < 1 || b.buffer[0].ID > id+1 {
+				missed = true
+				break
+			}
+
+			for _, event := range b.buffer {
+				if event.ID > id {
+					backlog = append(backlog, event)
+				}
+			}
+		}
+	}
+
+	subscriber = &eventSubscriber{
+		events: make(chan *eventBatch, eventSubscriberBacklog),
+	}
+
+	b.subscribers[subscriber] = struct{}{}
+
+	return subscriber, backlog, missed, b.lastID
+
+}
+
+func (b *eventBroker) unsubscribe(subscriber *eventSubscriber) {
+
+	b.Lock()
+	defer b.Unlock()
+
+	if _, ok := b.subscribers[subscriber]; ok {
+		delete(b.subscribers, subscriber)
+		close(subscriber.events)
+	}
+
+}
+
+// watch the change feed for changes made by other servers sharing the database, which this server can't stream,
+// and reset the event streams when there are some
+func startEventOriginCheck() {
+
+	_, since, _, err := getMariadbChangeBounds(0)
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	go func() {
+		for range time.Tick(eventOriginCheck) {
+			_, latest, _, err := getMariadbChangeBounds(since)
+			if err != nil {
+				log.Println(err.Error())
+				continue
+			}
+
+			others, err := getMariadbOtherOriginChanges(since, latest, eventOrigin)
+			if err != nil {
+				log.Println(err.Error())
+				continue
+			}
+
+			if others > 0 {
+				recordEvents.reset()
+			}
+
+			since = latest
+		}
+	}()
+
+}
+
+// read the records which have just changed, or are about to be deleted, so that the changes can be announced
+func gatherRecordChanges(event string, ids []string) recordChanges {
+
+	changes := recordChanges{
+		event:   event,
+		records: map[string]hostdb.Record{},
+	}
+
+	for start := 0; start < len(ids); start += defaultBulkBatchSize {
+		end := start + defaultBulkBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		records, _, err := getMariadbRows(hostdb.MariadbWhereClauses{
+			Groups: []hostdb.MariadbWhereGrouping{{
+				Clauses: []hostdb.MariadbWhereClause{{
+					Relativity: "AND",
+					Key:        []string{"id"},
+					Operator:   "IN",
+					Value:      ids[start:end],
+				}},
+			}},
+		}, hostdb.MariadbLimit{})
+		if err != nil {
+			log.Println(err.Error())
+			continue
+		}
+
+		for id, record := range records {
+			changes.records[id] = record
+		}
+	}
+
+	return changes
+
+}
+
+// announce the changes to some of the records (e.g. those which were actually deleted) to event streams and webhooks
+// the change feed is written along with the changes themselves
+func (changes recordChanges) announce(ids []string) {
+
+	var records []hostdb.Record
+	for _, id := range ids {
+		if record, ok := changes.records[id]; ok {
+			records = append(records, record)
+		}
+	}
+
+	if len(records) < 1 {
+		return
+	}
+
+	recordEvents.publish(changes.event, records)
+	queueWebhookDeliveries(changes.event, records)
+
+}
+
+// announce changes to records which have just been saved
+func announceRecordChanges(event string, ids []string) {
+
+	gatherRecordChanges(event, ids).announce(ids)
+
+}
+
+// which of the records match the where clauses (all of them, if there are none)
+// a record may appear more than once, e.g. as it was before and after an update
+func matchRecords(records []hostdb.Record, where hostdb.MariadbWhereClauses) (matched []bool, err error) {
+
+	matched = make([]bool, len(records))
+
+	if len(where.Groups) < 1 {
+		for i := range matched {
+			matched[i] = true
+		}
+		return matched, nil
+	}
+
+	// the records are matched in chunks, in which each id appears only once
+	for start := 0; start < len(records); {
+		seen := map[string]bool{}
+
+		end := start
+		for end < len(records) && end-start < defaultBulkBatchSize && !seen[records[end].ID] {
+			seen[records[end].ID] = true
+			end++
+		}
+
+		ids, err := matchMariadbRecords(records[start:end], where)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := start; i < end; i++ {
+			matched[i] = ids[records[i].ID]
+		}
+
+		start = end
+	}
+
+	return matched, nil
+
+}
+
+// which of the batch's records match the where clauses; resets aren't about any record, so they're left out
+// the first stream to ask about a filter matches the records, and any others with the same filter wait for its answer
+func (batch *eventBatch) match(where hostdb.MariadbWhereClauses) (matched []bool, err error) {
+
+	key, err := json.Marshal(where)
+	if err != nil {
+		return nil, err
+	}
+
+	batch.Lock()
+	match, ok := batch.matches[string(key)]
+	if !ok {
+		match = &eventMatch{done: make(chan struct{})}
+		batch.matches[string(key)] = match
+	}
+	batch.Unlock()
+
+	if ok {
+		<-match.done
+		return match.matched, match.err
+	}
+
+	records := make([]hostdb.Record, 0, len(batch.events))
+	for _, event := range batch.events {
+		if event.Event != recordEventReset {
+			records = append(records, event.Record)
+		}
+	}
+
+	match.matched, match.err = matchRecords(records, where)
+	close(match.done)
+
+	return match.matched, match.err
+
+}
+
+// write the events which match the stream's query params, and note that the rest have been considered
+func (s *eventStream) write(w io.Writer, batch *eventBatch) error {
+
+	if len(batch.events) < 1 {
+		return nil
+	}
+
+	// resets are always sent
+	matched, err := batch.match(s.where)
+	if err != nil {
+		return err
+	}
+
+	i := 0
+	for _, event := range batch.events {
+		s.lastID = event.ID
+
+		if event.Event == recordEventReset {
+			if err := s.reset(w); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		i++
+		if !matched[i-1] {
+			continue
+		}
+
+		if !s.legacy {
+			event.Record.Timestamp = rfc3339Timestamp(event.Record.Timestamp)
+		}
+
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Event, data); err != nil {
+			return err
+		}
+
+		s.sentID = event.ID
+	}
+
+	return nil
+
+}
+
+// tell the client that it has missed some events, so it should read the records it's interested in again
+func (s *eventStream) reset(w io.Writer) error {
+
+	data, err := json.Marshal(map[string]string{
+		"id":        strconv.FormatInt(s.lastID, 10),
+		"event":     recordEventReset,
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+
+	s.sentID = s.lastID
+
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", s.lastID, recordEventReset, data)
+
+	return err
+
+}
+
+// write a comment, to keep the stream open; with the id of the last event considered, if it wasn't sent,
+// so that a client which reconnects doesn't resume from before the events it wasn't interested in
+func (s *eventStream) keepAlive(w io.Writer) error {
+
+	if s.lastID == s.sentID {
+		_, err := fmt.Fprint(w, ": keep-alive\n\n")
+		return err
+	}
+
+	s.sentID = s.lastID
+
+	_, err := fmt.Fprintf(w, ": keep-alive\nid: %d\n\n", s.lastID)
+
+	return err
+
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/pdxfixit/hostdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventBroker(t *testing.T) {
+
+	saved := serverConfig.API.V0.EventBuffer
+	defer func() { serverConfig.API.V0.EventBuffer = saved }()
+	serverConfig.API.V0.EventBuffer = 3
+
+	broker := newEventBroker()
+	start := broker.lastID
+
+	live, backlog, missed, lastID := broker.subscribe("")
+	assert.Empty(t, backlog, "nothing to resume from")
+	assert.False(t, missed, "nothing missed")
+	assert.Equal(t, start, lastID, "last id")
+
+	broker.publish(recordEventCreate, []hostdb.Record{{ID: "a"}, {ID: "b"}})
+	broker.publish(recordEventUpdate, []hostdb.Record{{ID: "a"}, {ID: "c"}})
+
+	events := (<-live.events).events
+	assert.Equal(t, 2, len(events), "first batch")
+	assert.Equal(t, start+1, events[0].ID, "sequential ids")
+	assert.Equal(t, recordEventCreate, events[0].Event, "event")
+	assert.Equal(t, "b", events[1].Record.ID, "record")
+	assert.Equal(t, 2, len((<-live.events).events), "second batch")
+
+	assert.Equal(t, 3, len(broker.buffer), "the buffer is bounded")
+
+	// resume from the oldest buffered event
+	_, backlog, missed, _ = broker.subscribe(fmt.Sprint(start + 1))
+	assert.False(t, missed, "resumed")
+	assert.Equal(t, []int64{start + 2, start + 3, start + 4}, eventIDs(backlog), "backlog")
+
+	// resume from the latest event
+	_, backlog, missed, _ = broker.subscribe(fmt.Sprint(start + 4))
+	assert.False(t, missed, "up to date")
+	assert.Empty(t, backlog, "nothing missed")
+
+	// events which are no longer buffered, or unknown ids, are missed
+	for _, id := range []string{fmt.Sprint(start), fmt.Sprint(start + 5), "foo"} {
+		_, backlog, missed, _ = broker.subscribe(id)
+		assert.True(t, missed, id)
+		assert.Empty(t, backlog, id)
+	}
+
+	// a subscriber which falls too far behind is disconnected
+	for i := 0; i <= eventSubscriberBacklog; i++ {
+		broker.publish(recordEventUpdate, []hostdb.Record{{ID: "a"}})
+	}
+	for range live.events {
+	}
+	_, subscribed := broker.subscribers[live]
+	assert.False(t, subscribed, "disconnected")
+
+	// unsubscribing again is harmless
+	broker.unsubscribe(live)
+
+	// a reset is sent to subscribers, and to those which resume from before it
+	live, _, _, lastID = broker.subscribe("")
+	broker.reset()
+	events = (<-live.events).events
+	assert.Equal(t, 1, len(events), "reset")
+	assert.Equal(t, recordEventReset, events[0].Event, "reset")
+	assert.Equal(t, lastID+1, events[0].ID, "resets have ids like other events")
+
+	_, backlog, missed, _ = broker.subscribe(fmt.Sprint(lastID))
+	assert.False(t, missed, "resumed")
+	assert.Equal(t, []int64{lastID + 1}, eventIDs(backlog), "the reset is buffered")
+
+}
+
+func TestEventStream(t *testing.T) {
+
+	stream := eventStream{lastID: 10, sentID: 10}
+
+	var b bytes.Buffer
+
+	assert.Nil(t, stream.keepAlive(&b))
+	assert.Equal(t, ": keep-alive\n\n", b.String(), "nothing new")
+
+	b.Reset()
+	assert.Nil(t, stream.write(&b, newEventBatch([]recordEvent{
+		{ID: 11, Event: recordEventCreate, Timestamp: "2020-05-02T20:09:26Z", Record: hostdb.Record{ID: "a", Timestamp: "2020-05-02 20:09:26"}},
+		{ID: 12, Event: recordEventDelete, Timestamp: "2020-05-02T20:09:27Z", Record: hostdb.Record{ID: "a", Timestamp: "2020-05-02 20:09:26"}},
+	})))
+
+	messages := strings.Split(strings.TrimSuffix(b.String(), "\n\n"), "\n\n")
+	assert.Equal(t, 2, len(messages), "messages")
+
+	lines := strings.Split(messages[0], "\n")
+	assert.Equal(t, "id: 11", lines[0], "id")
+	assert.Equal(t, "event: create", lines[1], "event")
+
+	event := recordEvent{}
+	assert.Nil(t, json.Unmarshal([]byte(strings.TrimPrefix(lines[2], "data: ")), &event))
+	assert.Equal(t, int64(11), event.ID, "data id")
+	assert.Equal(t, "a", event.Record.ID, "record")
+	assert.Equal(t, "2020-05-02T20:09:26Z", event.Record.Timestamp, "rfc3339 by default")
+
+	assert.True(t, strings.HasPrefix(messages[1], "id: 12\nevent: delete\n"), "second event")
+	assert.Equal(t, int64(12), stream.sentID, "sent")
+
+	// a legacy stream leaves the timestamps alone
+	legacy := eventStream{legacy: true}
+	b.Reset()
+	assert.Nil(t, legacy.write(&b, newEventBatch([]recordEvent{{ID: 1, Event: recordEventUpdate, Record: hostdb.Record{ID: "a", Timestamp: "2020-05-02 20:09:26"}}})))
+	assert.Contains(t, b.String(), `"timestamp":"2020-05-02 20:09:26"`, "legacy")
+
+	// events which weren't sent still move the stream's id on, when it's kept alive
+	stream.lastID = 15
+	b.Reset()
+	assert.Nil(t, stream.keepAlive(&b))
+	assert.Equal(t, ": keep-alive\nid: 15\n\n", b.String(), "id moved on")
+
+	b.Reset()
+	assert.Nil(t, stream.reset(&b))
+	assert.True(t, strings.HasPrefix(b.String(), "id: 15\nevent: reset\ndata: {"), "reset")
+
+	// a reset from the broker is sent along with the events around it
+	b.Reset()
+	assert.Nil(t, stream.write(&b, newEventBatch([]recordEvent{
+		{ID: 16, Event: recordEventCreate, Record: hostdb.Record{ID: "a"}},
+		{ID: 17, Event: recordEventReset},
+		{ID: 18, Event: recordEventDelete, Record: hostdb.Record{ID: "a"}},
+	})))
+	messages = strings.Split(strings.TrimSuffix(b.String(), "\n\n"), "\n\n")
+	assert.Equal(t, 3, len(messages), "messages")
+	assert.True(t, strings.HasPrefix(messages[1], "id: 17\nevent: reset\n"), "reset")
+	assert.True(t, strings.HasPrefix(messages[2], "id: 18\nevent: delete\n"), "after the reset")
+	assert.Equal(t, int64(18), stream.sentID, "sent")
+
+}
+
+func TestEventBatchMatch(t *testing.T) {
+
+	batch := newEventBatch([]recordEvent{
+		{ID: 1, Event: recordEventCreate, Record: hostdb.Record{ID: "a"}},
+		{ID: 2, Event: recordEventReset},
+		{ID: 3, Event: recordEventDelete, Record: hostdb.Record{ID: "a"}},
+	})
+
+	matched, err := batch.match(hostdb.MariadbWhereClauses{})
+	assert.Nil(t, err)
+	assert.Equal(t, []bool{true, true}, matched, "resets are left out")
+
+	// streams with the same filter share the answer
+	_, err = batch.match(hostdb.MariadbWhereClauses{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(batch.matches), "matched once")
+
+}
+
+func eventIDs(events []recordEvent) (ids []int64) {
+
+	for _, event := range events {
+		ids = append(ids, event.ID)
+	}
+
+	return ids
+
+}
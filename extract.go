@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pdxfixit/hostdb"
+)
+
+// fill in a record's hostname and ip from its data, if they're absent and the type has extract paths configured
+// each field has an ordered list of paths; the first which holds a value wins
+// any addresses found with the ips paths are then added to the ip field, which is normalised into a comma separated list
+func extractRecordFields(record *hostdb.Record) error {
+
+	hostnamePaths := typeSettings(record.Type, serverConfig.API.V0.Extract.Hostname)
+	ipPaths := typeSettings(record.Type, serverConfig.API.V0.Extract.IP)
+	ipsPaths := typeSettings(record.Type, serverConfig.API.V0.Extract.IPs)
+
+	if (record.Hostname != "" || len(hostnamePaths) < 1) && (record.IP != "" || len(ipPaths) < 1) && len(ipsPaths) < 1 {
+		record.IP = joinIPs(splitIPs(record.IP))
+		return nil
+	}
+
+	data, err := decodeJSON(record.Data)
+	if err != nil {
+		return err
+	}
+
+	if record.Hostname == "" {
+		if record.Hostname, err = extractJSONValue(data, hostnamePaths); err != nil {
+			return err
+		}
+	}
+
+	if record.IP == "" {
+		if record.IP, err = extractJSONValue(data, ipPaths); err != nil {
+			return err
+		}
+	}
+
+	addresses := splitIPs(record.IP)
+
+	for _, p := range ipsPaths {
+		segments, err := parseJSONPath(p)
+		if err != nil {
+			return err
+		}
+
+		for _, value := range lookupJSONPathAll(data, segments) {
+			if s, ok := jsonScalarString(value); ok {
+				addresses = append(addresses, s)
+			}
+		}
+	}
+
+	record.IP = joinIPs(splitIPs(strings.Join(addresses, ",")))
+
+	return nil
+
+}
+
+// the first non-empty scalar value found at any of the paths
+func extractJSONValue(data interface{}, paths []string) (string, error) {
+
+	for _, p := range paths {
+		segments, err := parseJSONPath(p)
+		if err != nil {
+			return "", err
+		}
+
+		for _, value := range lookupJSONPathAll(data, segments) {
+			if s, ok := jsonScalarString(value); ok {
+				return s, nil
+			}
+		}
+	}
+
+	return "", nil
+
+}
+
+// a non-empty string, number or boolean from a decoded json document
+func jsonScalarString(value interface{}) (string, bool) {
+
+	switch value.(type) {
+	case nil, map[string]interface{}, []interface{}:
+		return "", false
+	}
+
+	s := strings.TrimSpace(fmt.Sprintf("%v", value))
+
+	return s, s != ""
+
+}
+
+// fill in the hostname and ip addresses of the existing records, using the extract config
+// the records are written in batches as they're found, unless this is a dry run; ids are those which were (or would be) updated
+// each update is added to the change feed, so that mirrors pick up the new hostname and ip
+func backfillRecordFields(clauses hostdb.MariadbWhereClauses, dryRun bool) (checked int, ids []string, err error) {
+
+	batchSize := serverConfig.API.V0.BulkBatchSize
+	if batchSize < 1 {
+		batchSize = defaultBulkBatchSize
+	}
+
+	var batch []hostdb.Record
+
+	flush := func() error {
+		if err := saveMariadbRows(batch, newChangeEntries(recordEventUpdate, batch)); err != nil {
+			return err
+		}
+
+		for _, record := range batch {
+			ids = append(ids, record.ID)
+		}
+
+		batch = nil
+
+		return nil
+	}
+
+	err = eachMariadbRow(clauses, func(record hostdb.Record) error {
+		checked++
+
+		updated := record
+		if err := extractRecordFields(&updated); err != nil {
+			return fmt.Errorf("record %s: %v", record.ID, err)
+		}
+
+		if updated.Hostname == record.Hostname && updated.IP == record.IP {
+			return nil
+		}
+
+		if dryRun {
+			ids = append(ids, record.ID)
+			return nil
+		}
+
+		batch = append(batch, updated)
+		if len(batch) < batchSize {
+			return nil
+		}
+
+		return flush()
+	})
+	if err != nil {
+		return checked, ids, err
+	}
+
+	return checked, ids, flush()
+
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/pdxfixit/hostdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractRecordFields(t *testing.T) {
+
+	original := serverConfig.API.V0.Extract
+	defer func() { serverConfig.API.V0.Extract = original }()
+
+	serverConfig.API.V0.Extract = extractSettings{
+		Hostname: map[string][]string{
+			"extract-*": {".name"},
+		},
+		IP: map[string][]string{
+			"extract-*": {".accessIPv4", ".addresses.private[0].addr"},
+		},
+	}
+
+	tests := []struct {
+		record   hostdb.Record
+		hostname string
+		ip       string
+	}{
+		{ // both extracted
+			record:   hostdb.Record{Type: "extract-test", Data: json.RawMessage(`{"name": "foo", "accessIPv4": "10.0.0.1"}`)},
+			hostname: "foo",
+			ip:       "10.0.0.1",
+		},
+		{ // the first path is empty, so the second is used
+			record:   hostdb.Record{Type: "extract-test", Data: json.RawMessage(`{"name": "foo", "accessIPv4": "", "addresses": {"private": [{"addr": "10.0.0.2"}]}}`)},
+			hostname: "foo",
+			ip:       "10.0.0.2",
+		},
+		{ // fields which were sent are left alone
+			record:   hostdb.Record{Type: "extract-test", Hostname: "bar", IP: "127.0.0.1", Data: json.RawMessage(`{"name": "foo", "accessIPv4": "10.0.0.1"}`)},
+			hostname: "bar",
+			ip:       "127.0.0.1",
+		},
+		{ // objects aren't values
+			record:   hostdb.Record{Type: "extract-test", Data: json.RawMessage(`{"name": {"first": "foo"}}`)},
+			hostname: "",
+			ip:       "",
+		},
+		{ // types without paths aren't touched
+			record:   hostdb.Record{Type: "other", Data: json.RawMessage(`{"name": "foo"}`)},
+			hostname: "",
+			ip:       "",
+		},
+	}
+
+	for i, test := range tests {
+		record := test.record
+		assert.NoError(t, extractRecordFields(&record), i)
+		assert.Equal(t, test.hostname, record.Hostname, i)
+		assert.Equal(t, test.ip, record.IP, i)
+	}
+
+}
@@ -9,6 +9,7 @@ import (
 	"html/template"
 	"io"
 	"log"
+	"net/http"
 	"os"
 	"reflect"
 	"strconv"
@@ -27,6 +28,9 @@ import (
 
 var config hostdb.GlobalConfig
 
+// the gin context key holding the id of the current request
+const requestIDKey = "request_id"
+
 func main() {
 
 	//gin.SetMode(gin.ReleaseMode)
@@ -49,8 +53,24 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if err := loadSchemas(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := startJobs(); err != nil {
+		log.Fatal(err)
+	}
+
+	startWebhooks()
+
+	startEventOriginCheck()
+
+	startJanitor()
+
 	r := gin.Default()
 
+	startCollectorMetrics(app)
+
 	// Add the nrgin middleware before other middlewares or routes:
 	r.Use(nrgin.Middleware(app))
 
@@ -59,8 +79,31 @@ func main() {
 
 	log.Println("HostDB has started up.")
 
+	address := config.Hostdb.Host + ":" + strconv.Itoa(config.Hostdb.Port)
+
+	// listen and serve https, when we're not relying on an ingress for tls
+	if serverConfig.Hostdb.TLS.Enabled {
+		tlsConfig, err := loadTLSConfig(serverConfig.Hostdb.TLS)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		server := &http.Server{
+			Addr:      address,
+			Handler:   r,
+			TLSConfig: tlsConfig,
+		}
+
+		// the certificate and key are provided by tlsConfig.GetCertificate
+		if err = server.ListenAndServeTLS("", ""); err != nil {
+			log.Fatal(err)
+		}
+
+		return
+	}
+
 	// listen and serve (usually on 0.0.0.0:8080)
-	err = r.Run(config.Hostdb.Host + ":" + strconv.Itoa(config.Hostdb.Port))
+	err = r.Run(address)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -70,8 +113,9 @@ func main() {
 // define the routes
 func setupRoutes(r *gin.Engine) *gin.Engine {
 
+	r.Use(requestID)
 	r.Use(favicon.New("assets/128.png"))
-	r.Use(gzip.Gzip(gzip.DefaultCompression))
+	r.Use(compress())
 
 	// allows all PDXfixIT origins https://github.com/gin-contrib/cors#default-allows-all-origins
 	corsConfig := cors.DefaultConfig()
@@ -100,10 +144,25 @@ func setupRoutes(r *gin.Engine) *gin.Engine {
 	r.Use(static.Serve("/", static.LocalFile("assets", false)))
 
 	// admin
-	basicAuth := gin.BasicAuthForRealm(gin.Accounts{"writer": config.Hostdb.Pass}, "HostDB")
-	admin := r.Group("/admin", basicAuth)
+	basicAuth := writerAuth()
+	adminBasicAuth := adminAuth()
+	admin := r.Group("/admin", adminBasicAuth)
 	{
+		admin.GET("/audit", getAudit)
+		admin.PUT("/collectors/:name", putCollector)
+		admin.DELETE("/collectors/:name", deleteCollector)
+		admin.POST("/extract", postExtract)
+		admin.GET("/schemas", getSchemas)
+		admin.GET("/schemas/:type", getSchema)
+		admin.PUT("/schemas/:type", putSchema)
+		admin.DELETE("/schemas/:type", deleteSchema)
 		admin.GET("/showConfig", showConfig)
+		admin.GET("/webhooks", getWebhooks)
+		admin.POST("/webhooks", postWebhook)
+		admin.GET("/webhooks/:id", getWebhook)
+		admin.PUT("/webhooks/:id", putWebhook)
+		admin.DELETE("/webhooks/:id", deleteWebhook)
+		admin.GET("/webhooks/:id/deliveries", getWebhookDeliveries)
 	}
 
 	// API v0 routes
@@ -127,18 +186,69 @@ func setupRoutes(r *gin.Engine) *gin.Engine {
 		// records is for record management
 		v0.GET("/records/", getList)
 		v0.GET("/records/:id", getDetail)
-		v0.POST("/records/", basicAuth, postBulk)
-		v0.PUT("/records/:id", basicAuth, saveRecord)
+		v0.POST("/records/", basicAuth, idempotent, postBulk)
+		v0.DELETE("/records/", adminBasicAuth, deleteRecords)
+		v0.PUT("/records/:id", basicAuth, idempotent, saveRecord)
+		v0.PATCH("/records/:id", basicAuth, patchRecord)
 		v0.DELETE("/records/:id", basicAuth, deleteRecord)
 
+		// jobs are queued bulk requests
+		v0.GET("/jobs/:id", basicAuth, getJob)
+
 		// catalog items
 		v0.GET("/catalog/:item", getCatalog)
+
+		// registered collectors, and their health
+		v0.GET("/collectors", getCollectors)
+		v0.GET("/collectors/:name", getCollector)
+
+		// the ledger of bulk POSTs
+		v0.GET("/runs", getRuns)
+		v0.GET("/runs/:id", getRun)
+
+		// a feed of record changes, to follow from a since token
+		v0.GET("/changes", getChanges)
+
+		// a stream of record changes
+		v0.GET("/events", getEvents)
 	}
 
 	return r
 
 }
 
+// gzip responses, except event streams, which must reach the client as they're written
+func compress() gin.HandlerFunc {
+
+	compressor := gzip.Gzip(gzip.DefaultCompression)
+
+	return func(c *gin.Context) {
+
+		if c.Request.URL.Path == "/v0/events" {
+			return
+		}
+
+		compressor(c)
+
+	}
+
+}
+
+// ensure every request has an id, preferring one provided by the client or ingress
+func requestID(c *gin.Context) {
+
+	id := c.GetHeader("X-Request-ID")
+	if id == "" || len(id) > 64 {
+		id = getUUID("req")
+	}
+
+	c.Set(requestIDKey, id)
+	c.Header("X-Request-ID", id)
+
+	c.Next()
+
+}
+
 // checks User-Agent; if the client is likely a human, return pretty json
 func sendResponse(c *gin.Context, code int, obj interface{}) {
 
@@ -174,6 +284,20 @@ func sendResponse(c *gin.Context, code int, obj interface{}) {
 
 }
 
+// whether a boolean query param has been set, e.g. ?_dry_run or ?_dry_run=true
+func queryFlag(c *gin.Context, name string) bool {
+
+	value, ok := c.GetQuery(name)
+	if !ok {
+		return false
+	}
+
+	value = strings.ToLower(value)
+
+	return value != "0" && value != "false" && value != "no"
+
+}
+
 // ensure we have a correct hash of the (compacted) payload
 func hashPayload(payload json.RawMessage) (string, error) {
 
@@ -201,13 +325,24 @@ func ensureDataIsComplete(record *hostdb.Record) error {
 
 	// Timestamp
 	if record.Timestamp == "" {
-		record.Timestamp = time.Now().UTC().Format("2006-01-02 15:04:05")
+		record.Timestamp = time.Now().UTC().Format(storedTimestampFormat)
+	} else {
+		timestamp, err := normaliseTimestamp(record.Timestamp)
+		if err != nil {
+			return err
+		}
+		record.Timestamp = timestamp
 	}
 
 	if len(record.Context) == 0 {
 		return errors.New("record has no context")
 	}
 
+	// fill in the hostname and ip from the data, if need be
+	if err := extractRecordFields(record); err != nil {
+		return fmt.Errorf("extracting the hostname or ip failed: %v", err)
+	}
+
 	// hash the payload
 	if record.Hash == "" {
 		hash, err := hashPayload(record.Data)
@@ -237,6 +372,11 @@ func anythingChanged(incoming hostdb.Record, existing hostdb.Record) bool {
 		changed = true
 	}
 
+	// the hostname and ip may have been extracted from unchanged data
+	if incoming.Hostname != existing.Hostname || incoming.IP != existing.IP {
+		changed = true
+	}
+
 	return changed
 
 }
@@ -31,6 +31,7 @@ var TestRecordCommitter = "Testy McTesterton"
 var TestRecordContext = map[string]interface{}{"test": true}
 var TestRecordData = []byte(`{"test": "yes"}`)
 var TestRecordHash = "b2869f424834f25fefbdec4a2141c26f1e413bc8cd8595389326396ff9beae99"
+var TestAdminPass = "adminpassword"
 var TestRecord = hostdb.Record{
 	ID:        getUUID("test"),
 	Type:      TestRecordType, // a view must exist for the given type
@@ -51,12 +52,25 @@ func TestMain(m *testing.M) {
 	// use a test database
 	config.Mariadb.DB = "test"
 
+	// the admin routes refuse everyone without an admin password
+	serverConfig.Hostdb.AdminPass = TestAdminPass
+
 	if err := loadMariadb(); err != nil {
 		log.Fatal(err)
 	}
 
 	setupTestDatabase()
 
+	if err := loadSchemas(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := startJobs(); err != nil {
+		log.Fatal(err)
+	}
+
+	startWebhooks()
+
 	r := gin.Default()
 	Router = setupRoutes(r)
 
@@ -301,9 +315,12 @@ func makeTestRequest(t *testing.T, method string, path string, auth bool, query
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest(method, path, body)
 
-	// auth
+	// auth; the admin routes, and deleting by query, need the admin's credentials
 	if auth {
 		encodedCreds := base64.StdEncoding.EncodeToString([]byte("writer:" + config.Hostdb.Pass))
+		if strings.HasPrefix(path, "/admin") || (method == "DELETE" && (path == "/v0/records/" || strings.HasPrefix(path, "/v0/records/?"))) {
+			encodedCreds = base64.StdEncoding.EncodeToString([]byte("admin:" + TestAdminPass))
+		}
 		req.Header.Add("Authorization", "Basic "+encodedCreds)
 	}
 
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pdxfixit/hostdb"
+)
+
+const (
+	defaultIdempotencyWindow = 24 * time.Hour
+	idempotencyClaimTimeout  = 15 * time.Minute // a key claimed for longer, without a response, was abandoned (e.g. by a restart)
+	maxIdempotencyKeyLength  = 255
+)
+
+// the response headers which are stored, and replayed along with the body
+var idempotentHeaders = []string{"Content-Location", "ETag", "Location", "Warning"}
+
+// the response to a request made with an Idempotency-Key
+// until the request has been handled, the key is claimed with a zero StatusCode
+type idempotentResponse struct {
+	Principal   string
+	Key         string
+	Fingerprint string // of the request
+	StatusCode  int
+	ContentType string
+	Headers     http.Header
+	Body        []byte
+	Created     string
+}
+
+// keeps a copy of the response body, so that it can be stored
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+
+	w.body.Write(b)
+
+	return w.ResponseWriter.Write(b)
+
+}
+
+func (w *responseRecorder) WriteString(s string) (int, error) {
+
+	w.body.WriteString(s)
+
+	return w.ResponseWriter.WriteString(s)
+
+}
+
+// how long a response is kept, and replayed for requests with the same Idempotency-Key
+func idempotencyWindow() time.Duration {
+
+	if window := serverConfig.API.V0.IdempotencyWindow; window > 0 {
+		return window
+	}
+
+	return defaultIdempotencyWindow
+
+}
+
+// identifies a request, so that a key reused for a different request can be refused
+// the body is copied to spool as it's hashed, so that it's never held in memory
+func idempotencyFingerprint(method string, uri string, body io.Reader, spool io.Writer) (string, error) {
+
+	hash := sha256.New()
+	hash.Write([]byte(method + " " + uri + "\n"))
+
+	if _, err := io.Copy(io.MultiWriter(hash, spool), body); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+
+}
+
+// middleware for writes which may be retried; a request with an Idempotency-Key header is only handled once
+// repeats of it within the idempotency window get the stored response, and the key can't be reused for a different request
+// keys are scoped to the principal, so this must come after the auth middleware
+func idempotent(c *gin.Context) {
+
+	key := c.GetHeader("Idempotency-Key")
+	if key == "" {
+		c.Next()
+		return
+	}
+
+	if len(key) > maxIdempotencyKeyLength {
+		c.AbortWithStatusJSON(http.StatusBadRequest, hostdb.GenericError{
+			Error: "the Idempotency-Key header is too long",
+		})
+		return
+	}
+
+	// the body is needed for the fingerprint, so it's spooled to a file as it's hashed, and the handler reads it back from there
+	spool, err := ioutil.TempFile("", "hostdb-idempotent-")
+	if err != nil {
+		log.Println(err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
+			Error: "could not spool the request body",
+		})
+		return
+	}
+	defer func() {
+		if err := spool.Close(); err != nil {
+			log.Println(err.Error())
+		}
+
+		if err := os.Remove(spool.Name()); err != nil {
+			log.Println(err.Error())
+		}
+	}()
+
+	fingerprint, err := idempotencyFingerprint(c.Request.Method, c.Request.URL.RequestURI(), c.Request.Body, spool)
+	if err != nil {
+		log.Println(err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
+			Error: "could not get raw request data",
+		})
+		return
+	}
+
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		log.Println(err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
+			Error: "could not spool the request body",
+		})
+		return
+	}
+	c.Request.Body = ioutil.NopCloser(spool)
+
+	now := time.Now().UTC()
+
+	claim := idempotentResponse{
+		Principal:   getPrincipal(c),
+		Key:         key,
+		Fingerprint: fingerprint,
+		Created:     now.Format("2006-01-02 15:04:05"),
+	}
+
+	stored, found, err := getMariadbIdempotentResponse(claim.Principal, key)
+	if err != nil {
+		log.Println(err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
+			Error: "could not get the idempotency key from the database",
+		})
+		return
+	}
+
+	// the key has expired, but the janitor hasn't got to it yet; or the request which claimed it never finished
+	expired := found && stored.Created < now.Add(-idempotencyWindow()).Format("2006-01-02 15:04:05")
+	abandoned := found && stored.StatusCode == 0 && stored.Created < now.Add(-idempotencyClaimTimeout).Format("2006-01-02 15:04:05")
+
+	if expired || abandoned {
+		// let this one try again
+		if err := deleteMariadbIdempotencyKey(claim.Principal, key); err != nil {
+			log.Println(err.Error())
+		}
+		found = false
+	}
+
+	if found {
+		if stored.Fingerprint != claim.Fingerprint {
+			c.AbortWithStatusJSON(http.StatusUnprocessableEntity, hostdb.GenericError{
+				Error: "the Idempotency-Key has already been used for a different request",
+			})
+			return
+		}
+
+		if stored.StatusCode == 0 {
+			c.AbortWithStatusJSON(http.StatusConflict, hostdb.GenericError{
+				Error: "a request with this Idempotency-Key is still being processed",
+			})
+			return
+		}
+
+		// replay
+		for name, values := range stored.Headers {
+			for _, value := range values {
+				c.Writer.Header().Add(name, value)
+			}
+		}
+		c.Header("Idempotent-Replayed", "true")
+		c.Data(stored.StatusCode, stored.ContentType, stored.Body)
+		c.Abort()
+		return
+	}
+
+	// claim the key, so that a concurrent retry doesn't also get handled
+	claimed, err := claimMariadbIdempotencyKey(claim)
+	if err != nil {
+		log.Println(err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
+			Error: "could not save the idempotency key to the database",
+		})
+		return
+	}
+
+	if !claimed {
+		c.AbortWithStatusJSON(http.StatusConflict, hostdb.GenericError{
+			Error: "a request with this Idempotency-Key is still being processed",
+		})
+		return
+	}
+
+	recorder := &responseRecorder{ResponseWriter: c.Writer}
+	c.Writer = recorder
+
+	c.Next()
+
+	// server errors aren't stored, so that the request can be retried
+	if recorder.Status() >= http.StatusInternalServerError {
+		if err := deleteMariadbIdempotencyKey(claim.Principal, key); err != nil {
+			log.Println(err.Error())
+		}
+		return
+	}
+
+	claim.StatusCode = recorder.Status()
+	claim.ContentType = recorder.Header().Get("Content-Type")
+	claim.Headers = http.Header{}
+	claim.Body = recorder.body.Bytes()
+
+	for _, name := range idempotentHeaders {
+		if values := recorder.Header().Values(name); len(values) > 0 {
+			claim.Headers[name] = values
+		}
+	}
+
+	if err := saveMariadbIdempotentResponse(claim); err != nil {
+		log.Println(err.Error())
+	}
+
+}
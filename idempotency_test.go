@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotencyFingerprint(t *testing.T) {
+
+	fingerprint := func(method string, uri string, body string) string {
+		f, err := idempotencyFingerprint(method, uri, strings.NewReader(body), ioutil.Discard)
+		assert.NoError(t, err, "fingerprint")
+		return f
+	}
+
+	assert.Regexp(t, `^[0-9a-f]{64}$`, fingerprint("PUT", "/v0/records/abc", `{"type":"test"}`), "sha256")
+
+	assert.Equal(t, fingerprint("PUT", "/v0/records/abc", `{"type":"test"}`), fingerprint("PUT", "/v0/records/abc", `{"type":"test"}`), "stable")
+	assert.NotEqual(t, fingerprint("PUT", "/v0/records/abc", `{"type":"test"}`), fingerprint("POST", "/v0/records/abc", `{"type":"test"}`), "method")
+	assert.NotEqual(t, fingerprint("PUT", "/v0/records/abc", `{"type":"test"}`), fingerprint("PUT", "/v0/records/abd", `{"type":"test"}`), "uri")
+	assert.NotEqual(t, fingerprint("PUT", "/v0/records/abc", `{"type":"test"}`), fingerprint("PUT", "/v0/records/abc", `{"type":"tset"}`), "body")
+
+	// the body is passed on to the spool as it's hashed
+	var spool bytes.Buffer
+	_, err := idempotencyFingerprint("PUT", "/v0/records/abc", strings.NewReader(`{"type":"test"}`), &spool)
+	assert.NoError(t, err, "spooled")
+	assert.Equal(t, `{"type":"test"}`, spool.String(), "spooled")
+
+}
+
+func TestResponseRecorder(t *testing.T) {
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+
+	recorder := &responseRecorder{ResponseWriter: c.Writer}
+	c.Writer = recorder
+
+	c.JSON(http.StatusCreated, gin.H{"ok": true})
+
+	assert.Equal(t, http.StatusCreated, recorder.Status(), "status")
+	assert.JSONEq(t, `{"ok":true}`, recorder.body.String(), "recorded body")
+	assert.Equal(t, w.Body.String(), recorder.body.String(), "written body")
+
+}
+
+func TestIdempotencyWindow(t *testing.T) {
+
+	saved := serverConfig.API.V0.IdempotencyWindow
+	defer func() { serverConfig.API.V0.IdempotencyWindow = saved }()
+
+	serverConfig.API.V0.IdempotencyWindow = 0
+	assert.Equal(t, defaultIdempotencyWindow, idempotencyWindow(), "default")
+
+	serverConfig.API.V0.IdempotencyWindow = 90 * time.Minute
+	assert.Equal(t, 90*time.Minute, idempotencyWindow(), "configured")
+
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/pdxfixit/hostdb"
+)
+
+// the width of the ip column; a record's addresses beyond this are only kept in the hostdb_ips table
+const ipColumnWidth = 1024
+
+// split an ip field into its addresses, normalising any which are ip addresses, and dropping duplicates
+// addresses may be separated by commas or whitespace; ipv6 addresses are written in their canonical form (RFC 5952)
+func splitIPs(field string) (addresses []string) {
+
+	seen := map[string]bool{}
+
+	for _, address := range strings.FieldsFunc(field, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' || r == '\n' }) {
+		if ip := net.ParseIP(address); ip != nil {
+			address = ip.String()
+		}
+
+		if !seen[address] {
+			seen[address] = true
+			addresses = append(addresses, address)
+		}
+	}
+
+	return addresses
+
+}
+
+// join addresses into an ip field, keeping as many as fit in the ip column
+func joinIPs(addresses []string) string {
+
+	field := ""
+
+	for _, address := range addresses {
+		if len(field)+len(address)+1 > ipColumnWidth {
+			break
+		}
+
+		if field != "" {
+			field += ","
+		}
+
+		field += address
+	}
+
+	return field
+
+}
+
+// the ip addresses of a record, as stored in the hostdb_ips table; ipv4 addresses are mapped to ipv6
+// anything in the ip field which isn't an ip address is left out
+func recordIPs(record hostdb.Record) (ips []net.IP) {
+
+	for _, address := range splitIPs(record.IP) {
+		if ip := net.ParseIP(address); ip != nil {
+			ips = append(ips, ip.To16())
+		}
+	}
+
+	return ips
+
+}
+
+// the first and last addresses of a cidr range (e.g. 10.20.0.0/16), or of a single ip address
+func ipRange(value string) (first net.IP, last net.IP, ok bool) {
+
+	if ip := net.ParseIP(value); ip != nil {
+		return ip.To16(), ip.To16(), true
+	}
+
+	_, network, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, nil, false
+	}
+
+	first = network.IP.To16()
+	last = make(net.IP, len(first))
+
+	// the mask of an ipv4 network only covers the last four bytes of the mapped address
+	mask := network.Mask
+	if len(mask) == net.IPv4len {
+		mask = append(net.CIDRMask(96, 128)[:12], mask...)
+	}
+
+	for i := range first {
+		last[i] = first[i] | ^mask[i]
+	}
+
+	return first, last, true
+
+}
+
+// the where clause matching records with any address in the given cidr ranges or ip addresses, or none of them
+// ok is false if any of the values isn't a cidr range or ip address, in which case the ip column should be compared as usual
+func ipWhereClause(values []string, negativeAssertion bool) (clause hostdb.MariadbWhereClause, ok bool) {
+
+	if len(values) < 1 {
+		return clause, false
+	}
+
+	var ranges []string
+
+	for _, value := range values {
+		first, last, ok := ipRange(strings.TrimSpace(value))
+		if !ok {
+			return clause, false
+		}
+
+		// the addresses are written as hex literals, since the clause has no placeholders
+		ranges = append(ranges, fmt.Sprintf("`hostdb_ips`.`ip` BETWEEN X'%x' AND X'%x'", []byte(first), []byte(last)))
+	}
+
+	operator := "IS NOT NULL"
+	if negativeAssertion {
+		operator = "IS NULL"
+	}
+
+	return hostdb.MariadbWhereClause{
+		Relativity: "AND",
+		Key: []string{fmt.Sprintf(
+			"(SELECT 1 FROM `hostdb_ips` WHERE `hostdb_ips`.`id` = `hostdb`.`id` AND (%s) LIMIT 1)",
+			strings.Join(ranges, " OR "),
+		)},
+		Operator: operator,
+		Value:    []string{},
+	}, true
+
+}
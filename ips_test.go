@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/pdxfixit/hostdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitIPs(t *testing.T) {
+
+	tests := map[string][]string{
+		"":                                     nil,
+		"10.0.0.1":                             {"10.0.0.1"},
+		"10.0.0.1, 10.0.0.2 10.0.0.1":          {"10.0.0.1", "10.0.0.2"},
+		"2001:DB8:0:0:0:0:0:1,2001:db8::1":     {"2001:db8::1"},
+		"::ffff:192.0.2.1":                     {"192.0.2.1"},
+		"not-an-ip,10.0.0.1":                   {"not-an-ip", "10.0.0.1"},
+		"fe80:0000:0000:0000:0000:0000:0000:1": {"fe80::1"},
+	}
+
+	for field, expected := range tests {
+		assert.Equal(t, expected, splitIPs(field), field)
+	}
+
+}
+
+func TestJoinIPs(t *testing.T) {
+
+	assert.Equal(t, "10.0.0.1,10.0.0.2", joinIPs([]string{"10.0.0.1", "10.0.0.2"}))
+
+	// too many addresses for the ip column
+	var addresses []string
+	for i := 0; i < 200; i++ {
+		addresses = append(addresses, "10.0.0.1")
+	}
+
+	field := joinIPs(addresses)
+	assert.True(t, len(field) <= ipColumnWidth, "fits the column")
+	assert.False(t, strings.HasSuffix(field, ","), "whole addresses")
+
+}
+
+func TestRecordIPs(t *testing.T) {
+
+	ips := recordIPs(hostdb.Record{IP: "10.0.0.1,bogus,2001:db8::1"})
+
+	assert.Equal(t, []net.IP{net.ParseIP("10.0.0.1").To16(), net.ParseIP("2001:db8::1")}, ips)
+
+}
+
+func TestIPRange(t *testing.T) {
+
+	tests := map[string][2]string{
+		"10.20.0.0/16":   {"10.20.0.0", "10.20.255.255"},
+		"10.20.30.40/16": {"10.20.0.0", "10.20.255.255"},
+		"10.0.0.1":       {"10.0.0.1", "10.0.0.1"},
+		"10.0.0.1/32":    {"10.0.0.1", "10.0.0.1"},
+		"2001:db8::/32":  {"2001:db8::", "2001:db8:ffff:ffff:ffff:ffff:ffff:ffff"},
+		"2001:DB8::1":    {"2001:db8::1", "2001:db8::1"},
+	}
+
+	for value, expected := range tests {
+		first, last, ok := ipRange(value)
+		if assert.True(t, ok, value) {
+			assert.Equal(t, expected[0], first.String(), value)
+			assert.Equal(t, expected[1], last.String(), value)
+			assert.Len(t, first, net.IPv6len, value)
+		}
+	}
+
+	for _, value := range []string{"", "foo", "10.0.0.0/33", "10.0.0"} {
+		_, _, ok := ipRange(value)
+		assert.False(t, ok, value)
+	}
+
+}
+
+func TestIPWhereClause(t *testing.T) {
+
+	clause, ok := ipWhereClause([]string{"10.20.0.0/16", "2001:db8::1"}, false)
+	if assert.True(t, ok) {
+		assert.Equal(t, "IS NOT NULL", clause.Operator)
+		assert.Contains(t, clause.Key[0], "BETWEEN X'00000000000000000000ffff0a140000' AND X'00000000000000000000ffff0a14ffff'")
+		assert.Contains(t, clause.Key[0], "BETWEEN X'20010db8000000000000000000000001' AND X'20010db8000000000000000000000001'")
+	}
+
+	clause, ok = ipWhereClause([]string{"10.0.0.1"}, true)
+	assert.True(t, ok)
+	assert.Equal(t, "IS NULL", clause.Operator)
+
+	// anything else compares the ip column as usual
+	_, ok = ipWhereClause([]string{"10.0.0.1", "localhost"}, false)
+	assert.False(t, ok)
+
+	_, ok = ipWhereClause(nil, false)
+	assert.False(t, ok)
+
+}
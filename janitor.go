@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	janitorInterval  = 10 * time.Minute
+	janitorBatchSize = 1000 // rows deleted per statement, so that no one delete holds its locks for long
+)
+
+// a table whose old rows are forgotten, once they're older than its retention
+type janitorTask struct {
+	table     string
+	retention func() time.Duration
+	delete    func(timestamp string, limit int) (deleted int64, err error) // delete up to limit rows from before the timestamp
+}
+
+// the tables the janitor keeps tidy
+var janitorTasks = []janitorTask{
+	{"changes", changesRetention, deleteMariadbChangesBefore},
+	{"idempotency_keys", idempotencyWindow, deleteMariadbIdempotencyKeysBefore},
+	{"jobs", jobRetention, deleteMariadbJobsBefore},
+	{"runs", runsRetention, deleteMariadbRunsBefore},
+	{"webhook_deliveries", webhookRetention, deleteMariadbWebhookDeliveriesBefore},
+}
+
+// periodically delete old rows in the background, rather than while handling writes
+func startJanitor() {
+
+	go func() {
+		for {
+			for _, task := range janitorTasks {
+				if err := task.run(time.Now()); err != nil {
+					log.Println(fmt.Sprintf("tidying the %s table failed: %v", task.table, err))
+				}
+			}
+
+			time.Sleep(janitorInterval)
+		}
+	}()
+
+}
+
+// delete the rows older than the retention, a batch at a time
+func (task janitorTask) run(now time.Time) error {
+
+	timestamp := now.Add(-task.retention()).UTC().Format(storedTimestampFormat)
+
+	for {
+		deleted, err := task.delete(timestamp, janitorBatchSize)
+		if err != nil {
+			return err
+		}
+
+		if deleted < janitorBatchSize {
+			return nil
+		}
+	}
+
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJanitorTask(t *testing.T) {
+
+	now := time.Date(2020, 1, 8, 0, 0, 0, 0, time.UTC)
+
+	remaining := 2*janitorBatchSize + 10
+	var timestamps []string
+
+	task := janitorTask{
+		table:     "test",
+		retention: func() time.Duration { return 7 * 24 * time.Hour },
+		delete: func(timestamp string, limit int) (int64, error) {
+			timestamps = append(timestamps, timestamp)
+
+			deleted := limit
+			if remaining < limit {
+				deleted = remaining
+			}
+			remaining -= deleted
+
+			return int64(deleted), nil
+		},
+	}
+
+	assert.Nil(t, task.run(now))
+	assert.Equal(t, 0, remaining, "everything old was deleted")
+	assert.Equal(t, 3, len(timestamps), "a batch at a time, until a short batch")
+	assert.Equal(t, "2020-01-01 00:00:00", timestamps[0], "older than the retention")
+
+	task.delete = func(timestamp string, limit int) (int64, error) {
+		return 0, errors.New("failed")
+	}
+	assert.Error(t, task.run(now), "errors are returned")
+
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pdxfixit/hostdb"
+)
+
+// the states of a bulk job
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+)
+
+const (
+	defaultJobWorkers   = 2
+	defaultJobRetention = 7 * 24 * time.Hour
+	jobBodyChunkSize    = 1 << 20         // request bodies are stored in chunks, comfortably within maxAllowedPacket
+	jobProgressInterval = 5 * time.Second // how often a running job's progress is saved
+	jobLease            = 2 * time.Minute // a running job isn't taken over by another server before this, unless its lease is renewed
+	jobLeaseRenewal     = 30 * time.Second
+	jobLockWait         = 10 * time.Second // how long to wait for another server's job in the same scope, before checking on this one again
+)
+
+// the runner for queued bulk jobs; started by startJobs
+var jobs *jobRunner
+
+// a bulk request, queued to be processed in the background
+type bulkJob struct {
+	ID          string      `json:"id"`
+	Status      string      `json:"status"`
+	Type        string      `json:"type"`
+	Scope       string      `json:"scope"`
+	ContentType string      `json:"content_type"`
+	DryRun      bool        `json:"dry_run"`
+	Partial     bool        `json:"partial"`
+	Force       bool        `json:"force"`
+	Committer   string      `json:"committer"` // for records which don't name one
+	Principal   string      `json:"principal"`
+	SourceIP    string      `json:"source_ip"`
+	RequestID   string      `json:"request_id"`
+	Path        string      `json:"path"`
+	Received    int         `json:"received"`              // how many records have been reconciled so far
+	StatusCode  int         `json:"status_code,omitempty"` // the http status the request would have had, if it weren't queued
+	Result      *bulkResult `json:"result,omitempty"`
+	Error       string      `json:"error,omitempty"`
+	Created     string      `json:"created"`
+	Started     string      `json:"started,omitempty"`
+	Finished    string      `json:"finished,omitempty"`
+	LeaseUntil  string      `json:"-"` // while running; renewed until the job finishes, and left to expire if the server running it goes away
+}
+
+// runs queued jobs on a pool of workers, one job at a time per scope
+// jobs in the same scope are also held to one at a time across servers, by a lock in the database
+type jobRunner struct {
+	mu      sync.Mutex
+	pending map[string][]string // map[scope][]job_id, oldest first
+	active  map[string]bool     // scopes with a job queued to a worker, or in progress
+	ready   chan bulkJobRef
+}
+
+type bulkJobRef struct {
+	id    string
+	scope string
+}
+
+// start the workers, and requeue any jobs which were interrupted by a restart
+// jobs which are still leased by another server are left to it, unless its lease runs out
+func startJobs() error {
+
+	workers := serverConfig.API.V0.Jobs.Workers
+	if workers < 1 {
+		workers = defaultJobWorkers
+	}
+
+	jobs = &jobRunner{
+		pending: map[string][]string{},
+		active:  map[string]bool{},
+		ready:   make(chan bulkJobRef),
+	}
+
+	for i := 0; i < workers; i++ {
+		go jobs.work()
+	}
+
+	unfinished, err := getMariadbUnfinishedJobs()
+	if err != nil {
+		return err
+	}
+
+	for _, job := range unfinished {
+		if job.Status == jobRunning {
+			if remaining := jobLeaseRemaining(job, time.Now()); remaining > 0 {
+				jobs.watch(job, remaining)
+				continue
+			}
+
+			// the records written so far will simply be matched again
+			log.Println(fmt.Sprintf("restarting job %s, which was interrupted", job.ID))
+		}
+
+		jobs.enqueue(job.Scope, job.ID)
+	}
+
+	return nil
+
+}
+
+// queue a job, to run once any earlier jobs in the same scope are done
+func (r *jobRunner) enqueue(scope string, id string) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.active[scope] {
+		r.pending[scope] = append(r.pending[scope], id)
+		return
+	}
+
+	r.active[scope] = true
+
+	go func() { r.ready <- bulkJobRef{id: id, scope: scope} }()
+
+}
+
+// hand the next job in a scope to a worker, if there is one
+func (r *jobRunner) done(scope string) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	queue := r.pending[scope]
+	if len(queue) < 1 {
+		delete(r.pending, scope)
+		delete(r.active, scope)
+		return
+	}
+
+	next := bulkJobRef{id: queue[0], scope: scope}
+	r.pending[scope] = queue[1:]
+
+	go func() { r.ready <- next }()
+
+}
+
+// queue a job which is running on another server once its lease runs out, in case that server has gone away
+func (r *jobRunner) watch(job bulkJob, remaining time.Duration) {
+
+	time.AfterFunc(remaining+time.Second, func() { r.enqueue(job.Scope, job.ID) })
+
+}
+
+func (r *jobRunner) work() {
+
+	for ref := range r.ready {
+		runJob(ref.id)
+		r.done(ref.scope)
+	}
+
+}
+
+// process a queued bulk job, saving its progress and outcome
+func runJob(id string) {
+
+	job, err := getMariadbJob(id)
+	if err != nil {
+		log.Println(fmt.Sprintf("getting job %s failed: %v", id, err))
+		return
+	}
+
+	// jobs in the same scope run one at a time on every server, not only this one
+	var unlock func()
+	if jobRunnable(job, time.Now()) {
+		if unlock, err = lockJobScope(&job); err != nil {
+			log.Println(fmt.Sprintf("locking the scope of job %s failed: %v", id, err))
+			jobs.watch(job, jobLease)
+			return
+		}
+	}
+
+	if unlock == nil {
+		// it's finished, or another server is running it
+		if remaining := jobLeaseRemaining(job, time.Now()); job.Status == jobRunning && remaining > 0 {
+			jobs.watch(job, remaining)
+		}
+		return
+	}
+	defer unlock()
+
+	now := time.Now().UTC()
+
+	job.Status = jobRunning
+	job.Received = 0
+	job.Started = now.Format(storedTimestampFormat)
+	job.LeaseUntil = now.Add(jobLease).Format(storedTimestampFormat)
+
+	claimed, err := claimMariadbJob(job, now.Format(storedTimestampFormat))
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	if !claimed {
+		// another server got to it first; check on it again once its lease could have run out
+		jobs.watch(job, jobLease)
+		return
+	}
+
+	stopRenewing := make(chan struct{})
+	defer close(stopRenewing)
+	go renewJobLease(job.ID, stopRenewing)
+
+	// a bug in one job shouldn't take the server down with it
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			log.Println(fmt.Sprintf("job %s panicked: %v", job.ID, recovered))
+			finishJob(job, http.StatusInternalServerError, bulkResult{Error: "processing the bulk job failed"})
+		}
+	}()
+
+	lastSaved := time.Now()
+	progress := func(received int) {
+		job.Received = received
+
+		if time.Since(lastSaved) < jobProgressInterval {
+			return
+		}
+
+		lastSaved = time.Now()
+
+		if err := saveMariadbJobProgress(job.ID, received); err != nil {
+			log.Println(err.Error())
+		}
+	}
+
+	body := &jobBodyReader{jobID: job.ID}
+
+	var reconciler *bulkReconciler
+
+	if job.ContentType == "application/x-ndjson" {
+		reconciler, err = reconcileNDJSON(body, job.DryRun, job.Committer, progress)
+	} else {
+		var rawData []byte
+		if rawData, err = ioutil.ReadAll(body); err == nil {
+			reconciler, err = reconcileJSON(rawData, job.DryRun, job.Committer, progress)
+		}
+	}
+
+	if err != nil {
+		if err, ok := err.(hostdb.ErrorResponse); ok {
+			finishJob(job, err.Code, bulkResult{Error: err.Message})
+			return
+		}
+
+		log.Println(err.Error())
+		finishJob(job, http.StatusInternalServerError, bulkResult{Error: "processing the bulk job failed"})
+		return
+	}
+	defer reconciler.close()
+
+	job.Received = len(reconciler.result.IDs)
+
+	status, result := applyBulk(reconciler, job.Partial, job.Force, job.auditor())
+
+	finishJob(job, status, result)
+
+}
+
+// whether a job is queued, or was running but its lease has run out
+func jobRunnable(job bulkJob, now time.Time) bool {
+
+	switch job.Status {
+	case jobQueued:
+		return true
+	case jobRunning:
+		return jobLeaseRemaining(job, now) <= 0
+	}
+
+	return false
+
+}
+
+// how long until a running job's lease runs out; a job whose lease has run out was interrupted, and may be run again
+func jobLeaseRemaining(job bulkJob, now time.Time) time.Duration {
+
+	leaseUntil, err := time.Parse(storedTimestampFormat, job.LeaseUntil)
+	if err != nil {
+		return 0
+	}
+
+	return leaseUntil.Sub(now)
+
+}
+
+// take the database lock for a job's scope, waiting while another server runs a job in the same scope
+// unlock is nil if, meanwhile, the job no longer needs running
+func lockJobScope(job *bulkJob) (func(), error) {
+
+	for {
+		unlock, locked, err := lockMariadb(jobScopeLock(job.Scope), jobLockWait)
+		if err != nil {
+			return nil, err
+		}
+
+		if locked {
+			return unlock, nil
+		}
+
+		id := job.ID
+		if *job, err = getMariadbJob(id); err != nil {
+			return nil, err
+		}
+
+		if !jobRunnable(*job, time.Now()) {
+			return nil, nil
+		}
+	}
+
+}
+
+// the name of the database lock for a scope; lock names are shared by every database on the server, and limited to 64 characters
+func jobScopeLock(scope string) string {
+
+	sum := sha256.Sum256([]byte(config.Mariadb.DB + "\n" + scope))
+
+	return fmt.Sprintf("hostdb_job_%x", sum[:16])
+
+}
+
+// renew a running job's lease until it's stopped, so that no other server takes the job over
+func renewJobLease(id string, stop <-chan struct{}) {
+
+	ticker := time.NewTicker(jobLeaseRenewal)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			renewed, err := renewMariadbJobLease(id, time.Now().UTC().Add(jobLease).Format(storedTimestampFormat))
+			if err != nil {
+				log.Println(err.Error())
+				continue
+			}
+
+			if !renewed {
+				log.Println(fmt.Sprintf("job %s is no longer running", id))
+				return
+			}
+		}
+	}
+
+}
+
+// save the outcome of a job, and clean up after it
+func finishJob(job bulkJob, status int, result bulkResult) {
+
+	job.Status = jobSucceeded
+	if status >= http.StatusBadRequest {
+		job.Status = jobFailed
+	}
+
+	job.StatusCode = status
+	job.Result = &result
+	job.Error = result.Error
+	job.Finished = time.Now().UTC().Format("2006-01-02 15:04:05")
+	job.LeaseUntil = ""
+
+	if err := saveMariadbJob(job); err != nil {
+		log.Println(err.Error())
+	}
+
+	// the body won't be needed again
+	if err := deleteMariadbJobBody(job.ID); err != nil {
+		log.Println(err.Error())
+	}
+
+}
+
+// how long finished jobs are kept; the janitor forgets about older ones
+func jobRetention() time.Duration {
+
+	if retention := serverConfig.API.V0.Jobs.Retention; retention > 0 {
+		return retention
+	}
+
+	return defaultJobRetention
+
+}
+
+// an auditFunc for actions taken by a job, attributed to the request which queued it
+func (job bulkJob) auditor() auditFunc {
+
+	return func(action string, ids []string, created int, updated int, deleted int, message string) {
+		writeAuditEntry(auditEntry{
+			Timestamp: time.Now().UTC().Format("2006-01-02 15:04:05"),
+			Principal: job.Principal,
+			SourceIP:  job.SourceIP,
+			RequestID: job.RequestID,
+			Method:    http.MethodPost,
+			Path:      job.Path,
+			Action:    action,
+			IDs:       ids,
+			Created:   created,
+			Updated:   updated,
+			Deleted:   deleted,
+			Message:   fmt.Sprintf("job %s: %s", job.ID, message),
+		})
+	}
+
+}
+
+// the key for the records a bulk request may change; jobs with the same key run one at a time
+func jobScope(bulk hostdb.RecordSet) (string, error) {
+
+	if _, err := bulkScope(bulk); err != nil {
+		return "", err
+	}
+
+	key := []string{bulk.Type}
+	for _, k := range typeSettings(bulk.Type, serverConfig.API.V0.BulkScope) {
+		value, _ := scopeValue(bulk.Context[k])
+		key = append(key, value)
+	}
+
+	b, err := json.Marshal(key)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+
+}
+
+// store a job's body in the database, a chunk at a time
+func saveJobBody(jobID string, body io.Reader) error {
+
+	buffer := make([]byte, jobBodyChunkSize)
+
+	for seq := 0; ; seq++ {
+		n, err := io.ReadFull(body, buffer)
+		if n > 0 {
+			if err := saveMariadbJobChunk(jobID, seq, buffer[:n]); err != nil {
+				return err
+			}
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+
+}
+
+// reads a job's body back from the database, a chunk at a time
+type jobBodyReader struct {
+	jobID  string
+	seq    int
+	buffer []byte
+	done   bool
+}
+
+func (r *jobBodyReader) Read(p []byte) (int, error) {
+
+	for len(r.buffer) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		chunk, found, err := getMariadbJobChunk(r.jobID, r.seq)
+		if err != nil {
+			return 0, err
+		}
+
+		if !found {
+			r.done = true
+			continue
+		}
+
+		r.buffer = chunk
+		r.seq++
+	}
+
+	n := copy(p, r.buffer)
+	r.buffer = r.buffer[n:]
+
+	return n, nil
+
+}
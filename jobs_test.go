@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pdxfixit/hostdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobRunner(t *testing.T) {
+
+	runner := &jobRunner{
+		pending: map[string][]string{},
+		active:  map[string]bool{},
+		ready:   make(chan bulkJobRef),
+	}
+
+	next := func() string {
+		select {
+		case ref := <-runner.ready:
+			return ref.id
+		case <-time.After(100 * time.Millisecond):
+			return ""
+		}
+	}
+
+	runner.enqueue("a", "job-1")
+	runner.enqueue("a", "job-2")
+	runner.enqueue("b", "job-3")
+
+	// one job per scope
+	assert.ElementsMatch(t, []string{"job-1", "job-3"}, []string{next(), next()}, "first jobs of each scope")
+	assert.Equal(t, "", next(), "second job in a scope waits")
+
+	runner.done("a")
+	assert.Equal(t, "job-2", next(), "second job runs once the first is done")
+
+	runner.done("a")
+	runner.done("b")
+	assert.Empty(t, runner.active, "no active scopes")
+
+	runner.enqueue("a", "job-4")
+	assert.Equal(t, "job-4", next(), "an idle scope runs straight away")
+
+}
+
+func TestJobScope(t *testing.T) {
+
+	saved := serverConfig.API.V0.BulkScope
+	defer func() { serverConfig.API.V0.BulkScope = saved }()
+
+	serverConfig.API.V0.BulkScope = map[string][]string{
+		"openstack": {"tenant_name"},
+	}
+
+	scope, err := jobScope(hostdb.RecordSet{Type: "openstack", Context: map[string]interface{}{"tenant_name": "admin"}})
+	assert.NoError(t, err, "openstack")
+	assert.Equal(t, `["openstack","admin"]`, scope, "openstack")
+
+	scope, err = jobScope(hostdb.RecordSet{Type: "test", Context: map[string]interface{}{"test": true}})
+	assert.NoError(t, err, "unscoped type")
+	assert.Equal(t, `["test"]`, scope, "unscoped type")
+
+	_, err = jobScope(hostdb.RecordSet{Type: "openstack", Context: map[string]interface{}{}})
+	assert.Error(t, err, "missing scope")
+
+}
+
+func TestJobRunnable(t *testing.T) {
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	assert.True(t, jobRunnable(bulkJob{Status: jobQueued}, now), "queued")
+	assert.False(t, jobRunnable(bulkJob{Status: jobSucceeded}, now), "succeeded")
+	assert.False(t, jobRunnable(bulkJob{Status: jobFailed}, now), "failed")
+	assert.False(t, jobRunnable(bulkJob{}, now), "no such job")
+
+	leased := bulkJob{Status: jobRunning, LeaseUntil: "2020-01-01 12:01:00"}
+	assert.False(t, jobRunnable(leased, now), "running, and leased")
+	assert.Equal(t, time.Minute, jobLeaseRemaining(leased, now), "running, and leased")
+
+	expired := bulkJob{Status: jobRunning, LeaseUntil: "2020-01-01 11:59:00"}
+	assert.True(t, jobRunnable(expired, now), "running, but the lease has run out")
+	assert.True(t, jobRunnable(bulkJob{Status: jobRunning}, now), "running, without a lease")
+
+}
+
+func TestJobScopeLock(t *testing.T) {
+
+	a := jobScopeLock(`["openstack","admin"]`)
+	b := jobScopeLock(`["openstack","demo"]`)
+
+	assert.NotEqual(t, a, b, "each scope has a lock of its own")
+	assert.Equal(t, a, jobScopeLock(`["openstack","admin"]`), "the same scope has the same lock")
+	assert.True(t, len(a) <= 64, "within the limit on lock names")
+
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// a single step along a json path; either an object key, or an array index
+// a wildcard step (.* or [*]) matches every key or index, and is only meaningful to lookupJSONPathAll
+type jsonPathSegment struct {
+	Key        string
+	Index      int
+	IsIndex    bool
+	IsWildcard bool
+}
+
+// parse a path in the same syntax as the query_params config, e.g. .metadata."app.list" or .addresses[0].addr
+func parseJSONPath(path string) (segments []jsonPathSegment, err error) {
+
+	if path == "" {
+		return nil, fmt.Errorf("empty json path")
+	}
+
+	i := 0
+	for i < len(path) {
+		switch path[i] {
+		case '.':
+			i++
+			if i >= len(path) {
+				return nil, fmt.Errorf("json path %s: missing key at position %d", path, i)
+			}
+
+			if path[i] == '"' {
+				// quoted key; may contain any character except a quote or backslash
+				end := strings.IndexByte(path[i+1:], '"')
+				if end < 0 {
+					return nil, fmt.Errorf("json path %s: unterminated quote at position %d", path, i)
+				}
+
+				key := path[i+1 : i+1+end]
+				if key == "" || strings.Contains(key, "\\") {
+					return nil, fmt.Errorf("json path %s: invalid quoted key at position %d", path, i)
+				}
+
+				segments = append(segments, jsonPathSegment{Key: key})
+				i += end + 2
+				continue
+			}
+
+			if path[i] == '*' {
+				segments = append(segments, jsonPathSegment{IsWildcard: true})
+				i++
+				continue
+			}
+
+			// bare key; letters, digits, underscores and dashes
+			start := i
+			for i < len(path) && isJSONPathKeyChar(path[i]) {
+				i++
+			}
+
+			if start == i {
+				return nil, fmt.Errorf("json path %s: unexpected character '%c' at position %d", path, path[i], i)
+			}
+
+			segments = append(segments, jsonPathSegment{Key: path[start:i]})
+		case '[':
+			end := strings.IndexByte(path[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("json path %s: unterminated index at position %d", path, i)
+			}
+
+			if path[i+1:i+end] == "*" {
+				segments = append(segments, jsonPathSegment{IsIndex: true, IsWildcard: true})
+				i += end + 1
+				continue
+			}
+
+			index, err := strconv.Atoi(path[i+1 : i+end])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("json path %s: invalid index at position %d", path, i)
+			}
+
+			segments = append(segments, jsonPathSegment{Index: index, IsIndex: true})
+			i += end + 1
+		default:
+			return nil, fmt.Errorf("json path %s: unexpected character '%c' at position %d", path, path[i], i)
+		}
+	}
+
+	return segments, nil
+
+}
+
+func isJSONPathKeyChar(c byte) bool {
+
+	return c == '_' || c == '-' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+
+}
+
+// whether a key can be written in a path without quotes
+func isBareJSONPathKey(key string) bool {
+
+	if key == "" {
+		return false
+	}
+
+	for i := 0; i < len(key); i++ {
+		if !isJSONPathKeyChar(key[i]) {
+			return false
+		}
+	}
+
+	return true
+
+}
+
+// the path of an object key, in the same syntax as diffJSON
+func jsonPathChild(path string, key string) string {
+
+	if !isBareJSONPathKey(key) {
+		return fmt.Sprintf("%s.\"%s\"", path, key)
+	}
+
+	return path + "." + key
+
+}
+
+// a path for a json_value in a where clause, rebuilt from its segments, since it's written into the statement rather than given as a value
+// wildcards aren't allowed, and nor are quoted keys with an apostrophe or question mark, which would end the statement's string or look like a placeholder
+func sqlJSONPath(path string) (string, error) {
+
+	segments, err := parseJSONPath(path)
+	if err != nil {
+		return "", err
+	}
+
+	sqlPath := ""
+
+	for _, segment := range segments {
+		switch {
+		case segment.IsWildcard:
+			return "", fmt.Errorf("json path %s: wildcards can't be used here", path)
+		case segment.IsIndex:
+			sqlPath += fmt.Sprintf("[%d]", segment.Index)
+		case strings.ContainsAny(segment.Key, "'?"):
+			return "", fmt.Errorf("json path %s: keys can't contain ' or ?", path)
+		default:
+			sqlPath = jsonPathChild(sqlPath, segment.Key)
+		}
+	}
+
+	return sqlPath, nil
+
+}
+
+// find the value at the given path within a decoded json document
+func lookupJSONPath(document interface{}, segments []jsonPathSegment) (value interface{}, found bool) {
+
+	value = document
+
+	for _, segment := range segments {
+		if segment.IsWildcard {
+			return nil, false
+		}
+
+		if segment.IsIndex {
+			array, ok := value.([]interface{})
+			if !ok || segment.Index >= len(array) {
+				return nil, false
+			}
+
+			value = array[segment.Index]
+			continue
+		}
+
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+
+		if value, ok = object[segment.Key]; !ok {
+			return nil, false
+		}
+	}
+
+	return value, true
+
+}
+
+// find every value matching the given path within a decoded json document, expanding any wildcards
+// keys matched by .* are visited in sorted order, so the values are always in the same order
+func lookupJSONPathAll(document interface{}, segments []jsonPathSegment) (values []interface{}) {
+
+	if len(segments) == 0 {
+		return []interface{}{document}
+	}
+
+	segment, rest := segments[0], segments[1:]
+
+	switch {
+	case segment.IsWildcard && segment.IsIndex:
+		array, _ := document.([]interface{})
+		for _, item := range array {
+			values = append(values, lookupJSONPathAll(item, rest)...)
+		}
+	case segment.IsWildcard:
+		object, _ := document.(map[string]interface{})
+
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			values = append(values, lookupJSONPathAll(object[key], rest)...)
+		}
+	default:
+		if value, found := lookupJSONPath(document, segments[:1]); found {
+			values = lookupJSONPathAll(value, rest)
+		}
+	}
+
+	return values
+
+}
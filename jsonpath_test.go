@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseJSONPath(t *testing.T) {
+
+	tests := map[string][]jsonPathSegment{
+		".id":                    {{Key: "id"}},
+		".flavor.id":             {{Key: "flavor"}, {Key: "id"}},
+		".metadata.\"app.list\"": {{Key: "metadata"}, {Key: "app.list"}},
+		".addresses[1].addr":     {{Key: "addresses"}, {Index: 1, IsIndex: true}, {Key: "addr"}},
+		".aws-account-id":        {{Key: "aws-account-id"}},
+		".addresses.*[*].addr":   {{Key: "addresses"}, {IsWildcard: true}, {IsIndex: true, IsWildcard: true}, {Key: "addr"}},
+	}
+
+	for path, expected := range tests {
+		segments, err := parseJSONPath(path)
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+			continue
+		}
+
+		assert.Equal(t, expected, segments, path)
+	}
+
+	for _, path := range []string{"", "id", ".", ".foo..bar", ".\"open", ".foo[", ".foo[-1]", ".foo bar", ".\"a\\\\b\""} {
+		_, err := parseJSONPath(path)
+		assert.Errorf(t, err, "expected an error for %s", path)
+	}
+
+}
+
+func TestSQLJSONPath(t *testing.T) {
+
+	for path, expected := range map[string]string{
+		".metadata.env":                ".metadata.env",
+		".metadata.\"app.list\"":       ".metadata.\"app.list\"",
+		".metadata.\"aws-region\"":     ".metadata.aws-region",
+		".addresses[1].addr":           ".addresses[1].addr",
+		".tags[0]":                     ".tags[0]",
+		".\"two words\".\"and, more\"": ".\"two words\".\"and, more\"",
+	} {
+		sqlPath, err := sqlJSONPath(path)
+		if assert.NoError(t, err, path) {
+			assert.Equal(t, expected, sqlPath, path)
+		}
+	}
+
+	for _, path := range []string{"", "metadata", ".metadata.*", ".tags[*]", ".\"it's\"", ".\"what?\"", ".a') OR 1=1 OR json_value(data, '$", ".a b"} {
+		_, err := sqlJSONPath(path)
+		assert.Error(t, err, path)
+	}
+
+}
+
+func TestLookupJSONPath(t *testing.T) {
+
+	var document interface{}
+	if err := json.Unmarshal([]byte(`{"id":"abc","metadata":{"app.list":"web"},"addresses":[{"addr":"10.0.0.1"},{"addr":"10.0.0.2"}]}`), &document); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]interface{}{
+		".id":                    "abc",
+		".metadata.\"app.list\"": "web",
+		".addresses[1].addr":     "10.0.0.2",
+	}
+
+	for path, expected := range tests {
+		segments, err := parseJSONPath(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		value, found := lookupJSONPath(document, segments)
+		assert.True(t, found, path)
+		assert.Equal(t, expected, value, path)
+	}
+
+	for _, path := range []string{".missing", ".id.deeper", ".addresses[5]", ".metadata[0]"} {
+		segments, err := parseJSONPath(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, found := lookupJSONPath(document, segments)
+		assert.False(t, found, path)
+	}
+
+}
+
+func TestLookupJSONPathAll(t *testing.T) {
+
+	var document interface{}
+	if err := json.Unmarshal([]byte(`{"addresses":{"public":[{"addr":"192.0.2.1"}],"private":[{"addr":"10.0.0.1"},{"addr":"10.0.0.2"}]}}`), &document); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string][]interface{}{
+		".addresses.*[*].addr":       {"10.0.0.1", "10.0.0.2", "192.0.2.1"},
+		".addresses.private[*].addr": {"10.0.0.1", "10.0.0.2"},
+		".addresses.public[0].addr":  {"192.0.2.1"},
+		".addresses.*[5].addr":       nil,
+		".missing[*]":                nil,
+	}
+
+	for path, expected := range tests {
+		segments, err := parseJSONPath(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, expected, lookupJSONPathAll(document, segments), path)
+	}
+
+	// a single lookup can't expand a wildcard
+	segments, _ := parseJSONPath(".addresses.*")
+	_, found := lookupJSONPath(document, segments)
+	assert.False(t, found)
+
+}
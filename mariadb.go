@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
@@ -58,6 +59,47 @@ func checkMariadb() bool {
 
 }
 
+// lock a record's row until the end of the transaction, and check that it still matches an If-Match header
+// nothing is locked if there's no header; errPreconditionFailed is returned if the record has changed, or is gone
+func checkMariadbIfMatch(tx *sql.Tx, id string, ifMatch string) error {
+
+	if ifMatch == "" {
+		return nil
+	}
+
+	var record hostdb.Record
+	var contextString string
+
+	statement := "SELECT `hash`, `context` FROM `hostdb` WHERE `id` = ? FOR UPDATE"
+
+	debugMessage(statement)
+
+	if err := tx.QueryRow(statement, id).Scan(&record.Hash, &contextString); err != nil {
+		if err == sql.ErrNoRows {
+			return errPreconditionFailed
+		}
+
+		return err
+	}
+
+	if err := json.Unmarshal([]byte(contextString), &record.Context); err != nil {
+		log.Println("failed to unmarshal context into a map")
+		return err
+	}
+
+	etag, err := recordETag(record)
+	if err != nil {
+		return err
+	}
+
+	if !etagMatches(ifMatch, etag) {
+		return errPreconditionFailed
+	}
+
+	return nil
+
+}
+
 func checkTable() bool {
 
 	var count int
@@ -79,6 +121,71 @@ func checkTable() bool {
 
 }
 
+// claim an idempotency key, before handling its request; returns false if it has already been claimed
+func claimMariadbIdempotencyKey(claim idempotentResponse) (claimed bool, err error) {
+
+	statement := "INSERT IGNORE INTO `idempotency_keys` (`principal`, `idempotency_key`, `fingerprint`, `created`) VALUES (?, ?, ?, ?)"
+
+	debugMessage(statement)
+
+	res, err := mariadb.Exec(statement, claim.Principal, claim.Key, claim.Fingerprint, claim.Created)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+
+}
+
+// claim a due webhook delivery, counting the attempt and leasing it until it's been sent
+// returns false if another sender got to it first
+func claimMariadbWebhookDelivery(delivery webhookDelivery, leaseUntil string) (claimed bool, err error) {
+
+	statement := "UPDATE `webhook_deliveries` SET `attempts` = `attempts` + 1, `next_attempt` = ? WHERE `id` = ? AND `status` = ? AND `attempts` = ?"
+
+	debugMessage(statement)
+
+	res, err := mariadb.Exec(statement, leaseUntil, delivery.ID, deliveryPending, delivery.Attempts)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+
+}
+
+// claim a job which is queued, or whose last run was interrupted, marking it as running and leasing it
+// returns false if it's already running elsewhere, or has finished
+func claimMariadbJob(job bulkJob, now string) (claimed bool, err error) {
+
+	statement := "UPDATE `jobs` SET `status` = ?, `received` = ?, `started` = ?, `lease_until` = ? WHERE `id` = ? AND (`status` = ? OR (`status` = ? AND (`lease_until` IS NULL OR `lease_until` < ?)))"
+
+	debugMessage(statement)
+
+	res, err := mariadb.Exec(statement, jobRunning, job.Received, job.Started, job.LeaseUntil, job.ID, jobQueued, jobRunning, now)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+
+}
+
 func createTable() error {
 
 	bytes, err := ioutil.ReadFile("mariadb/create-table.sql")
@@ -99,13 +206,171 @@ func createTable() error {
 		}
 	}
 
-	log.Println("table created")
+	log.Println("tables created")
 
 	return nil
 
 }
 
-func deleteMariadbRow(id string) error {
+// delete the stored body of a job
+func deleteMariadbJobBody(jobID string) error {
+
+	statement := "DELETE FROM `job_bodies` WHERE `job_id` = ?"
+
+	debugMessage(statement)
+
+	_, err := mariadb.Exec(statement, jobID)
+
+	return err
+
+}
+
+// delete an uploaded schema
+func deleteMariadbSchema(recordType string) error {
+
+	statement := "DELETE FROM `schemas` WHERE `type` = ?"
+
+	debugMessage(statement)
+
+	_, err := mariadb.Exec(statement, recordType)
+
+	return err
+
+}
+
+// delete the jobs which finished before the given timestamp
+func deleteMariadbJobsBefore(timestamp string, limit int) (deleted int64, err error) {
+
+	statement := fmt.Sprintf("DELETE FROM `jobs` WHERE `finished` IS NOT NULL AND `finished` < ? LIMIT %d", limit)
+
+	debugMessage(statement)
+
+	res, err := mariadb.Exec(statement, timestamp)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+
+}
+
+func deleteMariadbCollector(name string) (found bool, err error) {
+
+	statement := "DELETE FROM `collectors` WHERE `name` = ?"
+
+	debugMessage(statement)
+
+	res, err := mariadb.Exec(statement, name)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected > 0, nil
+
+}
+
+// forget about changes made before the timestamp
+func deleteMariadbChangesBefore(timestamp string, limit int) (deleted int64, err error) {
+
+	statement := fmt.Sprintf("DELETE FROM `changes` WHERE `timestamp` < ? LIMIT %d", limit)
+
+	debugMessage(statement)
+
+	res, err := mariadb.Exec(statement, timestamp)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+
+}
+
+// forget about runs which finished before the timestamp
+func deleteMariadbRunsBefore(timestamp string, limit int) (deleted int64, err error) {
+
+	statement := fmt.Sprintf("DELETE FROM `runs` WHERE `finished` < ? LIMIT %d", limit)
+
+	debugMessage(statement)
+
+	res, err := mariadb.Exec(statement, timestamp)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+
+}
+
+func deleteMariadbIdempotencyKey(principal string, key string) error {
+
+	statement := "DELETE FROM `idempotency_keys` WHERE `principal` = ? AND `idempotency_key` = ?"
+
+	debugMessage(statement)
+
+	_, err := mariadb.Exec(statement, principal, key)
+
+	return err
+
+}
+
+func deleteMariadbIdempotencyKeysBefore(timestamp string, limit int) (deleted int64, err error) {
+
+	statement := fmt.Sprintf("DELETE FROM `idempotency_keys` WHERE `created` < ? LIMIT %d", limit)
+
+	debugMessage(statement)
+
+	res, err := mariadb.Exec(statement, timestamp)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+
+}
+
+func deleteMariadbWebhook(id string) (found bool, err error) {
+
+	statement := "DELETE FROM `webhooks` WHERE `id` = ?"
+
+	debugMessage(statement)
+
+	res, err := mariadb.Exec(statement, id)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected > 0, nil
+
+}
+
+// delete finished webhook deliveries created before the timestamp
+func deleteMariadbWebhookDeliveriesBefore(timestamp string, limit int) (deleted int64, err error) {
+
+	statement := fmt.Sprintf("DELETE FROM `webhook_deliveries` WHERE `status` <> ? AND `created` < ? LIMIT %d", limit)
+
+	debugMessage(statement)
+
+	res, err := mariadb.Exec(statement, deliveryPending, timestamp)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+
+}
+
+// delete a record; if ifMatch isn't empty, only if the record still matches it (otherwise errPreconditionFailed)
+func deleteMariadbRow(id string, ifMatch string) error {
 
 	// check for an existing ID
 	record, err := getMariadbRow(id)
@@ -121,25 +386,110 @@ func deleteMariadbRow(id string) error {
 		return errors.New("weird, record IDs didn't match")
 	}
 
+	tx, err := mariadb.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := checkMariadbIfMatch(tx, id, ifMatch); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	records, err := lockMariadbRows(tx, []string{id})
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
 	statement := "DELETE FROM `hostdb` WHERE `id` = "
 
 	debugMessage(fmt.Sprintf("%s%v", statement, id))
 
-	res, err := mariadb.Exec(fmt.Sprintf("%s?", statement), id)
+	res, err := tx.Exec(fmt.Sprintf("%s?", statement), id)
 	if err != nil {
+		_ = tx.Rollback()
 		return err
 	}
 
 	rowsAffected, err := res.RowsAffected()
 	if err != nil {
+		_ = tx.Rollback()
 		return err
 	}
 
 	if rowsAffected == 0 {
+		_ = tx.Rollback()
 		return errors.New("zero records deleted")
 	}
 
-	return nil
+	if err := saveMariadbChanges(tx, newChangeEntries(recordEventDelete, records)); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+
+}
+
+// delete many records by id, in one transaction, along with their entries in the change feed; returns how many were actually deleted
+func deleteMariadbRows(ids []string) (deleted int, err error) {
+
+	tx, err := mariadb.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	var records []hostdb.Record
+
+	for start := 0; start < len(ids); start += defaultBulkBatchSize {
+		end := start + defaultBulkBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		locked, err := lockMariadbRows(tx, ids[start:end])
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+
+		records = append(records, locked...)
+
+		var values []interface{}
+		for _, id := range ids[start:end] {
+			values = append(values, id)
+		}
+
+		statement := fmt.Sprintf("DELETE FROM `hostdb` WHERE `id` IN (%s)", strings.TrimSuffix(strings.Repeat("?,", len(values)), ","))
+
+		debugMessage(statement)
+
+		res, err := tx.Exec(statement, values...)
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+
+		rowsAffected, err := res.RowsAffected()
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+
+		deleted += int(rowsAffected)
+	}
+
+	if err := saveMariadbChanges(tx, newChangeEntries(recordEventDelete, records)); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return deleted, nil
 
 }
 
@@ -177,33 +527,103 @@ func getRowIds(clauses hostdb.MariadbWhereClauses) (recordIDs []string, err erro
 
 }
 
-func getMariadbCatalog(item string, frequencyCount bool, filter string) (items map[string]int, err error) {
+// get audit log entries, newest first
+func getMariadbAuditEntries(clauses hostdb.MariadbWhereClauses, limit hostdb.MariadbLimit) (entries []auditEntry, foundRows int, err error) {
 
-	// if the data location is anything other than table,
-	// we will need to use the JSON_ functions
-	items = map[string]int{}
+	whereSQL, values, err := clauses.Stringify()
+	if err != nil {
+		return nil, 0, err
+	}
 
-	// for each record type
-	for _, dataLocation := range config.API.V0.QueryParams[item] {
+	limitSQL := limit.Stringify()
 
-		var field string
+	statement := fmt.Sprintf("SELECT `id`, `timestamp`, `principal`, `source_ip`, `request_id`, `method`, `path`, `action`, `ids`, `created`, `updated`, `deleted`, `message` FROM `audit` %s ORDER BY `id` DESC %s", whereSQL, limitSQL)
 
-		if dataLocation.Table != "" {
-			// look for the key in the table itself
-			field = dataLocation.Table
-		} else if dataLocation.Context != "" {
-			// look for the key in the record context
-			field = fmt.Sprintf("json_value(context, '$%s') ", dataLocation.Context)
-		} else if dataLocation.Data != "" {
-			// look for the key in the record data
-			// todo: consider using a different json_ function, like _contains or _search, so that we can extract data from vrops and AWS records
-			field = fmt.Sprintf("json_value(data, '$%s') ", dataLocation.Data)
-		} else {
-			// this param isn't supported after all; ignore it
-			continue
-		}
+	debugMessage(statement)
 
-		// SELECT
+	rows, err := mariadb.Query(statement, values...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer closer(rows)
+
+	totalStatement := fmt.Sprintf("SELECT COUNT(*) FROM `audit` %s", whereSQL)
+
+	debugMessage(totalStatement)
+
+	if err = mariadb.QueryRow(totalStatement, values...).Scan(&foundRows); err != nil {
+		return nil, 0, err
+	}
+
+	entries = []auditEntry{}
+
+	for rows.Next() {
+
+		var entry auditEntry
+		var idsString string
+
+		if err = rows.Scan(
+			&entry.ID,
+			&entry.Timestamp,
+			&entry.Principal,
+			&entry.SourceIP,
+			&entry.RequestID,
+			&entry.Method,
+			&entry.Path,
+			&entry.Action,
+			&idsString,
+			&entry.Created,
+			&entry.Updated,
+			&entry.Deleted,
+			&entry.Message,
+		); err != nil {
+			return nil, 0, err
+		}
+
+		if err := json.Unmarshal([]byte(idsString), &entry.IDs); err != nil {
+			log.Println("failed to unmarshal audit ids into a slice")
+			return nil, 0, err
+		}
+
+		entries = append(entries, entry)
+
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return entries, foundRows, nil
+
+}
+
+func getMariadbCatalog(item string, frequencyCount bool, filter string) (items map[string]int, err error) {
+
+	// if the data location is anything other than table,
+	// we will need to use the JSON_ functions
+	items = map[string]int{}
+
+	// for each record type
+	for _, dataLocation := range config.API.V0.QueryParams[item] {
+
+		var field string
+
+		if dataLocation.Table != "" {
+			// look for the key in the table itself
+			field = dataLocation.Table
+		} else if dataLocation.Context != "" {
+			// look for the key in the record context
+			field = fmt.Sprintf("json_value(context, '$%s') ", dataLocation.Context)
+		} else if dataLocation.Data != "" {
+			// look for the key in the record data
+			// todo: consider using a different json_ function, like _contains or _search, so that we can extract data from vrops and AWS records
+			field = fmt.Sprintf("json_value(data, '$%s') ", dataLocation.Data)
+		} else {
+			// this param isn't supported after all; ignore it
+			continue
+		}
+
+		// SELECT
 		var selectArgument string
 		if frequencyCount {
 			selectArgument = fmt.Sprintf("%s, COUNT(*)", field)
@@ -278,59 +698,106 @@ func getMariadbCatalog(item string, frequencyCount bool, filter string) (items m
 
 }
 
-func getMariadbRow(id string) (record hostdb.Record, err error) {
+// the columns of the collectors table, in the order scanned by scanMariadbCollector
+const collectorColumns = "`name`, `type`, `scope`, `interval`, `description`, `created`, `updated`, `principal`, `last_run`, `last_success`, `last_error`, `last_counts`"
 
-	var contextString string
+func getMariadbCollectors() (collectors []collector, err error) {
 
-	statement := "SELECT `id`, `type`, `hostname`, `ip`, `timestamp`, `committer`, `context`, `data`, `hash` FROM `hostdb` WHERE `id` = "
+	statement := fmt.Sprintf("SELECT %s FROM `collectors` ORDER BY `name`", collectorColumns)
 
-	debugMessage(fmt.Sprintf("%s%v", statement, id))
+	debugMessage(statement)
 
-	err = mariadb.QueryRow(fmt.Sprintf("%s?", statement), id).Scan(
-		&record.ID,
-		&record.Type,
-		&record.Hostname,
-		&record.IP,
-		&record.Timestamp,
-		&record.Committer,
-		&contextString,
-		&record.Data,
-		&record.Hash,
-	)
+	rows, err := mariadb.Query(statement)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return hostdb.Record{}, nil
-		}
+		return nil, err
+	}
+	defer closer(rows)
 
-		if err, ok := err.(*mysql.MySQLError); ok {
-			log.Println(fmt.Sprintf("DB ERROR: %v: %v", err.Number, err.Message))
-			return hostdb.Record{}, err
+	collectors = []collector{}
+
+	for rows.Next() {
+		c, err := scanMariadbCollector(rows)
+		if err != nil {
+			return nil, err
 		}
 
-		// TODO: if err.ErrorResponse == "invalid connection", re-establish connection and retry
-		log.Println(fmt.Sprintf("getting id (%v) failed: %v", id, err.Error()))
-		return hostdb.Record{}, err
+		collectors = append(collectors, c)
 	}
 
-	if err := json.Unmarshal([]byte(contextString), &record.Context); err != nil {
-		log.Println("failed to unmarshal context into a map")
-		return hostdb.Record{}, err
+	if err = rows.Err(); err != nil {
+		return nil, err
 	}
 
-	return record, nil
+	return collectors, nil
 
 }
 
-func getMariadbRows(clauses hostdb.MariadbWhereClauses, limit hostdb.MariadbLimit) (records map[string]hostdb.Record, foundRows int, err error) {
+func getMariadbCollector(name string) (c collector, err error) {
+
+	statement := fmt.Sprintf("SELECT %s FROM `collectors` WHERE `name` = ?", collectorColumns)
+
+	debugMessage(statement)
+
+	c, err = scanMariadbCollector(mariadb.QueryRow(statement, name))
+	if err == sql.ErrNoRows {
+		return collector{}, nil
+	}
+
+	return c, err
+
+}
+
+func scanMariadbCollector(row interface{ Scan(...interface{}) error }) (c collector, err error) {
+
+	var scope, counts string
+	var interval int64
+	var lastRun, lastSuccess sql.NullString
+
+	if err = row.Scan(
+		&c.Name,
+		&c.Type,
+		&scope,
+		&interval,
+		&c.Description,
+		&c.Created,
+		&c.Updated,
+		&c.Principal,
+		&lastRun,
+		&lastSuccess,
+		&c.LastError,
+		&counts,
+	); err != nil {
+		return collector{}, err
+	}
+
+	c.Interval = (time.Duration(interval) * time.Second).String()
+	c.LastRun = lastRun.String
+	c.LastSuccess = lastSuccess.String
+
+	if err = json.Unmarshal([]byte(scope), &c.Scope); err != nil {
+		return collector{}, err
+	}
+
+	if err = json.Unmarshal([]byte(counts), &c.LastRunCounts); err != nil {
+		return collector{}, err
+	}
+
+	return c, nil
+
+}
+
+// the columns of the runs table, in the order scanned by scanMariadbRun
+const runColumns = "`id`, `type`, `context`, `committer`, `started`, `finished`, `status`, `status_code`, `received`, `created`, `updated`, `unchanged`, `deleted`, `rejected`, `error`, `errors`"
+
+// get runs from the ledger, newest first, along with how many match altogether
+func getMariadbRuns(clauses hostdb.MariadbWhereClauses, limit hostdb.MariadbLimit) (runs []run, foundRows int, err error) {
 
 	whereSQL, values, err := clauses.Stringify()
 	if err != nil {
 		return nil, 0, err
 	}
 
-	limitSQL := limit.Stringify()
-
-	statement := fmt.Sprintf("SELECT `id`, `type`, `hostname`, `ip`, `timestamp`, `committer`, `context`, `data`, `hash` FROM `hostdb` %s %s", whereSQL, limitSQL)
+	statement := fmt.Sprintf("SELECT %s FROM `runs` %s ORDER BY `id` DESC %s", runColumns, whereSQL, limit.Stringify())
 
 	debugMessage(statement)
 
@@ -340,170 +807,1441 @@ func getMariadbRows(clauses hostdb.MariadbWhereClauses, limit hostdb.MariadbLimi
 	}
 	defer closer(rows)
 
-	// get total number of records
-	// http://www.mysqlperformanceblog.com/2007/08/28/to-sql_calc_found_rows-or-not-to-sql_calc_found_rows/
-	totalRecordsStatement := fmt.Sprintf("SELECT COUNT(*) FROM `hostdb` %s", whereSQL)
+	runs = []run{}
 
-	debugMessage(totalRecordsStatement)
+	for rows.Next() {
+		entry, err := scanMariadbRun(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		runs = append(runs, entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	totalStatement := fmt.Sprintf("SELECT COUNT(*) FROM `runs` %s", whereSQL)
+
+	debugMessage(totalStatement)
+
+	if err = mariadb.QueryRow(totalStatement, values...).Scan(&foundRows); err != nil {
+		return nil, 0, err
+	}
+
+	return runs, foundRows, nil
+
+}
+
+// get a run, or an empty run if there's no such run
+func getMariadbRun(id string) (entry run, err error) {
+
+	statement := fmt.Sprintf("SELECT %s FROM `runs` WHERE `id` = ?", runColumns)
+
+	debugMessage(statement)
+
+	entry, err = scanMariadbRun(mariadb.QueryRow(statement, id))
+	if err == sql.ErrNoRows {
+		return run{}, nil
+	}
+
+	return entry, err
+
+}
+
+func scanMariadbRun(row interface{ Scan(...interface{}) error }) (entry run, err error) {
+
+	var context, errors string
+
+	if err = row.Scan(
+		&entry.ID,
+		&entry.Type,
+		&context,
+		&entry.Committer,
+		&entry.Started,
+		&entry.Finished,
+		&entry.Status,
+		&entry.StatusCode,
+		&entry.Received,
+		&entry.Created,
+		&entry.Updated,
+		&entry.Unchanged,
+		&entry.Deleted,
+		&entry.Rejected,
+		&entry.Error,
+		&errors,
+	); err != nil {
+		return run{}, err
+	}
+
+	if err = json.Unmarshal([]byte(context), &entry.Context); err != nil {
+		return run{}, err
+	}
+
+	if err = json.Unmarshal([]byte(errors), &entry.Errors); err != nil {
+		return run{}, err
+	}
+
+	return entry, nil
+
+}
+
+// the number of records matching the where clauses
+func countMariadbRows(clauses hostdb.MariadbWhereClauses) (count int, err error) {
+
+	whereSQL, values, err := clauses.Stringify()
+	if err != nil {
+		return 0, err
+	}
+
+	statement := fmt.Sprintf("SELECT COUNT(*) FROM `hostdb` %s", whereSQL)
+
+	debugMessage(statement)
+
+	err = mariadb.QueryRow(statement, values...).Scan(&count)
+
+	return count, err
+
+}
+
+// the changes after a sequence number, up to the latest (as returned by getMariadbChangeBounds), in order
+func getMariadbChanges(since uint64, latest uint64, limit int) (changes []changeEntry, err error) {
+
+	statement := "SELECT `seq`, `id`, `type`, `event`, `hash`, `timestamp` FROM `changes` WHERE `seq` > ? AND `seq` <= ? ORDER BY `seq` LIMIT ?"
+
+	debugMessage(statement)
+
+	rows, err := mariadb.Query(statement, since, latest, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer closer(rows)
+
+	changes = []changeEntry{}
+
+	for rows.Next() {
+		var change changeEntry
+		if err := rows.Scan(&change.Seq, &change.ID, &change.Type, &change.Event, &change.Hash, &change.Timestamp); err != nil {
+			return nil, err
+		}
+
+		change.Deleted = change.Event == recordEventDelete
+
+		changes = append(changes, change)
+	}
+
+	return changes, rows.Err()
+
+}
+
+// the oldest sequence number which is still kept, the latest, and how many changes there are after a sequence number
+// the latest is read once the changes being written have been committed, so none before it can still appear;
+// changes written afterwards are given a later seq
+func getMariadbChangeBounds(since uint64) (oldest uint64, latest uint64, pending int, err error) {
+
+	tx, err := mariadb.Begin()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	if err := lockMariadbChanges(tx, "LOCK IN SHARE MODE"); err != nil {
+		_ = tx.Rollback()
+		return 0, 0, 0, err
+	}
+
+	statement := "SELECT COALESCE(MIN(`seq`), 0), COALESCE(MAX(`seq`), 0), COUNT(IF(`seq` > ?, 1, NULL)) FROM `changes`"
+
+	debugMessage(statement)
+
+	if err := tx.QueryRow(statement, since).Scan(&oldest, &latest, &pending); err != nil {
+		_ = tx.Rollback()
+		return 0, 0, 0, err
+	}
+
+	return oldest, latest, pending, tx.Commit()
+
+}
+
+// how many of the changes after a sequence number, up to the latest, were made by other servers
+func getMariadbOtherOriginChanges(since uint64, latest uint64, origin string) (others int, err error) {
+
+	statement := "SELECT COUNT(*) FROM `changes` WHERE `seq` > ? AND `seq` <= ? AND `origin` <> ?"
+
+	debugMessage(statement)
+
+	err = mariadb.QueryRow(statement, since, latest, origin).Scan(&others)
+
+	return others, err
+
+}
+
+// lock the rows of the records about to be deleted, and read what the change feed needs to know about them
+// the records which don't exist (any more) are left out
+func lockMariadbRows(tx *sql.Tx, ids []string) (records []hostdb.Record, err error) {
+
+	var values []interface{}
+	for _, id := range ids {
+		values = append(values, id)
+	}
+
+	statement := fmt.Sprintf("SELECT `id`, `type`, `hash` FROM `hostdb` WHERE `id` IN (%s) FOR UPDATE", strings.TrimSuffix(strings.Repeat("?,", len(values)), ","))
+
+	debugMessage(statement)
+
+	rows, err := tx.Query(statement, values...)
+	if err != nil {
+		return nil, err
+	}
+	defer closer(rows)
+
+	for rows.Next() {
+		var record hostdb.Record
+		if err := rows.Scan(&record.ID, &record.Type, &record.Hash); err != nil {
+			return nil, err
+		}
+
+		records = append(records, record)
+	}
+
+	return records, rows.Err()
+
+}
+
+func getMariadbIdempotentResponse(principal string, key string) (response idempotentResponse, found bool, err error) {
+
+	statement := "SELECT `principal`, `idempotency_key`, `fingerprint`, `status_code`, `content_type`, `headers`, `body`, `created` FROM `idempotency_keys` WHERE `principal` = ? AND `idempotency_key` = ?"
+
+	debugMessage(statement)
+
+	var headers string
+
+	err = mariadb.QueryRow(statement, principal, key).Scan(
+		&response.Principal,
+		&response.Key,
+		&response.Fingerprint,
+		&response.StatusCode,
+		&response.ContentType,
+		&headers,
+		&response.Body,
+		&response.Created,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return idempotentResponse{}, false, nil
+		}
+
+		return idempotentResponse{}, false, err
+	}
+
+	if err = json.Unmarshal([]byte(headers), &response.Headers); err != nil {
+		return idempotentResponse{}, false, err
+	}
+
+	return response, true, nil
+
+}
+
+const webhookColumns = "`id`, `url`, `secret`, `filter`, `events`, `disabled`, `created`, `updated`, `principal`"
+
+func getMariadbWebhooks() (hooks []webhook, err error) {
+
+	statement := fmt.Sprintf("SELECT %s FROM `webhooks` ORDER BY `created`, `id`", webhookColumns)
+
+	debugMessage(statement)
+
+	rows, err := mariadb.Query(statement)
+	if err != nil {
+		return nil, err
+	}
+	defer closer(rows)
+
+	for rows.Next() {
+		hook, err := scanMariadbWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		hooks = append(hooks, hook)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return hooks, nil
+
+}
+
+// get a webhook; its ID is empty if there isn't one
+func getMariadbWebhook(id string) (hook webhook, err error) {
+
+	statement := fmt.Sprintf("SELECT %s FROM `webhooks` WHERE `id` = ?", webhookColumns)
+
+	debugMessage(statement)
+
+	hook, err = scanMariadbWebhook(mariadb.QueryRow(statement, id))
+	if err == sql.ErrNoRows {
+		return webhook{}, nil
+	}
+
+	return hook, err
+
+}
+
+func scanMariadbWebhook(row interface{ Scan(...interface{}) error }) (hook webhook, err error) {
+
+	var filter, events string
+
+	if err = row.Scan(
+		&hook.ID,
+		&hook.URL,
+		&hook.Secret,
+		&filter,
+		&events,
+		&hook.Disabled,
+		&hook.Created,
+		&hook.Updated,
+		&hook.Principal,
+	); err != nil {
+		return webhook{}, err
+	}
+
+	if err = json.Unmarshal([]byte(filter), &hook.Filter); err != nil {
+		return webhook{}, err
+	}
+
+	if err = json.Unmarshal([]byte(events), &hook.Events); err != nil {
+		return webhook{}, err
+	}
+
+	return hook, nil
+
+}
+
+const webhookDeliveryColumns = "`id`, `webhook_id`, `event`, `record_id`, `payload`, `status`, `attempts`, `next_attempt`, `status_code`, `error`, `created`, `delivered`"
+
+// get the pending webhook deliveries which are due by the timestamp, oldest first
+func getMariadbDueWebhookDeliveries(timestamp string, limit int) (deliveries []webhookDelivery, err error) {
+
+	statement := fmt.Sprintf("SELECT %s FROM `webhook_deliveries` WHERE `status` = ? AND `next_attempt` <= ? ORDER BY `next_attempt` LIMIT %d", webhookDeliveryColumns, limit)
+
+	debugMessage(statement)
+
+	return queryMariadbWebhookDeliveries(statement, deliveryPending, timestamp)
+
+}
+
+// get the deliveries of a webhook, newest first, optionally only those with a status
+func getMariadbWebhookDeliveries(webhookID string, status string, limit int) (deliveries []webhookDelivery, err error) {
+
+	statement := fmt.Sprintf("SELECT %s FROM `webhook_deliveries` WHERE `webhook_id` = ? AND (? = '' OR `status` = ?) ORDER BY `created` DESC, `id` LIMIT %d", webhookDeliveryColumns, limit)
+
+	debugMessage(statement)
+
+	return queryMariadbWebhookDeliveries(statement, webhookID, status, status)
+
+}
+
+func queryMariadbWebhookDeliveries(statement string, values ...interface{}) (deliveries []webhookDelivery, err error) {
+
+	rows, err := mariadb.Query(statement, values...)
+	if err != nil {
+		return nil, err
+	}
+	defer closer(rows)
+
+	deliveries = []webhookDelivery{}
+
+	for rows.Next() {
+		var delivery webhookDelivery
+		var payload string
+		var nextAttempt, delivered sql.NullString
+
+		if err = rows.Scan(
+			&delivery.ID,
+			&delivery.WebhookID,
+			&delivery.Event,
+			&delivery.RecordID,
+			&payload,
+			&delivery.Status,
+			&delivery.Attempts,
+			&nextAttempt,
+			&delivery.StatusCode,
+			&delivery.Error,
+			&delivery.Created,
+			&delivered,
+		); err != nil {
+			return nil, err
+		}
+
+		delivery.Payload = json.RawMessage(payload)
+		delivery.NextAttempt = nextAttempt.String
+		delivery.Delivered = delivered.String
+
+		deliveries = append(deliveries, delivery)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+
+}
+
+// get a job, or an empty job if there's no such job
+func getMariadbJob(id string) (job bulkJob, err error) {
+
+	statement := fmt.Sprintf("SELECT %s FROM `jobs` WHERE `id` = ?", jobColumns)
+
+	debugMessage(statement)
+
+	job, err = scanMariadbJob(mariadb.QueryRow(statement, id))
+	if err == sql.ErrNoRows {
+		return bulkJob{}, nil
+	}
+
+	return job, err
+
+}
+
+// get a chunk of a job's body; found is false once there are no more chunks
+func getMariadbJobChunk(jobID string, seq int) (chunk []byte, found bool, err error) {
+
+	statement := "SELECT `chunk` FROM `job_bodies` WHERE `job_id` = ? AND `seq` = ?"
+
+	debugMessage(statement)
+
+	if err = mariadb.QueryRow(statement, jobID, seq).Scan(&chunk); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, false, nil
+		}
+
+		return nil, false, err
+	}
+
+	return chunk, true, nil
+
+}
+
+// get every uploaded schema
+func getMariadbSchemas() (entries []schemaEntry, err error) {
+
+	statement := "SELECT `type`, `schema`, `updated`, `principal` FROM `schemas` ORDER BY `type`"
+
+	debugMessage(statement)
+
+	rows, err := mariadb.Query(statement)
+	if err != nil {
+		return nil, err
+	}
+	defer closer(rows)
+
+	for rows.Next() {
+
+		entry := schemaEntry{Source: "upload"}
+		var schema string
+
+		if err := rows.Scan(&entry.Type, &schema, &entry.Updated, &entry.Principal); err != nil {
+			return nil, err
+		}
+
+		entry.Schema = json.RawMessage(schema)
+
+		entries = append(entries, entry)
+
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+
+}
+
+func getMariadbRow(id string) (record hostdb.Record, err error) {
+
+	var contextString string
+
+	statement := "SELECT `id`, `type`, `hostname`, `ip`, `timestamp`, `committer`, `context`, `data`, `hash` FROM `hostdb` WHERE `id` = "
+
+	debugMessage(fmt.Sprintf("%s%v", statement, id))
+
+	err = mariadb.QueryRow(fmt.Sprintf("%s?", statement), id).Scan(
+		&record.ID,
+		&record.Type,
+		&record.Hostname,
+		&record.IP,
+		&record.Timestamp,
+		&record.Committer,
+		&contextString,
+		&record.Data,
+		&record.Hash,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return hostdb.Record{}, nil
+		}
+
+		if err, ok := err.(*mysql.MySQLError); ok {
+			log.Println(fmt.Sprintf("DB ERROR: %v: %v", err.Number, err.Message))
+			return hostdb.Record{}, err
+		}
+
+		// TODO: if err.ErrorResponse == "invalid connection", re-establish connection and retry
+		log.Println(fmt.Sprintf("getting id (%v) failed: %v", id, err.Error()))
+		return hostdb.Record{}, err
+	}
+
+	if err := json.Unmarshal([]byte(contextString), &record.Context); err != nil {
+		log.Println("failed to unmarshal context into a map")
+		return hostdb.Record{}, err
+	}
+
+	return record, nil
+
+}
+
+func getMariadbRows(clauses hostdb.MariadbWhereClauses, limit hostdb.MariadbLimit) (records map[string]hostdb.Record, foundRows int, err error) {
+
+	whereSQL, values, err := clauses.Stringify()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	limitSQL := limit.Stringify()
+
+	statement := fmt.Sprintf("SELECT `id`, `type`, `hostname`, `ip`, `timestamp`, `committer`, `context`, `data`, `hash` FROM `hostdb` %s %s", whereSQL, limitSQL)
+
+	debugMessage(statement)
+
+	rows, err := mariadb.Query(statement, values...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer closer(rows)
+
+	// get total number of records
+	// http://www.mysqlperformanceblog.com/2007/08/28/to-sql_calc_found_rows-or-not-to-sql_calc_found_rows/
+	totalRecordsStatement := fmt.Sprintf("SELECT COUNT(*) FROM `hostdb` %s", whereSQL)
+
+	debugMessage(totalRecordsStatement)
+
+	if err = mariadb.QueryRow(totalRecordsStatement, values...).Scan(&foundRows); err != nil {
+		return nil, 0, err
+	}
+
+	records = map[string]hostdb.Record{}
+
+	for rows.Next() {
+
+		record, err := scanMariadbRecord(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		records[record.ID] = record
+
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return records, foundRows, nil
+
+}
+
+// the ids of those records which match the where clauses; the records needn't be in the database (e.g. they've been deleted since)
+// the clauses are run against common table expressions made from the records, which stand in for the hostdb and hostdb_ips tables
+// each record's id must be unique
+func matchMariadbRecords(records []hostdb.Record, clauses hostdb.MariadbWhereClauses) (ids map[string]bool, err error) {
+
+	ids = map[string]bool{}
+
+	if len(records) < 1 {
+		return ids, nil
+	}
+
+	whereSQL, whereValues, err := clauses.Stringify()
+	if err != nil {
+		return nil, err
+	}
+
+	var rows, ipRows []string
+	var values, ipValues []interface{}
+
+	for _, record := range records {
+		contextString, err := json.Marshal(record.Context)
+		if err != nil {
+			return nil, err
+		}
+
+		rows = append(rows, "SELECT ?,?,?,?,?,?,?,?,?")
+		values = append(values,
+			record.ID,
+			record.Type,
+			record.Hostname,
+			record.IP,
+			record.Timestamp,
+			record.Committer,
+			string(contextString),
+			string(record.Data),
+			record.Hash,
+		)
+
+		for _, ip := range recordIPs(record) {
+			ipRows = append(ipRows, "SELECT ?,?")
+			ipValues = append(ipValues, record.ID, []byte(ip))
+		}
+	}
+
+	if len(ipRows) < 1 {
+		ipRows = []string{"SELECT NULL, NULL FROM DUAL WHERE FALSE"}
+	}
+
+	statement := fmt.Sprintf(
+		"WITH `hostdb` (`id`, `type`, `hostname`, `ip`, `timestamp`, `committer`, `context`, `data`, `hash`) AS (%s), `hostdb_ips` (`id`, `ip`) AS (%s) SELECT `id` FROM `hostdb` %s",
+		strings.Join(rows, " UNION ALL "),
+		strings.Join(ipRows, " UNION ALL "),
+		whereSQL,
+	)
+
+	debugMessage(statement)
+
+	result, err := mariadb.Query(statement, append(append(values, ipValues...), whereValues...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer closer(result)
+
+	for result.Next() {
+		var id string
+		if err := result.Scan(&id); err != nil {
+			return nil, err
+		}
+
+		ids[id] = true
+	}
+
+	if err = result.Err(); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+
+}
+
+// call fn with each matching record in turn, without holding all of them in memory
+func eachMariadbRow(clauses hostdb.MariadbWhereClauses, fn func(record hostdb.Record) error) error {
+
+	whereSQL, values, err := clauses.Stringify()
+	if err != nil {
+		return err
+	}
+
+	statement := fmt.Sprintf("SELECT `id`, `type`, `hostname`, `ip`, `timestamp`, `committer`, `context`, `data`, `hash` FROM `hostdb` %s", whereSQL)
+
+	debugMessage(statement)
+
+	rows, err := mariadb.Query(statement, values...)
+	if err != nil {
+		return err
+	}
+	defer closer(rows)
+
+	for rows.Next() {
+
+		record, err := scanMariadbRecord(rows)
+		if err != nil {
+			return err
+		}
+
+		if err = fn(record); err != nil {
+			return err
+		}
+
+	}
+
+	return rows.Err()
+
+}
+
+// scan a row of the hostdb table, as selected by getMariadbRows
+func scanMariadbRecord(rows *sql.Rows) (record hostdb.Record, err error) {
+
+	var contextString string
+
+	if err = rows.Scan(
+		&record.ID,
+		&record.Type,
+		&record.Hostname,
+		&record.IP,
+		&record.Timestamp,
+		&record.Committer,
+		&contextString,
+		&record.Data,
+		&record.Hash,
+	); err != nil {
+		return hostdb.Record{}, err
+	}
+
+	// unmarshal the context string into a map
+	if err := json.Unmarshal([]byte(contextString), &record.Context); err != nil {
+		log.Println("failed to unmarshal context into a map")
+		return hostdb.Record{}, err
+	}
+
+	return record, nil
+
+}
+
+// get the jobs which are queued or running, oldest first
+func getMariadbUnfinishedJobs() (unfinished []bulkJob, err error) {
+
+	statement := fmt.Sprintf("SELECT %s FROM `jobs` WHERE `status` IN (?, ?) ORDER BY `created`, `id`", jobColumns)
+
+	debugMessage(statement)
+
+	rows, err := mariadb.Query(statement, jobQueued, jobRunning)
+	if err != nil {
+		return nil, err
+	}
+	defer closer(rows)
+
+	for rows.Next() {
+
+		job, err := scanMariadbJob(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		unfinished = append(unfinished, job)
+
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return unfinished, nil
+
+}
+
+// take a named lock, shared by every server using the database, waiting for it for up to the given time
+// the lock is held by a connection of its own, until unlock is called or the connection is lost
+func lockMariadb(name string, wait time.Duration) (unlock func(), locked bool, err error) {
+
+	ctx := context.Background()
+
+	conn, err := mariadb.Conn(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	statement := "SELECT GET_LOCK(?, ?)"
+
+	debugMessage(statement)
+
+	var result sql.NullInt64
+	if err = conn.QueryRowContext(ctx, statement, name, int(wait.Seconds())).Scan(&result); err != nil || result.Int64 != 1 {
+		if err := conn.Close(); err != nil {
+			log.Println(err.Error())
+		}
+
+		return nil, false, err
+	}
+
+	return func() {
+
+		statement := "SELECT RELEASE_LOCK(?)"
+
+		debugMessage(statement)
+
+		if err := conn.QueryRowContext(ctx, statement, name).Scan(&result); err != nil {
+			log.Println(err.Error())
+		}
+
+		if err := conn.Close(); err != nil {
+			log.Println(err.Error())
+		}
+
+	}, true, nil
+
+}
+
+// the maximum length of a column, and whether it exists at all
+func getMariadbColumnLength(table string, column string) (length int64, exists bool, err error) {
+
+	statement := "SELECT COALESCE(`CHARACTER_MAXIMUM_LENGTH`, 0) FROM `information_schema`.`COLUMNS` WHERE `TABLE_SCHEMA` = DATABASE() AND `TABLE_NAME` = ? AND `COLUMN_NAME` = ?"
+
+	debugMessage(statement)
+
+	if err = mariadb.QueryRow(statement, table, column).Scan(&length); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, false, nil
+		}
+
+		return 0, false, err
+	}
+
+	return length, true, nil
+
+}
+
+func getMariadbVersion() (version string, err error) {
+
+	if err = mariadb.QueryRow("SELECT VERSION()").Scan(&version); err != nil {
+		return "", err
+	}
+
+	return version, nil
+
+}
+
+// get the total number of records
+func getTotalRecords() (count int, err error) {
+
+	if err = mariadb.QueryRow("SELECT COUNT(*) FROM `hostdb`").Scan(&count); err != nil {
+		return 0, err
+	}
+
+	return
+
+}
+
+// get the timestamp for the newest record
+func getNewestTimestamp() (timestamp string, err error) {
+
+	if err = mariadb.QueryRow("SELECT `timestamp` FROM `hostdb` ORDER BY `timestamp` DESC LIMIT 1").Scan(&timestamp); err != nil {
+		return "", err
+	}
+
+	return
+
+}
+
+// get the timestamp for the oldest record
+func getOldestTimestamp() (timestamp string, err error) {
+
+	if err = mariadb.QueryRow("SELECT `timestamp` FROM `hostdb` ORDER BY `timestamp` ASC LIMIT 1").Scan(&timestamp); err != nil {
+		return "", err
+	}
+
+	return
+
+}
+
+// get the recent timestamps for each of the committers
+func getRecentCommitterTimestamps() (lastSeen map[string]string, err error) {
+
+	lastSeen = make(map[string]string)
+
+	rows, err := mariadb.Query("SELECT `committer`, MAX(`timestamp`) FROM hostdb WHERE `committer` IS NOT NULL GROUP BY `committer`")
+	if err != nil {
+		return nil, err
+	}
+	defer closer(rows)
+
+	for rows.Next() {
+		var committer, timestamp string
+
+		if err = rows.Scan(
+			&committer,
+			&timestamp,
+		); err != nil {
+			return nil, err
+		}
+
+		lastSeen[committer] = timestamp
+	}
+
+	return
+
+}
+
+// create some global, generic database objects
+func loadMariadb() (err error) {
+
+	log.Println(fmt.Sprintf("[NOTICE] Testing connection to: %v@tcp(%v:%v)/%v?%v", config.Mariadb.User, config.Mariadb.Host, config.Mariadb.Port, config.Mariadb.DB, marshalParams()))
+
+	mariadb, err = sql.Open("mysql",
+		fmt.Sprintf("%v:%v@tcp(%v:%v)/%v?%v", config.Mariadb.User, config.Mariadb.Pass, config.Mariadb.Host, config.Mariadb.Port, config.Mariadb.DB, marshalParams()))
+	if err != nil {
+		return err
+	}
+	//defer closer(mariadb)
+
+	if checkMariadb() == false {
+		if err = setupDatabase(); err != nil {
+			log.Println("setting up the database failed")
+			return err
+		}
+	}
+
+	// databases created by an older release may be missing some of the newer tables
+	if err = createTable(); err != nil {
+		log.Println("creating the tables failed")
+		return err
+	}
+
+	// ...and some of the changes made to the older tables since
+	if err = migrateMariadb(); err != nil {
+		log.Println("migrating the tables failed")
+		return err
+	}
+
+	// ...and the ip addresses of records saved before hostdb_ips existed
+	if err = syncMariadbIPs(); err != nil {
+		log.Println("indexing the ip addresses of existing records failed")
+		return err
+	}
+
+	// http://techblog.en.klab-blogs.com/archives/31093990.html
+	maxConnections := 20
+	mariadb.SetMaxOpenConns(maxConnections)
+	mariadb.SetMaxIdleConns(maxConnections)
+	mariadb.SetConnMaxLifetime(time.Duration(maxConnections) * time.Second)
+
+	return nil
+
+}
+
+// bring the tables of a database created by an older release up to date; each step checks whether it's needed first
+func migrateMariadb() error {
+
+	// the ip field used to hold only one address
+	length, exists, err := getMariadbColumnLength("hostdb", "ip")
+	if err != nil {
+		return err
+	}
+
+	if exists && length < ipColumnWidth {
+		statement := fmt.Sprintf("ALTER TABLE `hostdb` MODIFY `ip` varchar(%d) NOT NULL COMMENT 'comma separated'", ipColumnWidth)
+
+		debugMessage(statement)
+
+		if _, err := mariadb.Exec(statement); err != nil {
+			return err
+		}
+
+		log.Println("widened hostdb.ip to hold several addresses")
+	}
+
+	// running jobs used to be held only in memory
+	if _, exists, err = getMariadbColumnLength("jobs", "lease_until"); err != nil {
+		return err
+	}
+
+	if !exists {
+		statement := "ALTER TABLE `jobs` ADD COLUMN `lease_until` timestamp NULL COMMENT 'while running'"
+
+		debugMessage(statement)
+
+		if _, err := mariadb.Exec(statement); err != nil {
+			return err
+		}
+
+		log.Println("added jobs.lease_until")
+	}
+
+	// the change feed didn't say which server made each change
+	if _, exists, err = getMariadbColumnLength("changes", "origin"); err != nil {
+		return err
+	}
+
+	if !exists {
+		statement := "ALTER TABLE `changes` ADD COLUMN `origin` varchar(64) NOT NULL DEFAULT '' COMMENT 'the server which made the change'"
+
+		debugMessage(statement)
+
+		if _, err := mariadb.Exec(statement); err != nil {
+			return err
+		}
+
+		log.Println("added changes.origin")
+	}
+
+	return nil
+
+}
+
+func marshalParams() (params string) {
+
+	for _, v := range config.Mariadb.Params {
+		if len(params) > 1 {
+			params += "&"
+		}
+
+		params += v
+	}
+
+	return params
+
+}
+
+// append an entry to the audit log
+func saveMariadbAuditEntry(entry auditEntry) error {
+
+	statement := "INSERT INTO `audit` (`timestamp`, `principal`, `source_ip`, `request_id`, `method`, `path`, `action`, `ids`, `created`, `updated`, `deleted`, `message`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+
+	debugMessage(statement)
+
+	if entry.IDs == nil {
+		entry.IDs = []string{}
+	}
+
+	idsString, err := json.Marshal(entry.IDs)
+	if err != nil {
+		log.Println("failed to marshal audit ids")
+		return err
+	}
+
+	if _, err = mariadb.Exec(statement,
+		entry.Timestamp,
+		entry.Principal,
+		entry.SourceIP,
+		entry.RequestID,
+		entry.Method,
+		entry.Path,
+		entry.Action,
+		string(idsString),
+		entry.Created,
+		entry.Updated,
+		entry.Deleted,
+		entry.Message,
+	); err != nil {
+		log.Println(fmt.Sprintf("audit insert failed: %v", entry))
+		return err
+	}
+
+	return nil
+
+}
+
+// the columns of the jobs table, in the order scanned by scanMariadbJob
+const jobColumns = "`id`, `status`, `type`, `scope`, `content_type`, `dry_run`, `partial`, `force`, `committer`, `principal`, `source_ip`, `request_id`, `path`, `received`, `status_code`, `result`, `error`, `created`, `started`, `finished`, `lease_until`"
+
+// register a collector, or change its registration; what it has done is kept
+func saveMariadbCollector(c collector) error {
+
+	scope, err := json.Marshal(c.Scope)
+	if err != nil {
+		return err
+	}
+
+	statement := "INSERT INTO `collectors` (`name`, `type`, `scope`, `interval`, `description`, `created`, `updated`, `principal`) VALUES (?, ?, ?, ?, ?, ?, ?, ?) " +
+		"ON DUPLICATE KEY UPDATE `type` = VALUES(`type`), `scope` = VALUES(`scope`), `interval` = VALUES(`interval`), " +
+		"`description` = VALUES(`description`), `updated` = VALUES(`updated`), `principal` = VALUES(`principal`)"
+
+	debugMessage(statement)
+
+	_, err = mariadb.Exec(statement, c.Name, c.Type, string(scope), int64(c.interval().Seconds()), c.Description, c.Created, c.Updated, c.Principal)
+
+	return err
+
+}
+
+// save what a collector's last run did
+func saveMariadbCollectorRun(c collector) error {
+
+	counts, err := json.Marshal(c.LastRunCounts)
+	if err != nil {
+		return err
+	}
+
+	if len(c.LastError) > 1024 {
+		c.LastError = c.LastError[:1024]
+	}
+
+	statement := "UPDATE `collectors` SET `last_run` = NULLIF(?, ''), `last_success` = NULLIF(?, ''), `last_error` = ?, `last_counts` = ? WHERE `name` = ?"
+
+	debugMessage(statement)
+
+	_, err = mariadb.Exec(statement, c.LastRun, c.LastSuccess, c.LastError, string(counts), c.Name)
+
+	return err
+
+}
+
+// append entries to the change feed; each is given the next sequence number
+// the changes are written as part of the transaction making them, so that a change is listed if, and only if, it was made
+// the feed is locked until the transaction ends, so that changes are committed in the order of their seq
+func saveMariadbChanges(tx *sql.Tx, changes []changeEntry) error {
+
+	if len(changes) < 1 {
+		return nil
+	}
+
+	if err := lockMariadbChanges(tx, "FOR UPDATE"); err != nil {
+		return err
+	}
+
+	for start := 0; start < len(changes); start += defaultBulkBatchSize {
+		end := start + defaultBulkBatchSize
+		if end > len(changes) {
+			end = len(changes)
+		}
+
+		var inserts []string
+		var values []interface{}
+
+		for _, change := range changes[start:end] {
+			inserts = append(inserts, "(?,?,?,?,?,?)")
+			values = append(values, change.ID, change.Type, change.Event, change.Hash, change.Timestamp, change.Origin)
+		}
+
+		statement := fmt.Sprintf("INSERT INTO `changes` (`id`, `type`, `event`, `hash`, `timestamp`, `origin`) VALUES %s", strings.Join(inserts, ","))
+
+		debugMessage(statement)
+
+		if _, err := tx.Exec(statement, values...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// lock the change feed until the end of the transaction; FOR UPDATE while writing changes, or LOCK IN SHARE MODE
+// to wait for the changes being written to be committed
+func lockMariadbChanges(tx *sql.Tx, mode string) error {
+
+	statement := fmt.Sprintf("SELECT `id` FROM `changes_lock` WHERE `id` = 1 %s", mode)
+
+	debugMessage(statement)
+
+	var id int
+	if err := tx.QueryRow(statement).Scan(&id); err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	return nil
+
+}
+
+// store the response to a claimed idempotency key
+// add a run to the ledger
+func saveMariadbRun(entry run) error {
+
+	if entry.Context == nil {
+		entry.Context = map[string]interface{}{}
+	}
+
+	if entry.Errors == nil {
+		entry.Errors = []bulkRecordError{}
+	}
+
+	context, err := json.Marshal(entry.Context)
+	if err != nil {
+		return err
+	}
+
+	errors, err := json.Marshal(entry.Errors)
+	if err != nil {
+		return err
+	}
+
+	if len(entry.Error) > 1024 {
+		entry.Error = entry.Error[:1024]
+	}
+
+	statement := "INSERT INTO `runs` (`type`, `context`, `committer`, `started`, `finished`, `status`, `status_code`, `received`, `created`, `updated`, `unchanged`, `deleted`, `rejected`, `error`, `errors`) " +
+		"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+
+	debugMessage(statement)
+
+	_, err = mariadb.Exec(statement,
+		entry.Type,
+		string(context),
+		entry.Committer,
+		entry.Started,
+		entry.Finished,
+		entry.Status,
+		entry.StatusCode,
+		entry.Received,
+		entry.Created,
+		entry.Updated,
+		entry.Unchanged,
+		entry.Deleted,
+		entry.Rejected,
+		entry.Error,
+		string(errors),
+	)
+
+	return err
+
+}
+
+// store the response to a claimed idempotency key
+func saveMariadbIdempotentResponse(response idempotentResponse) error {
+
+	headers, err := json.Marshal(response.Headers)
+	if err != nil {
+		return err
+	}
+
+	statement := "UPDATE `idempotency_keys` SET `status_code` = ?, `content_type` = ?, `headers` = ?, `body` = ? WHERE `principal` = ? AND `idempotency_key` = ?"
+
+	debugMessage(statement)
+
+	_, err = mariadb.Exec(statement, response.StatusCode, response.ContentType, string(headers), response.Body, response.Principal, response.Key)
+
+	return err
+
+}
+
+// create or update a webhook, keeping its deliveries
+func saveMariadbWebhook(hook webhook) error {
+
+	filter, err := json.Marshal(hook.Filter)
+	if err != nil {
+		return err
+	}
+
+	events, err := json.Marshal(hook.Events)
+	if err != nil {
+		return err
+	}
+
+	statement := "INSERT INTO `webhooks` (`id`, `url`, `secret`, `filter`, `events`, `disabled`, `created`, `updated`, `principal`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) " +
+		"ON DUPLICATE KEY UPDATE `url` = VALUES(`url`), `secret` = VALUES(`secret`), `filter` = VALUES(`filter`), `events` = VALUES(`events`), " +
+		"`disabled` = VALUES(`disabled`), `updated` = VALUES(`updated`), `principal` = VALUES(`principal`)"
+
+	debugMessage(statement)
+
+	_, err = mariadb.Exec(statement, hook.ID, hook.URL, hook.Secret, string(filter), string(events), hook.Disabled, hook.Created, hook.Updated, hook.Principal)
+
+	return err
+
+}
+
+// queue new webhook deliveries
+func saveMariadbWebhookDeliveries(deliveries []webhookDelivery) error {
+
+	if len(deliveries) < 1 {
+		return nil
+	}
+
+	var inserts []string
+	var values []interface{}
 
-	if err = mariadb.QueryRow(totalRecordsStatement, values...).Scan(&foundRows); err != nil {
-		return nil, 0, err
+	for _, delivery := range deliveries {
+		inserts = append(inserts, "(?,?,?,?,?,?,?,?)")
+		values = append(values,
+			delivery.ID,
+			delivery.WebhookID,
+			delivery.Event,
+			delivery.RecordID,
+			string(delivery.Payload),
+			delivery.Status,
+			delivery.NextAttempt,
+			delivery.Created,
+		)
 	}
 
-	records = map[string]hostdb.Record{}
+	statement := fmt.Sprintf("INSERT INTO `webhook_deliveries` (`id`, `webhook_id`, `event`, `record_id`, `payload`, `status`, `next_attempt`, `created`) VALUES %s", strings.Join(inserts, ","))
 
-	for rows.Next() {
+	debugMessage(statement)
 
-		var record hostdb.Record
-		var contextString string
+	_, err := mariadb.Exec(statement, values...)
 
-		if err = rows.Scan(
-			&record.ID,
-			&record.Type,
-			&record.Hostname,
-			&record.IP,
-			&record.Timestamp,
-			&record.Committer,
-			&contextString,
-			&record.Data,
-			&record.Hash,
-		); err != nil {
-			return nil, 0, err
-		}
+	return err
 
-		// unmarshal the context string into a map
-		if err := json.Unmarshal([]byte(contextString), &record.Context); err != nil {
-			log.Println("failed to unmarshal context into a map")
-			return nil, 0, err
-		}
+}
 
-		records[record.ID] = record
+// save the outcome of an attempt at a webhook delivery
+func saveMariadbWebhookDelivery(delivery webhookDelivery) error {
 
-	}
+	statement := "UPDATE `webhook_deliveries` SET `status` = ?, `attempts` = ?, `next_attempt` = NULLIF(?, ''), `status_code` = ?, `error` = ?, `delivered` = NULLIF(?, '') WHERE `id` = ?"
 
-	if err = rows.Err(); err != nil {
-		return nil, 0, err
-	}
+	debugMessage(statement)
 
-	return records, foundRows, nil
+	_, err := mariadb.Exec(statement,
+		delivery.Status,
+		delivery.Attempts,
+		delivery.NextAttempt,
+		delivery.StatusCode,
+		delivery.Error,
+		delivery.Delivered,
+		delivery.ID,
+	)
 
-}
+	return err
 
-func getMariadbVersion() (version string, err error) {
+}
 
-	if err = mariadb.QueryRow("SELECT VERSION()").Scan(&version); err != nil {
-		return "", err
-	}
+// insert or replace a job
+func saveMariadbJob(job bulkJob) error {
 
-	return version, nil
+	statement := fmt.Sprintf("REPLACE INTO `jobs` (%s) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", jobColumns)
 
-}
+	debugMessage(statement)
 
-// get the total number of records
-func getTotalRecords() (count int, err error) {
+	var result interface{}
+	if job.Result != nil {
+		b, err := json.Marshal(job.Result)
+		if err != nil {
+			log.Println("failed to marshal job result")
+			return err
+		}
 
-	if err = mariadb.QueryRow("SELECT COUNT(*) FROM `hostdb`").Scan(&count); err != nil {
-		return 0, err
+		result = string(b)
 	}
 
-	return
-
-}
+	// timestamps which haven't happened yet are null
+	nullable := func(timestamp string) interface{} {
+		if timestamp == "" {
+			return nil
+		}
 
-// get the timestamp for the newest record
-func getNewestTimestamp() (timestamp string, err error) {
+		return timestamp
+	}
 
-	if err = mariadb.QueryRow("SELECT `timestamp` FROM `hostdb` ORDER BY `timestamp` DESC LIMIT 1").Scan(&timestamp); err != nil {
-		return "", err
+	if _, err := mariadb.Exec(statement,
+		job.ID,
+		job.Status,
+		job.Type,
+		job.Scope,
+		job.ContentType,
+		job.DryRun,
+		job.Partial,
+		job.Force,
+		job.Committer,
+		job.Principal,
+		job.SourceIP,
+		job.RequestID,
+		job.Path,
+		job.Received,
+		job.StatusCode,
+		result,
+		job.Error,
+		job.Created,
+		nullable(job.Started),
+		nullable(job.Finished),
+		nullable(job.LeaseUntil),
+	); err != nil {
+		log.Println(fmt.Sprintf("saving job %s failed", job.ID))
+		return err
 	}
 
-	return
+	return nil
 
 }
 
-// get the timestamp for the oldest record
-func getOldestTimestamp() (timestamp string, err error) {
+// save how many records a running job has reconciled so far
+func saveMariadbJobProgress(id string, received int) error {
 
-	if err = mariadb.QueryRow("SELECT `timestamp` FROM `hostdb` ORDER BY `timestamp` ASC LIMIT 1").Scan(&timestamp); err != nil {
-		return "", err
-	}
+	statement := "UPDATE `jobs` SET `received` = ? WHERE `id` = ? AND `status` = ?"
 
-	return
+	debugMessage(statement)
+
+	_, err := mariadb.Exec(statement, received, id, jobRunning)
+
+	return err
 
 }
 
-// get the recent timestamps for each of the committers
-func getRecentCommitterTimestamps() (lastSeen map[string]string, err error) {
+// extend the lease of a running job; returns false if it isn't running any more
+func renewMariadbJobLease(id string, leaseUntil string) (renewed bool, err error) {
 
-	lastSeen = make(map[string]string)
+	statement := "UPDATE `jobs` SET `lease_until` = ? WHERE `id` = ? AND `status` = ?"
 
-	rows, err := mariadb.Query("SELECT `committer`, MAX(`timestamp`) FROM hostdb WHERE `committer` IS NOT NULL GROUP BY `committer`")
+	debugMessage(statement)
+
+	res, err := mariadb.Exec(statement, leaseUntil, id, jobRunning)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
-	defer closer(rows)
-
-	for rows.Next() {
-		var committer, timestamp string
-
-		if err = rows.Scan(
-			&committer,
-			&timestamp,
-		); err != nil {
-			return nil, err
-		}
 
-		lastSeen[committer] = timestamp
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
 	}
 
-	return
+	return rowsAffected == 1, nil
 
 }
 
-// create some global, generic database objects
-func loadMariadb() (err error) {
+// store a chunk of a job's body
+func saveMariadbJobChunk(jobID string, seq int, chunk []byte) error {
 
-	log.Println(fmt.Sprintf("[NOTICE] Testing connection to: %v@tcp(%v:%v)/%v?%v", config.Mariadb.User, config.Mariadb.Host, config.Mariadb.Port, config.Mariadb.DB, marshalParams()))
+	statement := "INSERT INTO `job_bodies` (`job_id`, `seq`, `chunk`) VALUES (?, ?, ?)"
 
-	mariadb, err = sql.Open("mysql",
-		fmt.Sprintf("%v:%v@tcp(%v:%v)/%v?%v", config.Mariadb.User, config.Mariadb.Pass, config.Mariadb.Host, config.Mariadb.Port, config.Mariadb.DB, marshalParams()))
-	if err != nil {
-		return err
-	}
-	//defer closer(mariadb)
+	debugMessage(statement)
 
-	if checkMariadb() == false {
-		if err = setupDatabase(); err != nil {
-			log.Println("setting up the database failed")
-			return err
-		}
-	}
+	_, err := mariadb.Exec(statement, jobID, seq, chunk)
 
-	// http://techblog.en.klab-blogs.com/archives/31093990.html
-	maxConnections := 20
-	mariadb.SetMaxOpenConns(maxConnections)
-	mariadb.SetMaxIdleConns(maxConnections)
-	mariadb.SetConnMaxLifetime(time.Duration(maxConnections) * time.Second)
+	return err
 
-	return nil
+}
+
+// insert or replace an uploaded schema
+func saveMariadbSchema(entry schemaEntry) error {
+
+	statement := "REPLACE INTO `schemas` (`type`, `schema`, `updated`, `principal`) VALUES (?, ?, ?, ?)"
+
+	debugMessage(statement)
+
+	_, err := mariadb.Exec(statement, entry.Type, string(entry.Schema), entry.Updated, entry.Principal)
+
+	return err
 
 }
 
-func marshalParams() (params string) {
+// scan a row of the jobs table, selected using jobColumns
+func scanMariadbJob(row interface{ Scan(...interface{}) error }) (job bulkJob, err error) {
+
+	var result, started, finished, leaseUntil sql.NullString
+
+	if err = row.Scan(
+		&job.ID,
+		&job.Status,
+		&job.Type,
+		&job.Scope,
+		&job.ContentType,
+		&job.DryRun,
+		&job.Partial,
+		&job.Force,
+		&job.Committer,
+		&job.Principal,
+		&job.SourceIP,
+		&job.RequestID,
+		&job.Path,
+		&job.Received,
+		&job.StatusCode,
+		&result,
+		&job.Error,
+		&job.Created,
+		&started,
+		&finished,
+		&leaseUntil,
+	); err != nil {
+		return bulkJob{}, err
+	}
 
-	for _, v := range config.Mariadb.Params {
-		if len(params) > 1 {
-			params += "&"
+	if result.Valid {
+		job.Result = &bulkResult{}
+		if err := json.Unmarshal([]byte(result.String), job.Result); err != nil {
+			log.Println("failed to unmarshal job result")
+			return bulkJob{}, err
 		}
-
-		params += v
 	}
 
-	return params
+	job.Started = started.String
+	job.Finished = finished.String
+	job.LeaseUntil = leaseUntil.String
+
+	return job, nil
 
 }
 
-func saveMariadbRow(record hostdb.Record) error {
+// save a record, and add the changes (if any) to the change feed
+// if ifMatch isn't empty, only if the existing record still matches it (otherwise errPreconditionFailed)
+func saveMariadbRow(record hostdb.Record, ifMatch string, changes []changeEntry) error {
 
 	// failsafe
 	if record.ID == "" {
@@ -514,12 +2252,6 @@ func saveMariadbRow(record hostdb.Record) error {
 
 	debugMessage(statementString)
 
-	statement, err := mariadb.Prepare(statementString)
-	if err != nil {
-		log.Println(fmt.Sprintf("save prepare failed: %v", statementString))
-		return err
-	}
-
 	// marshal the context map into a string
 	contextString, err := json.Marshal(record.Context)
 	if err != nil {
@@ -541,6 +2273,25 @@ func saveMariadbRow(record hostdb.Record) error {
 
 	debugMessage(values)
 
+	// the record and its ip addresses are saved together, so that searches by ip never see one without the other
+	tx, err := mariadb.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := checkMariadbIfMatch(tx, record.ID, ifMatch); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	statement, err := tx.Prepare(statementString)
+	if err != nil {
+		_ = tx.Rollback()
+		log.Println(fmt.Sprintf("save prepare failed: %v", statementString))
+		return err
+	}
+	defer closeStatement(statement)
+
 	if _, err = statement.Exec(
 		record.ID,
 		record.Type,
@@ -552,10 +2303,27 @@ func saveMariadbRow(record hostdb.Record) error {
 		record.Data,
 		record.Hash,
 	); err != nil {
+		_ = tx.Rollback()
 		log.Println(fmt.Sprintf("save exec failed: %v", values))
 		return err
 	}
 
+	if err := saveMariadbIPs(tx, []hostdb.Record{record}); err != nil {
+		_ = tx.Rollback()
+		log.Println(fmt.Sprintf("saving the ip addresses of %s failed", record.ID))
+		return err
+	}
+
+	if err := saveMariadbChanges(tx, changes); err != nil {
+		_ = tx.Rollback()
+		log.Println(fmt.Sprintf("adding the changes to %s to the change feed failed", record.ID))
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
 	// sanity
 	//rowsAffected, err := result.RowsAffected()
 	//if err != nil {
@@ -570,8 +2338,17 @@ func saveMariadbRow(record hostdb.Record) error {
 
 }
 
-// prepare an INSERT statement from a slice of records
-func saveMariadbRows(records []hostdb.Record) error {
+// release a prepared statement on the server; each bulk save prepares one, so they mustn't be left to pile up
+func closeStatement(statement *sql.Stmt) {
+
+	if err := statement.Close(); err != nil {
+		log.Println(err.Error())
+	}
+
+}
+
+// prepare an INSERT statement from a slice of records, and add the changes to the change feed
+func saveMariadbRows(records []hostdb.Record, changes []changeEntry) error {
 
 	if len(records) < 1 {
 		return nil
@@ -611,13 +2388,8 @@ func saveMariadbRows(records []hostdb.Record) error {
 	debugMessage(statementString)
 	debugMessage(values)
 
-	statement, err := mariadb.Prepare(statementString)
+	err := saveMariadbRowsTransaction(statementString, values, records, changes)
 	if err != nil {
-		log.Println(fmt.Sprintf("bulk save prepare failed: %v", statementString))
-		return err
-	}
-
-	if _, err := statement.Exec(values...); err != nil {
 		// if error 1205, retry up to 5 times
 		if err, ok := err.(*mysql.MySQLError); ok {
 			if err.Number == mysqlerr.ER_LOCK_WAIT_TIMEOUT { // 1205
@@ -626,7 +2398,7 @@ func saveMariadbRows(records []hostdb.Record) error {
 				counter := 5
 
 				for i := 0; i < counter; i++ {
-					if _, err := statement.Exec(values...); err != nil {
+					if err := saveMariadbRowsTransaction(statementString, values, records, changes); err != nil {
 						if err, ok := err.(*mysql.MySQLError); ok {
 							if err.Number == mysqlerr.ER_LOCK_WAIT_TIMEOUT { // still 1205
 								log.Printf("Error 1205: Lock wait timeout exceeded; restarting transaction (%dx)\n", i+2)
@@ -655,6 +2427,146 @@ func saveMariadbRows(records []hostdb.Record) error {
 
 }
 
+// save the records, their ip addresses and changes in one transaction, which is rolled back if any of it fails
+func saveMariadbRowsTransaction(statementString string, values []interface{}, records []hostdb.Record, changes []changeEntry) error {
+
+	tx, err := mariadb.Begin()
+	if err != nil {
+		return err
+	}
+
+	statement, err := tx.Prepare(statementString)
+	if err != nil {
+		_ = tx.Rollback()
+		log.Println(fmt.Sprintf("bulk save prepare failed: %v", statementString))
+		return err
+	}
+	defer closeStatement(statement)
+
+	if _, err := statement.Exec(values...); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	if err := saveMariadbIPs(tx, records); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	if err := saveMariadbChanges(tx, changes); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+
+}
+
+// replace the rows of the hostdb_ips table for each of the records, as part of the transaction saving them
+func saveMariadbIPs(tx *sql.Tx, records []hostdb.Record) error {
+
+	if len(records) < 1 {
+		return nil
+	}
+
+	var ids []interface{}
+	var inserts []string
+	var values []interface{}
+
+	for _, record := range records {
+		ids = append(ids, record.ID)
+
+		for _, ip := range recordIPs(record) {
+			inserts = append(inserts, "(?,?)")
+			values = append(values, record.ID, []byte(ip))
+		}
+	}
+
+	statement := fmt.Sprintf("DELETE FROM `hostdb_ips` WHERE `id` IN (%s)", strings.TrimSuffix(strings.Repeat("?,", len(ids)), ","))
+
+	debugMessage(statement)
+
+	if _, err := tx.Exec(statement, ids...); err != nil {
+		return err
+	}
+
+	if len(inserts) < 1 {
+		return nil
+	}
+
+	statement = fmt.Sprintf("INSERT IGNORE INTO `hostdb_ips` (`id`, `ip`) VALUES %s", strings.Join(inserts, ","))
+
+	debugMessage(statement)
+
+	_, err := tx.Exec(statement, values...)
+
+	return err
+
+}
+
+// fill in the hostdb_ips table for records which have an ip field, but no rows in it
+func syncMariadbIPs() error {
+
+	statement := "SELECT `id`, `ip` FROM `hostdb` WHERE `ip` <> '' AND NOT EXISTS (SELECT 1 FROM `hostdb_ips` WHERE `hostdb_ips`.`id` = `hostdb`.`id`)"
+
+	debugMessage(statement)
+
+	rows, err := mariadb.Query(statement)
+	if err != nil {
+		return err
+	}
+	defer closer(rows)
+
+	var records []hostdb.Record
+
+	for rows.Next() {
+
+		var record hostdb.Record
+
+		if err := rows.Scan(&record.ID, &record.IP); err != nil {
+			return err
+		}
+
+		// records whose ip field holds no ip addresses will be checked again at the next start, which is harmless
+		if len(recordIPs(record)) > 0 {
+			records = append(records, record)
+		}
+
+	}
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for start := 0; start < len(records); start += defaultBulkBatchSize {
+		end := start + defaultBulkBatchSize
+		if end > len(records) {
+			end = len(records)
+		}
+
+		tx, err := mariadb.Begin()
+		if err != nil {
+			return err
+		}
+
+		if err := saveMariadbIPs(tx, records[start:end]); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	if len(records) > 0 {
+		log.Println(fmt.Sprintf("indexed the ip addresses of %d existing record(s)", len(records)))
+	}
+
+	return nil
+
+}
+
 func setupDatabase() error {
 
 	dsn := fmt.Sprintf("root@tcp(%v:%v)/%v", config.Mariadb.Host, config.Mariadb.Port, config.Mariadb.DB)
@@ -2,7 +2,7 @@ CREATE TABLE IF NOT EXISTS `hostdb` (
     `id`        char(64)     NOT NULL CHECK (`id` <> ''),
     `type`      varchar(128) NOT NULL CHECK (`type` <> ''),
     `hostname`  varchar(256) NOT NULL,
-    `ip`        varchar(45)  NOT NULL,
+    `ip`        varchar(1024) NOT NULL COMMENT 'comma separated',
     `timestamp` timestamp    NOT NULL DEFAULT current_timestamp(),
     `committer` varchar(256) NOT NULL CHECK (`committer` <> ''),
     `context`   longtext     NOT NULL CHECK (json_valid(`context`)),
@@ -11,4 +11,176 @@ CREATE TABLE IF NOT EXISTS `hostdb` (
     PRIMARY KEY (`id`),
     UNIQUE KEY `id` (`id`)
 ) ENGINE = InnoDB
-  DEFAULT CHARSET = utf8 COMMENT ='HostDB records'
\ No newline at end of file
+  DEFAULT CHARSET = utf8 COMMENT ='HostDB records';
+CREATE TABLE IF NOT EXISTS `audit` (
+    `id`         bigint unsigned NOT NULL AUTO_INCREMENT,
+    `timestamp`  timestamp       NOT NULL DEFAULT current_timestamp(),
+    `principal`  varchar(256)    NOT NULL,
+    `source_ip`  varchar(45)     NOT NULL,
+    `request_id` varchar(64)     NOT NULL,
+    `method`     varchar(16)     NOT NULL,
+    `path`       varchar(2048)   NOT NULL,
+    `action`     varchar(64)     NOT NULL CHECK (`action` <> ''),
+    `ids`        longtext        NOT NULL CHECK (json_valid(`ids`)),
+    `created`    int unsigned    NOT NULL DEFAULT 0,
+    `updated`    int unsigned    NOT NULL DEFAULT 0,
+    `deleted`    int unsigned    NOT NULL DEFAULT 0,
+    `message`    varchar(1024)   NOT NULL DEFAULT '',
+    PRIMARY KEY (`id`),
+    KEY `timestamp` (`timestamp`),
+    KEY `principal` (`principal`)
+) ENGINE = InnoDB
+  DEFAULT CHARSET = utf8 COMMENT ='HostDB audit log';
+CREATE TABLE IF NOT EXISTS `jobs` (
+    `id`           char(64)      NOT NULL CHECK (`id` <> ''),
+    `status`       varchar(16)   NOT NULL CHECK (`status` <> ''),
+    `type`         varchar(128)  NOT NULL CHECK (`type` <> ''),
+    `scope`        varchar(1024) NOT NULL,
+    `content_type` varchar(64)   NOT NULL,
+    `dry_run`      tinyint(1)    NOT NULL DEFAULT 0,
+    `partial`      tinyint(1)    NOT NULL DEFAULT 0,
+    `force`        tinyint(1)    NOT NULL DEFAULT 0,
+    `committer`    varchar(256)  NOT NULL,
+    `principal`    varchar(256)  NOT NULL,
+    `source_ip`    varchar(45)   NOT NULL,
+    `request_id`   varchar(64)   NOT NULL,
+    `path`         varchar(2048) NOT NULL,
+    `received`     int unsigned  NOT NULL DEFAULT 0,
+    `status_code`  int unsigned  NOT NULL DEFAULT 0,
+    `result`       longtext      NULL CHECK (`result` IS NULL OR json_valid(`result`)),
+    `error`        varchar(1024) NOT NULL DEFAULT '',
+    `created`      timestamp     NOT NULL DEFAULT current_timestamp(),
+    `started`      timestamp     NULL,
+    `finished`     timestamp     NULL,
+    `lease_until`  timestamp     NULL COMMENT 'while running',
+    PRIMARY KEY (`id`),
+    KEY `status` (`status`),
+    KEY `finished` (`finished`)
+) ENGINE = InnoDB
+  DEFAULT CHARSET = utf8 COMMENT ='HostDB queued bulk requests';
+CREATE TABLE IF NOT EXISTS `job_bodies` (
+    `job_id` char(64)     NOT NULL,
+    `seq`    int unsigned NOT NULL,
+    `chunk`  longblob     NOT NULL,
+    PRIMARY KEY (`job_id`, `seq`)
+) ENGINE = InnoDB
+  DEFAULT CHARSET = utf8 COMMENT ='HostDB queued bulk request bodies';
+CREATE TABLE IF NOT EXISTS `schemas` (
+    `type`      varchar(128) NOT NULL CHECK (`type` <> ''),
+    `schema`    longtext     NOT NULL CHECK (json_valid(`schema`)),
+    `updated`   timestamp    NOT NULL DEFAULT current_timestamp(),
+    `principal` varchar(256) NOT NULL,
+    PRIMARY KEY (`type`)
+) ENGINE = InnoDB
+  DEFAULT CHARSET = utf8 COMMENT ='HostDB json schemas for record data, by type';
+CREATE TABLE IF NOT EXISTS `hostdb_ips` (
+    `id` char(64)      NOT NULL,
+    `ip` varbinary(16) NOT NULL COMMENT 'ipv4 addresses are mapped to ipv6',
+    PRIMARY KEY (`id`, `ip`),
+    KEY `ip` (`ip`),
+    FOREIGN KEY (`id`) REFERENCES `hostdb` (`id`) ON DELETE CASCADE
+) ENGINE = InnoDB
+  DEFAULT CHARSET = utf8 COMMENT ='HostDB record ip addresses';
+CREATE TABLE IF NOT EXISTS `idempotency_keys` (
+    `principal`       varchar(256) NOT NULL,
+    `idempotency_key` varchar(255) NOT NULL,
+    `fingerprint`     char(64)     NOT NULL COMMENT 'sha256 of the request',
+    `status_code`     int unsigned NOT NULL DEFAULT 0 COMMENT '0 until the request has been handled',
+    `content_type`    varchar(128) NOT NULL DEFAULT '',
+    `headers`         longtext     NOT NULL DEFAULT '{}' CHECK (json_valid(`headers`)),
+    `body`            longblob     NULL,
+    `created`         timestamp    NOT NULL DEFAULT current_timestamp(),
+    PRIMARY KEY (`principal`, `idempotency_key`),
+    KEY `created` (`created`)
+) ENGINE = InnoDB
+  DEFAULT CHARSET = utf8 COMMENT ='HostDB responses to requests with an Idempotency-Key';
+CREATE TABLE IF NOT EXISTS `webhooks` (
+    `id`        char(64)      NOT NULL CHECK (`id` <> ''),
+    `url`       varchar(2048) NOT NULL CHECK (`url` <> ''),
+    `secret`    varchar(256)  NOT NULL CHECK (`secret` <> ''),
+    `filter`    longtext      NOT NULL CHECK (json_valid(`filter`)) COMMENT 'query params',
+    `events`    longtext      NOT NULL CHECK (json_valid(`events`)),
+    `disabled`  tinyint(1)    NOT NULL DEFAULT 0,
+    `created`   timestamp     NOT NULL DEFAULT current_timestamp(),
+    `updated`   timestamp     NOT NULL DEFAULT current_timestamp(),
+    `principal` varchar(256)  NOT NULL,
+    PRIMARY KEY (`id`)
+) ENGINE = InnoDB
+  DEFAULT CHARSET = utf8 COMMENT ='HostDB webhook subscriptions';
+CREATE TABLE IF NOT EXISTS `webhook_deliveries` (
+    `id`           char(64)      NOT NULL CHECK (`id` <> ''),
+    `webhook_id`   char(64)      NOT NULL,
+    `event`        varchar(16)   NOT NULL,
+    `record_id`    char(64)      NOT NULL,
+    `payload`      longtext      NOT NULL CHECK (json_valid(`payload`)),
+    `status`       varchar(16)   NOT NULL CHECK (`status` <> ''),
+    `attempts`     int unsigned  NOT NULL DEFAULT 0,
+    `next_attempt` timestamp     NULL,
+    `status_code`  int unsigned  NOT NULL DEFAULT 0 COMMENT 'of the last attempt',
+    `error`        varchar(1024) NOT NULL DEFAULT '' COMMENT 'of the last attempt',
+    `created`      timestamp     NOT NULL DEFAULT current_timestamp(),
+    `delivered`    timestamp     NULL,
+    PRIMARY KEY (`id`),
+    KEY `due` (`status`, `next_attempt`),
+    KEY `webhook` (`webhook_id`, `created`),
+    FOREIGN KEY (`webhook_id`) REFERENCES `webhooks` (`id`) ON DELETE CASCADE
+) ENGINE = InnoDB
+  DEFAULT CHARSET = utf8 COMMENT ='HostDB webhook deliveries, and their history';
+CREATE TABLE IF NOT EXISTS `changes` (
+    `seq`       bigint unsigned NOT NULL AUTO_INCREMENT,
+    `id`        char(64)        NOT NULL,
+    `type`      varchar(128)    NOT NULL,
+    `event`     varchar(16)     NOT NULL,
+    `hash`      varchar(64)     NOT NULL COMMENT 'of the record data after the change, or before a delete',
+    `timestamp` timestamp       NOT NULL DEFAULT current_timestamp(),
+    `origin`    varchar(64)     NOT NULL DEFAULT '' COMMENT 'the server which made the change',
+    PRIMARY KEY (`seq`),
+    KEY `timestamp` (`timestamp`)
+) ENGINE = InnoDB
+  DEFAULT CHARSET = utf8 COMMENT ='HostDB change feed';
+CREATE TABLE IF NOT EXISTS `changes_lock` (
+    `id` tinyint unsigned NOT NULL,
+    PRIMARY KEY (`id`)
+) ENGINE = InnoDB
+  DEFAULT CHARSET = utf8 COMMENT ='HostDB change feed lock; its one row is locked while changes are written, so they commit in order';
+INSERT IGNORE INTO `changes_lock` (`id`) VALUES (1);
+CREATE TABLE IF NOT EXISTS `collectors` (
+    `name`         varchar(128)  NOT NULL CHECK (`name` <> ''),
+    `type`         varchar(128)  NOT NULL CHECK (`type` <> ''),
+    `scope`        longtext      NOT NULL CHECK (json_valid(`scope`)) COMMENT 'bulk_scope context values',
+    `interval`     int unsigned  NOT NULL COMMENT 'seconds between expected runs',
+    `description`  varchar(1024) NOT NULL DEFAULT '',
+    `created`      timestamp     NOT NULL DEFAULT current_timestamp(),
+    `updated`      timestamp     NOT NULL DEFAULT current_timestamp(),
+    `principal`    varchar(256)  NOT NULL,
+    `last_run`     timestamp     NULL,
+    `last_success` timestamp     NULL,
+    `last_error`   varchar(1024) NOT NULL DEFAULT '' COMMENT 'of the last run',
+    `last_counts`  longtext      NOT NULL DEFAULT '{}' CHECK (json_valid(`last_counts`)) COMMENT 'of the last run',
+    PRIMARY KEY (`name`),
+    KEY `type` (`type`)
+) ENGINE = InnoDB
+  DEFAULT CHARSET = utf8 COMMENT ='HostDB collectors, and their last runs';
+CREATE TABLE IF NOT EXISTS `runs` (
+    `id`          bigint unsigned NOT NULL AUTO_INCREMENT,
+    `type`        varchar(128)    NOT NULL,
+    `context`     longtext        NOT NULL CHECK (json_valid(`context`)) COMMENT 'of the record set',
+    `committer`   varchar(256)    NOT NULL,
+    `started`     timestamp       NOT NULL DEFAULT current_timestamp(),
+    `finished`    timestamp       NOT NULL DEFAULT current_timestamp(),
+    `status`      varchar(16)     NOT NULL,
+    `status_code` int unsigned    NOT NULL,
+    `received`    int unsigned    NOT NULL DEFAULT 0,
+    `created`     int unsigned    NOT NULL DEFAULT 0,
+    `updated`     int unsigned    NOT NULL DEFAULT 0,
+    `unchanged`   int unsigned    NOT NULL DEFAULT 0,
+    `deleted`     int unsigned    NOT NULL DEFAULT 0,
+    `rejected`    int unsigned    NOT NULL DEFAULT 0 COMMENT 'records which failed validation',
+    `error`       varchar(1024)   NOT NULL DEFAULT '',
+    `errors`      longtext        NOT NULL DEFAULT '[]' CHECK (json_valid(`errors`)) COMMENT 'the first of the records which failed validation',
+    PRIMARY KEY (`id`),
+    KEY `type` (`type`, `started`),
+    KEY `started` (`started`),
+    KEY `finished` (`finished`)
+) ENGINE = InnoDB
+  DEFAULT CHARSET = utf8 COMMENT ='HostDB bulk POSTs, and what they did'
@@ -49,7 +49,7 @@ func TestDeleteMariaRow(t *testing.T) {
 		t.Errorf("%v", err)
 	}
 
-	err = deleteMariadbRow(recordIds[0])
+	err = deleteMariadbRow(recordIds[0], "")
 	if err != nil {
 		t.Errorf("%v", err)
 	}
@@ -228,10 +228,20 @@ func TestMarshalParams(t *testing.T) {
 
 func TestSaveMariadbRow(t *testing.T) {
 
-	if err := saveMariadbRow(TestRecord); err != nil {
+	if err := saveMariadbRow(TestRecord, "", nil); err != nil {
 		t.Errorf("%v", err)
 	}
 
+	etag, err := recordETag(TestRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the write is conditional on the record as it is when the row is locked
+	assert.Nil(t, saveMariadbRow(TestRecord, etag, nil), "matching")
+	assert.Equal(t, errPreconditionFailed, saveMariadbRow(TestRecord, `"stale"`, nil), "changed")
+	assert.Equal(t, errPreconditionFailed, deleteMariadbRow(TestRecord.ID, `"stale"`), "changed")
+
 }
 
 func TestSaveMariadbRows(t *testing.T) {
@@ -270,7 +280,7 @@ func TestSaveMariadbRows(t *testing.T) {
 		},
 	}
 
-	if err := saveMariadbRows(records); err != nil {
+	if err := saveMariadbRows(records, nil); err != nil {
 		t.Errorf("%v", err)
 	}
 
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pdxfixit/hostdb"
+)
+
+// a json patch test operation didn't match
+var errPatchTestFailed = errors.New("test failed")
+
+// a single RFC 6902 json patch operation
+type jsonPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"` // nil if absent, as opposed to null
+}
+
+// apply a patch to the context and data of a record, according to the content type of the patch
+// the patch applies to the document {"context": {...}, "data": ...}; changed is false if the patch made no difference
+func applyRecordPatch(record hostdb.Record, contentType string, patch []byte) (patched hostdb.Record, changed bool, err error) {
+
+	// decode the record into the document to be patched
+	contextBytes, err := json.Marshal(record.Context)
+	if err != nil {
+		return record, false, err
+	}
+
+	context, err := decodeJSON(contextBytes)
+	if err != nil {
+		return record, false, err
+	}
+
+	data, err := decodeJSON(record.Data)
+	if err != nil {
+		return record, false, err
+	}
+
+	originalData, err := encodeJSON(data)
+	if err != nil {
+		return record, false, err
+	}
+
+	originalContext, err := encodeJSON(context)
+	if err != nil {
+		return record, false, err
+	}
+
+	var document interface{} = map[string]interface{}{
+		"context": context,
+		"data":    data,
+	}
+
+	switch contentType {
+	case "application/merge-patch+json":
+		mergePatchDocument, err := decodeJSON(patch)
+		if err != nil {
+			return record, false, hostdb.ErrorResponse{
+				Code:    http.StatusBadRequest,
+				Message: fmt.Sprintf("the merge patch is not valid json: %v", err),
+			}
+		}
+
+		document = mergePatch(document, mergePatchDocument)
+	case "application/json-patch+json":
+		var operations []jsonPatchOperation
+
+		if err := json.Unmarshal(patch, &operations); err != nil {
+			return record, false, hostdb.ErrorResponse{
+				Code:    http.StatusBadRequest,
+				Message: fmt.Sprintf("the json patch is not an array of operations: %v", err),
+			}
+		}
+
+		if document, err = applyJSONPatch(document, operations); err != nil {
+			code := http.StatusUnprocessableEntity
+			if errors.Is(err, errPatchTestFailed) {
+				code = http.StatusConflict
+			}
+
+			return record, false, hostdb.ErrorResponse{
+				Code:    code,
+				Message: err.Error(),
+			}
+		}
+	default:
+		return record, false, hostdb.ErrorResponse{
+			Code:    http.StatusUnsupportedMediaType,
+			Message: "the patch must be either application/merge-patch+json or application/json-patch+json",
+		}
+	}
+
+	// only the context and data may be patched
+	unprocessable := func(message string) error {
+		return hostdb.ErrorResponse{
+			Code:    http.StatusUnprocessableEntity,
+			Message: message,
+		}
+	}
+
+	object, ok := document.(map[string]interface{})
+	if !ok {
+		return record, false, unprocessable("the patched record must be an object")
+	}
+
+	for key := range object {
+		if key != "context" && key != "data" {
+			return record, false, unprocessable(fmt.Sprintf("only context and data may be patched, not %s", key))
+		}
+	}
+
+	newContext, ok := object["context"].(map[string]interface{})
+	if !ok {
+		return record, false, unprocessable("context must be an object")
+	}
+
+	if object["data"] == nil {
+		return record, false, unprocessable("data cannot be removed")
+	}
+
+	newData, err := encodeJSON(object["data"])
+	if err != nil {
+		return record, false, err
+	}
+
+	contextBytes, err = encodeJSON(newContext)
+	if err != nil {
+		return record, false, err
+	}
+
+	if bytes.Equal(originalData, newData) && bytes.Equal(originalContext, contextBytes) {
+		return record, false, nil
+	}
+
+	patched = record
+	patched.Context = newContext
+	patched.Timestamp = time.Now().UTC().Format("2006-01-02 15:04:05")
+
+	// leave the data as it was written, unless it changed
+	if !bytes.Equal(originalData, newData) {
+		patched.Data = json.RawMessage(newData)
+
+		if patched.Hash, err = hashPayload(patched.Data); err != nil {
+			return record, false, err
+		}
+	}
+
+	return patched, true, nil
+
+}
+
+// apply an RFC 7396 json merge patch to a decoded json document
+func mergePatch(target interface{}, patch interface{}) interface{} {
+
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+			continue
+		}
+
+		targetObject[key] = mergePatch(targetObject[key], value)
+	}
+
+	return targetObject
+
+}
+
+// apply RFC 6902 json patch operations to a decoded json document, in order
+// the document may be modified, even if an operation fails
+func applyJSONPatch(document interface{}, operations []jsonPatchOperation) (interface{}, error) {
+
+	for i, operation := range operations {
+		var err error
+
+		if document, err = applyJSONPatchOperation(document, operation); err != nil {
+			return nil, fmt.Errorf("operation %d (%s %s): %w", i, operation.Op, operation.Path, err)
+		}
+	}
+
+	return document, nil
+
+}
+
+func applyJSONPatchOperation(document interface{}, operation jsonPatchOperation) (interface{}, error) {
+
+	path, err := parseJSONPointer(operation.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var value interface{}
+
+	switch operation.Op {
+	case "add", "replace", "test":
+		if operation.Value == nil {
+			return nil, errors.New("missing value")
+		}
+
+		if value, err = decodeJSON(operation.Value); err != nil {
+			return nil, err
+		}
+	}
+
+	switch operation.Op {
+	case "add":
+		return jsonPointerAdd(document, path, value)
+	case "remove":
+		document, _, err = jsonPointerRemove(document, path)
+		return document, err
+	case "replace":
+		if document, _, err = jsonPointerRemove(document, path); err != nil {
+			return nil, err
+		}
+
+		return jsonPointerAdd(document, path, value)
+	case "move", "copy":
+		from, err := parseJSONPointer(operation.From)
+		if err != nil {
+			return nil, err
+		}
+
+		if operation.Op == "copy" {
+			if value, err = jsonPointerGet(document, from); err != nil {
+				return nil, err
+			}
+
+			// copies mustn't share maps or slices with the original
+			b, err := encodeJSON(value)
+			if err != nil {
+				return nil, err
+			}
+
+			if value, err = decodeJSON(b); err != nil {
+				return nil, err
+			}
+		} else {
+			if len(from) < len(path) && reflect.DeepEqual(from, path[:len(from)]) {
+				return nil, errors.New("cannot move a value into itself")
+			}
+
+			if document, value, err = jsonPointerRemove(document, from); err != nil {
+				return nil, err
+			}
+		}
+
+		return jsonPointerAdd(document, path, value)
+	case "test":
+		actual, err := jsonPointerGet(document, path)
+		if err != nil {
+			return nil, err
+		}
+
+		if !jsonEqual(actual, value) {
+			return nil, errPatchTestFailed
+		}
+
+		return document, nil
+	default:
+		return nil, fmt.Errorf("unsupported op '%s'", operation.Op)
+	}
+
+}
+
+// parse an RFC 6901 json pointer into its reference tokens
+func parseJSONPointer(pointer string) ([]string, error) {
+
+	if pointer == "" {
+		return []string{}, nil
+	}
+
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("json pointer %s must start with /", pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+	}
+
+	return tokens, nil
+
+}
+
+// the array index of a reference token; "-" (the end of the array) is only allowed when adding
+func jsonPointerIndex(token string, length int, adding bool) (int, error) {
+
+	if adding && token == "-" {
+		return length, nil
+	}
+
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, fmt.Errorf("invalid array index %s", token)
+	}
+
+	if index > length || (!adding && index == length) {
+		return 0, fmt.Errorf("array index %d out of range", index)
+	}
+
+	return index, nil
+
+}
+
+func jsonPointerGet(document interface{}, path []string) (interface{}, error) {
+
+	for _, token := range path {
+		switch container := document.(type) {
+		case map[string]interface{}:
+			value, ok := container[token]
+			if !ok {
+				return nil, fmt.Errorf("path not found at %s", token)
+			}
+
+			document = value
+		case []interface{}:
+			index, err := jsonPointerIndex(token, len(container), false)
+			if err != nil {
+				return nil, err
+			}
+
+			document = container[index]
+		default:
+			return nil, fmt.Errorf("path not found at %s", token)
+		}
+	}
+
+	return document, nil
+
+}
+
+// add a value at the path, returning the updated document
+func jsonPointerAdd(document interface{}, path []string, value interface{}) (interface{}, error) {
+
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	token := path[0]
+
+	switch container := document.(type) {
+	case map[string]interface{}:
+		if len(path) == 1 {
+			container[token] = value
+			return container, nil
+		}
+
+		child, ok := container[token]
+		if !ok {
+			return nil, fmt.Errorf("path not found at %s", token)
+		}
+
+		child, err := jsonPointerAdd(child, path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+
+		container[token] = child
+
+		return container, nil
+	case []interface{}:
+		index, err := jsonPointerIndex(token, len(container), len(path) == 1)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(path) == 1 {
+			container = append(container, nil)
+			copy(container[index+1:], container[index:])
+			container[index] = value
+			return container, nil
+		}
+
+		if container[index], err = jsonPointerAdd(container[index], path[1:], value); err != nil {
+			return nil, err
+		}
+
+		return container, nil
+	default:
+		return nil, fmt.Errorf("path not found at %s", token)
+	}
+
+}
+
+// remove the value at the path, returning the updated document and the removed value
+func jsonPointerRemove(document interface{}, path []string) (interface{}, interface{}, error) {
+
+	if len(path) == 0 {
+		return nil, document, nil
+	}
+
+	token := path[0]
+
+	switch container := document.(type) {
+	case map[string]interface{}:
+		child, ok := container[token]
+		if !ok {
+			return nil, nil, fmt.Errorf("path not found at %s", token)
+		}
+
+		if len(path) == 1 {
+			delete(container, token)
+			return container, child, nil
+		}
+
+		child, removed, err := jsonPointerRemove(child, path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+
+		container[token] = child
+
+		return container, removed, nil
+	case []interface{}:
+		index, err := jsonPointerIndex(token, len(container), false)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(path) == 1 {
+			removed := container[index]
+			return append(container[:index], container[index+1:]...), removed, nil
+		}
+
+		child, removed, err := jsonPointerRemove(container[index], path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+
+		container[index] = child
+
+		return container, removed, nil
+	default:
+		return nil, nil, fmt.Errorf("path not found at %s", token)
+	}
+
+}
+
+// compare decoded json values, treating numbers as equal if their values are equal
+func jsonEqual(a interface{}, b interface{}) bool {
+
+	switch a := a.(type) {
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+
+		if a == b {
+			return true
+		}
+
+		x, errA := a.Float64()
+		y, errB := b.Float64()
+
+		return errA == nil && errB == nil && x == y
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+
+		for key, value := range a {
+			other, ok := b[key]
+			if !ok || !jsonEqual(value, other) {
+				return false
+			}
+		}
+
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+
+		for i := range a {
+			if !jsonEqual(a[i], b[i]) {
+				return false
+			}
+		}
+
+		return true
+	default:
+		return reflect.DeepEqual(a, b)
+	}
+
+}
+
+// encode json without escaping html, and without a trailing newline
+func encodeJSON(value interface{}) ([]byte, error) {
+
+	buffer := new(bytes.Buffer)
+
+	encoder := json.NewEncoder(buffer)
+	encoder.SetEscapeHTML(false)
+
+	if err := encoder.Encode(value); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimRight(buffer.Bytes(), "\n"), nil
+
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/pdxfixit/hostdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergePatch(t *testing.T) {
+
+	// from RFC 7396, appendix A
+	tests := []struct {
+		target string
+		patch  string
+		result string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+
+	for _, test := range tests {
+		target, _ := decodeJSON([]byte(test.target))
+		patch, _ := decodeJSON([]byte(test.patch))
+
+		result, err := encodeJSON(mergePatch(target, patch))
+		assert.NoError(t, err, test.patch)
+		assert.JSONEq(t, test.result, string(result), "%s + %s", test.target, test.patch)
+	}
+
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+
+	tests := []struct {
+		document string
+		patch    string
+		result   string
+	}{
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`},
+		{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":"baz"}]`, `{"foo":["bar","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`},
+		{`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`},
+		{`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{`{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`},
+		{`{"foo":{"bar":[1]}}`, `[{"op":"copy","from":"/foo/bar","path":"/baz"},{"op":"add","path":"/baz/-","value":2}]`, `{"foo":{"bar":[1]},"baz":[1,2]}`},
+		{`{"baz":"qux","foo":["a",2,"c"]}`, `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2.0}]`, `{"baz":"qux","foo":["a",2,"c"]}`},
+		{`{"a/b":1,"m~n":2}`, `[{"op":"replace","path":"/a~1b","value":3},{"op":"remove","path":"/m~0n"}]`, `{"a/b":3}`},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`, `{"foo":"bar","child":{"grandchild":{}}}`},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":null}]`, `{"foo":"bar","baz":null}`},
+	}
+
+	for _, test := range tests {
+		var operations []jsonPatchOperation
+		if err := json.Unmarshal([]byte(test.patch), &operations); err != nil {
+			t.Fatal(err)
+		}
+
+		document, _ := decodeJSON([]byte(test.document))
+
+		result, err := applyJSONPatch(document, operations)
+		if assert.NoError(t, err, test.patch) {
+			b, _ := encodeJSON(result)
+			assert.JSONEq(t, test.result, string(b), test.patch)
+		}
+	}
+
+	failures := []struct {
+		document string
+		patch    string
+	}{
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`},
+		{`{"foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`},
+		{`{"foo":"bar"}`, `[{"op":"replace","path":"/baz","value":1}]`},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/2","value":"baz"}]`},
+		{`{"foo":["bar"]}`, `[{"op":"remove","path":"/foo/01"}]`},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz"}]`},
+		{`{"foo":"bar"}`, `[{"op":"frobnicate","path":"/foo"}]`},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"foo","value":1}]`},
+		{`{"foo":{"bar":1}}`, `[{"op":"move","from":"/foo","path":"/foo/bar/baz"}]`},
+	}
+
+	for _, test := range failures {
+		var operations []jsonPatchOperation
+		if err := json.Unmarshal([]byte(test.patch), &operations); err != nil {
+			t.Fatal(err)
+		}
+
+		document, _ := decodeJSON([]byte(test.document))
+
+		_, err := applyJSONPatch(document, operations)
+		assert.Error(t, err, test.patch)
+	}
+
+	document, _ := decodeJSON([]byte(`{"baz":"qux"}`))
+	_, err := applyJSONPatch(document, []jsonPatchOperation{{Op: "test", Path: "/baz", Value: json.RawMessage(`"bar"`)}})
+	assert.True(t, errors.Is(err, errPatchTestFailed), "failed test")
+
+}
+
+func TestApplyRecordPatch(t *testing.T) {
+
+	record := hostdb.Record{
+		ID:       "abc123",
+		Type:     "test",
+		Hostname: "foo.pdxfixit.com",
+		Context:  map[string]interface{}{"owner": "alice", "test": true},
+		Data:     json.RawMessage(`{"name":"foo","size":10,"tags":["<a>"]}`),
+		Hash:     "unchanged",
+	}
+
+	// a context change leaves the data, and its hash, alone
+	patched, changed, err := applyRecordPatch(record, "application/merge-patch+json", []byte(`{"context":{"owner":"bob"}}`))
+	if assert.NoError(t, err, "merge patch") {
+		assert.True(t, changed, "merge patch changed")
+		assert.Equal(t, "bob", patched.Context["owner"], "patched context")
+		assert.Equal(t, string(record.Data), string(patched.Data), "data untouched")
+		assert.Equal(t, "unchanged", patched.Hash, "hash untouched")
+	}
+
+	// a data change is rehashed
+	patched, changed, err = applyRecordPatch(record, "application/json-patch+json", []byte(`[{"op":"replace","path":"/data/size","value":20}]`))
+	if assert.NoError(t, err, "json patch") {
+		assert.True(t, changed, "json patch changed")
+		assert.JSONEq(t, `{"name":"foo","size":20,"tags":["<a>"]}`, string(patched.Data), "patched data")
+		assert.Contains(t, string(patched.Data), "<a>", "html isn't escaped")
+
+		hash, _ := hashPayload(patched.Data)
+		assert.Equal(t, hash, patched.Hash, "rehashed")
+	}
+
+	// no difference
+	_, changed, err = applyRecordPatch(record, "application/merge-patch+json", []byte(`{"context":{"owner":"alice"}}`))
+	assert.NoError(t, err, "no-op patch")
+	assert.False(t, changed, "no-op patch")
+
+	statusCode := func(err error) int {
+		if err, ok := err.(hostdb.ErrorResponse); ok {
+			return err.Code
+		}
+
+		return 0
+	}
+
+	_, _, err = applyRecordPatch(record, "application/json", []byte(`{}`))
+	assert.Equal(t, http.StatusUnsupportedMediaType, statusCode(err), "unsupported media type")
+
+	_, _, err = applyRecordPatch(record, "application/merge-patch+json", []byte(`{"hostname":"bar"}`))
+	assert.Equal(t, http.StatusUnprocessableEntity, statusCode(err), "only context and data")
+
+	_, _, err = applyRecordPatch(record, "application/merge-patch+json", []byte(`{"data":null}`))
+	assert.Equal(t, http.StatusUnprocessableEntity, statusCode(err), "data removed")
+
+	_, _, err = applyRecordPatch(record, "application/json-patch+json", []byte(`[{"op":"test","path":"/context/owner","value":"bob"}]`))
+	assert.Equal(t, http.StatusConflict, statusCode(err), "failed test")
+
+	_, _, err = applyRecordPatch(record, "application/json-patch+json", []byte(`{"op":"add"}`))
+	assert.Equal(t, http.StatusBadRequest, statusCode(err), "malformed patch")
+
+}
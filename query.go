@@ -0,0 +1,601 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/pdxfixit/hostdb"
+)
+
+// the _q query language, e.g. (env=prod OR env=stage) AND NOT owner~bob
+//
+//   expr       = term { OR term }
+//   term       = factor { AND factor }
+//   factor     = NOT factor | "(" expr ")" | EXISTS field | comparison
+//   comparison = field ( "=" | "!=" | "~" | "!~" | "<" | "<=" | ">" | ">=" ) value | field [ NOT ] IN "(" value { "," value } ")"
+//
+// keywords aren't case sensitive; a value is a bare word (other than a keyword), a "quoted" or 'quoted' string, or a /regex/ (for ~ and !~)
+// fields are the configured query params, the columns of the hostdb table, and paths into the data or context, e.g. _data.metadata.env
+// <, <=, > and >= compare the timestamp with a timestamp or age, and values in the context or data as numbers; see rangeWhereClause
+
+const (
+	maxQueryLength  = 4096
+	maxQueryDepth   = 32  // how deeply parentheses and NOTs may be nested
+	maxQueryClauses = 256 // once compiled; ORs of ANDs multiply
+)
+
+// the columns of the hostdb table which may be queried by name, when there's no query param of the same name
+var queryColumns = []string{"id", "type", "hostname", "ip", "timestamp", "committer", "hash"}
+
+// the kinds of token in a _q expression
+const (
+	queryTokenEnd = iota
+	queryTokenWord
+	queryTokenString
+	queryTokenRegex
+	queryTokenOperator
+	queryTokenOpen
+	queryTokenClose
+	queryTokenComma
+)
+
+type queryToken struct {
+	kind int
+	text string // a string or regex without its quotes or slashes, and with escapes resolved
+	pos  int    // of the token's first character, counting from 1
+}
+
+// a node of a parsed _q expression
+type queryNode struct {
+	op       string // and, or, not, =, ~, <, <=, >, >=, in or exists; != and !~ are parsed as not
+	children []*queryNode
+	field    string
+	keys     []string // where the field is found
+	values   []string
+	pos      int
+}
+
+// a compiled expression; the clauses of each group are ORed, and the groups are ANDed
+type queryCNF [][]hostdb.MariadbWhereClause
+
+type queryParser struct {
+	tokens []queryToken
+	next   int
+	depth  int
+}
+
+// parse a _q expression, and compile it into WHERE clause groups which are ANDed together
+func parseQuery(query string) ([]hostdb.MariadbWhereGrouping, error) {
+
+	if strings.TrimSpace(query) == "" {
+		return nil, queryError(0, "_q must not be empty")
+	}
+
+	if len(query) > maxQueryLength {
+		return nil, queryError(0, fmt.Sprintf("_q must not be longer than %d characters", maxQueryLength))
+	}
+
+	tokens, err := tokenizeQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	p := queryParser{tokens: tokens}
+
+	node, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+
+	if token := p.peek(); token.kind != queryTokenEnd {
+		return nil, p.unexpected(token, "AND, OR or the end of the query")
+	}
+
+	cnf, err := node.compile(false)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make([]hostdb.MariadbWhereGrouping, 0, len(cnf))
+	for _, clauses := range cnf {
+		relativity := "AND"
+		if len(clauses) > 1 {
+			relativity = "OR"
+		}
+
+		for i := range clauses {
+			clauses[i].Relativity = relativity
+		}
+
+		groups = append(groups, hostdb.MariadbWhereGrouping{Clauses: clauses})
+	}
+
+	return groups, nil
+
+}
+
+// a 400, saying where in the query the problem is
+func queryError(pos int, message string) error {
+
+	if pos > 0 {
+		message = fmt.Sprintf("at position %d of _q: %s", pos, message)
+	}
+
+	return hostdb.ErrorResponse{
+		Code:    http.StatusBadRequest,
+		Message: message,
+	}
+
+}
+
+// split a _q expression into tokens
+func tokenizeQuery(query string) (tokens []queryToken, err error) {
+
+	runes := []rune(query)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		pos := i + 1
+
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, queryToken{kind: queryTokenOpen, text: "(", pos: pos})
+			i++
+		case r == ')':
+			tokens = append(tokens, queryToken{kind: queryTokenClose, text: ")", pos: pos})
+			i++
+		case r == ',':
+			tokens = append(tokens, queryToken{kind: queryTokenComma, text: ",", pos: pos})
+			i++
+		case r == '=' || r == '~':
+			tokens = append(tokens, queryToken{kind: queryTokenOperator, text: string(r), pos: pos})
+			i++
+		case r == '<' || r == '>':
+			operator := string(r)
+			if i+1 < len(runes) && runes[i+1] == '=' {
+				operator += "="
+			}
+			tokens = append(tokens, queryToken{kind: queryTokenOperator, text: operator, pos: pos})
+			i += len(operator)
+		case r == '!':
+			if i+1 >= len(runes) || (runes[i+1] != '=' && runes[i+1] != '~') {
+				return nil, queryError(pos, "expected != or !~")
+			}
+			tokens = append(tokens, queryToken{kind: queryTokenOperator, text: string(runes[i : i+2]), pos: pos})
+			i += 2
+		case r == '"' || r == '\'' || r == '/':
+			// quoted strings and regexes run to the next unescaped quote or slash
+			kind := queryTokenString
+			if r == '/' {
+				kind = queryTokenRegex
+			}
+
+			var text []rune
+			closed := false
+
+			for i++; i < len(runes); i++ {
+				if runes[i] == '\\' && i+1 < len(runes) && (runes[i+1] == r || (runes[i+1] == '\\' && kind == queryTokenString)) {
+					// a regex keeps its other escapes, which mean something to it
+					i++
+				} else if runes[i] == r {
+					closed = true
+					i++
+					break
+				}
+
+				text = append(text, runes[i])
+			}
+
+			if !closed {
+				return nil, queryError(pos, fmt.Sprintf("unterminated %c", r))
+			}
+
+			tokens = append(tokens, queryToken{kind: kind, text: string(text), pos: pos})
+		default:
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && !strings.ContainsRune(`()=!~<>,"'`, runes[i]) {
+				i++
+			}
+
+			tokens = append(tokens, queryToken{kind: queryTokenWord, text: string(runes[start:i]), pos: pos})
+		}
+	}
+
+	return append(tokens, queryToken{kind: queryTokenEnd, pos: len(runes) + 1}), nil
+
+}
+
+func (p *queryParser) peek() queryToken {
+
+	return p.tokens[p.next]
+
+}
+
+func (p *queryParser) take() queryToken {
+
+	token := p.tokens[p.next]
+	if token.kind != queryTokenEnd {
+		p.next++
+	}
+
+	return token
+
+}
+
+// whether the next token is the keyword, in which case it's taken
+func (p *queryParser) keyword(keyword string) bool {
+
+	if token := p.peek(); token.kind == queryTokenWord && strings.EqualFold(token.text, keyword) {
+		p.next++
+		return true
+	}
+
+	return false
+
+}
+
+// an error for a token which isn't what was expected
+func (p *queryParser) unexpected(token queryToken, expected string) error {
+
+	if token.kind == queryTokenEnd {
+		return queryError(token.pos, fmt.Sprintf("expected %s, but the query ended", expected))
+	}
+
+	return queryError(token.pos, fmt.Sprintf("expected %s, but found '%s'", expected, token.text))
+
+}
+
+func (p *queryParser) expr() (*queryNode, error) {
+
+	node, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.keyword("OR") {
+		right, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+
+		node = &queryNode{op: "or", children: []*queryNode{node, right}, pos: node.pos}
+	}
+
+	return node, nil
+
+}
+
+func (p *queryParser) term() (*queryNode, error) {
+
+	node, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.keyword("AND") {
+		right, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+
+		node = &queryNode{op: "and", children: []*queryNode{node, right}, pos: node.pos}
+	}
+
+	return node, nil
+
+}
+
+func (p *queryParser) factor() (*queryNode, error) {
+
+	token := p.peek()
+
+	p.depth++
+	defer func() { p.depth-- }()
+
+	if p.depth > maxQueryDepth {
+		return nil, queryError(token.pos, fmt.Sprintf("_q must not be nested more than %d deep", maxQueryDepth))
+	}
+
+	switch {
+	case p.keyword("NOT"):
+		node, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+
+		return &queryNode{op: "not", children: []*queryNode{node}, pos: token.pos}, nil
+	case token.kind == queryTokenOpen:
+		p.take()
+
+		node, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+
+		if closing := p.take(); closing.kind != queryTokenClose {
+			return nil, p.unexpected(closing, fmt.Sprintf("AND, OR or ')' to close the '(' at position %d", token.pos))
+		}
+
+		return node, nil
+	case p.keyword("EXISTS"):
+		node, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+
+		node.op = "exists"
+		node.pos = token.pos
+
+		return node, nil
+	}
+
+	return p.comparison()
+
+}
+
+// a field, by the name of a query param or column
+func (p *queryParser) field() (*queryNode, error) {
+
+	token := p.take()
+
+	if token.kind != queryTokenWord || isQueryKeyword(token.text) {
+		return nil, p.unexpected(token, "a field")
+	}
+
+	node := &queryNode{field: token.text, pos: token.pos}
+
+	if param, ok := config.API.V0.QueryParams[token.text]; ok {
+		node.keys = queryParamKeys(param)
+	} else if strings.HasPrefix(token.text, "_data.") || strings.HasPrefix(token.text, "_context.") {
+		// an ad-hoc path into the data or context
+		param, err := adhocQueryParam(token.text[1:])
+		if response, ok := err.(hostdb.ErrorResponse); ok {
+			return nil, queryError(token.pos, response.Message)
+		} else if err != nil {
+			return nil, err
+		}
+
+		node.keys = queryParamKeys(param)
+	} else {
+		for _, column := range queryColumns {
+			if column == token.text {
+				node.keys = []string{column}
+			}
+		}
+	}
+
+	if len(node.keys) < 1 {
+		return nil, queryError(token.pos, fmt.Sprintf("unknown field '%s'; fields are the query params listed at /v0/config, %s, and paths like _data.metadata.env",
+			token.text, strings.Join(queryColumns, ", ")))
+	}
+
+	return node, nil
+
+}
+
+func (p *queryParser) comparison() (*queryNode, error) {
+
+	node, err := p.field()
+	if err != nil {
+		return nil, err
+	}
+
+	negated := false
+	operator := p.peek()
+
+	switch {
+	case operator.kind == queryTokenOperator:
+		p.take()
+
+		node.op = strings.TrimPrefix(operator.text, "!")
+		negated = operator.text[0] == '!'
+
+		value := p.take()
+		switch {
+		case value.kind == queryTokenRegex && node.op != "~":
+			return nil, queryError(value.pos, "a /regex/ must be compared with ~ or !~")
+		case value.kind != queryTokenWord && value.kind != queryTokenString && value.kind != queryTokenRegex,
+			value.kind == queryTokenWord && isQueryKeyword(value.text):
+			return nil, p.unexpected(value, fmt.Sprintf("a value after '%s'", operator.text))
+		}
+
+		node.values = []string{value.text}
+	case p.keyword("NOT"):
+		if !p.keyword("IN") {
+			return nil, p.unexpected(p.peek(), "IN after NOT")
+		}
+		negated = true
+		fallthrough
+	case p.keyword("IN"):
+		node.op = "in"
+
+		if open := p.take(); open.kind != queryTokenOpen {
+			return nil, p.unexpected(open, "'(' after IN")
+		}
+
+		for {
+			value := p.take()
+			if value.kind != queryTokenString && (value.kind != queryTokenWord || isQueryKeyword(value.text)) {
+				return nil, p.unexpected(value, "a value")
+			}
+
+			node.values = append(node.values, value.text)
+
+			if next := p.take(); next.kind == queryTokenClose {
+				break
+			} else if next.kind != queryTokenComma {
+				return nil, p.unexpected(next, "',' or ')'")
+			}
+		}
+	default:
+		return nil, p.unexpected(operator, fmt.Sprintf("=, !=, ~, !~, <, <=, >, >= or IN after '%s'", node.field))
+	}
+
+	if negated {
+		return &queryNode{op: "not", children: []*queryNode{node}, pos: node.pos}, nil
+	}
+
+	return node, nil
+
+}
+
+// whether a key is a column, rather than a value within the context or data
+func isQueryColumn(key string) bool {
+
+	return !strings.HasPrefix(key, "json_value(")
+
+}
+
+func isQueryKeyword(word string) bool {
+
+	for _, keyword := range []string{"AND", "OR", "NOT", "IN", "EXISTS"} {
+		if strings.EqualFold(word, keyword) {
+			return true
+		}
+	}
+
+	return false
+
+}
+
+// compile a node into groups of clauses, pushing any NOTs down to the comparisons
+func (n *queryNode) compile(negated bool) (queryCNF, error) {
+
+	switch n.op {
+	case "not":
+		return n.children[0].compile(!negated)
+	case "and", "or":
+		left, err := n.children[0].compile(negated)
+		if err != nil {
+			return nil, err
+		}
+
+		right, err := n.children[1].compile(negated)
+		if err != nil {
+			return nil, err
+		}
+
+		// NOT (a AND b) is NOT a OR NOT b, and vice versa
+		if (n.op == "and") != negated {
+			return append(left, right...), nil
+		}
+
+		// (a AND b) OR (c AND d) is (a OR c) AND (a OR d) AND (b OR c) AND (b OR d)
+		var cnf queryCNF
+		clauses := 0
+		for _, l := range left {
+			for _, r := range right {
+				clauses += len(l) + len(r)
+				if clauses > maxQueryClauses {
+					return nil, queryError(n.pos, "_q is too complex; try fewer ORs of ANDs, e.g. by using IN")
+				}
+
+				cnf = append(cnf, append(append([]hostdb.MariadbWhereClause{}, l...), r...))
+			}
+		}
+
+		return cnf, nil
+	}
+
+	return n.comparison(negated)
+
+}
+
+// the opposites of the range comparisons, for NOT
+var queryRangeOpposites = map[string]string{"<": ">=", "<=": ">", ">": "<=", ">=": "<"}
+
+// the groups of clauses for a comparison; a field with more than one key matches if any of them does
+// a negated comparison also matches records which don't have the field
+func (n *queryNode) comparison(negated bool) (queryCNF, error) {
+
+	clause := func(key string, operator string, values ...string) hostdb.MariadbWhereClause {
+		return hostdb.MariadbWhereClause{Key: []string{key}, Operator: operator, Value: values}
+	}
+
+	// or missing, for a negated comparison; columns are never null
+	missing := func(key string, clauses ...hostdb.MariadbWhereClause) []hostdb.MariadbWhereClause {
+		if isQueryColumn(key) {
+			return clauses
+		}
+		return append(clauses, clause(key, "IS NULL"))
+	}
+
+	// ip addresses and cidr ranges match any of a record's addresses
+	if len(n.keys) == 1 && n.keys[0] == "ip" && (n.op == "=" || n.op == "in") {
+		if ipClause, ok := ipWhereClause(n.values, negated); ok {
+			return queryCNF{{ipClause}}, nil
+		}
+	}
+
+	// ranges are typed by their keys; e.g. NOT ram > 16 is ram <= 16, or no ram
+	if opposite, ok := queryRangeOpposites[n.op]; ok {
+		operator := n.op
+		if negated {
+			operator = opposite
+		}
+
+		var cnf queryCNF
+		var either []hostdb.MariadbWhereClause
+
+		for _, key := range n.keys {
+			rangeClause, err := rangeWhereClause([]string{key}, rangeBound{operator: operator, value: n.values[0]})
+			if response, ok := err.(hostdb.ErrorResponse); ok {
+				return nil, queryError(n.pos, response.Message)
+			} else if err != nil {
+				return nil, err
+			}
+
+			if negated {
+				cnf = append(cnf, missing(key, rangeClause))
+			} else {
+				either = append(either, rangeClause)
+			}
+		}
+
+		if len(either) > 0 {
+			cnf = append(cnf, either)
+		}
+
+		return cnf, nil
+	}
+
+	var cnf queryCNF
+	var either []hostdb.MariadbWhereClause
+
+	for _, key := range n.keys {
+		switch {
+		case n.op == "exists" && isQueryColumn(key) && !negated:
+			either = append(either, clause(key, "!=", ""))
+		case n.op == "exists" && isQueryColumn(key):
+			cnf = append(cnf, []hostdb.MariadbWhereClause{clause(key, "=", "")})
+		case n.op == "exists" && !negated:
+			either = append(either, clause(key, "IS NOT NULL"))
+		case n.op == "exists":
+			cnf = append(cnf, []hostdb.MariadbWhereClause{clause(key, "IS NULL")})
+		case n.op == "~" && !negated:
+			either = append(either, clause(key, "RLIKE", n.values...))
+		case n.op == "~":
+			cnf = append(cnf, missing(key, clause(key, "NOT RLIKE", n.values...)))
+		case n.op == "in" && !negated && len(n.values) > 1:
+			either = append(either, clause(key, "IN", n.values...))
+		case !negated:
+			either = append(either, clause(key, "=", n.values...))
+		default:
+			// NOT IN is != each of the values
+			for _, value := range n.values {
+				cnf = append(cnf, missing(key, clause(key, "!=", value)))
+			}
+		}
+	}
+
+	if len(either) > 0 {
+		cnf = append(cnf, either)
+	}
+
+	return cnf, nil
+
+}
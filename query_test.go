@@ -0,0 +1,171 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pdxfixit/hostdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseQuery(t *testing.T) {
+
+	saved := config.API.V0.QueryParams
+	defer func() { config.API.V0.QueryParams = saved }()
+	config.API.V0.QueryParams = map[string]map[string]hostdb.APIv0QueryParam{
+		"env":   {"openstack": {Context: ".env"}},
+		"owner": {"openstack": {Data: ".metadata.owner"}, "aws": {Context: ".owner"}},
+		"name":  {"openstack": {Table: "hostname"}},
+	}
+
+	env := "json_value(context, '$.env') "
+	ownerKeys := queryParamKeys(config.API.V0.QueryParams["owner"])
+
+	clause := func(relativity string, key string, operator string, values ...string) hostdb.MariadbWhereClause {
+		if values == nil {
+			values = []string{}
+		}
+		return hostdb.MariadbWhereClause{Relativity: relativity, Key: []string{key}, Operator: operator, Value: values}
+	}
+
+	parse := func(query string) []hostdb.MariadbWhereGrouping {
+		groups, err := parseQuery(query)
+		if !assert.NoError(t, err, query) {
+			return nil
+		}
+		for i := range groups {
+			for j := range groups[i].Clauses {
+				if groups[i].Clauses[j].Value == nil {
+					groups[i].Clauses[j].Value = []string{}
+				}
+			}
+		}
+		return groups
+	}
+
+	group := func(clauses ...hostdb.MariadbWhereClause) hostdb.MariadbWhereGrouping {
+		return hostdb.MariadbWhereGrouping{Clauses: clauses}
+	}
+
+	assert.Equal(t, []hostdb.MariadbWhereGrouping{group(clause("AND", env, "=", "prod"))}, parse("env=prod"), "comparison")
+	assert.Equal(t, []hostdb.MariadbWhereGrouping{group(clause("AND", "hostname", "=", "web 1"))}, parse(`name = "web 1"`), "table param")
+	assert.Equal(t, []hostdb.MariadbWhereGrouping{group(clause("AND", "type", "RLIKE", "^open"))}, parse(`type ~ /^open/`), "column and regex")
+
+	// ORs within a group, and ANDs between groups
+	assert.Equal(t, []hostdb.MariadbWhereGrouping{
+		group(clause("OR", env, "=", "prod"), clause("OR", env, "=", "stage")),
+		group(clause("OR", "type", "=", "openstack"), clause("OR", "type", "=", "aws")),
+	}, parse("(env=prod or env=stage) AND (type=openstack OR type=aws)"), "and of ors")
+
+	// ANDs are distributed over ORs
+	assert.Equal(t, []hostdb.MariadbWhereGrouping{
+		group(clause("OR", env, "=", "prod"), clause("OR", "type", "=", "aws")),
+		group(clause("OR", "hostname", "=", "web"), clause("OR", "type", "=", "aws")),
+	}, parse("env=prod AND name=web OR type=aws"), "AND binds tighter than OR")
+
+	// NOT is pushed down to the comparisons, which then match records without the field too
+	assert.Equal(t, []hostdb.MariadbWhereGrouping{
+		group(clause("OR", env, "!=", "prod"), clause("OR", env, "IS NULL")),
+		group(clause("OR", env, "!=", "stage"), clause("OR", env, "IS NULL")),
+	}, parse("NOT (env=prod OR env=stage)"), "de morgan")
+	assert.Equal(t, parse("NOT (env=prod OR env=stage)"), parse("env != prod AND env!=stage"), "!=")
+	assert.Equal(t, parse("NOT (env=prod OR env=stage)"), parse("env NOT IN (prod, stage)"), "NOT IN")
+	assert.Equal(t, parse("env=prod"), parse("NOT NOT env=prod"), "double negative")
+	assert.Equal(t, []hostdb.MariadbWhereGrouping{group(clause("AND", "hostname", "!=", "web"))}, parse("name != web"), "columns are never null")
+
+	assert.Equal(t, []hostdb.MariadbWhereGrouping{group(clause("AND", env, "IN", "prod", "stage"))}, parse("env IN (prod, 'stage')"), "IN")
+	assert.Equal(t, []hostdb.MariadbWhereGrouping{group(clause("AND", env, "=", "prod"))}, parse("env in (prod)"), "IN one value")
+
+	// a param with several keys matches if any of them does
+	if assert.Len(t, ownerKeys, 2, "owner keys") {
+		assert.Equal(t, []hostdb.MariadbWhereGrouping{
+			group(clause("OR", ownerKeys[0], "RLIKE", "bob"), clause("OR", ownerKeys[1], "RLIKE", "bob")),
+		}, parse("owner ~ bob"), "any key")
+		assert.Equal(t, []hostdb.MariadbWhereGrouping{
+			group(clause("OR", ownerKeys[0], "NOT RLIKE", "bob"), clause("OR", ownerKeys[0], "IS NULL")),
+			group(clause("OR", ownerKeys[1], "NOT RLIKE", "bob"), clause("OR", ownerKeys[1], "IS NULL")),
+		}, parse("owner !~ bob"), "no key")
+	}
+
+	// ranges compare numbers in the context or data, and timestamps
+	envNumber := "CAST(json_value(context, '$.env') AS DECIMAL(65,10)) "
+	assert.Equal(t, []hostdb.MariadbWhereGrouping{group(clause("AND", envNumber, ">", "16"))}, parse("env>16"), "range")
+	assert.Equal(t, []hostdb.MariadbWhereGrouping{
+		group(clause("OR", envNumber, "<", "16"), clause("OR", env, "IS NULL")),
+	}, parse("NOT env >= 16"), "not range")
+	assert.Equal(t, []hostdb.MariadbWhereGrouping{
+		group(clause("AND", "timestamp", ">=", "2020-05-02 20:09:26")),
+		group(clause("AND", "timestamp", "<", "2020-05-03 00:00:00")),
+	}, parse("timestamp >= '2020-05-02 20:09:26' AND timestamp < 2020-05-03T00:00:00Z"), "timestamp range")
+
+	// paths into the data or context needn't be configured
+	assert.Equal(t, []hostdb.MariadbWhereGrouping{group(clause("AND", "json_value(data, '$.metadata.owner') ", "=", "bob"))}, parse("_data.metadata.owner = bob"), "data path")
+	assert.Equal(t, []hostdb.MariadbWhereGrouping{group(clause("AND", "json_value(context, '$.tags[0]') ", "IS NOT NULL"))}, parse("EXISTS _context.tags[0]"), "context path")
+
+	assert.Equal(t, []hostdb.MariadbWhereGrouping{group(clause("AND", env, "IS NOT NULL"))}, parse("EXISTS env"), "exists")
+	assert.Equal(t, []hostdb.MariadbWhereGrouping{group(clause("AND", env, "IS NULL"))}, parse("NOT EXISTS env"), "doesn't exist")
+	assert.Equal(t, []hostdb.MariadbWhereGrouping{group(clause("AND", "hostname", "!=", ""))}, parse("exists name"), "column exists")
+
+	// quoting
+	assert.Equal(t, []hostdb.MariadbWhereGrouping{group(clause("AND", env, "=", `it's "quoted"`))}, parse(`env = 'it\'s "quoted"'`), "escaped quote")
+	assert.Equal(t, []hostdb.MariadbWhereGrouping{group(clause("AND", env, "RLIKE", `a/b\.c`))}, parse(`env ~ /a\/b\.c/`), "regex escapes")
+	assert.Equal(t, []hostdb.MariadbWhereGrouping{group(clause("AND", env, "=", "AND"))}, parse(`env = "AND"`), "quoted keyword")
+
+	// ip addresses and cidr ranges match any of a record's addresses
+	if groups := parse("ip = 10.0.0.0/8"); assert.Len(t, groups, 1, "ip") {
+		assert.Contains(t, groups[0].Clauses[0].Key[0], "hostdb_ips", "ip")
+		assert.Equal(t, "IS NOT NULL", groups[0].Clauses[0].Operator, "ip")
+	}
+	if groups := parse("NOT ip IN (10.0.0.0/8, 192.168.1.1)"); assert.Len(t, groups, 1, "not ip") {
+		assert.Equal(t, "IS NULL", groups[0].Clauses[0].Operator, "not ip")
+	}
+
+}
+
+func TestParseQueryErrors(t *testing.T) {
+
+	for query, message := range map[string]string{
+		"":                      "_q must not be empty",
+		"env=":                  "at position 5 of _q: expected a value after '=', but the query ended",
+		"env= AND type=aws":     "at position 6 of _q: expected a value after '=', but found 'AND'",
+		"env IN (prod, or)":     "at position 15 of _q: expected a value, but found 'or'",
+		"env prod":              "at position 5 of _q: expected =, !=, ~, !~, <, <=, >, >= or IN after 'env', but found 'prod'",
+		"(env=prod":             "at position 10 of _q: expected AND, OR or ')' to close the '(' at position 1, but the query ended",
+		"env=prod)":             "at position 9 of _q: expected AND, OR or the end of the query, but found ')'",
+		"env=prod type=aws":     "at position 10 of _q: expected AND, OR or the end of the query, but found 'type'",
+		"nope=1":                "at position 1 of _q: unknown field 'nope'; fields are the query params listed at /v0/config, id, type, hostname, ip, timestamp, committer, hash, and paths like _data.metadata.env",
+		"env = /prod/":          "at position 7 of _q: a /regex/ must be compared with ~ or !~",
+		"env ~ /prod":           "at position 7 of _q: unterminated /",
+		`env = "prod`:           `at position 7 of _q: unterminated "`,
+		"env ! prod":            "at position 5 of _q: expected != or !~",
+		"env IN prod":           "at position 8 of _q: expected '(' after IN, but found 'prod'",
+		"env IN (prod stage)":   "at position 14 of _q: expected ',' or ')', but found 'stage'",
+		"env NOT prod":          "at position 9 of _q: expected IN after NOT, but found 'prod'",
+		"AND env=prod":          "at position 1 of _q: expected a field, but found 'AND'",
+		"env=prod AND":          "at position 13 of _q: expected a field, but the query ended",
+		"EXISTS (env)":          "at position 8 of _q: expected a field, but found '('",
+		"NOT":                   "at position 4 of _q: expected a field, but the query ended",
+		"env=prod OR OR env=qa": "at position 13 of _q: expected a field, but found 'OR'",
+		"env > big":             "at position 1 of _q: 'big' is not a number; only numbers may be compared with >",
+		"hostname <= web":       "at position 1 of _q: <= may only be used with the timestamp, or with numbers in the context or data",
+		"env < /1/":             "at position 7 of _q: a /regex/ must be compared with ~ or !~",
+		"_data.* = 1":           "at position 1 of _q: 'data.*' is not a valid path into the data or context; json path .*: wildcards can't be used here",
+	} {
+		_, err := parseQuery(query)
+		if assert.Error(t, err, query) {
+			assert.Equal(t, message, err.(hostdb.ErrorResponse).Message, query)
+		}
+	}
+
+	// nesting and complexity are limited
+	deep := ""
+	for i := 0; i < maxQueryDepth; i++ {
+		deep += "("
+	}
+	_, err := parseQuery(deep + "type=aws")
+	assert.Error(t, err, "too deep")
+
+	ands := "(type=a AND type=b AND type=c AND type=d)"
+	_, err = parseQuery(ands + " OR " + ands + " OR " + ands + " OR " + ands + " OR " + ands)
+	assert.Error(t, err, "too complex")
+
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pdxfixit/hostdb"
+)
+
+// range filters compare the timestamp column, or numeric values in the context or data, e.g. ram=>:16 or timestamp=between:2020-01-01T00:00:00Z..7d
+var rangePrefixes = []struct {
+	prefix   string
+	operator string
+}{
+	{">=:", ">="},
+	{"<=:", "<="},
+	{">:", ">"},
+	{"<:", "<"},
+}
+
+// between:LOW..HIGH is inclusive of both
+const (
+	rangeBetweenPrefix    = "between:"
+	rangeBetweenSeparator = ".."
+)
+
+// the numbers a range filter on the context or data may be compared with; no hex, infinities or NaN
+var rangeNumber = regexp.MustCompile(`^[-+]?([0-9]+\.?[0-9]*|\.[0-9]+)([eE][-+]?[0-9]+)?$`)
+
+// an age, e.g. 7d or 36h, which is a timestamp that long ago
+var rangeAgeDays = regexp.MustCompile(`^([0-9]+)d$`)
+
+// one end of a range
+type rangeBound struct {
+	operator string
+	value    string
+}
+
+// parse the value of a range filter; ok is false if the value isn't one, and should be compared as usual
+func parseRangeFilter(value string) (bounds []rangeBound, ok bool, err error) {
+
+	if strings.HasPrefix(value, rangeBetweenPrefix) {
+		between := strings.Split(strings.TrimPrefix(value, rangeBetweenPrefix), rangeBetweenSeparator)
+		if len(between) != 2 || strings.TrimSpace(between[0]) == "" || strings.TrimSpace(between[1]) == "" {
+			return nil, true, hostdb.ErrorResponse{
+				Code:    http.StatusBadRequest,
+				Message: fmt.Sprintf("'%s' is not a valid range; use %sLOW%sHIGH", value, rangeBetweenPrefix, rangeBetweenSeparator),
+			}
+		}
+
+		return []rangeBound{{">=", between[0]}, {"<=", between[1]}}, true, nil
+	}
+
+	for _, r := range rangePrefixes {
+		if strings.HasPrefix(value, r.prefix) {
+			if strings.TrimSpace(value[len(r.prefix):]) == "" {
+				return nil, true, hostdb.ErrorResponse{
+					Code:    http.StatusBadRequest,
+					Message: fmt.Sprintf("expected a value after '%s'", r.prefix),
+				}
+			}
+
+			return []rangeBound{{r.operator, value[len(r.prefix):]}}, true, nil
+		}
+	}
+
+	return nil, false, nil
+
+}
+
+// the clause comparing keys with one end of a range, typed by the keys:
+// the timestamp column is compared with a timestamp, and values in the context or data are compared as numbers
+func rangeWhereClause(keys []string, bound rangeBound) (clause hostdb.MariadbWhereClause, err error) {
+
+	value := strings.TrimSpace(bound.value)
+	typed := make([]string, 0, len(keys))
+
+	for _, key := range keys {
+		switch {
+		case strings.TrimSpace(key) == "timestamp":
+			timestamp, err := parseRangeTimestamp(value, time.Now())
+			if err != nil {
+				return clause, hostdb.ErrorResponse{
+					Code:    http.StatusBadRequest,
+					Message: err.Error(),
+				}
+			}
+
+			value = timestamp.Format(storedTimestampFormat)
+			typed = append(typed, "timestamp")
+		case !isQueryColumn(key):
+			if !rangeNumber.MatchString(value) {
+				return clause, hostdb.ErrorResponse{
+					Code:    http.StatusBadRequest,
+					Message: fmt.Sprintf("'%s' is not a number; only numbers may be compared with %s", value, bound.operator),
+				}
+			}
+
+			typed = append(typed, fmt.Sprintf("CAST(%s AS DECIMAL(65,10)) ", strings.TrimSpace(key)))
+		default:
+			return clause, hostdb.ErrorResponse{
+				Code:    http.StatusBadRequest,
+				Message: fmt.Sprintf("%s may only be used with the timestamp, or with numbers in the context or data", bound.operator),
+			}
+		}
+	}
+
+	return hostdb.MariadbWhereClause{
+		Relativity: "AND",
+		Key:        typed,
+		Operator:   bound.operator,
+		Value:      []string{value},
+	}, nil
+
+}
+
+// parse a timestamp, or an age such as 7d or 36h, which is the time that long before now
+func parseRangeTimestamp(value string, now time.Time) (time.Time, error) {
+
+	value = strings.TrimSpace(value)
+
+	timestamp, err := parseTimestamp(value)
+	if err == nil {
+		return timestamp, nil
+	}
+
+	// a number is epoch seconds, and never an age; e.g. 0 is out of range, rather than now
+	if rangeNumber.MatchString(value) {
+		return time.Time{}, err
+	}
+
+	if match := rangeAgeDays.FindStringSubmatch(value); match != nil {
+		if days, err := strconv.Atoi(match[1]); err == nil {
+			return now.AddDate(0, 0, -days).UTC(), nil
+		}
+	}
+
+	if age, err := time.ParseDuration(value); err == nil && age >= 0 {
+		return now.Add(-age).UTC(), nil
+	}
+
+	return time.Time{}, fmt.Errorf("'%s' is not a valid timestamp; use RFC 3339, epoch seconds, %s, or an age such as 7d or 36h", value, storedTimestampFormat)
+
+}
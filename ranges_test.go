@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pdxfixit/hostdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRangeFilter(t *testing.T) {
+
+	for value, expected := range map[string][]rangeBound{
+		">:16":           {{">", "16"}},
+		">=:16":          {{">=", "16"}},
+		"<:7d":           {{"<", "7d"}},
+		"<=:-1.5":        {{"<=", "-1.5"}},
+		"between:8..16":  {{">=", "8"}, {"<=", "16"}},
+		"between:.5..1":  {{">=", ".5"}, {"<=", "1"}},
+		"between:1d..2h": {{">=", "1d"}, {"<=", "2h"}},
+	} {
+		bounds, ok, err := parseRangeFilter(value)
+		assert.NoError(t, err, value)
+		assert.True(t, ok, value)
+		assert.Equal(t, expected, bounds, value)
+	}
+
+	for _, value := range []string{"16", "/^>:/", "prod", ":>16", ""} {
+		_, ok, err := parseRangeFilter(value)
+		assert.NoError(t, err, value)
+		assert.False(t, ok, value)
+	}
+
+	for _, value := range []string{">:", ">=: ", "between:8", "between:8..", "between:1..2..3"} {
+		_, ok, err := parseRangeFilter(value)
+		assert.Error(t, err, value)
+		assert.True(t, ok, value)
+	}
+
+}
+
+func TestRangeWhereClause(t *testing.T) {
+
+	ram := "json_value(data, '$.ram') "
+
+	clause, err := rangeWhereClause([]string{ram}, rangeBound{">", " 16"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, hostdb.MariadbWhereClause{
+			Relativity: "AND",
+			Key:        []string{"CAST(json_value(data, '$.ram') AS DECIMAL(65,10)) "},
+			Operator:   ">",
+			Value:      []string{"16"},
+		}, clause, "numbers")
+	}
+
+	clause, err = rangeWhereClause([]string{"timestamp"}, rangeBound{"<=", "2020-05-02T13:09:26-07:00"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"timestamp"}, clause.Key, "timestamp")
+		assert.Equal(t, []string{"2020-05-02 20:09:26"}, clause.Value, "timestamps are stored in utc")
+	}
+
+	for _, value := range []string{"16GB", "0x10", "NaN", "Inf", "1e", ""} {
+		_, err := rangeWhereClause([]string{ram}, rangeBound{">", value})
+		assert.Error(t, err, value)
+	}
+
+	_, err = rangeWhereClause([]string{"timestamp"}, rangeBound{">", "yesterday"})
+	assert.Error(t, err, "not a timestamp")
+
+	_, err = rangeWhereClause([]string{"hostname"}, rangeBound{">", "a"})
+	assert.Error(t, err, "only the timestamp column")
+
+}
+
+func TestParseRangeTimestamp(t *testing.T) {
+
+	now := time.Date(2020, 5, 9, 20, 9, 26, 0, time.UTC)
+
+	for value, expected := range map[string]time.Time{
+		"7d":                   time.Date(2020, 5, 2, 20, 9, 26, 0, time.UTC),
+		"36h":                  time.Date(2020, 5, 8, 8, 9, 26, 0, time.UTC),
+		"1h30m":                time.Date(2020, 5, 9, 18, 39, 26, 0, time.UTC),
+		"2020-05-02 20:09:26":  time.Date(2020, 5, 2, 20, 9, 26, 0, time.UTC),
+		"2020-05-02T20:09:26Z": time.Date(2020, 5, 2, 20, 9, 26, 0, time.UTC),
+		"1588450166":           time.Date(2020, 5, 2, 20, 9, 26, 0, time.UTC),
+	} {
+		timestamp, err := parseRangeTimestamp(value, now)
+		if assert.NoError(t, err, value) {
+			assert.Equal(t, expected, timestamp, value)
+		}
+	}
+
+	for _, value := range []string{"-7d", "-1h", "7 days", "d", "", "0", "2020", "1588450166000"} {
+		_, err := parseRangeTimestamp(value, now)
+		assert.Error(t, err, value)
+	}
+
+}
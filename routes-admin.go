@@ -1,11 +1,119 @@
 package main
 
 import (
+	"fmt"
+	"log"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/pdxfixit/hostdb"
 )
 
+// query the audit log, optionally filtered by principal, action and time
+func getAudit(c *gin.Context) {
+
+	// timer
+	start := time.Now()
+
+	where := hostdb.MariadbWhereClauses{
+		Groups: []hostdb.MariadbWhereGrouping{},
+	}
+
+	limit := hostdb.MariadbLimit{
+		Limit: config.API.V0.DefaultLimit,
+	}
+
+	for key, values := range c.Request.URL.Query() {
+		switch key {
+		case "_limit", "_offset":
+			i, err := strconv.Atoi(values[0])
+			if err != nil || i < 0 {
+				c.AbortWithStatusJSON(http.StatusBadRequest, hostdb.GenericError{
+					Error: fmt.Sprintf("%s parameter must be a positive integer", key),
+				})
+				return
+			}
+
+			if key == "_limit" {
+				limit.Limit = i
+			} else {
+				limit.Offset = i
+			}
+		case "action", "principal", "request_id", "source_ip":
+			operator := "="
+			if len(values) > 1 {
+				operator = "IN"
+			}
+
+			where.Groups = append(where.Groups, hostdb.MariadbWhereGrouping{
+				Clauses: []hostdb.MariadbWhereClause{
+					{
+						Relativity: "AND",
+						Key:        []string{key},
+						Operator:   operator,
+						Value:      values,
+					},
+				},
+			})
+		case "since", "until":
+			timestamp, err := parseTimestamp(values[0])
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, hostdb.GenericError{
+					Error: fmt.Sprintf("%s parameter must be a timestamp", key),
+				})
+				return
+			}
+
+			operator := ">="
+			if key == "until" {
+				operator = "<="
+			}
+
+			where.Groups = append(where.Groups, hostdb.MariadbWhereGrouping{
+				Clauses: []hostdb.MariadbWhereClause{
+					{
+						Relativity: "AND",
+						Key:        []string{"timestamp"},
+						Operator:   operator,
+						Value:      []string{timestamp.Format(storedTimestampFormat)},
+					},
+				},
+			})
+		default:
+			c.AbortWithStatusJSON(http.StatusBadRequest, hostdb.GenericError{
+				Error: fmt.Sprintf("unsupported query param '%s'", key),
+			})
+			return
+		}
+	}
+
+	entries, foundRows, err := getMariadbAuditEntries(where, limit)
+	if err != nil {
+		log.Println(err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
+			Error: "getting the audit log from the database failed",
+		})
+		return
+	}
+
+	for i := range entries {
+		formatTimestamps(c, &entries[i].Timestamp)
+	}
+
+	// stop the query timer
+	end := time.Now()
+	latency := end.Sub(start)
+
+	sendResponse(c, http.StatusOK, getAuditResponse{
+		Count:     foundRows,
+		QueryTime: fmt.Sprintf("%v", latency),
+		Entries:   entries,
+	})
+
+}
+
 // show the current (redacted) hostdb configuration
 func showConfig(c *gin.Context) {
 
@@ -14,6 +122,456 @@ func showConfig(c *gin.Context) {
 	displayConfig.Hostdb.Pass = "*******" + config.Hostdb.Pass[len(config.Hostdb.Pass)-3:]
 	displayConfig.Mariadb.Pass = "*******" + config.Mariadb.Pass[len(config.Mariadb.Pass)-3:]
 
+	auditLog(c, "show_config", nil, 0, 0, 0, "")
+
 	sendResponse(c, http.StatusOK, displayConfig)
 
 }
+
+// the outcome of back-filling the hostname and ip of existing records
+type extractResponse struct {
+	OK      bool     `json:"ok"`
+	DryRun  bool     `json:"dry_run,omitempty"`
+	Checked int      `json:"checked"` // how many records were looked at
+	Updated int      `json:"updated"` // how many records were (or would be) given a hostname or ip
+	IDs     []string `json:"ids"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// fill in the hostname and ip addresses of existing records from their data, using the extract config
+// optionally limited to one or more types
+func postExtract(c *gin.Context) {
+
+	dryRun := queryFlag(c, "_dry_run")
+
+	where := hostdb.MariadbWhereClauses{
+		Groups: []hostdb.MariadbWhereGrouping{},
+	}
+
+	if types := c.QueryArray("type"); len(types) > 0 {
+		where.Groups = append(where.Groups, hostdb.MariadbWhereGrouping{
+			Clauses: []hostdb.MariadbWhereClause{
+				{
+					Relativity: "AND",
+					Key:        []string{"type"},
+					Operator:   "IN",
+					Value:      types,
+				},
+			},
+		})
+	}
+
+	checked, ids, err := backfillRecordFields(where, dryRun)
+
+	response := extractResponse{
+		OK:      err == nil,
+		DryRun:  dryRun,
+		Checked: checked,
+		Updated: len(ids),
+		IDs:     append([]string{}, ids...),
+	}
+
+	if !dryRun && len(ids) > 0 {
+		auditLog(c, "extract_fields", ids, 0, len(ids), 0, fmt.Sprintf("%d record(s) checked", checked))
+	}
+
+	if err != nil {
+		log.Println(err.Error())
+		response.Error = "back-filling the hostname and ip failed; some records may have been updated"
+		c.AbortWithStatusJSON(http.StatusInternalServerError, response)
+		return
+	}
+
+	sendResponse(c, http.StatusOK, response)
+
+}
+
+// list the json schemas registered for record data
+func getSchemas(c *gin.Context) {
+
+	entries := schemas.list()
+	for i := range entries {
+		formatTimestamps(c, &entries[i].Updated)
+	}
+
+	sendResponse(c, http.StatusOK, entries)
+
+}
+
+// get the json schema registered for a type (or type pattern)
+func getSchema(c *gin.Context) {
+
+	for _, entry := range schemas.list() {
+		if entry.Type == c.Param("type") {
+			formatTimestamps(c, &entry.Updated)
+			sendResponse(c, http.StatusOK, entry)
+			return
+		}
+	}
+
+	c.AbortWithStatusJSON(http.StatusNotFound, hostdb.GenericError{Error: "schema not found"})
+
+}
+
+// upload the json schema for a type (or type pattern), replacing any schema from the schema directory
+func putSchema(c *gin.Context) {
+
+	rawData, err := c.GetRawData()
+	if err != nil {
+		log.Println(err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
+			Error: "could not get raw request data",
+		})
+		return
+	}
+
+	entry := schemaEntry{
+		Type:      c.Param("type"),
+		Source:    "upload",
+		Schema:    rawData,
+		Updated:   time.Now().UTC().Format("2006-01-02 15:04:05"),
+		Principal: getPrincipal(c),
+	}
+
+	if err := validateSchemaEntry(&entry); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, hostdb.GenericError{Error: err.Error()})
+		return
+	}
+
+	if err := saveMariadbSchema(entry); err != nil {
+		log.Println(err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
+			Error: "saving the schema failed",
+		})
+		return
+	}
+
+	schemas.set(entry)
+
+	auditLog(c, "put_schema", nil, 0, 0, 0, entry.Type)
+
+	formatTimestamps(c, &entry.Updated)
+
+	sendResponse(c, http.StatusOK, entry)
+
+}
+
+// delete an uploaded json schema; a schema for the type in the schema directory applies again
+func deleteSchema(c *gin.Context) {
+
+	recordType := c.Param("type")
+
+	if err := deleteMariadbSchema(recordType); err != nil {
+		log.Println(err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
+			Error: "deleting the schema failed",
+		})
+		return
+	}
+
+	// fall back to the schema directory
+	if err := loadSchemas(); err != nil {
+		log.Println(err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
+			Error: "reloading the schemas failed",
+		})
+		return
+	}
+
+	auditLog(c, "delete_schema", nil, 0, 0, 0, recordType)
+
+	sendResponse(c, http.StatusOK, gin.H{
+		"type":    recordType,
+		"deleted": true,
+	})
+
+}
+
+// list the webhook subscriptions
+func getWebhooks(c *gin.Context) {
+
+	hooks, err := getMariadbWebhooks()
+	if err != nil {
+		log.Println(err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
+			Error: "getting the webhooks from the database failed",
+		})
+		return
+	}
+
+	response := []webhook{}
+	for _, hook := range hooks {
+		hook = hook.redacted()
+		formatTimestamps(c, &hook.Created, &hook.Updated)
+		response = append(response, hook)
+	}
+
+	sendResponse(c, http.StatusOK, response)
+
+}
+
+// get a webhook subscription, or respond with a 404
+func findWebhook(c *gin.Context) (hook webhook, ok bool) {
+
+	hook, err := getMariadbWebhook(c.Param("id"))
+	if err != nil {
+		log.Println(err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
+			Error: "getting the webhook from the database failed",
+		})
+		return webhook{}, false
+	}
+
+	if hook.ID == "" {
+		c.AbortWithStatusJSON(http.StatusNotFound, hostdb.GenericError{Error: "webhook not found"})
+		return webhook{}, false
+	}
+
+	return hook, true
+
+}
+
+func getWebhook(c *gin.Context) {
+
+	hook, ok := findWebhook(c)
+	if !ok {
+		return
+	}
+
+	hook = hook.redacted()
+	formatTimestamps(c, &hook.Created, &hook.Updated)
+
+	sendResponse(c, http.StatusOK, hook)
+
+}
+
+// subscribe a url to record changes
+func postWebhook(c *gin.Context) {
+
+	saveWebhook(c, webhook{
+		ID:      getUUID("whk"),
+		Created: time.Now().UTC().Format(storedTimestampFormat),
+	}, true)
+
+}
+
+// replace a webhook subscription; the secret is kept if none is given
+func putWebhook(c *gin.Context) {
+
+	existing, ok := findWebhook(c)
+	if !ok {
+		return
+	}
+
+	saveWebhook(c, existing, false)
+
+}
+
+// fill in a webhook subscription from the request body, and save it
+func saveWebhook(c *gin.Context, existing webhook, created bool) {
+
+	var hook webhook
+	if err := c.ShouldBindJSON(&hook); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, hostdb.GenericError{
+			Error: fmt.Sprintf("could not unmarshal the webhook: %v", err),
+		})
+		return
+	}
+
+	hook.ID = existing.ID
+	hook.Created = existing.Created
+	hook.Updated = time.Now().UTC().Format(storedTimestampFormat)
+	hook.Principal = getPrincipal(c)
+
+	if hook.Secret == "" {
+		hook.Secret = existing.Secret
+	}
+
+	if err := validateWebhook(&hook); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, hostdb.GenericError{Error: err.Error()})
+		return
+	}
+
+	if err := saveMariadbWebhook(hook); err != nil {
+		log.Println(err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
+			Error: "saving the webhook failed",
+		})
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+		auditLog(c, "post_webhook", nil, 0, 0, 0, fmt.Sprintf("%s %s", hook.ID, hook.URL))
+		c.Header("Location", fmt.Sprintf("/admin/webhooks/%s", hook.ID))
+	} else {
+		auditLog(c, "put_webhook", nil, 0, 0, 0, fmt.Sprintf("%s %s", hook.ID, hook.URL))
+	}
+
+	hook = hook.redacted()
+	formatTimestamps(c, &hook.Created, &hook.Updated)
+
+	sendResponse(c, status, hook)
+
+}
+
+// unsubscribe a webhook; its delivery history is deleted with it
+func deleteWebhook(c *gin.Context) {
+
+	id := c.Param("id")
+
+	found, err := deleteMariadbWebhook(id)
+	if err != nil {
+		log.Println(err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
+			Error: "deleting the webhook failed",
+		})
+		return
+	}
+
+	if !found {
+		c.AbortWithStatusJSON(http.StatusNotFound, hostdb.GenericError{Error: "webhook not found"})
+		return
+	}
+
+	auditLog(c, "delete_webhook", nil, 0, 0, 0, id)
+
+	sendResponse(c, http.StatusOK, gin.H{
+		"id":      id,
+		"deleted": true,
+	})
+
+}
+
+// the delivery history of a webhook, newest first, optionally filtered by status
+func getWebhookDeliveries(c *gin.Context) {
+
+	hook, ok := findWebhook(c)
+	if !ok {
+		return
+	}
+
+	status := c.Query("status")
+	if status != "" && status != deliveryPending && status != deliverySucceeded && status != deliveryFailed {
+		c.AbortWithStatusJSON(http.StatusBadRequest, hostdb.GenericError{
+			Error: fmt.Sprintf("status must be %s, %s or %s", deliveryPending, deliverySucceeded, deliveryFailed),
+		})
+		return
+	}
+
+	limit := 100
+	if value := c.Query("_limit"); value != "" {
+		i, err := strconv.Atoi(value)
+		if err != nil || i < 1 || i > 1000 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, hostdb.GenericError{
+				Error: "_limit parameter must be between 1 and 1000",
+			})
+			return
+		}
+		limit = i
+	}
+
+	deliveries, err := getMariadbWebhookDeliveries(hook.ID, status, limit)
+	if err != nil {
+		log.Println(err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
+			Error: "getting the deliveries from the database failed",
+		})
+		return
+	}
+
+	for i := range deliveries {
+		formatTimestamps(c, &deliveries[i].NextAttempt, &deliveries[i].Created, &deliveries[i].Delivered)
+	}
+
+	sendResponse(c, http.StatusOK, deliveries)
+
+}
+
+// register a collector, or change its registration
+func putCollector(c *gin.Context) {
+
+	var registration collector
+	if err := c.ShouldBindJSON(&registration); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, hostdb.GenericError{
+			Error: fmt.Sprintf("could not unmarshal the collector: %v", err),
+		})
+		return
+	}
+
+	existing, err := getMariadbCollector(c.Param("name"))
+	if err != nil {
+		log.Println(err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
+			Error: "getting the collector from the database failed",
+		})
+		return
+	}
+
+	now := time.Now().UTC().Format(storedTimestampFormat)
+
+	// what the collector has done isn't part of its registration
+	existing.Name = c.Param("name")
+	existing.Type = registration.Type
+	existing.Scope = registration.Scope
+	existing.Interval = registration.Interval
+	existing.Description = registration.Description
+	existing.Updated = now
+	existing.Principal = getPrincipal(c)
+
+	status := http.StatusOK
+	if existing.Created == "" {
+		existing.Created = now
+		status = http.StatusCreated
+	}
+
+	if err := validateCollector(&existing); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, hostdb.GenericError{Error: err.Error()})
+		return
+	}
+
+	if err := saveMariadbCollector(existing); err != nil {
+		log.Println(err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
+			Error: "saving the collector failed",
+		})
+		return
+	}
+
+	auditLog(c, "put_collector", nil, 0, 0, 0, fmt.Sprintf("%s %s every %s", existing.Name, existing.Type, existing.Interval))
+
+	existing.Status = existing.health(time.Now().UTC())
+	formatTimestamps(c, &existing.Created, &existing.Updated, &existing.LastRun, &existing.LastSuccess)
+
+	sendResponse(c, status, existing)
+
+}
+
+// forget about a collector; its records are kept
+func deleteCollector(c *gin.Context) {
+
+	name := c.Param("name")
+
+	found, err := deleteMariadbCollector(name)
+	if err != nil {
+		log.Println(err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
+			Error: "deleting the collector failed",
+		})
+		return
+	}
+
+	if !found {
+		c.AbortWithStatusJSON(http.StatusNotFound, hostdb.GenericError{Error: "collector not found"})
+		return
+	}
+
+	auditLog(c, "delete_collector", nil, 0, 0, 0, name)
+
+	sendResponse(c, http.StatusOK, gin.H{
+		"name":    name,
+		"deleted": true,
+	})
+
+}
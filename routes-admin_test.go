@@ -1,8 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/pdxfixit/hostdb"
 	"github.com/stretchr/testify/assert"
@@ -23,3 +30,326 @@ func TestShowConfig(t *testing.T) {
 	assert.Equal(t, "*******ord", testConfig.Hostdb.Pass, "Hostdb writer password")
 	assert.Equal(t, 3306, testConfig.Mariadb.Port, "Mariadb port")
 }
+
+// GET /admin/audit
+func TestGetAudit(t *testing.T) {
+
+	// make a write, so that there's something in the audit log
+	record := generateTestRecord()
+	body, err := json.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	makeTestPutRequest(t, fmt.Sprintf("/v0/records/%s", record.ID), bytes.NewReader(body))
+
+	w := makeTestGetRequest(t, "/admin/audit", true, map[string][]string{
+		"principal": {"writer"},
+		"action":    {"put_record"},
+	})
+
+	response := getAuditResponse{}
+
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Errorf("%v", err)
+	}
+
+	assert.NotZero(t, response.Count, "number of audit entries")
+	assert.NotEmpty(t, response.Entries, "audit entries")
+
+	// newest first
+	entry := response.Entries[0]
+	assert.Equal(t, "writer", entry.Principal, "principal")
+	assert.Equal(t, "put_record", entry.Action, "action")
+	assert.Equal(t, []string{record.ID}, entry.IDs, "affected ids")
+	assert.Equal(t, 1, entry.Created, "created count")
+	assert.NotEmpty(t, entry.RequestID, "request id")
+
+	// bad filters
+	makeTestRequest(t, "GET", "/admin/audit", true, map[string][]string{"since": {"yesterday"}}, nil, http.StatusBadRequest)
+	makeTestRequest(t, "GET", "/admin/audit", true, map[string][]string{"foo": {"bar"}}, nil, http.StatusBadRequest)
+
+}
+
+// PUT, GET & DELETE /admin/schemas/:type
+func TestSchemas(t *testing.T) {
+
+	schema := `{"type": "object", "required": ["test"], "properties": {"test": {"type": "string"}}}`
+
+	// an invalid schema is refused
+	makeTestRequest(t, "PUT", "/admin/schemas/schema-test", true, nil, bytes.NewReader([]byte(`{"type": "thing"}`)), http.StatusBadRequest)
+
+	makeTestRequest(t, "PUT", "/admin/schemas/schema-test", true, nil, bytes.NewReader([]byte(schema)), http.StatusOK)
+
+	w := makeTestGetRequest(t, "/admin/schemas/schema-test", true, nil)
+
+	entry := schemaEntry{}
+	if err := json.NewDecoder(w.Body).Decode(&entry); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "schema-test", entry.Type, "type")
+	assert.Equal(t, "upload", entry.Source, "source")
+	assert.Equal(t, "admin", entry.Principal, "principal")
+
+	// a record which doesn't match is refused
+	record := generateTestRecord()
+	record.Type = "schema-test"
+	record.Data = json.RawMessage(`{"test": 1}`)
+	record.Hash = ""
+
+	body, err := json.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = makeTestRequest(t, "PUT", fmt.Sprintf("/v0/records/%s", record.ID), true, nil, bytes.NewReader(body), http.StatusUnprocessableEntity)
+	assert.Contains(t, w.Body.String(), ".test: expected string, but got integer", "violation path")
+
+	// unless the type is in warn mode
+	serverConfig.API.V0.Schemas.Modes = map[string]string{"schema-*": schemaWarn}
+	defer func() { serverConfig.API.V0.Schemas.Modes = nil }()
+
+	w = makeTestRequest(t, "PUT", fmt.Sprintf("/v0/records/%s", record.ID), true, nil, bytes.NewReader(body), http.StatusCreated)
+	assert.Contains(t, w.Header().Get("Warning"), ".test: expected string", "warning")
+
+	makeTestRequest(t, "DELETE", "/admin/schemas/schema-test", true, nil, nil, http.StatusOK)
+	makeTestRequest(t, "GET", "/admin/schemas/schema-test", true, nil, nil, http.StatusNotFound)
+	makeTestRequest(t, "DELETE", fmt.Sprintf("/v0/records/%s", record.ID), true, nil, nil, http.StatusOK)
+
+}
+
+// POST /admin/extract
+func TestPostExtract(t *testing.T) {
+
+	// a record saved before its type had extract paths
+	record := generateTestRecord()
+	record.Type = "extract-test"
+	record.Hostname = ""
+	record.IP = ""
+	record.Data = json.RawMessage(`{"name": "extracted.example.com", "ip": "10.1.2.3"}`)
+	record.Hash = ""
+
+	body, err := json.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	makeTestPutRequest(t, fmt.Sprintf("/v0/records/%s", record.ID), bytes.NewReader(body))
+
+	original := serverConfig.API.V0.Extract
+	defer func() { serverConfig.API.V0.Extract = original }()
+
+	serverConfig.API.V0.Extract = extractSettings{
+		Hostname: map[string][]string{"extract-test": {".name"}},
+		IP:       map[string][]string{"extract-test": {".ip"}},
+	}
+
+	extract := func(query map[string][]string) extractResponse {
+		w := makeTestRequest(t, "POST", "/admin/extract", true, query, nil, http.StatusOK)
+
+		response := extractResponse{}
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+
+		return response
+	}
+
+	response := extract(map[string][]string{"type": {"extract-test"}, "_dry_run": {"true"}})
+	assert.True(t, response.DryRun, "dry run")
+	assert.Equal(t, []string{record.ID}, response.IDs, "dry run ids")
+
+	records := decodeRecords(t, makeTestGetRequest(t, fmt.Sprintf("/v0/records/%s", record.ID), false, nil))
+	assert.Empty(t, records[record.ID].Hostname, "dry run hostname")
+
+	response = extract(map[string][]string{"type": {"extract-test"}})
+	assert.Equal(t, 1, response.Checked, "checked")
+	assert.Equal(t, []string{record.ID}, response.IDs, "ids")
+
+	records = decodeRecords(t, makeTestGetRequest(t, fmt.Sprintf("/v0/records/%s", record.ID), false, nil))
+	assert.Equal(t, "extracted.example.com", records[record.ID].Hostname, "hostname")
+	assert.Equal(t, "10.1.2.3", records[record.ID].IP, "ip")
+
+	// nothing left to do
+	response = extract(map[string][]string{"type": {"extract-test"}})
+	assert.Empty(t, response.IDs, "second run")
+
+	makeTestRequest(t, "DELETE", fmt.Sprintf("/v0/records/%s", record.ID), true, nil, nil, http.StatusOK)
+
+}
+
+func TestWebhooks(t *testing.T) {
+
+	received := make(chan webhookPayload, 10)
+	signatures := make(chan string, 10)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		var payload webhookPayload
+		_ = json.Unmarshal(body, &payload)
+
+		signatures <- map[bool]string{true: "valid", false: "invalid"}[r.Header.Get("X-HostDB-Signature") == webhookSignature("s3cret", body)]
+		received <- payload
+	}))
+	defer server.Close()
+
+	// an invalid subscription is refused
+	makeTestRequest(t, "POST", "/admin/webhooks", true, nil, strings.NewReader(`{"url":"/relative","secret":"s3cret"}`), http.StatusBadRequest)
+
+	body := fmt.Sprintf(`{"url":%q,"secret":"s3cret","filter":{"type":["test-webhooks"]}}`, server.URL)
+	w := makeTestRequest(t, "POST", "/admin/webhooks", true, nil, strings.NewReader(body), http.StatusCreated)
+
+	hook := webhook{}
+	if err := json.NewDecoder(w.Body).Decode(&hook); err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEmpty(t, hook.ID, "id")
+	assert.Empty(t, hook.Secret, "the secret isn't shown")
+	assert.Equal(t, recordEventTypes, hook.Events, "events")
+
+	defer makeTestRequest(t, "DELETE", fmt.Sprintf("/admin/webhooks/%s", hook.ID), true, nil, nil, http.StatusOK)
+
+	next := func(event string) webhookPayload {
+		select {
+		case payload := <-received:
+			assert.Equal(t, "valid", <-signatures, "signature")
+			assert.Equal(t, event, payload.Event, "event")
+			return payload
+		case <-time.After(10 * time.Second):
+			t.Fatalf("no %s delivery", event)
+		}
+		return webhookPayload{}
+	}
+
+	// records which don't match the filter aren't sent
+	other := generateTestRecord()
+	otherBytes, err := json.Marshal(&other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	makeTestPutRequest(t, fmt.Sprintf("/v0/records/%s", other.ID), bytes.NewReader(otherBytes))
+
+	record := generateTestRecord()
+	record.Type = "test-webhooks"
+	recordBytes, err := json.Marshal(&record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	makeTestPutRequest(t, fmt.Sprintf("/v0/records/%s", record.ID), bytes.NewReader(recordBytes))
+	assert.Equal(t, record.ID, next(recordEventCreate).Record.ID, "created record")
+
+	makeTestRequest(t, "DELETE", fmt.Sprintf("/v0/records/%s", record.ID), true, nil, nil, http.StatusOK)
+	deleted := next(recordEventDelete)
+	assert.Equal(t, record.ID, deleted.Record.ID, "deleted record")
+	assert.Equal(t, record.Hostname, deleted.Record.Hostname, "deleted record hostname")
+
+	makeTestRequest(t, "DELETE", fmt.Sprintf("/v0/records/%s", other.ID), true, nil, nil, http.StatusOK)
+
+	select {
+	case payload := <-received:
+		t.Errorf("unexpected %s delivery for %s", payload.Event, payload.Record.ID)
+	default:
+	}
+
+	// the history shows both deliveries
+	w = makeTestGetRequest(t, fmt.Sprintf("/admin/webhooks/%s/deliveries", hook.ID), true, nil)
+
+	var deliveries []webhookDelivery
+	if err := json.NewDecoder(w.Body).Decode(&deliveries); err != nil {
+		t.Fatal(err)
+	}
+
+	if assert.Len(t, deliveries, 2, "deliveries") {
+		for _, delivery := range deliveries {
+			assert.Equal(t, record.ID, delivery.RecordID, "delivery record")
+			assert.Equal(t, 1, delivery.Attempts, "attempts")
+		}
+	}
+
+	// the secret is kept when a subscription is replaced without one
+	body = fmt.Sprintf(`{"url":%q,"filter":{"type":["test-webhooks"]},"events":["delete"]}`, server.URL)
+	makeTestRequest(t, "PUT", fmt.Sprintf("/admin/webhooks/%s", hook.ID), true, nil, strings.NewReader(body), http.StatusOK)
+
+	saved, err := getMariadbWebhook(hook.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "s3cret", saved.Secret, "secret")
+	assert.Equal(t, []string{recordEventDelete}, saved.Events, "replaced events")
+
+	makeTestRequest(t, "GET", "/admin/webhooks/whk-missing", true, nil, nil, http.StatusNotFound)
+
+}
+
+func TestCollectors(t *testing.T) {
+
+	// an invalid registration is refused
+	makeTestRequest(t, "PUT", "/admin/collectors/test-collector", true, nil, strings.NewReader(`{"type":"test-collectors","interval":"hourly"}`), http.StatusBadRequest)
+
+	body := `{"type":"test-collectors","interval":"1h","description":"testing"}`
+	w := makeTestRequest(t, "PUT", "/admin/collectors/test-collector", true, nil, strings.NewReader(body), http.StatusCreated)
+
+	registered := collector{}
+	if err := json.NewDecoder(w.Body).Decode(&registered); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "test-collector", registered.Name, "name")
+	assert.Equal(t, "1h0m0s", registered.Interval, "interval")
+	assert.Equal(t, collectorHealthy, registered.Status, "healthy until it's overdue")
+	assert.Empty(t, registered.LastRun, "no runs yet")
+
+	defer makeTestRequest(t, "DELETE", "/admin/collectors/test-collector", true, nil, nil, http.StatusOK)
+
+	makeTestPostRequest(t, "/v0/records/", strings.NewReader(`{
+"type":"test-collectors",
+"timestamp":"2020-05-02 20:09:26",
+"committer":"testing",
+"context": {
+  "test": true
+},
+"records":[
+  {"hostname":"one.pdxfixit.com","data":{"name":"one"}},
+  {"hostname":"two.pdxfixit.com","data":{"name":"two"}}
+]}`))
+	defer makeTestRequest(t, "DELETE", "/v0/records/", true, map[string][]string{"type": {"test-collectors"}, "_confirm": {"2"}}, nil, http.StatusOK)
+
+	w = makeTestGetRequest(t, "/v0/collectors/test-collector", false, nil)
+
+	found := collector{}
+	if err := json.NewDecoder(w.Body).Decode(&found); err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEmpty(t, found.LastRun, "last run")
+	assert.Equal(t, found.LastRun, found.LastSuccess, "last success")
+	assert.Empty(t, found.LastError, "last error")
+	assert.Equal(t, runCounts{Received: 2, Created: 2}, found.LastRunCounts, "counts")
+	assert.Equal(t, 2, found.Records, "records")
+
+	// the list can be narrowed by status
+	w = makeTestGetRequest(t, "/v0/collectors", false, map[string][]string{"type": {"test-collectors"}, "status": {collectorHealthy}})
+
+	var collectors []collector
+	if err := json.NewDecoder(w.Body).Decode(&collectors); err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, collectors, 1, "healthy collectors")
+
+	w = makeTestGetRequest(t, "/v0/collectors", false, map[string][]string{"type": {"test-collectors"}, "status": {collectorStale}})
+	assert.Equal(t, "[]", strings.TrimSpace(w.Body.String()), "stale collectors")
+
+	// the health check summarises the collectors
+	w = makeTestGetRequest(t, "/health", false, nil)
+
+	health := healthResponse{}
+	if err := json.NewDecoder(w.Body).Decode(&health); err != nil {
+		t.Fatal(err)
+	}
+	if assert.NotNil(t, health.Collectors, "collectors") {
+		assert.NotContains(t, health.Collectors.Stale, "test-collector", "not stale")
+	}
+
+	makeTestRequest(t, "GET", "/v0/collectors/missing", false, nil, nil, http.StatusNotFound)
+
+}
@@ -59,16 +59,32 @@ func getReleaseTimestamp() string {
 	return t.Format("Jan 2 2006 @ 15:04:05")
 }
 
+// the health of the app and database, and of the registered collectors
+type healthResponse struct {
+	hostdb.GetHealthResponse
+	Collectors *collectorHealth `json:"collectors,omitempty"`
+}
+
 // run a health check
 func getHealth(c *gin.Context) {
 
-	health := hostdb.GetHealthResponse{
-		App: "up",
-		DB:  "absent",
+	health := healthResponse{
+		GetHealthResponse: hostdb.GetHealthResponse{
+			App: "up",
+			DB:  "absent",
+		},
 	}
 
 	if checkMariadb() {
 		health.DB = "present"
+
+		// a stale collector doesn't make the app unhealthy, so the status is unaffected
+		if collectors, err := loadCollectors(time.Now().UTC()); err != nil {
+			log.Println(err.Error())
+		} else {
+			summary := summariseCollectors(collectors)
+			health.Collectors = &summary
+		}
 	}
 
 	sendResponse(c, http.StatusOK, health)
@@ -127,6 +143,12 @@ func getStats(c *gin.Context) {
 	}
 	stats.LastSeenCollectors = lastSeen
 
+	formatTimestamps(c, &stats.NewestRecord, &stats.OldestRecord)
+	for committer, timestamp := range stats.LastSeenCollectors {
+		formatTimestamps(c, &timestamp)
+		stats.LastSeenCollectors[committer] = timestamp
+	}
+
 	sendResponse(c, http.StatusOK, stats)
 
 }
@@ -5,6 +5,7 @@ import (
 	"encoding/csv"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"reflect"
@@ -55,6 +56,13 @@ func saveRecord(c *gin.Context) {
 
 	// ensure all the necessary data is there
 	if err = ensureDataIsComplete(&data); err != nil {
+		if err, ok := err.(hostdb.ErrorResponse); ok {
+			c.AbortWithStatusJSON(err.Code, hostdb.GenericError{
+				Error: err.Message,
+			})
+			return
+		}
+
 		log.Println(fmt.Sprintf("%v", err.Error()))
 		c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
 			Error: "data is not complete",
@@ -62,8 +70,47 @@ func saveRecord(c *gin.Context) {
 		return
 	}
 
+	// check for an existing record, so that the audit log can tell creates from updates
+	existing, err := getMariadbRow(data.ID)
+	if err != nil {
+		log.Println(err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
+			Error: "could not get record from the database",
+		})
+		return
+	}
+
+	if !checkIfMatch(c, existing) {
+		return
+	}
+
+	// validate the data against the schema for its type
+	if !checkRecordSchemaResponse(c, data) {
+		return
+	}
+
+	// the change feed is written along with the record; an unchanged record isn't a change
+	event := ""
+	if existing.ID == "" {
+		event = recordEventCreate
+	} else if anythingChanged(data, existing) {
+		event = recordEventUpdate
+	}
+
+	var changes []changeEntry
+	if event != "" {
+		changes = newChangeEntries(event, []hostdb.Record{data})
+	}
+
 	// SAVE
-	if err := saveMariadbRow(data); err != nil {
+	if err := saveMariadbRow(data, c.GetHeader("If-Match"), changes); err != nil {
+		if err == errPreconditionFailed {
+			c.AbortWithStatusJSON(http.StatusPreconditionFailed, hostdb.GenericError{
+				Error: err.Error(),
+			})
+			return
+		}
+
 		if err, ok := err.(*mysql.MySQLError); ok {
 			log.Println(fmt.Sprintf("%v: %v", err.Number, err.Message))
 			c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
@@ -80,6 +127,18 @@ func saveRecord(c *gin.Context) {
 		return
 	}
 
+	if existing.ID == "" {
+		auditLog(c, "put_record", []string{data.ID}, 1, 0, 0, "")
+	} else {
+		auditLog(c, "put_record", []string{data.ID}, 0, 1, 0, "")
+	}
+
+	if event != "" {
+		announceRecordChanges(event, []string{data.ID})
+	}
+
+	setETag(c, data)
+
 	sendResponse(c, http.StatusCreated, hostdb.PutRecordResponse{
 		ID: data.ID,
 		OK: true,
@@ -88,6 +147,91 @@ func saveRecord(c *gin.Context) {
 
 }
 
+// apply a json merge patch (RFC 7396) or json patch (RFC 6902) to the context and data of a record
+func patchRecord(c *gin.Context) {
+
+	// get the raw request data
+	rawData, err := c.GetRawData()
+	if err != nil {
+		log.Println(err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
+			Error: "could not get raw request data",
+		})
+		return
+	}
+
+	existing, err := getMariadbRow(c.Param("id"))
+	if err != nil {
+		log.Println(err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
+			Error: "could not get record from the database",
+		})
+		return
+	}
+
+	if existing.ID == "" {
+		c.AbortWithStatusJSON(http.StatusNotFound, hostdb.GenericError{Error: "record not found"})
+		return
+	}
+
+	if !checkIfMatch(c, existing) {
+		return
+	}
+
+	record, changed, err := applyRecordPatch(existing, c.ContentType(), rawData)
+	if err != nil {
+		if err, ok := err.(hostdb.ErrorResponse); ok {
+			c.AbortWithStatusJSON(err.Code, hostdb.GenericError{Error: err.Message})
+			return
+		}
+
+		log.Println(err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
+			Error: "applying the patch failed",
+		})
+		return
+	}
+
+	if changed {
+		// ensure all the necessary data is still there
+		if err = ensureDataIsComplete(&record); err != nil {
+			c.AbortWithStatusJSON(http.StatusUnprocessableEntity, hostdb.GenericError{
+				Error: fmt.Sprintf("the patched record is not complete: %v", err),
+			})
+			return
+		}
+
+		if !checkRecordSchemaResponse(c, record) {
+			return
+		}
+
+		if err := saveMariadbRow(record, c.GetHeader("If-Match"), newChangeEntries(recordEventUpdate, []hostdb.Record{record})); err != nil {
+			if err == errPreconditionFailed {
+				c.AbortWithStatusJSON(http.StatusPreconditionFailed, hostdb.GenericError{
+					Error: err.Error(),
+				})
+				return
+			}
+
+			log.Println(err.Error())
+			c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
+				Error: "something went wrong saving the record",
+			})
+			return
+		}
+
+		auditLog(c, "patch_record", []string{record.ID}, 0, 1, 0, c.ContentType())
+		announceRecordChanges(recordEventUpdate, []string{record.ID})
+	}
+
+	setETag(c, record)
+
+	formatTimestamps(c, &record.Timestamp)
+
+	sendResponse(c, http.StatusOK, record)
+
+}
+
 // get full detail of record(s)
 func getDetail(c *gin.Context) {
 
@@ -106,6 +250,15 @@ func getDetail(c *gin.Context) {
 
 	// is it a response
 	if response, ok := response.(hostdb.GetRecordsResponse); ok {
+		// a single record can be polled cheaply, with If-None-Match
+		if id := c.Param("id"); id != "" {
+			etag := setETag(c, response.Records[id])
+			if etag != "" && etagMatches(c.GetHeader("If-None-Match"), etag) {
+				c.Status(http.StatusNotModified)
+				return
+			}
+		}
+
 		sendResponse(c, http.StatusOK, response)
 		return
 	}
@@ -250,6 +403,8 @@ func get(c *gin.Context) (response interface{}) {
 			return err
 		}
 
+		formatTimestamps(c, &record.Timestamp)
+
 		// stop the query timer
 		end := time.Now()
 		latency := end.Sub(start)
@@ -271,6 +426,8 @@ func get(c *gin.Context) (response interface{}) {
 			return err
 		}
 
+		formatRecordTimestamps(c, records)
+
 		// stop the query timer
 		end := time.Now()
 		latency := end.Sub(start)
@@ -288,6 +445,8 @@ func get(c *gin.Context) (response interface{}) {
 		return err
 	}
 
+	formatRecordTimestamps(c, records)
+
 	// stop the query timer
 	end := time.Now()
 	latency := end.Sub(start)
@@ -303,11 +462,27 @@ func get(c *gin.Context) (response interface{}) {
 // parse the query parameters into a Where object, return a collection of records indexed by their ID
 func processQueryParams(query map[string][]string) (records map[string]hostdb.Record, foundRows int, err error) {
 
-	where := hostdb.MariadbWhereClauses{
-		Groups: []hostdb.MariadbWhereGrouping{},
+	where, limit, err := queryWhereClauses(query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// get records from the db
+	records, foundRows, err = getMariadbRows(where, limit)
+	if err != nil {
+		return nil, 0, err
 	}
 
-	limit := hostdb.MariadbLimit{}
+	return records, foundRows, nil
+
+}
+
+// parse the query parameters into a Where object and a limit
+func queryWhereClauses(query map[string][]string) (where hostdb.MariadbWhereClauses, limit hostdb.MariadbLimit, err error) {
+
+	where = hostdb.MariadbWhereClauses{
+		Groups: []hostdb.MariadbWhereGrouping{},
+	}
 
 	// for each of the requested query params
 	i := 0
@@ -317,11 +492,11 @@ func processQueryParams(query map[string][]string) (records map[string]hostdb.Re
 		case "_limit":
 			i, err := strconv.Atoi(requestedParamValue[0])
 			if err != nil {
-				return nil, 0, err
+				return where, limit, err
 			}
 			// if i is negative, foul
 			if i < 0 {
-				return nil, 0, hostdb.ErrorResponse{
+				return where, limit, hostdb.ErrorResponse{
 					Code:    http.StatusBadRequest,
 					Message: "_limit parameter must not be negative",
 				}
@@ -330,16 +505,69 @@ func processQueryParams(query map[string][]string) (records map[string]hostdb.Re
 		case "_offset":
 			i, err := strconv.Atoi(requestedParamValue[0])
 			if err != nil {
-				return nil, 0, err
+				return where, limit, err
 			}
 			// if i is negative, foul
 			if i < 0 {
-				return nil, 0, hostdb.ErrorResponse{
+				return where, limit, hostdb.ErrorResponse{
 					Code:    http.StatusBadRequest,
 					Message: "_offset parameter must not be negative",
 				}
 			}
 			limit.Offset = i
+		case "_q":
+			// boolean expressions; see parseQuery
+			for _, val := range requestedParamValue {
+				groups, err := parseQuery(val)
+				if err != nil {
+					return where, limit, err
+				}
+
+				where.Groups = append(where.Groups, groups...)
+			}
+		case "_since", "_before":
+			// shorthands for range filters on the timestamp, e.g. _before=7d for records not updated in a week
+			operator := ">="
+			if requestedParam == "_before" {
+				operator = "<"
+			}
+
+			for _, val := range requestedParamValue {
+				clause, err := rangeWhereClause([]string{"timestamp"}, rangeBound{operator: operator, value: val})
+				if err != nil {
+					return where, limit, err
+				}
+
+				where.Groups = append(where.Groups, hostdb.MariadbWhereGrouping{
+					Clauses: []hostdb.MariadbWhereClause{clause},
+				})
+			}
+		case "_exists", "!_exists":
+			// whether records have a path in their data or context, e.g. _exists=data.metadata.env
+			operator := "IS NOT NULL"
+			if requestedParam[0:1] == "!" {
+				operator = "IS NULL"
+			}
+
+			for _, val := range requestedParamValue {
+				for _, name := range strings.Split(val, ",") {
+					param, err := adhocQueryParam(strings.TrimSpace(name))
+					if err != nil {
+						return where, limit, err
+					}
+
+					where.Groups = append(where.Groups, hostdb.MariadbWhereGrouping{
+						Clauses: []hostdb.MariadbWhereClause{
+							{
+								Relativity: "AND",
+								Key:        queryParamKeys(param),
+								Operator:   operator,
+								Value:      []string{},
+							},
+						},
+					})
+				}
+			}
 		case "_search", "!_search":
 			// sloppy search
 			for _, val := range requestedParamValue {
@@ -418,45 +646,32 @@ func processQueryParams(query map[string][]string) (records map[string]hostdb.Re
 				}
 			}
 
+			// the timestamp column may be filtered without a query param of its own, e.g. timestamp=<:7d
+			if !paramMatch && requestedParam == "timestamp" {
+				paramMatch = true
+				param = map[string]hostdb.APIv0QueryParam{"*": {Table: "timestamp"}}
+			}
+
+			// ad-hoc filters on a path in the data or context, e.g. _data.metadata.env=prod, needn't be configured
+			if !paramMatch && (strings.HasPrefix(requestedParam, "_data.") || strings.HasPrefix(requestedParam, "_context.")) {
+				param, err = adhocQueryParam(requestedParam[1:])
+				if err != nil {
+					return where, limit, err
+				}
+				paramMatch = true
+			}
+
 			// foul if a requested param isn't supported
 			// params with leading underscores are special/fancy and exempt
 			if !paramMatch && requestedParam[0:1] != "_" {
-				return nil, 0, hostdb.ErrorResponse{
+				return where, limit, hostdb.ErrorResponse{
 					Code:    http.StatusBadRequest,
 					Message: fmt.Sprintf("unsupported query param '%s'", requestedParam),
 				}
 			}
 
 			// prepare the key/field for the WHERE clause
-			for _, recordType := range param {
-				var key string
-
-				// key
-				if recordType.Table != "" {
-					// look for the key in the table itself
-					key = recordType.Table
-				} else if recordType.Context != "" {
-					// look for the key in the record context
-					key = fmt.Sprintf("json_value(context, '$%s') ", recordType.Context)
-				} else if recordType.Data != "" {
-					// look for the key in the record data
-					key = fmt.Sprintf("json_value(data, '$%s') ", recordType.Data)
-				} else {
-					// this param isn't supported after all; ignore it
-					continue
-				}
-
-				exist := false
-				for _, k := range keys {
-					if k == key {
-						exist = true
-					}
-				}
-
-				if !exist {
-					keys = append(keys, key)
-				}
-			}
+			keys = queryParamKeys(param)
 
 			if len(keys) < 1 {
 				continue
@@ -469,7 +684,36 @@ func processQueryParams(query map[string][]string) (records map[string]hostdb.Re
 				operator = "!="
 			}
 
+			ranged := false
+
 			for _, value := range requestedParamValue {
+				// range filters, e.g. ram=>:16, are each compared as the type of their key
+				bounds, ok, err := parseRangeFilter(value)
+				if err != nil {
+					return where, limit, err
+				} else if ok {
+					if negativeAssertion {
+						return where, limit, hostdb.ErrorResponse{
+							Code:    http.StatusBadRequest,
+							Message: fmt.Sprintf("range filters can't be negated; use the opposite comparison with '%s'", requestedParam),
+						}
+					}
+
+					for _, bound := range bounds {
+						clause, err := rangeWhereClause(keys, bound)
+						if err != nil {
+							return where, limit, err
+						}
+
+						where.Groups = append(where.Groups, hostdb.MariadbWhereGrouping{
+							Clauses: []hostdb.MariadbWhereClause{clause},
+						})
+					}
+
+					ranged = true
+					continue
+				}
+
 				if strings.Contains(value, ",") {
 					split := strings.Split(value, ",")
 					values = append(values, split...)
@@ -490,6 +734,11 @@ func processQueryParams(query map[string][]string) (records map[string]hostdb.Re
 				}
 			}
 
+			if ranged && len(values) < 1 {
+				i++
+				continue
+			}
+
 			if len(values) < 1 {
 				if negativeAssertion {
 					operator = "IS NULL"
@@ -504,6 +753,18 @@ func processQueryParams(query map[string][]string) (records map[string]hostdb.Re
 				}
 			}
 
+			// ip addresses and cidr ranges match any of a record's addresses
+			if len(keys) == 1 && keys[0] == "ip" && !strings.Contains(operator, "RLIKE") {
+				if clause, ok := ipWhereClause(values, negativeAssertion); ok {
+					where.Groups = append(where.Groups, hostdb.MariadbWhereGrouping{
+						Clauses: []hostdb.MariadbWhereClause{clause},
+					})
+
+					i++
+					continue
+				}
+			}
+
 			// put it all together
 			if len(keys) > 0 && operator != "" {
 				where.Groups = append(where.Groups, hostdb.MariadbWhereGrouping{
@@ -523,13 +784,79 @@ func processQueryParams(query map[string][]string) (records map[string]hostdb.Re
 
 	}
 
-	// get records from the db
-	records, foundRows, err = getMariadbRows(where, limit)
+	return where, limit, nil
+
+}
+
+// the keys/fields for the WHERE clause of a query param, for each of the types it applies to
+func queryParamKeys(param map[string]hostdb.APIv0QueryParam) (keys []string) {
+
+	// in the order of the types, so that the same query always makes the same statement
+	types := make([]string, 0, len(param))
+	for name := range param {
+		types = append(types, name)
+	}
+	sort.Strings(types)
+
+	for _, name := range types {
+		recordType := param[name]
+		var key string
+
+		// key
+		if recordType.Table != "" {
+			// look for the key in the table itself
+			key = recordType.Table
+		} else if recordType.Context != "" {
+			// look for the key in the record context
+			key = fmt.Sprintf("json_value(context, '$%s') ", recordType.Context)
+		} else if recordType.Data != "" {
+			// look for the key in the record data
+			key = fmt.Sprintf("json_value(data, '$%s') ", recordType.Data)
+		} else {
+			// this param isn't supported after all; ignore it
+			continue
+		}
+
+		exist := false
+		for _, k := range keys {
+			if k == key {
+				exist = true
+			}
+		}
+
+		if !exist {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+
+}
+
+// the query param for a path into a record's data or context, e.g. data.metadata.env, for filtering on paths which aren't configured
+func adhocQueryParam(name string) (param map[string]hostdb.APIv0QueryParam, err error) {
+
+	location := strings.SplitN(name, ".", 2)[0]
+
+	path, err := sqlJSONPath(strings.TrimPrefix(name, location))
 	if err != nil {
-		return nil, 0, err
+		return nil, hostdb.ErrorResponse{
+			Code:    http.StatusBadRequest,
+			Message: fmt.Sprintf("'%s' is not a valid path into the data or context; %s", name, err.Error()),
+		}
 	}
 
-	return records, foundRows, nil
+	switch location {
+	case "data":
+		return map[string]hostdb.APIv0QueryParam{"*": {Data: path}}, nil
+	case "context":
+		return map[string]hostdb.APIv0QueryParam{"*": {Context: path}}, nil
+	}
+
+	return nil, hostdb.ErrorResponse{
+		Code:    http.StatusBadRequest,
+		Message: fmt.Sprintf("'%s' is not a path into the data or context; it should start with data. or context.", name),
+	}
 
 }
 
@@ -673,661 +1000,806 @@ func validQueryParam(item string) bool {
 
 }
 
-// delete a single record
-func deleteRecord(c *gin.Context) {
+// list the registered collectors, with what they last did, how many records they have, and whether they're stale
+// ?type and ?status (healthy or stale) narrow the list
+func getCollectors(c *gin.Context) {
 
-	// verify id
-	id := c.Param("id")
-	if id == "" {
-		c.AbortWithStatusJSON(http.StatusBadRequest, hostdb.GenericError{
-			Error: "no id provided",
+	collectors, err := loadCollectors(time.Now().UTC())
+	if err != nil {
+		log.Println(err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
+			Error: "getting the collectors from the database failed",
 		})
 		return
 	}
 
-	// check for the record
-	record, err := getMariadbRow(id)
-	if err != nil {
-		if err, ok := err.(*mysql.MySQLError); ok {
-			log.Println(fmt.Sprintf("%v: %v", err.Number, err.Message))
-			c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
-				Error: "could not get record from the database",
-			})
+	response := []collector{}
+	for _, found := range collectors {
+		if value := c.Query("type"); value != "" && value != found.Type {
+			continue
+		}
+
+		if value := c.Query("status"); value != "" && value != found.Status {
+			continue
+		}
+
+		if !describeCollector(c, &found) {
 			return
 		}
 
-		// all other errors
+		response = append(response, found)
+	}
+
+	sendResponse(c, http.StatusOK, response)
+
+}
+
+// get a single collector
+func getCollector(c *gin.Context) {
+
+	found, err := getMariadbCollector(c.Param("name"))
+	if err != nil {
 		log.Println(err.Error())
 		c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
-			Error: "delete failed",
+			Error: "getting the collector from the database failed",
 		})
 		return
 	}
 
-	// if we didn't get a record back, return a 422
-	if record.ID == "" {
-		c.AbortWithStatus(http.StatusUnprocessableEntity)
+	if found.Name == "" {
+		c.AbortWithStatusJSON(http.StatusNotFound, hostdb.GenericError{Error: "collector not found"})
 		return
 	}
 
-	// DELETE
-	if err := deleteMariadbRow(id); err != nil {
-		if err, ok := err.(*mysql.MySQLError); ok {
-			log.Println(fmt.Sprintf("%v: %v", err.Number, err.Message))
-			c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
-				Error: "deleting the record failed",
-			})
-			return
-		}
+	found.Status = found.health(time.Now().UTC())
 
-		// all other errors
-		log.Println(err.Error())
-		c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
-			Error: "delete failed",
-		})
+	if !describeCollector(c, &found) {
 		return
 	}
 
-	sendResponse(c, http.StatusOK, gin.H{
-		"id":      id,
-		"deleted": true,
-	})
-	return
+	sendResponse(c, http.StatusOK, found)
 
 }
 
-// post many records at once
-func postBulk(c *gin.Context) {
-
-	var bulk hostdb.RecordSet
-	var replacements []hostdb.Record
+// count the records in a collector's scope, and format its timestamps for the response
+func describeCollector(c *gin.Context, found *collector) bool {
 
-	// get the raw request data
-	rawData, err := c.GetRawData()
+	records, err := countMariadbRows(found.where())
 	if err != nil {
 		log.Println(err.Error())
-		c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.PostRecordsResponse{
-			OK:    false,
-			Error: "failed to get request data",
+		c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
+			Error: "counting the collector's records failed",
 		})
-		return
+		return false
 	}
 
-	// marshal the []bytes into our struct
-	if err = json.Unmarshal([]byte(rawData), &bulk); err != nil {
-		log.Println(err.Error())
-		c.AbortWithStatusJSON(http.StatusBadRequest, hostdb.PostRecordsResponse{
-			OK:    false,
-			Error: "did not conform to expected standards",
-		})
-		return
+	found.Records = records
+	formatTimestamps(c, &found.Created, &found.Updated, &found.LastRun, &found.LastSuccess)
+
+	return true
+
+}
+
+// query the run ledger, newest first
+// narrowed by type, committer, status, collector (its type and scope), and since or until a start time
+func getRuns(c *gin.Context) {
+
+	// timer
+	start := time.Now()
+
+	where := hostdb.MariadbWhereClauses{
+		Groups: []hostdb.MariadbWhereGrouping{},
 	}
 
-	//
-	// validation
-	//
+	limit := hostdb.MariadbLimit{
+		Limit: config.API.V0.DefaultLimit,
+	}
 
-	// ensure we have a type, and that it contains no spaces
-	if bulk.Type == "" {
-		c.AbortWithStatusJSON(http.StatusBadRequest, hostdb.PostRecordsResponse{
-			OK:    false,
-			Error: "no type provided",
-		})
-		return
-	} else if strings.Contains(bulk.Type, " ") {
-		c.AbortWithStatusJSON(http.StatusBadRequest, hostdb.PostRecordsResponse{
-			OK:    false,
-			Error: "type cannot contain a space character",
-		})
-		return
+	for key, values := range c.Request.URL.Query() {
+		switch key {
+		case "_timestamp_format":
+			// see formatTimestamps
+		case "_limit", "_offset":
+			i, err := strconv.Atoi(values[0])
+			if err != nil || i < 0 {
+				c.AbortWithStatusJSON(http.StatusBadRequest, hostdb.GenericError{
+					Error: fmt.Sprintf("%s parameter must be a positive integer", key),
+				})
+				return
+			}
+
+			if key == "_limit" {
+				limit.Limit = i
+			} else {
+				limit.Offset = i
+			}
+		case "type", "committer", "status":
+			if key == "status" {
+				for _, value := range values {
+					if !runStatusValid(value) {
+						c.AbortWithStatusJSON(http.StatusBadRequest, hostdb.GenericError{
+							Error: fmt.Sprintf("status parameter must be one of %v", runStatuses),
+						})
+						return
+					}
+				}
+			}
+
+			operator := "="
+			if len(values) > 1 {
+				operator = "IN"
+			}
+
+			where.Groups = append(where.Groups, hostdb.MariadbWhereGrouping{
+				Clauses: []hostdb.MariadbWhereClause{
+					{
+						Relativity: "AND",
+						Key:        []string{key},
+						Operator:   operator,
+						Value:      values,
+					},
+				},
+			})
+		case "collector":
+			found, err := getMariadbCollector(values[0])
+			if err != nil {
+				log.Println(err.Error())
+				c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
+					Error: "getting the collector from the database failed",
+				})
+				return
+			}
+
+			if found.Name == "" {
+				c.AbortWithStatusJSON(http.StatusBadRequest, hostdb.GenericError{
+					Error: fmt.Sprintf("there is no collector named '%s'", values[0]),
+				})
+				return
+			}
+
+			// the runs table has the same type and context columns as the records
+			where.Groups = append(where.Groups, found.where().Groups...)
+		case "since", "until":
+			timestamp, err := parseTimestamp(values[0])
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, hostdb.GenericError{
+					Error: fmt.Sprintf("%s parameter must be a timestamp", key),
+				})
+				return
+			}
+
+			operator := ">="
+			if key == "until" {
+				operator = "<="
+			}
+
+			where.Groups = append(where.Groups, hostdb.MariadbWhereGrouping{
+				Clauses: []hostdb.MariadbWhereClause{
+					{
+						Relativity: "AND",
+						Key:        []string{"started"},
+						Operator:   operator,
+						Value:      []string{timestamp.Format(storedTimestampFormat)},
+					},
+				},
+			})
+		default:
+			c.AbortWithStatusJSON(http.StatusBadRequest, hostdb.GenericError{
+				Error: fmt.Sprintf("unsupported query param '%s'", key),
+			})
+			return
+		}
 	}
 
-	// ensure we have a timestamp
-	if bulk.Timestamp == "" {
-		c.AbortWithStatusJSON(http.StatusBadRequest, hostdb.PostRecordsResponse{
-			OK:    false,
-			Error: "no timestamp provided",
+	runs, foundRows, err := getMariadbRuns(where, limit)
+	if err != nil {
+		log.Println(err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
+			Error: "getting the runs from the database failed",
 		})
 		return
 	}
 
-	// is the timestamp valid
-	timestamp, err := time.Parse("2006-01-02 15:04:05", bulk.Timestamp)
-	if timestamp.IsZero() {
-		bulk.Timestamp = time.Now().UTC().Format("2006-01-02 15:04:05")
+	for i := range runs {
+		formatTimestamps(c, &runs[i].Started, &runs[i].Finished)
 	}
 
-	// ensure we have context
-	if bulk.Context == nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, hostdb.PostRecordsResponse{
-			OK:    false,
-			Error: "no context provided",
+	// stop the query timer
+	end := time.Now()
+	latency := end.Sub(start)
+
+	sendResponse(c, http.StatusOK, getRunsResponse{
+		Count:     foundRows,
+		QueryTime: fmt.Sprintf("%v", latency),
+		Runs:      runs,
+	})
+
+}
+
+// get a single run from the ledger
+func getRun(c *gin.Context) {
+
+	found, err := getMariadbRun(c.Param("id"))
+	if err != nil {
+		log.Println(err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
+			Error: "getting the run from the database failed",
 		})
 		return
 	}
 
-	// ensure we have a committer
-	if bulk.Committer == "" {
-		bulk.Committer = fmt.Sprintf("%v: %v", c.Request.RemoteAddr, c.Request.UserAgent())
+	if found.ID == "" {
+		c.AbortWithStatusJSON(http.StatusNotFound, hostdb.GenericError{Error: "run not found"})
+		return
 	}
 
-	// ensure each of the required context fields are present for this type of record
-	for recordType := range config.API.V0.ContextFields {
-		if strings.Contains(bulk.Type, recordType) {
-			for _, k := range config.API.V0.ContextFields[bulk.Type] {
-				if _, ok := bulk.Context[k]; !ok {
-					c.AbortWithStatusJSON(http.StatusBadRequest, hostdb.PostRecordsResponse{
-						OK:    false,
-						Error: fmt.Sprintf("missing context value for %s", k),
-					})
-					return
-				}
-			}
-			break
+	formatTimestamps(c, &found.Started, &found.Finished)
+
+	sendResponse(c, http.StatusOK, found)
+
+}
+
+// list the changes to records after the since token, in order
+// since may be 0 (the default) for every change which is still kept, or now for none; each page has the token for the next
+func getChanges(c *gin.Context) {
+
+	limit := defaultChangesLimit
+	if value := c.Query("limit"); value != "" {
+		i, err := strconv.Atoi(value)
+		if err != nil || i < 0 || i > maxChangesLimit {
+			c.AbortWithStatusJSON(http.StatusBadRequest, hostdb.GenericError{
+				Error: fmt.Sprintf("limit must be a number from 0 to %d", maxChangesLimit),
+			})
+			return
 		}
+		limit = i
 	}
 
-	// ensure we have a data payload for each record
-	for _, record := range bulk.Records {
-		if record.Data == nil {
-			c.AbortWithStatusJSON(http.StatusBadRequest, hostdb.PostRecordsResponse{
-				OK:    false,
-				Error: "data payload/element is missing from one or more records",
+	var since uint64
+	if value := c.DefaultQuery("since", "0"); value != "now" {
+		i, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, hostdb.GenericError{
+				Error: "since must be a token from a previous response, 0 or now",
 			})
 			return
 		}
+		since = i
 	}
 
-	// prepare a collection of existing records, based on type and bulk.Context
-	var collection map[string]hostdb.Record
-
-	where := hostdb.MariadbWhereClauses{
-		Groups: []hostdb.MariadbWhereGrouping{
-			{
-				Clauses: []hostdb.MariadbWhereClause{
-					{
-						Relativity: "AND",
-						Key:        []string{"type"},
-						Operator:   "=",
-						Value:      []string{bulk.Type},
-					},
-				},
-			},
-		},
-	}
-
-	// build the WHERE clauses for this bulk.Type
-	if strings.Contains(bulk.Type, "aws") {
-		where.Groups = append(where.Groups, hostdb.MariadbWhereGrouping{
-			Clauses: []hostdb.MariadbWhereClause{
-				{
-					Relativity: "AND",
-					Key:        []string{fmt.Sprintf("json_value(context, '$%s')", config.API.V0.QueryParams["aws-region"]["aws"].Context)},
-					Operator:   "",
-					Value:      []string{bulk.Context["aws-region"].(string)},
-				}, {
-					Relativity: "AND",
-					Key:        []string{fmt.Sprintf("json_value(context, '$%s')", config.API.V0.QueryParams["aws-account-id"]["aws"].Context)},
-					Operator:   "",
-					Value:      []string{bulk.Context["aws-account-id"].(string)},
-				},
-			},
-		})
-	} else if strings.Contains(bulk.Type, "oneview") { // filter by oneview_url
-		where.Groups = append(where.Groups, hostdb.MariadbWhereGrouping{
-			Clauses: []hostdb.MariadbWhereClause{
-				{
-					Relativity: "AND",
-					Key:        []string{fmt.Sprintf("json_value(context, '$%s')", config.API.V0.QueryParams["oneview_url"]["oneview"].Context)},
-					Operator:   "",
-					Value:      []string{bulk.Context["oneview_url"].(string)},
-				},
-			},
-		})
-	} else if bulk.Type == "openstack" { // ensure we only get records for this tenant
-		where.Groups = append(where.Groups, hostdb.MariadbWhereGrouping{
-			Clauses: []hostdb.MariadbWhereClause{
-				{
-					Relativity: "AND",
-					Key:        []string{fmt.Sprintf("json_value(context, '$%s')", config.API.V0.QueryParams["tenant"]["openstack"].Context)},
-					Operator:   "=",
-					Value:      []string{bulk.Context["tenant_name"].(string)},
-				},
-			},
-		})
-	} else if strings.Contains(bulk.Type, "ucs") { // filter by ucs_url
-		where.Groups = append(where.Groups, hostdb.MariadbWhereGrouping{
-			Clauses: []hostdb.MariadbWhereClause{
-				{
-					Relativity: "AND",
-					Key:        []string{fmt.Sprintf("json_value(context, '$%s')", config.API.V0.QueryParams["ucs_url"]["ucs"].Context)},
-					Operator:   "",
-					Value:      []string{bulk.Context["ucs_url"].(string)},
-				},
-			},
+	oldest, latest, pending, err := getMariadbChangeBounds(since)
+	if err != nil {
+		log.Println(err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
+			Error: "could not get changes from the database",
 		})
-	} else if bulk.Type == "vrops-vmware" { // filter by vc_url
-		where.Groups[0].Clauses[0].Operator = "LIKE"
-		where.Groups[0].Clauses[0].Value = []string{fmt.Sprintf("%s%%", where.Groups[0].Clauses[0].Value[0])}
-		where.Groups = append(where.Groups, hostdb.MariadbWhereGrouping{
-			Clauses: []hostdb.MariadbWhereClause{
-				{
-
-					Relativity: "AND",
-					Key:        []string{fmt.Sprintf("json_value(context, '$%s')", config.API.V0.QueryParams["vc_url"]["vrops-vmware"].Context)},
-					Operator:   "=",
-					Value:      []string{bulk.Context["vc_url"].(string)},
-				},
-			},
+		return
+	}
+
+	if c.Query("since") == "now" {
+		since = latest
+		pending = 0
+	} else if since > 0 && since+1 < oldest {
+		c.AbortWithStatusJSON(http.StatusGone, hostdb.GenericError{
+			Error: "the changes since that token are no longer kept; read the records again, and follow the changes from since=now",
 		})
+		return
 	}
 
-	// attempt to retrieve existing records
-	if len(where.Groups[0].Clauses) > 0 {
-		collection, _, err = getMariadbRows(where, hostdb.MariadbLimit{})
-		if err != nil {
+	response := changesResponse{
+		Changes: []changeEntry{},
+		LastSeq: strconv.FormatUint(since, 10),
+	}
+
+	if limit > 0 && pending > 0 {
+		if response.Changes, err = getMariadbChanges(since, latest, limit); err != nil {
 			log.Println(err.Error())
-			c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.PostRecordsResponse{
-				OK:    false,
-				Error: "Couldn't get existing records before applying bulk record request.",
+			c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
+				Error: "could not get changes from the database",
 			})
 			return
 		}
 	}
 
-	// loop over the new records in the request
-	for _, record := range bulk.Records {
+	for i := range response.Changes {
+		formatTimestamps(c, &response.Changes[i].Timestamp)
+	}
 
-		// get any missing data from the bulk record set
-		if record.Type == "" {
-			record.Type = bulk.Type
-		}
+	if len(response.Changes) > 0 {
+		response.LastSeq = response.Changes[len(response.Changes)-1].Seq
+	}
+	response.Pending = pending - len(response.Changes)
+
+	sendResponse(c, http.StatusOK, response)
+
+}
+
+// stream the changes to records matching the query params, as server-sent events
+// a client which reconnects with a Last-Event-ID header (or _last_event_id) is sent the buffered events it missed
+func getEvents(c *gin.Context) {
+
+	query := c.Request.URL.Query()
+
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = query.Get("_last_event_id")
+	}
+	query.Del("_last_event_id")
 
-		if record.Timestamp == "" {
-			record.Timestamp = bulk.Timestamp
+	for _, param := range []string{"_limit", "_offset"} {
+		if _, ok := query[param]; ok {
+			c.AbortWithStatusJSON(http.StatusBadRequest, hostdb.GenericError{
+				Error: fmt.Sprintf("%s is not supported for event streams", param),
+			})
+			return
 		}
+	}
 
-		if record.Committer == "" {
-			record.Committer = bulk.Committer
+	where, _, err := queryWhereClauses(query)
+	if err != nil {
+		if err, ok := err.(hostdb.ErrorResponse); ok {
+			c.AbortWithStatusJSON(err.Code, hostdb.GenericError{
+				Error: err.Message,
+			})
+			return
 		}
 
-		// smoosh context
-		for key, val := range bulk.Context {
-			if record.Context == nil {
-				record.Context = map[string]interface{}{}
-			}
+		c.AbortWithStatusJSON(http.StatusBadRequest, hostdb.GenericError{
+			Error: err.Error(),
+		})
+		return
+	}
 
-			if _, ok := record.Context[key]; ok {
-				if record.Context[key] == "" {
-					// if the context key is present, but empty
-					record.Context[key] = val
-				}
-			} else {
-				// if the context key is absent
-				record.Context[key] = val
+	subscriber, backlog, missed, lastID := recordEvents.subscribe(lastEventID)
+	defer recordEvents.unsubscribe(subscriber)
+
+	stream := eventStream{
+		where:  where,
+		legacy: legacyTimestamps(c),
+		lastID: lastID,
+	}
+	if lastEventID == "" {
+		stream.sentID = lastID
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no") // otherwise nginx buffers the stream
+	c.Status(http.StatusOK)
+
+	if missed {
+		err = stream.reset(c.Writer)
+	} else {
+		err = stream.write(c.Writer, newEventBatch(backlog))
+	}
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+
+	c.Writer.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case batch, ok := <-subscriber.events:
+			if !ok {
+				// it fell too far behind; the client can reconnect, and resume from the buffer
+				return
 			}
+			err = stream.write(c.Writer, batch)
+		case <-keepAlive.C:
+			err = stream.keepAlive(c.Writer)
 		}
 
-		// hash data payload
-		record.Hash, err = hashPayload(record.Data)
 		if err != nil {
 			log.Println(err.Error())
-			c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.PostRecordsResponse{
-				OK:    false,
-				Error: "hashing the data failed",
+			return
+		}
+
+		c.Writer.Flush()
+	}
+
+}
+
+// delete a single record
+func deleteRecord(c *gin.Context) {
+
+	// verify id
+	id := c.Param("id")
+	if id == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, hostdb.GenericError{
+			Error: "no id provided",
+		})
+		return
+	}
+
+	// check for the record
+	record, err := getMariadbRow(id)
+	if err != nil {
+		if err, ok := err.(*mysql.MySQLError); ok {
+			log.Println(fmt.Sprintf("%v: %v", err.Number, err.Message))
+			c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
+				Error: "could not get record from the database",
 			})
 			return
 		}
 
-		// ensure data consistency before finding a match
-		if err = ensureDataIsComplete(&record); err != nil {
-			log.Println(err.Error())
-			c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.PostRecordsResponse{
-				OK:    false,
-				Error: "attempting to enforce data consistency failed",
+		// all other errors
+		log.Println(err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
+			Error: "delete failed",
+		})
+		return
+	}
+
+	// if we didn't get a record back, return a 422
+	if record.ID == "" {
+		c.AbortWithStatus(http.StatusUnprocessableEntity)
+		return
+	}
+
+	if !checkIfMatch(c, record) {
+		return
+	}
+
+	// the record is read while it still exists, to announce its deletion
+	changes := gatherRecordChanges(recordEventDelete, []string{id})
+
+	// DELETE
+	if err := deleteMariadbRow(id, c.GetHeader("If-Match")); err != nil {
+		if err == errPreconditionFailed {
+			c.AbortWithStatusJSON(http.StatusPreconditionFailed, hostdb.GenericError{
+				Error: err.Error(),
 			})
 			return
 		}
 
-		existing := hostdb.Record{}
-		if record.ID == "" {
+		if err, ok := err.(*mysql.MySQLError); ok {
+			log.Println(fmt.Sprintf("%v: %v", err.Number, err.Message))
+			c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
+				Error: "deleting the record failed",
+			})
+			return
+		}
 
-			// if there are no records to check against
-			// then this must be a new record
-			if len(collection) < 1 {
-				record.ID = getUUID("hdb")
-			}
+		// all other errors
+		log.Println(err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
+			Error: "delete failed",
+		})
+		return
+	}
 
-			for _, v := range collection {
-				// attempt to match a record
-				switch bulk.Type {
-				case "aws-bucket":
-					var newRecord, oldRecord struct {
-						ID string `json:"Name"`
-					}
+	auditLog(c, "delete_record", []string{id}, 0, 0, 1, "")
+	changes.announce([]string{id})
 
-					if err := loadRecords(record.Data, &newRecord, v.Data, &oldRecord); err != nil {
-						log.Println(err.Error())
-						c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.PostRecordsResponse{
-							OK:    false,
-							Error: "failed to unmarshal record data",
-						})
-						return
-					}
+	sendResponse(c, http.StatusOK, gin.H{
+		"id":      id,
+		"deleted": true,
+	})
+	return
 
-					if newRecord.ID != oldRecord.ID {
-						continue // keep looking for a match
-					}
-				case "aws-database":
-					var newRecord, oldRecord struct {
-						ID string `json:"DbiResourceId"`
-					}
+}
 
-					if err := loadRecords(record.Data, &newRecord, v.Data, &oldRecord); err != nil {
-						log.Println(err.Error())
-						c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.PostRecordsResponse{
-							OK:    false,
-							Error: "failed to unmarshal record data",
-						})
-						return
-					}
+// the records matched by a delete by query, and whether they were deleted
+type deleteRecordsResponse struct {
+	Count   int      `json:"count"`
+	IDs     []string `json:"ids"`
+	Deleted bool     `json:"deleted"`
+	Message string   `json:"message,omitempty"`
+}
 
-					if newRecord.ID != oldRecord.ID {
-						continue // keep looking for a match
-					}
-				case "aws-directconnect":
-					var newRecord, oldRecord struct {
-						ID string `json:"VirtualInterfaceId"`
-					}
+// delete every record matching the query params
+// nothing is deleted unless _confirm is the number of matching records, as returned by a preview (the same request without _confirm)
+func deleteRecords(c *gin.Context) {
 
-					if err := loadRecords(record.Data, &newRecord, v.Data, &oldRecord); err != nil {
-						log.Println(err.Error())
-						c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.PostRecordsResponse{
-							OK:    false,
-							Error: "failed to unmarshal record data",
-						})
-						return
-					}
+	query := c.Request.URL.Query()
 
-					if newRecord.ID != oldRecord.ID {
-						continue // keep looking for a match
-					}
-				case "aws-hostedzone":
-					var newRecord, oldRecord struct {
-						ID string `json:"Id"`
-					}
+	confirm := query.Get("_confirm")
+	query.Del("_confirm")
 
-					if err := loadRecords(record.Data, &newRecord, v.Data, &oldRecord); err != nil {
-						log.Println(err.Error())
-						c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.PostRecordsResponse{
-							OK:    false,
-							Error: "failed to unmarshal record data",
-						})
-						return
-					}
+	// a limit or offset would make the count meaningless
+	for _, param := range []string{"_limit", "_offset"} {
+		if _, ok := query[param]; ok {
+			c.AbortWithStatusJSON(http.StatusBadRequest, hostdb.GenericError{
+				Error: fmt.Sprintf("%s is not supported when deleting records", param),
+			})
+			return
+		}
+	}
 
-					if newRecord.ID != oldRecord.ID {
-						continue // keep looking for a match
-					}
-				case "aws-image":
-					var newRecord, oldRecord struct {
-						ID string `json:"ImageId"`
-					}
+	where, _, err := queryWhereClauses(query)
+	if err != nil {
+		if err, ok := err.(hostdb.ErrorResponse); ok {
+			c.AbortWithStatusJSON(err.Code, hostdb.GenericError{
+				Error: err.Message,
+			})
+			return
+		}
 
-					if err := loadRecords(record.Data, &newRecord, v.Data, &oldRecord); err != nil {
-						log.Println(err.Error())
-						c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.PostRecordsResponse{
-							OK:    false,
-							Error: "failed to unmarshal record data",
-						})
-						return
-					}
+		c.AbortWithStatusJSON(http.StatusBadRequest, hostdb.GenericError{
+			Error: err.Error(),
+		})
+		return
+	}
 
-					if newRecord.ID != oldRecord.ID {
-						continue // keep looking for a match
-					}
-				case "aws-keypair":
-					var newRecord, oldRecord struct {
-						ID string `json:"KeyName"`
-					}
+	// without any filters, every record would match
+	if len(where.Groups) < 1 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, hostdb.GenericError{
+			Error: "at least one query param is required to delete records",
+		})
+		return
+	}
 
-					if err := loadRecords(record.Data, &newRecord, v.Data, &oldRecord); err != nil {
-						log.Println(err.Error())
-						c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.PostRecordsResponse{
-							OK:    false,
-							Error: "failed to unmarshal record data",
-						})
-						return
-					}
+	ids, err := getRowIds(where)
+	if err != nil {
+		log.Println(err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
+			Error: "could not get records from the database",
+		})
+		return
+	}
 
-					if newRecord.ID != oldRecord.ID {
-						continue // keep looking for a match
-					}
-				case "aws-securitygroup":
-					var newRecord, oldRecord struct {
-						ID string `json:"GroupId"`
-					}
+	sort.Strings(ids)
 
-					if err := loadRecords(record.Data, &newRecord, v.Data, &oldRecord); err != nil {
-						log.Println(err.Error())
-						c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.PostRecordsResponse{
-							OK:    false,
-							Error: "failed to unmarshal record data",
-						})
-						return
-					}
+	response := deleteRecordsResponse{
+		Count: len(ids),
+		IDs:   append([]string{}, ids...),
+	}
 
-					if newRecord.ID != oldRecord.ID {
-						continue // keep looking for a match
-					}
-				case "aws-subnet":
-					var newRecord, oldRecord struct {
-						ID string `json:"SubnetId"`
-					}
+	// preview
+	if confirm == "" {
+		response.Message = fmt.Sprintf("repeat the request with _confirm=%d to delete these records", len(ids))
+		sendResponse(c, http.StatusPreconditionRequired, response)
+		return
+	}
 
-					if err := loadRecords(record.Data, &newRecord, v.Data, &oldRecord); err != nil {
-						log.Println(err.Error())
-						c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.PostRecordsResponse{
-							OK:    false,
-							Error: "failed to unmarshal record data",
-						})
-						return
-					}
+	confirmed, err := strconv.Atoi(confirm)
+	if err != nil || confirmed < 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, hostdb.GenericError{
+			Error: "_confirm must be the number of records to be deleted",
+		})
+		return
+	}
 
-					if newRecord.ID != oldRecord.ID {
-						continue // keep looking for a match
-					}
-				case "aws-vpc":
-					var newRecord, oldRecord struct {
-						ID string `json:"VpcId"`
-					}
+	// the records have changed since the preview, or the caller is guessing
+	if confirmed != len(ids) {
+		response.Message = fmt.Sprintf("_confirm=%d doesn't match the %d record(s) matching the query; nothing was deleted", confirmed, len(ids))
+		sendResponse(c, http.StatusConflict, response)
+		return
+	}
 
-					if err := loadRecords(record.Data, &newRecord, v.Data, &oldRecord); err != nil {
-						log.Println(err.Error())
-						c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.PostRecordsResponse{
-							OK:    false,
-							Error: "failed to unmarshal record data",
-						})
-						return
-					}
+	if len(ids) > 0 {
+		changes := gatherRecordChanges(recordEventDelete, ids)
 
-					if newRecord.ID != oldRecord.ID {
-						continue // keep looking for a match
-					}
-				case "oneview-enclosure", "oneview-enclosure_group", "oneview-ethernet_network", "oneview-fc_network", "oneview-fcoe_network", "oneview-interconnect", "oneview-interconnect_type", "oneview-logical_enclosure", "oneview-logical_interconnect", "oneview-logical_interconnect_group", "oneview-network_set", "oneview-scope", "oneview-server_hardware", "oneview-server_hardware_type", "oneview-server_profile", "oneview-server_profile_template", "oneview-storage_pool", "oneview-storage_system", "oneview-storage_volume", "oneview-storage_volume_attachment", "oneview-storage_volume_template", "oneview-task", "oneview-uplink_set":
-					var newRecord, oldRecord struct {
-						ID string `json:"uri"`
-					}
+		deleted, err := deleteMariadbRows(ids)
+		if err != nil {
+			log.Println(err.Error())
+			c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
+				Error: "deleting the records failed",
+			})
+			return
+		}
 
-					if err := loadRecords(record.Data, &newRecord, v.Data, &oldRecord); err != nil {
-						log.Println(err.Error())
-						c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.PostRecordsResponse{
-							OK:    false,
-							Error: "failed to unmarshal record data",
-						})
-						return
-					}
+		response.Count = deleted
+		auditLog(c, "delete_records", ids, 0, 0, deleted, c.Request.URL.RawQuery)
+		changes.announce(ids)
+	}
 
-					if newRecord.ID != oldRecord.ID {
-						continue // keep looking for a match
-					}
-				case "openstack": // match on openstack guid
-					var newRecord, oldRecord struct {
-						ID string `json:"id"`
-					}
+	response.Deleted = true
 
-					if err := loadRecords(record.Data, &newRecord, v.Data, &oldRecord); err != nil {
-						log.Println(err.Error())
-						c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.PostRecordsResponse{
-							OK:    false,
-							Error: "failed to unmarshal record data",
-						})
-						return
-					}
+	sendResponse(c, http.StatusOK, response)
 
-					if newRecord.ID != oldRecord.ID {
-						continue // keep looking for a match
-					}
-				case "ucs-cpu", "ucs-fabric_interconnect", "ucs-memory", "ucs-pci", "ucs-storage", "ucs-vhba", "ucs-vic", "ucs-vnic":
-					var newRecord, oldRecord struct {
-						ID string `json:"dn"`
-					}
+}
 
-					if err := loadRecords(record.Data, &newRecord, v.Data, &oldRecord); err != nil {
-						log.Println(err.Error())
-						c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.PostRecordsResponse{
-							OK:    false,
-							Error: "failed to unmarshal record data",
-						})
-						return
-					}
+// post many records at once
+// the body is either a json record set, or newline delimited json (see reconcileNDJSON)
+func postBulk(c *gin.Context) {
 
-					if newRecord.ID != oldRecord.ID {
-						continue // keep looking for a match
-					}
-				case "ucs-disk", "ucs-psu":
-					var newRecord, oldRecord struct {
-						ID string `json:"serial"`
-					}
+	var reconciler *bulkReconciler
+	var err error
 
-					if err := loadRecords(record.Data, &newRecord, v.Data, &oldRecord); err != nil {
-						log.Println(err.Error())
-						c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.PostRecordsResponse{
-							OK:    false,
-							Error: "failed to unmarshal record data",
-						})
-						return
-					}
+	dryRun := queryFlag(c, "_dry_run")
+	partial := queryFlag(c, "_partial")
+	force := queryFlag(c, "_force")
 
-					if newRecord.ID != oldRecord.ID {
-						continue // keep looking for a match
-					}
-				case "vrops-vmware":
-					var newRecord, oldRecord struct {
-						ID string `json:"resourceId"`
-					}
+	// records without a committer are attributed to the client
+	committer := fmt.Sprintf("%v: %v", c.Request.RemoteAddr, c.Request.UserAgent())
 
-					if err := loadRecords(record.Data, &newRecord, v.Data, &oldRecord); err != nil {
-						log.Println(err.Error())
-						c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.PostRecordsResponse{
-							OK:    false,
-							Error: "failed to unmarshal record data",
-						})
-						return
-					}
+	// big requests can be queued, and processed in the background
+	if queryFlag(c, "_async") {
+		queueBulkJob(c, committer)
+		return
+	}
 
-					if newRecord.ID != oldRecord.ID {
-						continue // keep looking for a match
-					}
-				default:
-					// if we don't have a better way of identifying existing records, fall back on hostname (this really *is* awful. i'm so ashamed.)
-					if record.Hostname != v.Hostname {
-						continue // keep looking for a match
-					}
-				}
+	if c.ContentType() == "application/x-ndjson" {
+		reconciler, err = reconcileNDJSON(c.Request.Body, dryRun, committer, nil)
+	} else {
+		// get the raw request data
+		var rawData []byte
+		if rawData, err = c.GetRawData(); err != nil {
+			log.Println(err.Error())
+			c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.PostRecordsResponse{
+				OK:    false,
+				Error: "failed to get request data",
+			})
+			return
+		}
 
-				// since we've found a match in the database, give record the id
-				record.ID = v.ID
-				existing = v
+		reconciler, err = reconcileJSON(rawData, dryRun, committer, nil)
+	}
+	if err != nil {
+		abortBulk(c, err)
+		return
+	}
+	defer reconciler.close()
 
-				// don't need to keep loo{k|p}ing, we found a match
-				break
-			}
+	status, result := applyBulk(reconciler, partial, force, requestAuditor(c))
 
-		} else { // if id is present, attempt match to existing
+	if status >= http.StatusBadRequest {
+		c.AbortWithStatusJSON(status, result)
+		return
+	}
 
-			existing, err = getMariadbRow(record.ID)
-			if err != nil {
-				log.Println(err.Error())
-				c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.PostRecordsResponse{
-					OK:    false,
-					Error: fmt.Sprintf("failed to get database record, id = %v", record.ID),
-				})
-				return
-			}
+	sendResponse(c, status, result)
+
+}
+
+// queue a bulk request, to be processed in the background
+// the request is validated as far as possible first, so that the client hears about bad requests straight away
+func queueBulkJob(c *gin.Context, committer string) {
+
+	var bulk hostdb.RecordSet
+	var body io.Reader
+
+	contentType := c.ContentType()
+
+	if contentType == "application/x-ndjson" {
+		reader := newNDJSONReader(c.Request.Body)
 
+		header, line, err := reader.header()
+		if err != nil {
+			abortBulk(c, err)
+			return
 		}
 
-		// if we don't have a record id by now, generate a new one
-		if record.ID == "" {
-			record.ID = getUUID("hdb")
+		bulk = header
+
+		// put the header line back in front of the records
+		body = io.MultiReader(bytes.NewReader(append(line, '\n')), reader.reader)
+	} else {
+		rawData, err := c.GetRawData()
+		if err != nil {
+			log.Println(err.Error())
+			c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.PostRecordsResponse{
+				OK:    false,
+				Error: "failed to get request data",
+			})
+			return
 		}
 
-		// if the record has changed, replace it in the database
-		if anythingChanged(record, existing) {
-			replacements = append(replacements, record)
+		if err = json.Unmarshal(rawData, &bulk); err != nil {
+			log.Println(err.Error())
+			c.AbortWithStatusJSON(http.StatusBadRequest, hostdb.PostRecordsResponse{
+				OK:    false,
+				Error: "did not conform to expected standards",
+			})
+			return
 		}
 
-		// remove this id from the records to be deleted
-		delete(collection, record.ID)
+		body = bytes.NewReader(rawData)
+		contentType = "application/json"
 	}
 
-	// save all the records
-	if err := saveMariadbRows(replacements); err != nil {
-		log.Println(err.Error())
-		c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.PostRecordsResponse{
+	if err := validateRecordSet(&bulk, committer); err != nil {
+		abortBulk(c, err)
+		return
+	}
+
+	scope, err := jobScope(bulk)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, hostdb.PostRecordsResponse{
 			OK:    false,
-			Error: "failed to insert/replace records",
+			Error: err.Error(),
 		})
 		return
 	}
 
-	// delete all ids that remain in the collection
-	deleteFail := false
-	for id := range collection {
-		if err = deleteMariadbRow(id); err != nil {
+	job := bulkJob{
+		ID:          getUUID("job"),
+		Status:      jobQueued,
+		Type:        bulk.Type,
+		Scope:       scope,
+		ContentType: contentType,
+		DryRun:      queryFlag(c, "_dry_run"),
+		Partial:     queryFlag(c, "_partial"),
+		Force:       queryFlag(c, "_force"),
+		Committer:   committer,
+		Principal:   getPrincipal(c),
+		SourceIP:    c.ClientIP(),
+		RequestID:   c.GetString(requestIDKey),
+		Path:        c.Request.URL.RequestURI(),
+		Created:     time.Now().UTC().Format("2006-01-02 15:04:05"),
+	}
+
+	// the body is stored before the job, so that a job is never queued without its body
+	if err := saveJobBody(job.ID, body); err != nil {
+		log.Println(err.Error())
+
+		if err := deleteMariadbJobBody(job.ID); err != nil {
 			log.Println(err.Error())
-			deleteFail = true // keep trying
 		}
+
+		c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.PostRecordsResponse{
+			OK:    false,
+			Error: "failed to queue the bulk request",
+		})
+		return
 	}
 
-	if deleteFail {
+	if err := saveMariadbJob(job); err != nil {
+		log.Println(err.Error())
 		c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.PostRecordsResponse{
 			OK:    false,
-			Error: "Deleting one or more records failed. Please check the HostDB server logs.",
+			Error: "failed to queue the bulk request",
 		})
 		return
 	}
 
-	sendResponse(c, http.StatusOK, hostdb.PostRecordsResponse{
-		OK:    true,
-		Error: fmt.Sprintf("%d record(s) processed", len(bulk.Records)),
-	})
+	jobs.enqueue(job.Scope, job.ID)
+
+	c.Header("Location", fmt.Sprintf("/v0/jobs/%s", job.ID))
+	formatTimestamps(c, &job.Created, &job.Started, &job.Finished)
+	sendResponse(c, http.StatusAccepted, job)
 
 }
 
-func loadRecords(newRecord []byte, newRecordStruct interface{}, existingRecord []byte, existingRecordStruct interface{}) error {
-	// get the new record openstack id
-	if err := json.Unmarshal(newRecord, &newRecordStruct); err != nil {
-		return err
+// get the status of a queued bulk request, and its result once finished
+func getJob(c *gin.Context) {
+
+	job, err := getMariadbJob(c.Param("id"))
+	if err != nil {
+		log.Println(err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
+			Error: "getting the job from the database failed",
+		})
+		return
 	}
 
-	// get the existing record openstack id
-	if err := json.Unmarshal(existingRecord, &existingRecordStruct); err != nil {
-		return err
+	if job.ID == "" {
+		c.AbortWithStatusJSON(http.StatusNotFound, hostdb.GenericError{Error: "job not found"})
+		return
+	}
+
+	formatTimestamps(c, &job.Created, &job.Started, &job.Finished)
+
+	sendResponse(c, http.StatusOK, job)
+
+}
+
+// abort a bulk request which couldn't be reconciled
+func abortBulk(c *gin.Context, err error) {
+
+	if err, ok := err.(hostdb.ErrorResponse); ok {
+		c.AbortWithStatusJSON(err.Code, hostdb.PostRecordsResponse{
+			OK:    false,
+			Error: err.Message,
+		})
+		return
 	}
 
-	return nil
+	log.Println(err.Error())
+	c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.PostRecordsResponse{
+		OK:    false,
+		Error: "planning the bulk request failed",
+	})
+
 }
 
 // take in a map of records, and return headers and lines for printing
@@ -1441,6 +1913,8 @@ func outputCSV(c *gin.Context) {
 		return
 	}
 
+	formatRecordTimestamps(c, records)
+
 	header, lines, err := renderData(records)
 	if err != nil {
 		c.HTML(http.StatusInternalServerError, "error.html", err.Error())
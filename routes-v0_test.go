@@ -1,13 +1,16 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"sort"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -343,6 +346,731 @@ func TestPutRecords(t *testing.T) {
 
 }
 
+func TestPatchRecord(t *testing.T) {
+
+	record := generateTestRecord()
+	recordBytes, err := json.Marshal(&record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	makeTestPutRequest(t, fmt.Sprintf("/v0/records/%s", record.ID), bytes.NewReader(recordBytes))
+
+	patch := func(id string, contentType string, body string, respCode int) hostdb.Record {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("PATCH", fmt.Sprintf("/v0/records/%s", id), strings.NewReader(body))
+		req.Header.Add("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("writer:"+config.Hostdb.Pass)))
+		req.Header.Add("Content-Type", contentType)
+		Router.ServeHTTP(w, req)
+
+		assert.Equalf(t, respCode, w.Code, "%s", w.Body)
+
+		patched := hostdb.Record{}
+		if respCode == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&patched); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		return patched
+	}
+
+	// fix a single context field
+	patched := patch(record.ID, "application/merge-patch+json", `{"context":{"patched":"merge"}}`, http.StatusOK)
+	assert.Equal(t, "merge", patched.Context["patched"], "merge patch response")
+	assert.Equal(t, record.Hash, patched.Hash, "context patch leaves the hash")
+
+	patched = patch(record.ID, "application/json-patch+json", `[{"op":"add","path":"/data/patched","value":"json"}]`, http.StatusOK)
+	assert.NotEqual(t, record.Hash, patched.Hash, "data patch changes the hash")
+
+	// verify it worked
+	verifyRecord := decodeRecords(t, makeTestGetRequest(t, fmt.Sprintf("/v0/records/%s", record.ID), false, nil))[record.ID]
+
+	assert.Equal(t, "merge", verifyRecord.Context["patched"], "patched context")
+	assert.Contains(t, string(verifyRecord.Data), `"patched":"json"`, "patched data")
+	assert.Equal(t, record.Hostname, verifyRecord.Hostname, "hostname")
+
+	// failures
+	patch(record.ID, "application/json-patch+json", `[{"op":"test","path":"/context/patched","value":"nope"}]`, http.StatusConflict)
+	patch(record.ID, "application/merge-patch+json", `{"context":null}`, http.StatusUnprocessableEntity)
+	patch(record.ID, "application/json", `{}`, http.StatusUnsupportedMediaType)
+	patch("hdb-nonexistent", "application/merge-patch+json", `{}`, http.StatusNotFound)
+
+}
+
+func TestRecordPreconditions(t *testing.T) {
+
+	record := generateTestRecord()
+	recordBytes, err := json.Marshal(&record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	makeTestPutRequest(t, fmt.Sprintf("/v0/records/%s", record.ID), bytes.NewReader(recordBytes))
+
+	request := func(method string, header string, value string, contentType string, body string, respCode int) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, fmt.Sprintf("/v0/records/%s", record.ID), strings.NewReader(body))
+		req.Header.Add("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("writer:"+config.Hostdb.Pass)))
+		req.Header.Add(header, value)
+		if contentType != "" {
+			req.Header.Add("Content-Type", contentType)
+		}
+		Router.ServeHTTP(w, req)
+
+		assert.Equalf(t, respCode, w.Code, "%s %s: %s", method, header, w.Body)
+
+		return w
+	}
+
+	etag := makeTestGetRequest(t, fmt.Sprintf("/v0/records/%s", record.ID), false, nil).Header().Get("ETag")
+	assert.NotEmpty(t, etag, "etag")
+
+	// polling
+	request("GET", "If-None-Match", etag, "", "", http.StatusNotModified)
+	request("GET", "If-None-Match", `"stale"`, "", "", http.StatusOK)
+
+	// a write with a stale etag is refused
+	request("PATCH", "If-Match", `"stale"`, "application/merge-patch+json", `{"context":{"writer":"a"}}`, http.StatusPreconditionFailed)
+	request("PUT", "If-Match", `"stale"`, "", string(recordBytes), http.StatusPreconditionFailed)
+	request("DELETE", "If-Match", `"stale"`, "", "", http.StatusPreconditionFailed)
+
+	// a write with the current etag succeeds, and changes the etag
+	w := request("PATCH", "If-Match", etag, "application/merge-patch+json", `{"context":{"writer":"a"}}`, http.StatusOK)
+	newETag := w.Header().Get("ETag")
+	assert.NotEqual(t, etag, newETag, "patched etag")
+
+	// the second writer loses
+	request("PATCH", "If-Match", etag, "application/merge-patch+json", `{"context":{"writer":"b"}}`, http.StatusPreconditionFailed)
+	request("GET", "If-None-Match", etag, "", "", http.StatusOK)
+
+	request("DELETE", "If-Match", newETag, "", "", http.StatusOK)
+
+}
+
+func TestIPSearch(t *testing.T) {
+
+	record := generateTestRecord()
+	record.IP = "10.20.1.5, 2001:DB8:0:0::1"
+
+	recordBytes, err := json.Marshal(&record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	makeTestPutRequest(t, fmt.Sprintf("/v0/records/%s", record.ID), bytes.NewReader(recordBytes))
+
+	// the addresses are normalised
+	verifyRecord := decodeRecords(t, makeTestGetRequest(t, fmt.Sprintf("/v0/records/%s", record.ID), false, nil))[record.ID]
+	assert.Equal(t, "10.20.1.5,2001:db8::1", verifyRecord.IP, "ip")
+
+	search := func(ip string) map[string]hostdb.Record {
+		return decodeRecords(t, makeTestGetRequest(t, "/v0/detail/", false, map[string][]string{"ip": {ip}}))
+	}
+
+	for _, ip := range []string{"10.20.0.0/16", "10.20.1.5", "2001:db8::/32", "2001:0db8::0001", "10.21.0.0/16,2001:db8::1"} {
+		assert.Contains(t, search(ip), record.ID, ip)
+	}
+
+	for _, ip := range []string{"10.21.0.0/16", "2001:db9::/32", "10.20.1.6"} {
+		assert.NotContains(t, search(ip), record.ID, ip)
+	}
+
+	// a negative assertion excludes records with any matching address
+	records := decodeRecords(t, makeTestGetRequest(t, "/v0/detail/", false, map[string][]string{"type": {"test"}, "!ip": {"10.20.0.0/16"}}))
+	assert.NotContains(t, records, record.ID, "!ip")
+
+	makeTestRequest(t, "DELETE", fmt.Sprintf("/v0/records/%s", record.ID), true, nil, nil, http.StatusOK)
+
+	assert.NotContains(t, search("10.20.0.0/16"), record.ID, "deleted")
+
+}
+
+func TestDeleteRecordsByQuery(t *testing.T) {
+
+	const hostname = "delete-by-query.example.com"
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		record := generateTestRecord()
+		record.Hostname = hostname
+
+		recordBytes, err := json.Marshal(&record)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		makeTestPutRequest(t, fmt.Sprintf("/v0/records/%s", record.ID), bytes.NewReader(recordBytes))
+
+		ids = append(ids, record.ID)
+	}
+	sort.Strings(ids)
+
+	query := map[string][]string{"hostname": {hostname}}
+
+	decode := func(w *httptest.ResponseRecorder) (response deleteRecordsResponse) {
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	// admin auth, a filter, and no limit are required
+	makeTestRequest(t, "DELETE", "/v0/records/", false, query, nil, http.StatusUnauthorized)
+	makeTestRequest(t, "DELETE", "/v0/records/", true, nil, nil, http.StatusBadRequest)
+	makeTestRequest(t, "DELETE", "/v0/records/", true, map[string][]string{"hostname": {hostname}, "_limit": {"1"}}, nil, http.StatusBadRequest)
+
+	// preview
+	preview := decode(makeTestRequest(t, "DELETE", "/v0/records/", true, query, nil, http.StatusPreconditionRequired))
+	assert.Equal(t, 3, preview.Count, "preview count")
+	assert.Equal(t, ids, preview.IDs, "preview ids")
+	assert.False(t, preview.Deleted, "preview deleted")
+
+	// a mismatched confirmation deletes nothing
+	mismatch := decode(makeTestRequest(t, "DELETE", "/v0/records/", true, map[string][]string{"hostname": {hostname}, "_confirm": {"2"}}, nil, http.StatusConflict))
+	assert.False(t, mismatch.Deleted, "mismatch deleted")
+	makeTestGetRequest(t, fmt.Sprintf("/v0/records/%s", ids[0]), false, nil)
+
+	// confirmed
+	confirmed := decode(makeTestRequest(t, "DELETE", "/v0/records/", true, map[string][]string{"hostname": {hostname}, "_confirm": {"3"}}, nil, http.StatusOK))
+	assert.True(t, confirmed.Deleted, "confirmed deleted")
+	assert.Equal(t, 3, confirmed.Count, "confirmed count")
+	assert.Equal(t, ids, confirmed.IDs, "confirmed ids")
+
+	for _, id := range ids {
+		makeTestRequest(t, "GET", fmt.Sprintf("/v0/records/%s", id), false, nil, nil, http.StatusUnprocessableEntity)
+	}
+
+}
+
+func TestIdempotencyKey(t *testing.T) {
+
+	request := func(method string, path string, key string, body string, respCode int) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Add("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("writer:"+config.Hostdb.Pass)))
+		req.Header.Add("Idempotency-Key", key)
+		Router.ServeHTTP(w, req)
+
+		assert.Equalf(t, respCode, w.Code, "%s %s: %s", method, key, w.Body)
+
+		return w
+	}
+
+	// a retried PUT gets the stored response
+	record := generateTestRecord()
+	recordBytes, err := json.Marshal(&record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := getUUID("idm")
+	path := fmt.Sprintf("/v0/records/%s", record.ID)
+
+	first := request("PUT", path, key, string(recordBytes), http.StatusCreated)
+	assert.Empty(t, first.Header().Get("Idempotent-Replayed"), "first")
+
+	retry := request("PUT", path, key, string(recordBytes), http.StatusCreated)
+	assert.Equal(t, "true", retry.Header().Get("Idempotent-Replayed"), "retry")
+	assert.Equal(t, first.Body.String(), retry.Body.String(), "retry body")
+	assert.Equal(t, first.Header().Get("ETag"), retry.Header().Get("ETag"), "retry etag")
+
+	// the key can't be reused for a different request
+	record.Hostname = "different.pdxfixit.com"
+	differentBytes, err := json.Marshal(&record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request("PUT", path, key, string(differentBytes), http.StatusUnprocessableEntity)
+
+	makeTestRequest(t, "DELETE", path, true, nil, nil, http.StatusOK)
+
+	// a retried bulk POST doesn't create the records again
+	bulk := `{
+"type":"test-idempotency",
+"timestamp":"2020-05-02 20:09:26",
+"committer":"testing",
+"context": {
+  "test": true
+},
+"records":[
+  {
+    "hostname":"one.pdxfixit.com",
+    "data":{"name":"one"}
+  },{
+    "hostname":"two.pdxfixit.com",
+    "data":{"name":"two"}
+  }
+]}`
+
+	key = getUUID("idm")
+
+	first = request("POST", "/v0/records/", key, bulk, http.StatusOK)
+	retry = request("POST", "/v0/records/", key, bulk, http.StatusOK)
+	assert.Equal(t, "true", retry.Header().Get("Idempotent-Replayed"), "bulk retry")
+	assert.Equal(t, first.Body.String(), retry.Body.String(), "bulk retry body")
+
+	records := decodeRecords(t, makeTestGetRequest(t, "/v0/records/", false, map[string][]string{"type": {"test-idempotency"}}))
+	assert.Len(t, records, 2, "bulk records")
+
+	// without a key, nothing is replayed
+	w := makeTestPostRequest(t, "/v0/records/", strings.NewReader(bulk))
+	assert.Empty(t, w.Header().Get("Idempotent-Replayed"), "no key")
+
+}
+
+func TestTimestamps(t *testing.T) {
+
+	record := generateTestRecord()
+	record.Timestamp = "2020-05-02T13:09:26-07:00"
+
+	recordBytes, err := json.Marshal(&record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	makeTestPutRequest(t, fmt.Sprintf("/v0/records/%s", record.ID), bytes.NewReader(recordBytes))
+
+	// stored in utc, and shown in rfc 3339, unless the legacy format is asked for
+	verifyRecord := decodeRecords(t, makeTestGetRequest(t, fmt.Sprintf("/v0/records/%s", record.ID), false, nil))[record.ID]
+	assert.Equal(t, "2020-05-02T20:09:26Z", verifyRecord.Timestamp, "rfc3339")
+
+	verifyRecord = decodeRecords(t, makeTestGetRequest(t, fmt.Sprintf("/v0/records/%s", record.ID), false, map[string][]string{"_timestamp_format": {"legacy"}}))[record.ID]
+	assert.Equal(t, "2020-05-02 20:09:26", verifyRecord.Timestamp, "legacy")
+
+	// an invalid timestamp is refused, rather than replaced
+	record.Timestamp = "0000-00-00 00:00:00"
+	recordBytes, err = json.Marshal(&record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	makeTestRequest(t, "PUT", fmt.Sprintf("/v0/records/%s", record.ID), true, nil, bytes.NewReader(recordBytes), http.StatusBadRequest)
+
+	body := `{
+"type":"test-timestamps",
+"timestamp":"last tuesday",
+"committer":"testing",
+"context": {
+  "test": true
+},
+"records":[]}`
+
+	makeTestRequest(t, "POST", "/v0/records/", true, nil, strings.NewReader(body), http.StatusBadRequest)
+
+	makeTestRequest(t, "DELETE", fmt.Sprintf("/v0/records/%s", record.ID), true, nil, nil, http.StatusOK)
+
+}
+
+func TestEvents(t *testing.T) {
+
+	server := httptest.NewServer(Router)
+	defer server.Close()
+
+	// read the events from a stream, until it's cancelled
+	stream := func(ctx context.Context, lastEventID string) <-chan recordEvent {
+		req, err := http.NewRequestWithContext(ctx, "GET", server.URL+"/v0/events?type=test-events", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "status")
+		assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"), "content type")
+
+		events := make(chan recordEvent, 10)
+
+		go func() {
+			defer closer(resp.Body)
+			defer close(events)
+
+			scanner := bufio.NewScanner(resp.Body)
+			for scanner.Scan() {
+				if data := strings.TrimPrefix(scanner.Text(), "data: "); data != scanner.Text() {
+					event := recordEvent{}
+					if err := json.Unmarshal([]byte(data), &event); err == nil {
+						events <- event
+					}
+				}
+			}
+		}()
+
+		return events
+	}
+
+	next := func(events <-chan recordEvent, event string) recordEvent {
+		select {
+		case e := <-events:
+			assert.Equal(t, event, e.Event, "event")
+			return e
+		case <-time.After(10 * time.Second):
+			t.Fatalf("no %s event", event)
+		}
+		return recordEvent{}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := stream(ctx, "")
+
+	// records which don't match the query params aren't sent
+	other := generateTestRecord()
+	otherBytes, err := json.Marshal(&other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	makeTestPutRequest(t, fmt.Sprintf("/v0/records/%s", other.ID), bytes.NewReader(otherBytes))
+	defer makeTestRequest(t, "DELETE", fmt.Sprintf("/v0/records/%s", other.ID), true, nil, nil, http.StatusOK)
+
+	record := generateTestRecord()
+	record.Type = "test-events"
+	recordBytes, err := json.Marshal(&record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	makeTestPutRequest(t, fmt.Sprintf("/v0/records/%s", record.ID), bytes.NewReader(recordBytes))
+	created := next(events, recordEventCreate)
+	assert.Equal(t, record.ID, created.Record.ID, "created record")
+
+	cancel()
+
+	// while disconnected, the record is deleted
+	makeTestRequest(t, "DELETE", fmt.Sprintf("/v0/records/%s", record.ID), true, nil, nil, http.StatusOK)
+
+	// the stream resumes from the last event seen
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+
+	events = stream(ctx, fmt.Sprint(created.ID))
+	deleted := next(events, recordEventDelete)
+	assert.Equal(t, record.ID, deleted.Record.ID, "deleted record")
+	assert.True(t, deleted.ID > created.ID, "ids increase")
+
+	// an unknown id can't be resumed from
+	reset, cancelReset := context.WithCancel(context.Background())
+	defer cancelReset()
+	next(stream(reset, "foo"), recordEventReset)
+
+	// a limit makes no sense for a stream
+	makeTestRequest(t, "GET", "/v0/events", false, map[string][]string{"_limit": {"1"}}, nil, http.StatusBadRequest)
+
+}
+
+func TestChanges(t *testing.T) {
+
+	changes := func(query map[string][]string) (response changesResponse) {
+		w := makeTestGetRequest(t, "/v0/changes", false, query)
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	start := changes(map[string][]string{"since": {"now"}})
+	assert.Empty(t, start.Changes, "nothing since now")
+	assert.Equal(t, 0, start.Pending, "nothing pending")
+
+	bulk := func(names ...string) {
+		var records []string
+		for _, name := range names {
+			records = append(records, fmt.Sprintf(`{"hostname":"%s.pdxfixit.com","data":{"name":"%s"}}`, name, name))
+		}
+
+		makeTestPostRequest(t, "/v0/records/", strings.NewReader(fmt.Sprintf(`{
+"type":"test-changes",
+"timestamp":"2020-05-02 20:09:26",
+"committer":"testing",
+"context": {
+  "test": true
+},
+"records":[%s]}`, strings.Join(records, ","))))
+	}
+
+	// two are created, then one is deleted by reconciliation
+	bulk("one", "two")
+	bulk("one")
+
+	// the changes are listed once they're committed, a page at a time
+	var feed []changeEntry
+	token := start.LastSeq
+	for len(feed) < 3 {
+		page := changes(map[string][]string{"since": {token}, "limit": {"2"}})
+		assert.True(t, len(page.Changes) <= 2, "limited")
+
+		if len(page.Changes) < 1 {
+			break
+		}
+
+		feed = append(feed, page.Changes...)
+		token = page.LastSeq
+	}
+
+	if !assert.Equal(t, 3, len(feed), "changes") {
+		return
+	}
+
+	assert.Equal(t, recordEventCreate, feed[0].Event, "created")
+	assert.Equal(t, recordEventCreate, feed[1].Event, "created")
+	assert.Equal(t, recordEventDelete, feed[2].Event, "reconciled")
+	assert.True(t, feed[2].Deleted, "deleted")
+	assert.Equal(t, "test-changes", feed[2].Type, "type")
+	assert.Equal(t, token, feed[2].Seq, "the last seq is the token")
+
+	for i := 1; i < len(feed); i++ {
+		previous, _ := strconv.ParseUint(feed[i-1].Seq, 10, 64)
+		seq, _ := strconv.ParseUint(feed[i].Seq, 10, 64)
+		assert.True(t, seq > previous, "ordered")
+	}
+
+	// following the token finds nothing new
+	assert.Empty(t, changes(map[string][]string{"since": {token}}).Changes, "up to date")
+
+	makeTestRequest(t, "GET", "/v0/changes", false, map[string][]string{"since": {"yesterday"}}, nil, http.StatusBadRequest)
+	makeTestRequest(t, "GET", "/v0/changes", false, map[string][]string{"limit": {"-1"}}, nil, http.StatusBadRequest)
+
+	makeTestRequest(t, "DELETE", "/v0/records/", true, map[string][]string{"type": {"test-changes"}, "_confirm": {"1"}}, nil, http.StatusOK)
+
+	// a delete by query is listed as soon as it's made
+	deleted := changes(map[string][]string{"since": {token}}).Changes
+	if assert.Len(t, deleted, 1, "deleted by query") {
+		assert.Equal(t, recordEventDelete, deleted[0].Event, "deleted by query")
+	}
+
+}
+
+func TestRuns(t *testing.T) {
+
+	// runs from earlier tests are left out
+	since := time.Now().Add(-time.Second).UTC().Format(time.RFC3339)
+
+	bulk := func(records string, status int) {
+		makeTestRequest(t, "POST", "/v0/records/", true, nil, strings.NewReader(fmt.Sprintf(`{
+"type":"test-runs",
+"timestamp":"2020-05-02 20:09:26",
+"committer":"testing",
+"context": {
+  "test": true
+},
+"records":[%s]}`, records)), status)
+	}
+
+	bulk(`{"hostname":"one.pdxfixit.com","data":{"name":"one"}},{"hostname":"two.pdxfixit.com","data":{"name":"two"}}`, http.StatusOK)
+	bulk(`{"hostname":"one.pdxfixit.com","data":{"name":"one"}},{"hostname":"two.pdxfixit.com"}`, http.StatusBadRequest)
+
+	runs := func(query map[string][]string) getRunsResponse {
+		query["type"] = []string{"test-runs"}
+		query["since"] = []string{since}
+
+		response := getRunsResponse{}
+		if err := json.NewDecoder(makeTestGetRequest(t, "/v0/runs", false, query).Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+
+		return response
+	}
+
+	response := runs(map[string][]string{})
+	if !assert.Equal(t, 2, response.Count, "count") || !assert.Len(t, response.Runs, 2, "runs") {
+		return
+	}
+
+	// newest first
+	failed, succeeded := response.Runs[0], response.Runs[1]
+
+	assert.Equal(t, runFailed, failed.Status, "failed")
+	assert.Equal(t, http.StatusBadRequest, failed.StatusCode, "status code")
+	assert.Equal(t, runCounts{Received: 2, Rejected: 1}, failed.runCounts, "nothing changed")
+	assert.NotEmpty(t, failed.Error, "error")
+	if assert.Len(t, failed.Errors, 1, "record errors") {
+		assert.Equal(t, 1, failed.Errors[0].Index, "error index")
+	}
+
+	assert.Equal(t, runSucceeded, succeeded.Status, "succeeded")
+	assert.Equal(t, runCounts{Received: 2, Created: 2}, succeeded.runCounts, "created")
+	assert.Equal(t, "testing", succeeded.Committer, "committer")
+	assert.Equal(t, true, succeeded.Context["test"], "context")
+	assert.NotEmpty(t, succeeded.Started, "started")
+	assert.NotEmpty(t, succeeded.Finished, "finished")
+
+	// the list can be narrowed
+	assert.Equal(t, 1, runs(map[string][]string{"status": {runSucceeded}}).Count, "by status")
+	assert.Equal(t, 0, runs(map[string][]string{"committer": {"someone else"}}).Count, "by committer")
+	assert.Len(t, runs(map[string][]string{"_limit": {"1"}}).Runs, 1, "limited")
+
+	// a single run
+	w := makeTestGetRequest(t, fmt.Sprintf("/v0/runs/%s", succeeded.ID), false, nil)
+
+	found := run{}
+	if err := json.NewDecoder(w.Body).Decode(&found); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, succeeded, found, "run")
+
+	makeTestRequest(t, "GET", "/v0/runs/0", false, nil, nil, http.StatusNotFound)
+	makeTestRequest(t, "GET", "/v0/runs", false, map[string][]string{"status": {"ok"}}, nil, http.StatusBadRequest)
+	makeTestRequest(t, "GET", "/v0/runs", false, map[string][]string{"collector": {"missing"}}, nil, http.StatusBadRequest)
+	makeTestRequest(t, "GET", "/v0/runs", false, map[string][]string{"foo": {"bar"}}, nil, http.StatusBadRequest)
+
+	makeTestRequest(t, "DELETE", "/v0/records/", true, map[string][]string{"type": {"test-runs"}, "_confirm": {"2"}}, nil, http.StatusOK)
+
+}
+
+func TestQueryLanguage(t *testing.T) {
+
+	makeTestPostRequest(t, "/v0/records/", strings.NewReader(`{
+"type":"test-q",
+"timestamp":"2020-05-02 20:09:26",
+"committer":"testing",
+"context": {
+  "test": true
+},
+"records":[
+  {"hostname":"prod.pdxfixit.com","data":{"status":"ACTIVE","metadata":{"env":"prod"}}},
+  {"hostname":"stage.pdxfixit.com","data":{"status":"ACTIVE","metadata":{"env":"stage"}}},
+  {"hostname":"down.pdxfixit.com","data":{"status":"SHUTOFF","metadata":{"env":"prod"}}},
+  {"hostname":"dev.pdxfixit.com","data":{"status":"ACTIVE","metadata":{"env":"dev"}}},
+  {"hostname":"none.pdxfixit.com","data":{"status":"ACTIVE"}}
+]}`))
+	defer makeTestRequest(t, "DELETE", "/v0/records/", true, map[string][]string{"type": {"test-q"}, "_confirm": {"5"}}, nil, http.StatusOK)
+
+	hostnames := func(q string) (found []string) {
+		w := makeTestGetRequest(t, "/v0/detail/", false, map[string][]string{"_q": {"type=test-q AND (" + q + ")"}})
+		for _, record := range decodeRecords(t, w) {
+			found = append(found, strings.TrimSuffix(record.Hostname, ".pdxfixit.com"))
+		}
+		sort.Strings(found)
+		return found
+	}
+
+	assert.Equal(t, []string{"prod", "stage"}, hostnames("(env=prod OR env=stage) AND NOT status=SHUTOFF"), "and, or, not")
+	assert.Equal(t, []string{"down", "prod", "stage"}, hostnames("env IN (prod, stage)"), "in")
+	assert.Equal(t, []string{"dev", "none"}, hostnames("env NOT IN (prod, stage)"), "not in, including records without the field")
+	assert.Equal(t, []string{"dev", "stage"}, hostnames("env ~ /^(st|d)/"), "regex")
+	assert.Equal(t, []string{"none"}, hostnames("NOT EXISTS env"), "doesn't exist")
+	assert.Equal(t, []string{"down"}, hostnames("hostname = down.pdxfixit.com"), "column")
+
+	// _q is ANDed with the other params
+	w := makeTestGetRequest(t, "/v0/detail/", false, map[string][]string{"_q": {"type=test-q AND env=prod"}, "status": {"SHUTOFF"}})
+	assert.Len(t, decodeRecords(t, w), 1, "with other params")
+
+	w = makeTestRequest(t, "GET", "/v0/detail/", false, map[string][]string{"_q": {"type=test-q AND (env=prod"}}, nil, http.StatusBadRequest)
+	assert.Contains(t, w.Body.String(), "at position 26 of _q", "syntax error")
+
+}
+
+func TestRangeFilters(t *testing.T) {
+
+	makeTestPostRequest(t, "/v0/records/", strings.NewReader(`{
+"type":"test-range",
+"timestamp":"2020-05-02 20:09:26",
+"committer":"testing",
+"context": {
+  "test": true
+},
+"records":[
+  {"hostname":"four.pdxfixit.com","data":{"test":4}},
+  {"hostname":"sixteen.pdxfixit.com","data":{"test":16}},
+  {"hostname":"hundred.pdxfixit.com","data":{"test":"100"}},
+  {"hostname":"none.pdxfixit.com","data":{}}
+]}`))
+	defer makeTestRequest(t, "DELETE", "/v0/records/", true, map[string][]string{"type": {"test-range"}, "_confirm": {"4"}}, nil, http.StatusOK)
+
+	hostnames := func(params map[string][]string) (found []string) {
+		params["type"] = []string{"test-range"}
+		w := makeTestGetRequest(t, "/v0/detail/", false, params)
+		for _, record := range decodeRecords(t, w) {
+			found = append(found, strings.TrimSuffix(record.Hostname, ".pdxfixit.com"))
+		}
+		sort.Strings(found)
+		return found
+	}
+
+	// numbers are compared as numbers, not strings, even when they're json strings
+	assert.Equal(t, []string{"hundred", "sixteen"}, hostnames(map[string][]string{"test": {">:5"}}), ">")
+	assert.Equal(t, []string{"four", "sixteen"}, hostnames(map[string][]string{"test": {"<=:16"}}), "<=")
+	assert.Equal(t, []string{"sixteen"}, hostnames(map[string][]string{"test": {"between:5..16"}}), "between")
+	assert.Equal(t, []string{"hundred", "sixteen"}, hostnames(map[string][]string{"_q": {"test >= 16"}}), "_q")
+	assert.Equal(t, []string{"four", "none"}, hostnames(map[string][]string{"_q": {"NOT test >= 16"}}), "not _q, including records without the field")
+
+	// timestamps
+	assert.Len(t, hostnames(map[string][]string{"_before": {"2020-05-03T00:00:00Z"}}), 4, "_before")
+	assert.Len(t, hostnames(map[string][]string{"_since": {"2020-05-03T00:00:00Z"}}), 0, "_since")
+	assert.Len(t, hostnames(map[string][]string{"_before": {"7d"}}), 4, "_before an age")
+	assert.Len(t, hostnames(map[string][]string{"timestamp": {"between:2020-05-02 00:00:00..2020-05-02 23:59:59"}}), 4, "timestamp between")
+
+	for params, message := range map[string]string{
+		"test=>:big":          "'big' is not a number",
+		"hostname=>:a":        "may only be used with the timestamp",
+		"_since=yesterday":    "'yesterday' is not a valid timestamp",
+		"!test=>:5":           "range filters can't be negated",
+		"test=between:5":      "is not a valid range",
+		"_q=hostname > a.com": "may only be used with the timestamp",
+	} {
+		kv := strings.SplitN(params, "=", 2)
+		w := makeTestRequest(t, "GET", "/v0/detail/", false, map[string][]string{kv[0]: {kv[1]}}, nil, http.StatusBadRequest)
+		assert.Contains(t, w.Body.String(), message, params)
+	}
+
+}
+
+func TestAdhocFilters(t *testing.T) {
+
+	makeTestPostRequest(t, "/v0/records/", strings.NewReader(`{
+"type":"test-adhoc",
+"timestamp":"2020-05-02 20:09:26",
+"committer":"testing",
+"context": {
+  "test": true,
+  "team": "web"
+},
+"records":[
+  {"hostname":"prod.pdxfixit.com","data":{"metadata":{"env":"prod","cores":8}}},
+  {"hostname":"stage.pdxfixit.com","data":{"metadata":{"env":"stage","app.list":"a,b"}}},
+  {"hostname":"none.pdxfixit.com","data":{}}
+]}`))
+	defer makeTestRequest(t, "DELETE", "/v0/records/", true, map[string][]string{"type": {"test-adhoc"}, "_confirm": {"3"}}, nil, http.StatusOK)
+
+	hostnames := func(params map[string][]string) (found []string) {
+		params["type"] = []string{"test-adhoc"}
+		w := makeTestGetRequest(t, "/v0/detail/", false, params)
+		for _, record := range decodeRecords(t, w) {
+			found = append(found, strings.TrimSuffix(record.Hostname, ".pdxfixit.com"))
+		}
+		sort.Strings(found)
+		return found
+	}
+
+	assert.Equal(t, []string{"prod"}, hostnames(map[string][]string{"_data.metadata.env": {"prod"}}), "data path")
+	assert.Equal(t, []string{"none", "stage"}, hostnames(map[string][]string{"!_data.metadata.env": {"prod"}}), "negated data path")
+	assert.Equal(t, []string{"prod", "stage"}, hostnames(map[string][]string{"_data.metadata.env": {"/^(prod|stage)$/"}}), "regex")
+	assert.Equal(t, []string{"prod"}, hostnames(map[string][]string{"_data.metadata.cores": {">=:4"}}), "range")
+	assert.Len(t, hostnames(map[string][]string{"_context.team": {"web"}}), 3, "context path")
+	assert.Equal(t, []string{"stage"}, hostnames(map[string][]string{"_exists": {`data.metadata."app.list"`}}), "exists")
+	assert.Equal(t, []string{"none"}, hostnames(map[string][]string{"!_exists": {"data.metadata.env"}}), "doesn't exist")
+	assert.Equal(t, []string{"prod"}, hostnames(map[string][]string{"_q": {"_data.metadata.env = prod OR _data.metadata.cores > 100"}}), "_q")
+
+	for params, message := range map[string]string{
+		"_data.metadata.*":     "wildcards can't be used here",
+		`_data."it's"`:         "keys can't contain ' or ?",
+		"_exists=metadata.env": "'metadata.env' is not a path into the data or context",
+		"_exists=data":         "'data' is not a valid path into the data or context",
+	} {
+		kv := strings.SplitN(params, "=", 2)
+		if len(kv) < 2 {
+			kv = append(kv, "x")
+		}
+		w := makeTestRequest(t, "GET", "/v0/detail/", false, map[string][]string{kv[0]: {kv[1]}}, nil, http.StatusBadRequest)
+		assert.Contains(t, w.Body.String(), message, params)
+	}
+
+}
+
 // todo: bulk test different tenants, that one bulk-import of tenant X doesn't clobber Y
 // todo: ensure context, including negative assertions
 
@@ -351,7 +1079,7 @@ func TestBulkSave(t *testing.T) {
 
 	body := `{
 "type":"test",
-"timestamp":"0000-00-00 00:00:00",
+"timestamp":"2020-05-02 20:09:26",
 "committer":"tester",
 "context": {
   "test": false
@@ -379,7 +1107,7 @@ func TestBulkSave(t *testing.T) {
 ]}`
 
 	w := httptest.NewRecorder()
-	response := new(hostdb.PostRecordsResponse)
+	response := new(bulkResult)
 	encodedCreds := base64.StdEncoding.EncodeToString([]byte("writer:" + config.Hostdb.Pass))
 
 	// place the initial 3 records
@@ -397,7 +1125,7 @@ func TestBulkSave(t *testing.T) {
 	}
 
 	assert.Equal(t, true, response.OK, "Bulk Save OK")
-	assert.Equal(t, "3 record(s) processed", response.Error, "Bulk Save ErrorResponse")
+	assert.Equal(t, "3 record(s) processed", response.Message, "Bulk Save Message")
 
 	// verify the hash values (for the data/payload) of what we just posted
 	verifyData := map[string]string{
@@ -422,7 +1150,7 @@ func TestBulkDelete(t *testing.T) {
 
 	body := `{
 "type":"test",
-"timestamp":"0000-00-00 00:00:00",
+"timestamp":"2020-05-02 20:09:26",
 "committer":"testing",
 "context": {
   "test": false
@@ -444,7 +1172,7 @@ func TestBulkDelete(t *testing.T) {
 ]}`
 
 	w := httptest.NewRecorder()
-	response := new(hostdb.PostRecordsResponse)
+	response := new(bulkResult)
 	encodedCreds := base64.StdEncoding.EncodeToString([]byte("writer:" + config.Hostdb.Pass))
 
 	// post second round of bulk records, which should cause all but one to be deleted.
@@ -462,7 +1190,7 @@ func TestBulkDelete(t *testing.T) {
 	}
 
 	assert.Equal(t, true, response.OK, "Bulk Save OK")
-	assert.Equal(t, "2 record(s) processed", response.Error, "Bulk Save ErrorResponse")
+	assert.Equal(t, "2 record(s) processed", response.Message, "Bulk Save Message")
 
 	// get the records from the database to verify that only they remain
 	records, _, err := getMariadbRows(hostdb.MariadbWhereClauses{
@@ -492,7 +1220,7 @@ func TestBulkPostWithNothing(t *testing.T) {
 
 	body := `{
 "type":"test",
-"timestamp":"0000-00-00 00:00:00",
+"timestamp":"2020-05-02 20:09:26",
 "committer":"testing",
 "context": {
   "test": false
@@ -500,7 +1228,7 @@ func TestBulkPostWithNothing(t *testing.T) {
 "records":[]}`
 
 	w := httptest.NewRecorder()
-	response := new(hostdb.PostRecordsResponse)
+	response := new(bulkResult)
 	encodedCreds := base64.StdEncoding.EncodeToString([]byte("writer:" + config.Hostdb.Pass))
 
 	// post second round of bulk records, which should cause all but one to be deleted.
@@ -518,7 +1246,7 @@ func TestBulkPostWithNothing(t *testing.T) {
 	}
 
 	assert.Equal(t, true, response.OK, "Bulk Save OK")
-	assert.Equal(t, "0 record(s) processed", response.Error, "Bulk Save ErrorResponse")
+	assert.Equal(t, "0 record(s) processed", response.Message, "Bulk Save Message")
 
 	// get the records from the database to verify that only they remain
 	records, _, err := getMariadbRows(hostdb.MariadbWhereClauses{
@@ -549,7 +1277,7 @@ func TestPrettyJson(t *testing.T) {
 	// ensure we have sample data to work with
 	body := `{
 "type":"test",
-"timestamp":"0000-00-00 00:00:00",
+"timestamp":"2020-05-02 20:09:26",
 "committer":"testing",
 "context": {
   "test": false
@@ -571,7 +1299,7 @@ func TestPrettyJson(t *testing.T) {
 ]}`
 
 	w := httptest.NewRecorder()
-	response := new(hostdb.PostRecordsResponse)
+	response := new(bulkResult)
 	encodedCreds := base64.StdEncoding.EncodeToString([]byte("writer:" + config.Hostdb.Pass))
 
 	// post second round of bulk records, which should cause all but one to be deleted.
@@ -589,7 +1317,7 @@ func TestPrettyJson(t *testing.T) {
 	}
 
 	assert.Equal(t, true, response.OK, "Bulk Save OK")
-	assert.Equal(t, "2 record(s) processed", response.Error, "Bulk Save ErrorResponse")
+	assert.Equal(t, "2 record(s) processed", response.Message, "Bulk Save Message")
 
 	// test compact json
 	resp := makeTestGetRequest(t, "/v0/records/ghi789", false, nil)
@@ -734,7 +1462,7 @@ func TestUnusualData(t *testing.T) {
 	// ensure we have sample data to work with
 	body := `{
 "type":"test",
-"timestamp":"0000-00-00 00:00:00",
+"timestamp":"2020-05-02 20:09:26",
 "committer":"testing",
 "context": {
   "test": false
@@ -759,7 +1487,7 @@ func TestUnusualData(t *testing.T) {
 ]}`
 
 	w := httptest.NewRecorder()
-	response := new(hostdb.PostRecordsResponse)
+	response := new(bulkResult)
 	encodedCreds := base64.StdEncoding.EncodeToString([]byte("writer:" + config.Hostdb.Pass))
 
 	// post second round of bulk records, which should cause all but one to be deleted.
@@ -777,7 +1505,7 @@ func TestUnusualData(t *testing.T) {
 	}
 
 	assert.Equal(t, true, response.OK, "Bulk Save OK")
-	assert.Equal(t, "2 record(s) processed", response.Error, "Bulk Save ErrorResponse")
+	assert.Equal(t, "2 record(s) processed", response.Message, "Bulk Save Message")
 
 	// verify the values (for the data/payload) of what we just posted
 	verifyData := map[string]string{
@@ -992,3 +1720,408 @@ func TestOffset(t *testing.T) {
 	)
 
 }
+
+// bulk requests must include every context key in the bulk_scope for their type
+func TestBulkPostMissingScope(t *testing.T) {
+
+	body := `{
+"type":"ucs-test",
+"timestamp":"2020-05-02 20:09:26",
+"committer":"testing",
+"context": {
+  "test": true
+},
+"records":[]}`
+
+	w := makeTestRequest(t, "POST", "/v0/records/", true, nil, strings.NewReader(body), http.StatusBadRequest)
+
+	response := new(hostdb.PostRecordsResponse)
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	assert.False(t, response.OK, "Bulk Save OK")
+	assert.Contains(t, response.Error, "ucs_url", "Bulk Save ErrorResponse")
+
+}
+
+// a dry run should describe the changes, without making any of them
+func TestBulkDryRun(t *testing.T) {
+
+	initial := `{
+"type":"test-dryrun",
+"timestamp":"2020-05-02 20:09:26",
+"committer":"testing",
+"context": {
+  "test": true
+},
+"records":[
+  {
+    "hostname":"one.pdxfixit.com",
+    "data":{"name":"one","status":"ACTIVE"}
+  },{
+    "hostname":"two.pdxfixit.com",
+    "data":{"name":"two","status":"ACTIVE"}
+  },{
+    "hostname":"three.pdxfixit.com",
+    "data":{"name":"three","status":"ACTIVE"}
+  }
+]}`
+
+	makeTestPostRequest(t, "/v0/records/", strings.NewReader(initial))
+
+	// one changed, one the same, one missing and one new
+	changes := `{
+"type":"test-dryrun",
+"timestamp":"2020-05-02 20:09:26",
+"committer":"testing",
+"context": {
+  "test": true
+},
+"records":[
+  {
+    "hostname":"one.pdxfixit.com",
+    "data":{"name":"one","status":"SHUTOFF"}
+  },{
+    "hostname":"two.pdxfixit.com",
+    "data":{"name":"two","status":"ACTIVE"}
+  },{
+    "hostname":"four.pdxfixit.com",
+    "data":{"name":"four","status":"ACTIVE"}
+  }
+]}`
+
+	w := makeTestRequest(t, "POST", "/v0/records/", true, map[string][]string{"_dry_run": {"true"}}, strings.NewReader(changes), http.StatusOK)
+
+	response := bulkResult{}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, response.OK, "ok")
+	assert.True(t, response.DryRun, "dry run")
+
+	if assert.Len(t, response.Updated, 1, "updated") {
+		assert.Equal(t, 0, response.Updated[0].Index, "updated index")
+		assert.NotEmpty(t, response.Updated[0].ID, "updated id")
+		assert.Equal(t, []fieldDifference{{Path: "data.status", Old: "ACTIVE", New: "SHUTOFF"}}, response.Updated[0].Differences, "differences")
+	}
+
+	if assert.Len(t, response.Unchanged, 1, "unchanged") {
+		assert.Equal(t, 1, response.Unchanged[0].Index, "unchanged index")
+	}
+
+	if assert.Len(t, response.Created, 1, "created") {
+		assert.Equal(t, 2, response.Created[0].Index, "created index")
+		assert.Empty(t, response.Created[0].ID, "no id is generated during a dry run")
+	}
+
+	assert.Len(t, response.Deleted, 1, "deleted")
+
+	// nothing should have been written
+	w = makeTestGetRequest(t, "/v0/detail/", false, map[string][]string{"type": {"test-dryrun"}})
+	records := decodeRecords(t, w)
+
+	assert.Len(t, records, 3, "records after dry run")
+	for _, record := range records {
+		assert.NotEqual(t, "four.pdxfixit.com", record.Hostname, "new record was not created")
+		assert.NotContains(t, string(record.Data), "SHUTOFF", "record was not updated")
+	}
+
+}
+
+func TestBulkPartial(t *testing.T) {
+
+	initial := `{
+"type":"test-partial",
+"timestamp":"2020-05-02 20:09:26",
+"committer":"testing",
+"context": {
+  "test": true
+},
+"records":[
+  {
+    "hostname":"one.pdxfixit.com",
+    "data":{"name":"one","status":"ACTIVE"}
+  },{
+    "hostname":"two.pdxfixit.com",
+    "data":{"name":"two","status":"ACTIVE"}
+  }
+]}`
+
+	makeTestPostRequest(t, "/v0/records/", strings.NewReader(initial))
+
+	// the second record is missing its data
+	changes := `{
+"type":"test-partial",
+"timestamp":"2020-05-02 20:09:26",
+"committer":"testing",
+"context": {
+  "test": true
+},
+"records":[
+  {
+    "hostname":"one.pdxfixit.com",
+    "data":{"name":"one","status":"SHUTOFF"}
+  },{
+    "hostname":"two.pdxfixit.com"
+  },{
+    "hostname":"three.pdxfixit.com",
+    "data":{"name":"three","status":"ACTIVE"}
+  }
+]}`
+
+	// without opting in, nothing is applied
+	w := makeTestRequest(t, "POST", "/v0/records/", true, nil, strings.NewReader(changes), http.StatusBadRequest)
+
+	response := bulkResult{}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.False(t, response.OK, "not ok")
+	if assert.Len(t, response.Errors, 1, "errors") {
+		assert.Equal(t, 1, response.Errors[0].Index, "error index")
+	}
+
+	// nothing was written, so no changes are listed, and the new record has no id
+	assert.Empty(t, response.Created, "created by rejected request")
+	assert.Empty(t, response.Updated, "updated by rejected request")
+	assert.Empty(t, response.Deleted, "deleted by rejected request")
+	if assert.Len(t, response.IDs, 3, "ids of rejected request") {
+		assert.NotEmpty(t, response.IDs[0], "matched id")
+		assert.Empty(t, response.IDs[2], "no id for the record which would have been created")
+	}
+
+	w = makeTestGetRequest(t, "/v0/detail/", false, map[string][]string{"type": {"test-partial"}})
+	assert.Len(t, decodeRecords(t, w), 2, "records after rejected request")
+
+	// with partial success, the valid records are applied and the invalid record's counterpart is kept
+	w = makeTestRequest(t, "POST", "/v0/records/", true, map[string][]string{"_partial": {"true"}}, strings.NewReader(changes), http.StatusMultiStatus)
+
+	response = bulkResult{}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.False(t, response.OK, "not ok")
+	assert.True(t, response.Partial, "partial")
+	assert.Equal(t, "2 record(s) processed", response.Message, "message")
+	assert.Len(t, response.Errors, 1, "errors")
+	assert.Len(t, response.Updated, 1, "updated")
+	assert.Len(t, response.Created, 1, "created")
+	assert.Empty(t, response.Deleted, "deleted")
+
+	if assert.Len(t, response.IDs, 3, "ids") {
+		assert.NotEmpty(t, response.IDs[0], "updated id")
+		assert.Empty(t, response.IDs[1], "invalid record has no id")
+		assert.NotEmpty(t, response.IDs[2], "created id")
+	}
+
+	w = makeTestGetRequest(t, "/v0/detail/", false, map[string][]string{"type": {"test-partial"}})
+	assert.Len(t, decodeRecords(t, w), 3, "records after partial request")
+
+}
+
+func TestBulkDeleteThreshold(t *testing.T) {
+
+	saved := serverConfig.API.V0.DeleteThreshold
+	defer func() { serverConfig.API.V0.DeleteThreshold = saved }()
+
+	serverConfig.API.V0.DeleteThreshold = map[string]string{"test-threshold": "50%"}
+
+	initial := `{
+"type":"test-threshold",
+"timestamp":"2020-05-02 20:09:26",
+"committer":"testing",
+"context": {
+  "test": true
+},
+"records":[
+  {"hostname":"one.pdxfixit.com", "data":{"name":"one"}},
+  {"hostname":"two.pdxfixit.com", "data":{"name":"two"}},
+  {"hostname":"three.pdxfixit.com", "data":{"name":"three"}}
+]}`
+
+	makeTestPostRequest(t, "/v0/records/", strings.NewReader(initial))
+
+	// as if the collector failed to list most of its records
+	nearlyEmpty := `{
+"type":"test-threshold",
+"timestamp":"2020-05-02 20:09:26",
+"committer":"testing",
+"context": {
+  "test": true
+},
+"records":[
+  {"hostname":"one.pdxfixit.com", "data":{"name":"one"}}
+]}`
+
+	w := makeTestRequest(t, "POST", "/v0/records/", true, nil, strings.NewReader(nearlyEmpty), http.StatusConflict)
+
+	response := bulkResult{}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.False(t, response.OK, "not ok")
+	assert.Contains(t, response.Error, "_force", "error mentions the force flag")
+	assert.Empty(t, response.Created, "created by refused request")
+	assert.Empty(t, response.Updated, "updated by refused request")
+	assert.Empty(t, response.Deleted, "deleted by refused request")
+
+	w = makeTestGetRequest(t, "/v0/detail/", false, map[string][]string{"type": {"test-threshold"}})
+	assert.Len(t, decodeRecords(t, w), 3, "records after refused request")
+
+	// the refusal is in the audit log
+	w = makeTestGetRequest(t, "/admin/audit", true, map[string][]string{"action": {"bulk_refused"}})
+
+	audit := getAuditResponse{}
+	if err := json.NewDecoder(w.Body).Decode(&audit); err != nil {
+		t.Fatal(err)
+	}
+
+	if assert.NotEmpty(t, audit.Entries, "audit entries") {
+		assert.Len(t, audit.Entries[0].IDs, 2, "ids which would have been deleted")
+	}
+
+	// forcing the request deletes the records
+	w = makeTestRequest(t, "POST", "/v0/records/", true, map[string][]string{"_force": {"true"}}, strings.NewReader(nearlyEmpty), http.StatusOK)
+
+	response = bulkResult{}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, response.OK, "ok")
+	assert.Len(t, response.Deleted, 2, "deleted")
+
+}
+
+func TestBulkNDJSON(t *testing.T) {
+
+	saved := serverConfig.API.V0.BulkBatchSize
+	defer func() { serverConfig.API.V0.BulkBatchSize = saved }()
+
+	// force several batches
+	serverConfig.API.V0.BulkBatchSize = 2
+
+	post := func(body string, query string, respCode int) bulkResult {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v0/records/"+query, strings.NewReader(body))
+		req.Header.Add("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("writer:"+config.Hostdb.Pass)))
+		req.Header.Add("Content-Type", "application/x-ndjson")
+		Router.ServeHTTP(w, req)
+
+		assert.Equalf(t, respCode, w.Code, "%s", w.Body)
+
+		response := bulkResult{}
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+
+		return response
+	}
+
+	header := `{"type":"test-ndjson","timestamp":"2020-05-02 20:09:26","committer":"testing","context":{"test":true}}`
+
+	initial := header + `
+{"hostname":"one.pdxfixit.com","data":{"name":"one","status":"ACTIVE"}}
+{"hostname":"two.pdxfixit.com","data":{"name":"two","status":"ACTIVE"}}
+
+{"hostname":"three.pdxfixit.com","data":{"name":"three","status":"ACTIVE"}}
+`
+
+	response := post(initial, "", http.StatusOK)
+	assert.True(t, response.OK, "ok")
+	assert.Len(t, response.Created, 3, "created")
+	assert.Len(t, response.IDs, 3, "ids")
+
+	w := makeTestGetRequest(t, "/v0/detail/", false, map[string][]string{"type": {"test-ndjson"}})
+	assert.Len(t, decodeRecords(t, w), 3, "records after the first request")
+
+	// a malformed line fails the whole request
+	malformed := header + `
+{"hostname":"one.pdxfixit.com","data":{"name":"one","status":"SHUTOFF"}}
+{"hostname":"two.pdxfixit.com",
+`
+
+	response = post(malformed, "", http.StatusBadRequest)
+	if assert.Len(t, response.Errors, 1, "errors") {
+		assert.Equal(t, 1, response.Errors[0].Index, "error index")
+		assert.Contains(t, response.Errors[0].Error, "line 3", "error line")
+	}
+
+	// one changed, one the same, and one missing
+	changes := header + `
+{"hostname":"one.pdxfixit.com","data":{"name":"one","status":"SHUTOFF"}}
+{"hostname":"two.pdxfixit.com","data":{"name":"two","status":"ACTIVE"}}
+`
+
+	response = post(changes, "", http.StatusOK)
+	assert.True(t, response.OK, "ok")
+	assert.Len(t, response.Updated, 1, "updated")
+	assert.Len(t, response.Unchanged, 1, "unchanged")
+	assert.Len(t, response.Deleted, 1, "deleted")
+
+	w = makeTestGetRequest(t, "/v0/detail/", false, map[string][]string{"type": {"test-ndjson"}})
+	records := decodeRecords(t, w)
+	assert.Len(t, records, 2, "records after the second request")
+
+	// a header is required
+	post("", "", http.StatusBadRequest)
+
+}
+
+func TestBulkAsync(t *testing.T) {
+
+	body := `{
+"type":"test-async",
+"timestamp":"2020-05-02 20:09:26",
+"committer":"testing",
+"context": {
+  "test": true
+},
+"records":[
+  {"hostname":"one.pdxfixit.com", "data":{"name":"one"}},
+  {"hostname":"two.pdxfixit.com", "data":{"name":"two"}}
+]}`
+
+	w := makeTestRequest(t, "POST", "/v0/records/", true, map[string][]string{"_async": {"true"}}, strings.NewReader(body), http.StatusAccepted)
+
+	job := bulkJob{}
+	if err := json.NewDecoder(w.Body).Decode(&job); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NotEmpty(t, job.ID, "job id")
+	assert.Equal(t, jobQueued, job.Status, "queued")
+	assert.Equal(t, "/v0/jobs/"+job.ID, w.Header().Get("Location"), "location")
+
+	// wait for the job to finish
+	deadline := time.Now().Add(30 * time.Second)
+	for job.Finished == "" && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+
+		w = makeTestGetRequest(t, "/v0/jobs/"+job.ID, true, nil)
+		if err := json.NewDecoder(w.Body).Decode(&job); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assert.Equal(t, jobSucceeded, job.Status, "succeeded")
+	assert.Equal(t, http.StatusOK, job.StatusCode, "status code")
+	assert.Equal(t, 2, job.Received, "received")
+	if assert.NotNil(t, job.Result, "result") {
+		assert.Len(t, job.Result.Created, 2, "created")
+	}
+
+	w = makeTestGetRequest(t, "/v0/detail/", false, map[string][]string{"type": {"test-async"}})
+	assert.Len(t, decodeRecords(t, w), 2, "records after the job")
+
+	// bad requests are refused straight away
+	makeTestRequest(t, "POST", "/v0/records/", true, map[string][]string{"_async": {"true"}}, strings.NewReader(`{"type":"test-async"}`), http.StatusBadRequest)
+
+	makeTestRequest(t, "GET", "/v0/jobs/job-nonexistent", true, nil, nil, http.StatusNotFound)
+
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// the outcome of a run
+const (
+	runSucceeded = "succeeded"
+	runPartial   = "partial"
+	runFailed    = "failed"
+)
+
+const (
+	defaultRunsRetention = 90 * 24 * time.Hour
+	maxRunErrors         = 100 // the record errors kept for each run; the rest are only counted
+)
+
+var runStatuses = []string{runSucceeded, runPartial, runFailed}
+
+// a bulk POST, as kept in the run ledger
+type run struct {
+	ID         string                 `json:"id"`
+	Type       string                 `json:"type"`
+	Context    map[string]interface{} `json:"context"` // of the record set, which includes its scope
+	Committer  string                 `json:"committer"`
+	Started    string                 `json:"started"`
+	Finished   string                 `json:"finished"`
+	Status     string                 `json:"status"`
+	StatusCode int                    `json:"status_code"`
+	runCounts
+	Error  string            `json:"error,omitempty"`
+	Errors []bulkRecordError `json:"errors"` // the records which failed validation, up to maxRunErrors
+}
+
+// what a run did; a run which failed before its records were saved didn't change anything
+type runCounts struct {
+	Received  int `json:"received"`
+	Created   int `json:"created"`
+	Updated   int `json:"updated"`
+	Unchanged int `json:"unchanged"`
+	Deleted   int `json:"deleted"`
+	Rejected  int `json:"rejected"`
+}
+
+type getRunsResponse struct {
+	Count     int    `json:"count"`
+	QueryTime string `json:"query_time"`
+	Runs      []run  `json:"runs"`
+}
+
+// count what a bulk request did; applied is whether its records were saved
+func countRun(result bulkResult, applied bool) runCounts {
+
+	counts := runCounts{
+		Received: len(result.IDs),
+		Rejected: len(result.Errors),
+	}
+
+	if applied {
+		counts.Created = len(result.Created)
+		counts.Updated = len(result.Updated)
+		counts.Unchanged = len(result.Unchanged)
+		counts.Deleted = len(result.Deleted)
+	}
+
+	return counts
+
+}
+
+// the outcome of a run, from the status code of its response
+func runStatus(statusCode int) string {
+
+	switch {
+	case statusCode == http.StatusMultiStatus:
+		return runPartial
+	case statusCode < http.StatusMultipleChoices:
+		return runSucceeded
+	}
+
+	return runFailed
+
+}
+
+// whether a status is one a run may have
+func runStatusValid(status string) bool {
+
+	for _, valid := range runStatuses {
+		if status == valid {
+			return true
+		}
+	}
+
+	return false
+
+}
+
+// how long bulk requests are kept in the run ledger
+func runsRetention() time.Duration {
+
+	if retention := serverConfig.API.V0.RunsRetention; retention > 0 {
+		return retention
+	}
+
+	return defaultRunsRetention
+
+}
+
+// add a bulk request to the run ledger; the janitor forgets about runs older than the retention
+func recordRun(r *bulkReconciler, status int, result bulkResult, counts runCounts) {
+
+	errors := result.Errors
+	if len(errors) > maxRunErrors {
+		errors = errors[:maxRunErrors]
+	}
+
+	entry := run{
+		Type:       r.bulk.Type,
+		Context:    r.bulk.Context,
+		Committer:  r.bulk.Committer,
+		Started:    r.started.UTC().Format(storedTimestampFormat),
+		Finished:   time.Now().UTC().Format(storedTimestampFormat),
+		Status:     runStatus(status),
+		StatusCode: status,
+		runCounts:  counts,
+		Error:      result.Error,
+		Errors:     errors,
+	}
+
+	if err := saveMariadbRun(entry); err != nil {
+		log.Println(err.Error())
+	}
+
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountRun(t *testing.T) {
+
+	result := bulkResult{
+		IDs:       []string{"a", "b", "c", "", "e"},
+		Created:   []bulkResultEntry{{Index: 0, ID: "a"}},
+		Updated:   []bulkResultEntry{{Index: 1, ID: "b"}},
+		Unchanged: []bulkResultEntry{{Index: 2, ID: "c"}, {Index: 4, ID: "e"}},
+		Deleted:   []string{"f"},
+		Errors:    []bulkRecordError{{Index: 3, Error: "invalid"}},
+	}
+
+	assert.Equal(t, runCounts{Received: 5, Created: 1, Updated: 1, Unchanged: 2, Deleted: 1, Rejected: 1}, countRun(result, true), "applied")
+	assert.Equal(t, runCounts{Received: 5, Rejected: 1}, countRun(result, false), "nothing changed")
+
+}
+
+func TestRunStatus(t *testing.T) {
+
+	assert.Equal(t, runSucceeded, runStatus(http.StatusOK), "ok")
+	assert.Equal(t, runPartial, runStatus(http.StatusMultiStatus), "partial")
+	assert.Equal(t, runFailed, runStatus(http.StatusBadRequest), "bad request")
+	assert.Equal(t, runFailed, runStatus(http.StatusConflict), "refused")
+	assert.Equal(t, runFailed, runStatus(http.StatusInternalServerError), "error")
+
+	for _, status := range runStatuses {
+		assert.True(t, runStatusValid(status), status)
+	}
+	assert.False(t, runStatusValid("ok"), "invalid")
+
+}
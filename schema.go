@@ -0,0 +1,892 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pdxfixit/hostdb"
+)
+
+// how a type's schema is applied to incoming records
+const (
+	schemaEnforce = "enforce" // records which don't match are refused
+	schemaWarn    = "warn"    // records which don't match are saved, and the violations logged and reported
+)
+
+// the json schemas registered for each type, from the schema directory and the admin endpoint
+var schemas = &schemaRegistry{entries: map[string]schemaEntry{}}
+
+type schemaRegistry struct {
+	mu      sync.RWMutex
+	entries map[string]schemaEntry // map[type pattern]schema
+}
+
+// a json schema for the data of a type
+type schemaEntry struct {
+	Type      string          `json:"type"` // may contain * wildcards, like the identity config
+	Source    string          `json:"source"`
+	Schema    json.RawMessage `json:"schema"`
+	Updated   string          `json:"updated,omitempty"`
+	Principal string          `json:"principal,omitempty"`
+
+	compiled *jsonSchema
+}
+
+// a single place where a record's data doesn't match its schema
+type schemaViolation struct {
+	Path    string `json:"path"` // in the same syntax as the query_params config, e.g. .addresses[0].addr
+	Message string `json:"message"`
+}
+
+// a compiled json schema; supports the validation keywords of draft 7 (and later), except format and dependencies
+type jsonSchema struct {
+	root     interface{}
+	patterns map[string]*regexp.Regexp
+	refs     map[string][]string // the targets of the schema's references, by ref, as json pointer paths
+}
+
+// load the schemas from the schema directory, then those uploaded to the database, which take precedence
+func loadSchemas() error {
+
+	entries := map[string]schemaEntry{}
+
+	if directory := serverConfig.API.V0.Schemas.Directory; directory != "" {
+		files, err := filepath.Glob(filepath.Join(directory, "*.json"))
+		if err != nil {
+			return err
+		}
+
+		for _, file := range files {
+			b, err := ioutil.ReadFile(file)
+			if err != nil {
+				return err
+			}
+
+			entry := schemaEntry{
+				Type:   strings.TrimSuffix(filepath.Base(file), ".json"),
+				Source: file,
+				Schema: b,
+			}
+
+			if entry.compiled, err = compileJSONSchema(b); err != nil {
+				return fmt.Errorf("schema %s: %v", file, err)
+			}
+
+			entries[entry.Type] = entry
+		}
+	}
+
+	uploaded, err := getMariadbSchemas()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range uploaded {
+		if entry.compiled, err = compileJSONSchema(entry.Schema); err != nil {
+			// a bad schema in the database shouldn't stop the server; it would have been checked when it was uploaded
+			log.Println(fmt.Sprintf("ignoring the uploaded schema for type %s: %v", entry.Type, err))
+			continue
+		}
+
+		entries[entry.Type] = entry
+	}
+
+	schemas.mu.Lock()
+	schemas.entries = entries
+	schemas.mu.Unlock()
+
+	log.Println(fmt.Sprintf("loaded %d schema(s)", len(entries)))
+
+	return nil
+
+}
+
+// the schema for a record type, if there is one
+func (s *schemaRegistry) get(recordType string) (entry schemaEntry, ok bool) {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	patterns := make([]string, 0, len(s.entries))
+	for pattern := range s.entries {
+		patterns = append(patterns, pattern)
+	}
+
+	pattern, ok := matchRecordType(recordType, patterns)
+	if !ok {
+		return schemaEntry{}, false
+	}
+
+	return s.entries[pattern], true
+
+}
+
+// every registered schema, sorted by type
+func (s *schemaRegistry) list() []schemaEntry {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]schemaEntry, 0, len(s.entries))
+	for _, entry := range s.entries {
+		list = append(list, entry)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Type < list[j].Type })
+
+	return list
+
+}
+
+func (s *schemaRegistry) set(entry schemaEntry) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[entry.Type] = entry
+
+}
+
+// how the schema for a record type is applied; enforce, unless configured otherwise
+func schemaMode(recordType string) string {
+
+	patterns := make([]string, 0, len(serverConfig.API.V0.Schemas.Modes))
+	for pattern := range serverConfig.API.V0.Schemas.Modes {
+		patterns = append(patterns, pattern)
+	}
+
+	if pattern, ok := matchRecordType(recordType, patterns); ok {
+		return serverConfig.API.V0.Schemas.Modes[pattern]
+	}
+
+	if serverConfig.API.V0.Schemas.Mode != "" {
+		return serverConfig.API.V0.Schemas.Mode
+	}
+
+	return schemaEnforce
+
+}
+
+// validate a record's data against the schema for its type
+// a record which doesn't match is refused with a 422, unless the type is in warn mode, in which case the violations are logged and returned as warnings
+func checkRecordSchema(record hostdb.Record) (warnings []string, err error) {
+
+	entry, ok := schemas.get(record.Type)
+	if !ok {
+		return nil, nil
+	}
+
+	data, err := decodeJSON(record.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	violations := entry.compiled.validate(data)
+	if len(violations) == 0 {
+		return nil, nil
+	}
+
+	messages := make([]string, 0, len(violations))
+	for _, violation := range violations {
+		messages = append(messages, fmt.Sprintf("%s: %s", violation.Path, violation.Message))
+	}
+
+	message := fmt.Sprintf("data does not match the schema for type %s: %s", entry.Type, strings.Join(messages, "; "))
+
+	if schemaMode(record.Type) == schemaWarn {
+		log.Println(fmt.Sprintf("record %s: %s", record.ID, message))
+		return []string{message}, nil
+	}
+
+	return nil, hostdb.ErrorResponse{
+		Code:    http.StatusUnprocessableEntity,
+		Message: message,
+	}
+
+}
+
+// validate a single record's data against its schema, as checkRecordSchema
+// responds with a 422, and returns false, if the record is refused; warnings are sent as Warning headers
+func checkRecordSchemaResponse(c *gin.Context, record hostdb.Record) bool {
+
+	warnings, err := checkRecordSchema(record)
+	if err != nil {
+		if err, ok := err.(hostdb.ErrorResponse); ok {
+			c.AbortWithStatusJSON(err.Code, hostdb.GenericError{Error: err.Message})
+			return false
+		}
+
+		log.Println(err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, hostdb.GenericError{
+			Error: "validating the data against its schema failed",
+		})
+		return false
+	}
+
+	for _, warning := range warnings {
+		c.Writer.Header().Add("Warning", fmt.Sprintf("299 hostdb %q", warning))
+	}
+
+	return true
+
+}
+
+// decode a json schema, and check that it's one we can apply
+func compileJSONSchema(b []byte) (*jsonSchema, error) {
+
+	root, err := decodeJSON(b)
+	if err != nil {
+		return nil, fmt.Errorf("the schema is not valid json: %v", err)
+	}
+
+	s := &jsonSchema{
+		root:     root,
+		patterns: map[string]*regexp.Regexp{},
+		refs:     map[string][]string{},
+	}
+
+	if err := s.compile(root, "#"); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkRefCycles(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+
+}
+
+// check the keywords of a (sub)schema, compiling any patterns and resolving any references
+func (s *jsonSchema) compile(schema interface{}, location string) error {
+
+	if _, ok := schema.(bool); ok {
+		return nil
+	}
+
+	object, ok := schema.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%s: a schema must be an object or a boolean", location)
+	}
+
+	for keyword, value := range object {
+		at := location + "/" + keyword
+
+		switch keyword {
+		case "type":
+			types, ok := value.([]interface{})
+			if !ok {
+				types = []interface{}{value}
+			}
+
+			for _, t := range types {
+				switch t {
+				case "array", "boolean", "integer", "null", "number", "object", "string":
+				default:
+					return fmt.Errorf("%s: unknown type %v", at, t)
+				}
+			}
+		case "properties", "patternProperties", "definitions", "$defs":
+			properties, ok := value.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%s: must be an object", at)
+			}
+
+			for key, property := range properties {
+				if keyword == "patternProperties" {
+					if err := s.compilePattern(key, at); err != nil {
+						return err
+					}
+				}
+
+				if err := s.compile(property, at+"/"+key); err != nil {
+					return err
+				}
+			}
+		case "additionalProperties", "items", "additionalItems", "contains", "propertyNames", "not", "if", "then", "else":
+			if err := s.compile(value, at); err != nil {
+				return err
+			}
+		case "allOf", "anyOf", "oneOf", "prefixItems":
+			subschemas, ok := value.([]interface{})
+			if !ok || len(subschemas) == 0 {
+				return fmt.Errorf("%s: must be a non-empty array", at)
+			}
+
+			for i, subschema := range subschemas {
+				if err := s.compile(subschema, fmt.Sprintf("%s/%d", at, i)); err != nil {
+					return err
+				}
+			}
+		case "required":
+			required, ok := value.([]interface{})
+			if !ok {
+				return fmt.Errorf("%s: must be an array", at)
+			}
+
+			for _, key := range required {
+				if _, ok := key.(string); !ok {
+					return fmt.Errorf("%s: must be an array of strings", at)
+				}
+			}
+		case "enum":
+			if _, ok := value.([]interface{}); !ok {
+				return fmt.Errorf("%s: must be an array", at)
+			}
+		case "minimum", "maximum", "exclusiveMinimum", "exclusiveMaximum", "multipleOf",
+			"minLength", "maxLength", "minItems", "maxItems", "minProperties", "maxProperties":
+			if _, ok := value.(json.Number); !ok {
+				return fmt.Errorf("%s: must be a number", at)
+			}
+		case "pattern":
+			pattern, ok := value.(string)
+			if !ok {
+				return fmt.Errorf("%s: must be a string", at)
+			}
+
+			if err := s.compilePattern(pattern, at); err != nil {
+				return err
+			}
+		case "$ref":
+			ref, ok := value.(string)
+			if !ok {
+				return fmt.Errorf("%s: must be a string", at)
+			}
+
+			if _, compiled := s.refs[ref]; compiled {
+				continue
+			}
+
+			target, err := s.resolve(ref)
+			if err != nil {
+				return fmt.Errorf("%s: %v", at, err)
+			}
+
+			// resolve has already parsed the pointer successfully
+			path, _ := parseJSONPointer(ref[1:])
+
+			// the target is checked as a schema, wherever it is in the document (e.g. not #/required)
+			s.refs[ref] = path
+			if err := s.compile(target, ref); err != nil {
+				return fmt.Errorf("%s: %s doesn't refer to a schema: %v", at, ref, err)
+			}
+		}
+	}
+
+	return nil
+
+}
+
+func (s *jsonSchema) compilePattern(pattern string, location string) error {
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("%s: invalid pattern %s: %v", location, pattern, err)
+	}
+
+	s.patterns[pattern] = re
+
+	return nil
+
+}
+
+// refuse references which lead back to themselves without descending into the value, e.g. {"$ref": "#"}
+// these would recurse forever while validating, rather than fail
+func (s *jsonSchema) checkRefCycles() error {
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+
+	// refs with different spellings may point at the same subschema
+	key := func(ref string) string {
+		return strings.Join(s.refs[ref], "\x00")
+	}
+
+	state := map[string]int{}
+
+	var visit func(ref string) error
+	visit = func(ref string) error {
+
+		switch state[key(ref)] {
+		case visiting:
+			return fmt.Errorf("$ref %s refers back to itself, without descending into the value", ref)
+		case visited:
+			return nil
+		}
+
+		state[key(ref)] = visiting
+
+		target, err := s.resolve(ref)
+		if err != nil {
+			return err
+		}
+
+		for _, next := range inPlaceRefs(target) {
+			if err := visit(next); err != nil {
+				return err
+			}
+		}
+
+		state[key(ref)] = visited
+
+		return nil
+
+	}
+
+	refs := make([]string, 0, len(s.refs))
+	for ref := range s.refs {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+
+	for _, ref := range refs {
+		if err := visit(ref); err != nil {
+			return err
+		}
+	}
+
+	// the root isn't necessarily the target of a ref
+	for _, ref := range inPlaceRefs(s.root) {
+		if err := visit(ref); err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// the references a (sub)schema follows while checking a value, before it checks any part of the value
+func inPlaceRefs(schema interface{}) (refs []string) {
+
+	object, ok := schema.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	if ref, ok := object["$ref"].(string); ok {
+		refs = append(refs, ref)
+	}
+
+	for _, keyword := range []string{"allOf", "anyOf", "oneOf"} {
+		subschemas, _ := object[keyword].([]interface{})
+		for _, subschema := range subschemas {
+			refs = append(refs, inPlaceRefs(subschema)...)
+		}
+	}
+
+	for _, keyword := range []string{"not", "if", "then", "else"} {
+		if subschema, ok := object[keyword]; ok {
+			refs = append(refs, inPlaceRefs(subschema)...)
+		}
+	}
+
+	return refs
+
+}
+
+// find the subschema a $ref points to; only references within the schema (e.g. #/definitions/address) are supported
+func (s *jsonSchema) resolve(ref string) (interface{}, error) {
+
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("only local references are supported, not %s", ref)
+	}
+
+	path, err := parseJSONPointer(ref[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	return jsonPointerGet(s.root, path)
+
+}
+
+// validate a decoded json value against the schema, returning every violation
+func (s *jsonSchema) validate(value interface{}) []schemaViolation {
+
+	return s.check(s.root, value, "", nil)
+
+}
+
+func (s *jsonSchema) check(schema interface{}, value interface{}, path string, violations []schemaViolation) []schemaViolation {
+
+	if allowed, ok := schema.(bool); ok {
+		if !allowed {
+			violations = appendViolation(violations, path, "no value is allowed here")
+		}
+
+		return violations
+	}
+
+	violation := func(format string, a ...interface{}) {
+		violations = appendViolation(violations, path, fmt.Sprintf(format, a...))
+	}
+
+	// compile makes sure of this, but a bad schema mustn't take the server down
+	object, ok := schema.(map[string]interface{})
+	if !ok {
+		violation("the schema is invalid here")
+		return violations
+	}
+
+	if ref, ok := object["$ref"].(string); ok {
+		if subschema, err := s.resolve(ref); err == nil {
+			violations = s.check(subschema, value, path, violations)
+		}
+	}
+
+	// a value of the wrong type can't be checked any further
+	if t, ok := object["type"]; ok && !jsonSchemaTypeMatches(t, value) {
+		violation("expected %s, but got %s", jsonSchemaTypeString(t), jsonTypeOf(value))
+		return violations
+	}
+
+	if enum, ok := object["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			if jsonEqual(value, allowed) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			violation("must be one of %s", jsonString(enum))
+		}
+	}
+
+	if constant, ok := object["const"]; ok && !jsonEqual(value, constant) {
+		violation("must be %s", jsonString(constant))
+	}
+
+	switch value := value.(type) {
+	case json.Number:
+		number, _ := value.Float64()
+
+		if minimum, ok := jsonSchemaNumber(object, "minimum"); ok && number < minimum {
+			violation("must be at least %v", minimum)
+		}
+
+		if maximum, ok := jsonSchemaNumber(object, "maximum"); ok && number > maximum {
+			violation("must be at most %v", maximum)
+		}
+
+		if minimum, ok := jsonSchemaNumber(object, "exclusiveMinimum"); ok && number <= minimum {
+			violation("must be greater than %v", minimum)
+		}
+
+		if maximum, ok := jsonSchemaNumber(object, "exclusiveMaximum"); ok && number >= maximum {
+			violation("must be less than %v", maximum)
+		}
+
+		if multiple, ok := jsonSchemaNumber(object, "multipleOf"); ok && multiple > 0 {
+			if quotient := number / multiple; quotient != math.Trunc(quotient) {
+				violation("must be a multiple of %v", multiple)
+			}
+		}
+	case string:
+		length := utf8.RuneCountInString(value)
+
+		if minLength, ok := jsonSchemaNumber(object, "minLength"); ok && float64(length) < minLength {
+			violation("must be at least %v characters long", minLength)
+		}
+
+		if maxLength, ok := jsonSchemaNumber(object, "maxLength"); ok && float64(length) > maxLength {
+			violation("must be at most %v characters long", maxLength)
+		}
+
+		if pattern, ok := object["pattern"].(string); ok && !s.patterns[pattern].MatchString(value) {
+			violation("must match the pattern %s", pattern)
+		}
+	case []interface{}:
+		if minItems, ok := jsonSchemaNumber(object, "minItems"); ok && float64(len(value)) < minItems {
+			violation("must have at least %v item(s)", minItems)
+		}
+
+		if maxItems, ok := jsonSchemaNumber(object, "maxItems"); ok && float64(len(value)) > maxItems {
+			violation("must have at most %v item(s)", maxItems)
+		}
+
+		if unique, _ := object["uniqueItems"].(bool); unique {
+		unique:
+			for i := range value {
+				for j := i + 1; j < len(value); j++ {
+					if jsonEqual(value[i], value[j]) {
+						violation("items %d and %d must not be equal", i, j)
+						break unique
+					}
+				}
+			}
+		}
+
+		// prefixItems (or items as an array, in draft 7) applies to the leading items, and items (or additionalItems) to the rest
+		prefix, _ := object["prefixItems"].([]interface{})
+		rest, hasRest := object["items"]
+
+		if tuple, ok := rest.([]interface{}); ok {
+			prefix = tuple
+			rest, hasRest = object["additionalItems"]
+		}
+
+		for i, item := range value {
+			itemPath := fmt.Sprintf("%s[%d]", path, i)
+
+			if i < len(prefix) {
+				violations = s.check(prefix[i], item, itemPath, violations)
+			} else if hasRest {
+				violations = s.check(rest, item, itemPath, violations)
+			}
+		}
+
+		if contains, ok := object["contains"]; ok {
+			found := false
+			for _, item := range value {
+				if len(s.check(contains, item, path, nil)) == 0 {
+					found = true
+					break
+				}
+			}
+
+			if !found {
+				violation("must contain a matching item")
+			}
+		}
+	case map[string]interface{}:
+		if minProperties, ok := jsonSchemaNumber(object, "minProperties"); ok && float64(len(value)) < minProperties {
+			violation("must have at least %v propert(ies)", minProperties)
+		}
+
+		if maxProperties, ok := jsonSchemaNumber(object, "maxProperties"); ok && float64(len(value)) > maxProperties {
+			violation("must have at most %v propert(ies)", maxProperties)
+		}
+
+		if required, ok := object["required"].([]interface{}); ok {
+			for _, key := range required {
+				if _, ok := value[key.(string)]; !ok {
+					violations = appendViolation(violations, jsonPathChild(path, key.(string)), "is required")
+				}
+			}
+		}
+
+		properties, _ := object["properties"].(map[string]interface{})
+		patternProperties, _ := object["patternProperties"].(map[string]interface{})
+		additional, hasAdditional := object["additionalProperties"]
+
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			keyPath := jsonPathChild(path, key)
+			matched := false
+
+			if property, ok := properties[key]; ok {
+				violations = s.check(property, value[key], keyPath, violations)
+				matched = true
+			}
+
+			for pattern, property := range patternProperties {
+				if s.patterns[pattern].MatchString(key) {
+					violations = s.check(property, value[key], keyPath, violations)
+					matched = true
+				}
+			}
+
+			if !matched && hasAdditional {
+				if allowed, ok := additional.(bool); ok && !allowed {
+					violations = appendViolation(violations, keyPath, "is not allowed")
+				} else {
+					violations = s.check(additional, value[key], keyPath, violations)
+				}
+			}
+
+			if propertyNames, ok := object["propertyNames"]; ok && len(s.check(propertyNames, key, keyPath, nil)) > 0 {
+				violations = appendViolation(violations, keyPath, "is not an allowed property name")
+			}
+		}
+	}
+
+	// combinations
+	if allOf, ok := object["allOf"].([]interface{}); ok {
+		for _, subschema := range allOf {
+			violations = s.check(subschema, value, path, violations)
+		}
+	}
+
+	if anyOf, ok := object["anyOf"].([]interface{}); ok {
+		matched := false
+		for _, subschema := range anyOf {
+			if len(s.check(subschema, value, path, nil)) == 0 {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			violation("must match at least one of the schemas in anyOf")
+		}
+	}
+
+	if oneOf, ok := object["oneOf"].([]interface{}); ok {
+		matches := 0
+		for _, subschema := range oneOf {
+			if len(s.check(subschema, value, path, nil)) == 0 {
+				matches++
+			}
+		}
+
+		if matches != 1 {
+			violation("must match exactly one of the schemas in oneOf, but matched %d", matches)
+		}
+	}
+
+	if not, ok := object["not"]; ok && len(s.check(not, value, path, nil)) == 0 {
+		violation("must not match the schema in not")
+	}
+
+	if condition, ok := object["if"]; ok {
+		if len(s.check(condition, value, path, nil)) == 0 {
+			if then, ok := object["then"]; ok {
+				violations = s.check(then, value, path, violations)
+			}
+		} else if otherwise, ok := object["else"]; ok {
+			violations = s.check(otherwise, value, path, violations)
+		}
+	}
+
+	return violations
+
+}
+
+// whether a decoded json value is of the schema type (or one of the types)
+func jsonSchemaTypeMatches(schemaType interface{}, value interface{}) bool {
+
+	types, ok := schemaType.([]interface{})
+	if !ok {
+		types = []interface{}{schemaType}
+	}
+
+	actual := jsonTypeOf(value)
+
+	for _, t := range types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+
+	return false
+
+}
+
+func jsonSchemaTypeString(schemaType interface{}) string {
+
+	types, ok := schemaType.([]interface{})
+	if !ok {
+		return fmt.Sprintf("%v", schemaType)
+	}
+
+	names := make([]string, 0, len(types))
+	for _, t := range types {
+		names = append(names, fmt.Sprintf("%v", t))
+	}
+
+	return strings.Join(names, " or ")
+
+}
+
+// the json schema type of a decoded json value
+func jsonTypeOf(value interface{}) string {
+
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if f, err := value.Float64(); err == nil && f == math.Trunc(f) {
+			return "integer"
+		}
+
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return reflect.TypeOf(value).String()
+	}
+
+}
+
+func jsonSchemaNumber(schema map[string]interface{}, keyword string) (float64, bool) {
+
+	number, ok := schema[keyword].(json.Number)
+	if !ok {
+		return 0, false
+	}
+
+	f, err := number.Float64()
+
+	return f, err == nil
+
+}
+
+func appendViolation(violations []schemaViolation, path string, message string) []schemaViolation {
+
+	// the data itself
+	if path == "" {
+		path = "."
+	}
+
+	return append(violations, schemaViolation{Path: path, Message: message})
+
+}
+
+// a decoded json value, for an error message
+func jsonString(value interface{}) string {
+
+	b, err := encodeJSON(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+
+	return string(b)
+
+}
+
+// an uploaded schema must name a type, and be a schema we can apply
+func validateSchemaEntry(entry *schemaEntry) error {
+
+	if entry.Type == "" || strings.ContainsAny(entry.Type, " /") {
+		return errors.New("the type must not be empty, or contain spaces or slashes")
+	}
+
+	compiled, err := compileJSONSchema(entry.Schema)
+	if err != nil {
+		return err
+	}
+
+	entry.compiled = compiled
+
+	return nil
+
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/pdxfixit/hostdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONSchemaValidate(t *testing.T) {
+
+	schema, err := compileJSONSchema([]byte(`{
+		"type": "object",
+		"required": ["InstanceId", "State"],
+		"properties": {
+			"InstanceId": {"type": "string", "pattern": "^i-[0-9a-f]+$"},
+			"State": {"$ref": "#/definitions/state"},
+			"CpuCount": {"type": "integer", "minimum": 1},
+			"Tags": {"type": "array", "items": {"type": "object", "required": ["Key"]}},
+			"app.list": {"type": "string"}
+		},
+		"definitions": {
+			"state": {"type": "object", "properties": {"Name": {"enum": ["running", "stopped"]}}}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string][]schemaViolation{
+		`{"InstanceId": "i-0abc", "State": {"Name": "running"}, "CpuCount": 2, "Tags": [{"Key": "env"}]}`: nil,
+		`{"InstanceId": "i-0abc"}`: {
+			{Path: ".State", Message: "is required"},
+		},
+		`{"InstanceID": "i-0abc", "State": {"Name": "gone"}}`: {
+			{Path: ".InstanceId", Message: "is required"},
+			{Path: ".State.Name", Message: `must be one of ["running","stopped"]`},
+		},
+		`{"InstanceId": "vm-1", "State": {}, "CpuCount": 1.5, "Tags": [{"Key": "a"}, {"Value": "b"}], "app.list": 1}`: {
+			{Path: ".CpuCount", Message: "expected integer, but got number"},
+			{Path: ".InstanceId", Message: "must match the pattern ^i-[0-9a-f]+$"},
+			{Path: ".Tags[1].Key", Message: "is required"},
+			{Path: `."app.list"`, Message: "expected string, but got integer"},
+		},
+		`[]`: {
+			{Path: ".", Message: "expected object, but got array"},
+		},
+	}
+
+	for data, expected := range tests {
+		value, err := decodeJSON([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, expected, schema.validate(value), data)
+	}
+
+}
+
+func TestJSONSchemaCombinations(t *testing.T) {
+
+	schema, err := compileJSONSchema([]byte(`{
+		"anyOf": [{"type": "string"}, {"type": "number"}],
+		"not": {"const": "forbidden"},
+		"oneOf": [{"maxLength": 3}, {"minLength": 2}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]int{
+		`"a"`:         0,
+		`"abcd"`:      0,
+		`"ab"`:        1, // matches both oneOf schemas
+		`"forbidden"`: 1,
+		`true`:        2, // not a string or number, and matches both oneOf schemas
+	}
+
+	for data, expected := range tests {
+		value, _ := decodeJSON([]byte(data))
+		assert.Len(t, schema.validate(value), expected, data)
+	}
+
+}
+
+func TestCompileJSONSchema(t *testing.T) {
+
+	invalid := []string{
+		`not json`,
+		`"a string"`,
+		`{"type": "thing"}`,
+		`{"properties": {"a": {"pattern": "("}}}`,
+		`{"$ref": "#/definitions/missing"}`,
+		`{"$ref": "https://example.com/schema.json"}`,
+		`{"required": "a"}`,
+		`{"anyOf": []}`,
+		`{"$ref": "#"}`,
+		`{"required": ["a"], "$ref": "#/required"}`,
+		`{"$ref": "#/properties"}`,
+		`{"allOf": [{"$ref": "#/definitions/a"}], "definitions": {"a": {"not": {"$ref": "#"}}}}`,
+		`{"$ref": "#/definitions/a", "definitions": {"a": {"$ref": "#/definitions/b"}, "b": {"$ref": "#/definitions/a"}}}`,
+	}
+
+	for _, schema := range invalid {
+		_, err := compileJSONSchema([]byte(schema))
+		assert.Error(t, err, schema)
+	}
+
+	for _, schema := range []string{`true`, `{}`, `{"type": ["string", "null"]}`} {
+		_, err := compileJSONSchema([]byte(schema))
+		assert.NoError(t, err, schema)
+	}
+
+	// a reference back to the root is fine, so long as it descends into the value first
+	s, err := compileJSONSchema([]byte(`{"type": "object", "properties": {"child": {"$ref": "#"}, "name": {"type": "string"}}}`))
+	if assert.NoError(t, err) {
+		assert.Empty(t, s.validate(map[string]interface{}{"child": map[string]interface{}{"child": map[string]interface{}{"name": "a"}}}))
+		assert.NotEmpty(t, s.validate(map[string]interface{}{"child": map[string]interface{}{"child": map[string]interface{}{"name": 1}}}))
+	}
+
+}
+
+func TestCheckRecordSchema(t *testing.T) {
+
+	originalEntries := schemas.entries
+	originalSettings := serverConfig.API.V0.Schemas
+	defer func() {
+		schemas.entries = originalEntries
+		serverConfig.API.V0.Schemas = originalSettings
+	}()
+
+	entry := schemaEntry{Type: "schema-*", Schema: json.RawMessage(`{"required": ["id"]}`)}
+	if err := validateSchemaEntry(&entry); err != nil {
+		t.Fatal(err)
+	}
+
+	schemas.entries = map[string]schemaEntry{entry.Type: entry}
+	serverConfig.API.V0.Schemas = schemaSettings{
+		Mode:  schemaEnforce,
+		Modes: map[string]string{"schema-trial": schemaWarn},
+	}
+
+	record := hostdb.Record{Type: "schema-test", Data: json.RawMessage(`{"name": "foo"}`)}
+
+	warnings, err := checkRecordSchema(record)
+	assert.Empty(t, warnings)
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusUnprocessableEntity, err.(hostdb.ErrorResponse).Code)
+		assert.Contains(t, err.(hostdb.ErrorResponse).Message, ".id: is required")
+	}
+
+	record.Type = "schema-trial"
+	warnings, err = checkRecordSchema(record)
+	assert.NoError(t, err)
+	assert.Len(t, warnings, 1)
+
+	record.Data = json.RawMessage(`{"id": 1}`)
+	warnings, err = checkRecordSchema(record)
+	assert.NoError(t, err)
+	assert.Empty(t, warnings)
+
+	// types without a schema aren't checked
+	record.Type = "other"
+	record.Data = json.RawMessage(`[]`)
+	warnings, err = checkRecordSchema(record)
+	assert.NoError(t, err)
+	assert.Empty(t, warnings)
+
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pdxfixit/hostdb"
+)
+
+// timestamps are stored in UTC, in the legacy format
+const storedTimestampFormat = "2006-01-02 15:04:05"
+
+// the formats a response's timestamps may use; see api.v0.timestamp_format and the _timestamp_format query param
+const (
+	timestampFormatRFC3339 = "rfc3339"
+	timestampFormatLegacy  = "legacy"
+)
+
+var bareYear = regexp.MustCompile(`^[0-9]{4}$`)
+
+// the range of the timestamp column
+var (
+	minTimestamp = time.Date(1970, 1, 1, 0, 0, 1, 0, time.UTC)
+	maxTimestamp = time.Date(2038, 1, 19, 3, 14, 7, 0, time.UTC)
+)
+
+// parse a timestamp in RFC 3339, epoch seconds, or the legacy format (which is assumed to be UTC), and convert it to UTC
+// timestamps which the timestamp column can't hold are refused, e.g. epoch milliseconds, or a bare year taken as epoch seconds
+func parseTimestamp(value string) (time.Time, error) {
+
+	value = strings.TrimSpace(value)
+
+	timestamp, err := parseAnyTimestamp(value)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if timestamp.Before(minTimestamp) || timestamp.After(maxTimestamp) {
+		return time.Time{}, fmt.Errorf("'%s' is out of range; timestamps must be between %s and %s UTC, and epoch timestamps are in seconds",
+			value, minTimestamp.Format(storedTimestampFormat), maxTimestamp.Format(storedTimestampFormat))
+	}
+
+	return timestamp, nil
+
+}
+
+func parseAnyTimestamp(value string) (time.Time, error) {
+
+	if timestamp, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return timestamp.UTC(), nil
+	}
+
+	if timestamp, err := time.Parse(storedTimestampFormat, value); err == nil {
+		return timestamp, nil
+	}
+
+	// a bare year would otherwise be taken as a few minutes after the epoch
+	if bareYear.MatchString(value) {
+		return time.Time{}, fmt.Errorf("'%s' looks like a year, rather than epoch seconds; use RFC 3339, e.g. %s-01-01T00:00:00Z", value, value)
+	}
+
+	// epoch seconds, possibly with a fraction
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && !math.IsInf(seconds, 0) && !math.IsNaN(seconds) && math.Abs(seconds) < 1e15 {
+		whole, fraction := math.Modf(seconds)
+		return time.Unix(int64(whole), int64(fraction*1e9)).UTC(), nil
+	}
+
+	return time.Time{}, fmt.Errorf("'%s' is not a valid timestamp; use RFC 3339, epoch seconds, or %s", value, storedTimestampFormat)
+
+}
+
+// parse a timestamp, and return it in the stored format
+// an invalid timestamp is a 400
+func normaliseTimestamp(value string) (string, error) {
+
+	timestamp, err := parseTimestamp(value)
+	if err != nil {
+		return "", hostdb.ErrorResponse{
+			Code:    http.StatusBadRequest,
+			Message: err.Error(),
+		}
+	}
+
+	return timestamp.Format(storedTimestampFormat), nil
+
+}
+
+// whether a response should use the legacy timestamp format, rather than RFC 3339
+func legacyTimestamps(c *gin.Context) bool {
+
+	format := serverConfig.API.V0.TimestampFormat
+	if value := c.Query("_timestamp_format"); value != "" {
+		format = value
+	}
+
+	return strings.ToLower(format) == timestampFormatLegacy
+
+}
+
+// convert stored timestamps, in place, into the format of the response
+// anything which isn't a stored timestamp (such as an empty string) is left alone
+func formatTimestamps(c *gin.Context, timestamps ...*string) {
+
+	if legacyTimestamps(c) {
+		return
+	}
+
+	for _, value := range timestamps {
+		*value = rfc3339Timestamp(*value)
+	}
+
+}
+
+// convert a stored timestamp into RFC 3339; anything else is returned as it is
+func rfc3339Timestamp(value string) string {
+
+	timestamp, err := time.Parse(storedTimestampFormat, value)
+	if err != nil {
+		return value
+	}
+
+	return timestamp.Format(time.RFC3339)
+
+}
+
+// convert the timestamps of a collection of records into the format of the response
+func formatRecordTimestamps(c *gin.Context, records map[string]hostdb.Record) {
+
+	for id, record := range records {
+		formatTimestamps(c, &record.Timestamp)
+		records[id] = record
+	}
+
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pdxfixit/hostdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTimestamp(t *testing.T) {
+
+	expected := time.Date(2020, 5, 2, 20, 9, 26, 0, time.UTC)
+
+	for _, value := range []string{
+		"2020-05-02 20:09:26",
+		"2020-05-02T20:09:26Z",
+		"2020-05-02T13:09:26-07:00",
+		"1588450166",
+		" 1588450166 ",
+	} {
+		timestamp, err := parseTimestamp(value)
+		if assert.NoError(t, err, value) {
+			assert.True(t, expected.Equal(timestamp), "%s: %v", value, timestamp)
+			assert.Equal(t, time.UTC, timestamp.Location(), "%s is utc", value)
+		}
+	}
+
+	timestamp, err := parseTimestamp("1588450166.5")
+	if assert.NoError(t, err, "fractional epoch") {
+		assert.Equal(t, expected.Add(500*time.Millisecond), timestamp, "fractional epoch")
+	}
+
+	for _, value := range []string{"", "0000-00-00 00:00:00", "yesterday", "2020-13-01 00:00:00", "NaN"} {
+		_, err := parseTimestamp(value)
+		assert.Error(t, err, value)
+	}
+
+	// outside the range of the timestamp column
+	for _, value := range []string{"1700000000000", "2024", "0", "1e300", "1969-12-31T23:59:59Z", "2038-01-19 03:14:08", "9999-01-01T00:00:00Z"} {
+		_, err := parseTimestamp(value)
+		assert.Error(t, err, value)
+	}
+
+	for _, value := range []string{"1970-01-01 00:00:01", "2038-01-19T03:14:07Z", "2147483647"} {
+		_, err := parseTimestamp(value)
+		assert.NoError(t, err, value)
+	}
+
+}
+
+func TestNormaliseTimestamp(t *testing.T) {
+
+	timestamp, err := normaliseTimestamp("2020-05-02T13:09:26-07:00")
+	assert.NoError(t, err)
+	assert.Equal(t, "2020-05-02 20:09:26", timestamp, "utc")
+
+	_, err = normaliseTimestamp("0000-00-00 00:00:00")
+	if assert.IsType(t, hostdb.ErrorResponse{}, err) {
+		assert.Equal(t, http.StatusBadRequest, err.(hostdb.ErrorResponse).Code, "code")
+	}
+
+}
+
+func TestFormatTimestamps(t *testing.T) {
+
+	saved := serverConfig.API.V0.TimestampFormat
+	defer func() { serverConfig.API.V0.TimestampFormat = saved }()
+
+	format := func(query string) []string {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request, _ = http.NewRequest("GET", "/v0/records/"+query, nil)
+
+		values := []string{"2020-05-02 20:09:26", "", "not a timestamp"}
+		formatTimestamps(c, &values[0], &values[1], &values[2])
+
+		return values
+	}
+
+	serverConfig.API.V0.TimestampFormat = ""
+	assert.Equal(t, []string{"2020-05-02T20:09:26Z", "", "not a timestamp"}, format(""), "default")
+	assert.Equal(t, []string{"2020-05-02 20:09:26", "", "not a timestamp"}, format("?_timestamp_format=legacy"), "legacy param")
+
+	serverConfig.API.V0.TimestampFormat = timestampFormatLegacy
+	assert.Equal(t, "2020-05-02 20:09:26", format("")[0], "legacy config")
+	assert.Equal(t, "2020-05-02T20:09:26Z", format("?_timestamp_format=rfc3339")[0], "rfc3339 param")
+
+}
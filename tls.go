@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pdxfixit/hostdb"
+)
+
+// how often the certificate files are checked for changes
+const certCheckInterval = 10 * time.Second
+
+// serves the current certificate/key pair, reloading it whenever the files change
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+
+	reloader := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+
+	return reloader, nil
+
+}
+
+// the newest modification time of the certificate and key files
+func (r *certReloader) filesModTime() (time.Time, error) {
+
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if keyInfo.ModTime().After(certInfo.ModTime()) {
+		return keyInfo.ModTime(), nil
+	}
+
+	return certInfo.ModTime(), nil
+
+}
+
+func (r *certReloader) reload() error {
+
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.lastCheck = time.Now()
+	r.mu.Unlock()
+
+	return nil
+
+}
+
+// for use as tls.Config.GetCertificate
+// if reloading fails (e.g. a half-written file), keep serving the previous certificate
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+
+	r.mu.RLock()
+	cert, modTime, lastCheck := r.cert, r.modTime, r.lastCheck
+	r.mu.RUnlock()
+
+	if time.Since(lastCheck) < certCheckInterval {
+		return cert, nil
+	}
+
+	r.mu.Lock()
+	r.lastCheck = time.Now()
+	r.mu.Unlock()
+
+	if newModTime, err := r.filesModTime(); err != nil {
+		log.Println(fmt.Sprintf("checking the tls certificate failed: %v", err))
+	} else if !newModTime.Equal(modTime) {
+		if err := r.reload(); err != nil {
+			log.Println(fmt.Sprintf("reloading the tls certificate failed: %v", err))
+		} else {
+			log.Println("tls certificate reloaded")
+
+			r.mu.RLock()
+			cert = r.cert
+			r.mu.RUnlock()
+		}
+	}
+
+	return cert, nil
+
+}
+
+// prepare the tls configuration for serving https
+func loadTLSConfig(settings tlsSettings) (*tls.Config, error) {
+
+	reloader, err := newCertReloader(settings.CertFile, settings.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	switch settings.ClientAuth {
+	case "", "none":
+		tlsConfig.ClientAuth = tls.NoClientCert
+		return tlsConfig, nil
+	case "optional":
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unsupported tls client_auth value '%s'", settings.ClientAuth)
+	}
+
+	bundle, err := ioutil.ReadFile(settings.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, errors.New("no certificates found in the client ca bundle")
+	}
+
+	tlsConfig.ClientCAs = pool
+
+	return tlsConfig, nil
+
+}
+
+// if the request came with a verified client certificate, return the mapped writer identity
+func clientCertIdentity(r *http.Request) string {
+
+	return mappedClientCertIdentity(r, serverConfig.Hostdb.TLS.ClientIdentities)
+
+}
+
+// if the request came with a verified client certificate, return the mapped admin identity
+func clientCertAdminIdentity(r *http.Request) string {
+
+	return mappedClientCertIdentity(r, serverConfig.Hostdb.TLS.AdminIdentities)
+
+}
+
+// the identity a verified client certificate's subject is mapped to, if any
+func mappedClientCertIdentity(r *http.Request, mappings []tlsClientIdentity) string {
+
+	if r.TLS == nil || len(r.TLS.VerifiedChains) < 1 || len(r.TLS.VerifiedChains[0]) < 1 {
+		return ""
+	}
+
+	leaf := r.TLS.VerifiedChains[0][0]
+
+	for _, mapping := range mappings {
+		if mapping.Subject == leaf.Subject.String() || mapping.Subject == leaf.Subject.CommonName {
+			return mapping.Identity
+		}
+	}
+
+	return ""
+
+}
+
+// accept either a mapped client certificate, or the writer's basic auth credentials
+func writerAuth() gin.HandlerFunc {
+
+	basicAuth := gin.BasicAuthForRealm(gin.Accounts{"writer": config.Hostdb.Pass}, "HostDB")
+
+	return func(c *gin.Context) {
+
+		if identity := clientCertIdentity(c.Request); identity != "" {
+			c.Set(gin.AuthUserKey, identity)
+			return
+		}
+
+		basicAuth(c)
+
+	}
+
+}
+
+// require the admin's credentials, for destructive or administrative requests;
+// either a client certificate mapped to an admin identity, or the admin's basic auth credentials
+// the writer's credentials are never accepted, so without an admin_pass, only admin certificates are
+func adminAuth() gin.HandlerFunc {
+
+	basicAuth := func(c *gin.Context) {
+		c.Header("WWW-Authenticate", `Basic realm="HostDB"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, hostdb.GenericError{
+			Error: "admin_pass isn't set, so only a client certificate mapped to an admin identity may be used",
+		})
+	}
+
+	if serverConfig.Hostdb.AdminPass != "" {
+		basicAuth = gin.BasicAuthForRealm(gin.Accounts{"admin": serverConfig.Hostdb.AdminPass}, "HostDB")
+	}
+
+	return func(c *gin.Context) {
+
+		if identity := clientCertAdminIdentity(c.Request); identity != "" {
+			c.Set(gin.AuthUserKey, identity)
+			return
+		}
+
+		basicAuth(c)
+
+	}
+
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// write a self-signed certificate and key for the given common name
+func writeTestCertificate(t *testing.T, dir string, commonName string) (certFile string, keyFile string, cert *x509.Certificate) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName, Organization: []string{"PDXfixIT"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, "tls.crt")
+	keyFile = filepath.Join(dir, "tls.key")
+
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile, cert
+
+}
+
+func TestCertReloader(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "hostdb-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	certFile, keyFile, first := writeTestCertificate(t, dir, "first")
+
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := reloader.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, first.Raw, cert.Certificate[0], "initial certificate")
+
+	// replace the files, and pretend the last check was a while ago
+	_, _, second := writeTestCertificate(t, dir, "second")
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(certFile, future, future); err != nil {
+		t.Fatal(err)
+	}
+	reloader.lastCheck = time.Now().Add(-2 * certCheckInterval)
+
+	cert, err = reloader.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, second.Raw, cert.Certificate[0], "reloaded certificate")
+
+	// a broken key file shouldn't take down the current certificate
+	if err := ioutil.WriteFile(keyFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := future.Add(time.Minute)
+	if err := os.Chtimes(keyFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	reloader.lastCheck = time.Now().Add(-2 * certCheckInterval)
+
+	cert, err = reloader.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, second.Raw, cert.Certificate[0], "previous certificate kept")
+
+}
+
+func TestLoadTLSConfig(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "hostdb-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	certFile, keyFile, _ := writeTestCertificate(t, dir, "server")
+
+	tlsConfig, err := loadTLSConfig(tlsSettings{CertFile: certFile, KeyFile: keyFile, ClientAuth: "none"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, tls.NoClientCert, tlsConfig.ClientAuth, "no client auth")
+
+	tlsConfig, err = loadTLSConfig(tlsSettings{CertFile: certFile, KeyFile: keyFile, ClientAuth: "require", ClientCAFile: certFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, tls.RequireAndVerifyClientCert, tlsConfig.ClientAuth, "client auth required")
+	assert.NotNil(t, tlsConfig.ClientCAs, "client ca pool")
+
+	_, err = loadTLSConfig(tlsSettings{CertFile: certFile, KeyFile: keyFile, ClientAuth: "sometimes"})
+	assert.Error(t, err, "unsupported client_auth")
+
+	_, err = loadTLSConfig(tlsSettings{CertFile: certFile, KeyFile: keyFile, ClientAuth: "optional", ClientCAFile: keyFile})
+	assert.Error(t, err, "ca bundle without certificates")
+
+}
+
+func TestAdminAuth(t *testing.T) {
+
+	saved := serverConfig.Hostdb.AdminPass
+	defer func() { serverConfig.Hostdb.AdminPass = saved }()
+
+	request := func(handler gin.HandlerFunc, user string, pass string) int {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request, _ = http.NewRequest("DELETE", "/v0/records/", nil)
+		c.Request.SetBasicAuth(user, pass)
+
+		handler(c)
+
+		if c.IsAborted() {
+			return w.Code
+		}
+
+		return http.StatusOK
+	}
+
+	// without an admin password, no basic auth credentials are accepted, not even the writer's
+	serverConfig.Hostdb.AdminPass = ""
+	assert.Equal(t, http.StatusUnauthorized, request(adminAuth(), "writer", config.Hostdb.Pass), "writer without admin_pass")
+	assert.Equal(t, http.StatusUnauthorized, request(adminAuth(), "admin", ""), "admin without admin_pass")
+
+	serverConfig.Hostdb.AdminPass = "adminpassword"
+	handler := adminAuth()
+	assert.Equal(t, http.StatusOK, request(handler, "admin", "adminpassword"), "admin")
+	assert.Equal(t, http.StatusUnauthorized, request(handler, "writer", config.Hostdb.Pass), "writer with admin_pass")
+	assert.Equal(t, http.StatusUnauthorized, request(handler, "admin", "wrong"), "wrong password")
+
+}
+
+func TestClientCertIdentity(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "hostdb-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	_, _, cert := writeTestCertificate(t, dir, "hostdb-collector-aws")
+
+	saved := serverConfig.Hostdb.TLS.ClientIdentities
+	defer func() { serverConfig.Hostdb.TLS.ClientIdentities = saved }()
+
+	serverConfig.Hostdb.TLS.ClientIdentities = []tlsClientIdentity{
+		{Subject: "hostdb-collector-aws", Identity: "collector-aws"},
+	}
+
+	req, _ := http.NewRequest("POST", "/v0/records/", nil)
+	assert.Equal(t, "", clientCertIdentity(req), "plain http")
+
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	assert.Equal(t, "collector-aws", clientCertIdentity(req), "matched by common name")
+
+	serverConfig.Hostdb.TLS.ClientIdentities = []tlsClientIdentity{
+		{Subject: cert.Subject.String(), Identity: "collector-aws-dn"},
+	}
+	assert.Equal(t, "collector-aws-dn", clientCertIdentity(req), "matched by distinguished name")
+
+	serverConfig.Hostdb.TLS.ClientIdentities = nil
+	assert.Equal(t, "", clientCertIdentity(req), "unmapped subject")
+
+	// writer and admin identities are mapped separately
+	savedAdmins := serverConfig.Hostdb.TLS.AdminIdentities
+	defer func() { serverConfig.Hostdb.TLS.AdminIdentities = savedAdmins }()
+
+	serverConfig.Hostdb.TLS.ClientIdentities = []tlsClientIdentity{
+		{Subject: "hostdb-collector-aws", Identity: "collector-aws"},
+	}
+	assert.Equal(t, "", clientCertAdminIdentity(req), "a writer isn't an admin")
+
+	serverConfig.Hostdb.TLS.AdminIdentities = []tlsClientIdentity{
+		{Subject: "hostdb-collector-aws", Identity: "admin-aws"},
+	}
+	assert.Equal(t, "admin-aws", clientCertAdminIdentity(req), "admin")
+
+}
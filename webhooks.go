@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pdxfixit/hostdb"
+)
+
+// the states of a webhook delivery
+const (
+	deliveryPending   = "pending"
+	deliverySucceeded = "succeeded"
+	deliveryFailed    = "failed"
+)
+
+const (
+	defaultWebhookMaxAttempts = 8
+	defaultWebhookTimeout     = 10 * time.Second
+	defaultWebhookRetention   = 7 * 24 * time.Hour
+	webhookPollInterval       = 5 * time.Second  // how often due deliveries are looked for, when nothing has been queued
+	webhookRetryDelay         = 30 * time.Second // before the first retry; doubled for each retry after that
+	webhookMaxRetryDelay      = time.Hour
+	webhookLease              = 5 * time.Minute // a delivery being sent isn't retried before this, even if its sender dies
+	webhookSendBatchSize      = 100
+)
+
+// the sender of queued webhook deliveries; started by startWebhooks
+var webhookSender *webhookRunner
+
+// a subscription to record change events
+type webhook struct {
+	ID        string              `json:"id"`
+	URL       string              `json:"url"`
+	Secret    string              `json:"secret,omitempty"` // signs each delivery; write-only
+	Filter    map[string][]string `json:"filter"`           // query params, as for GET /v0/records/; only matching records are sent
+	Events    []string            `json:"events"`
+	Disabled  bool                `json:"disabled"`
+	Created   string              `json:"created"`
+	Updated   string              `json:"updated"`
+	Principal string              `json:"principal"`
+}
+
+// an event for a single record, queued to be sent to a webhook
+type webhookDelivery struct {
+	ID          string          `json:"id"`
+	WebhookID   string          `json:"webhook_id"`
+	Event       string          `json:"event"`
+	RecordID    string          `json:"record_id"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt string          `json:"next_attempt,omitempty"`
+	StatusCode  int             `json:"status_code,omitempty"` // the response to the last attempt
+	Error       string          `json:"error,omitempty"`       // why the last attempt failed
+	Created     string          `json:"created"`
+	Delivered   string          `json:"delivered,omitempty"`
+}
+
+// the body of a webhook request
+type webhookPayload struct {
+	Delivery  string        `json:"delivery"`
+	Event     string        `json:"event"`
+	Timestamp string        `json:"timestamp"`
+	Record    hostdb.Record `json:"record"`
+}
+
+// sends due deliveries, when woken or every webhookPollInterval
+type webhookRunner struct {
+	client *http.Client
+	wake   chan struct{}
+}
+
+// start sending queued webhook deliveries, including those left over from before a restart
+func startWebhooks() {
+
+	timeout := serverConfig.API.V0.Webhooks.Timeout
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeout
+	}
+
+	webhookSender = &webhookRunner{
+		client: &http.Client{Timeout: timeout},
+		wake:   make(chan struct{}, 1),
+	}
+
+	go webhookSender.run()
+
+}
+
+// check that a webhook subscription can be saved, and fill in its defaults
+func validateWebhook(hook *webhook) error {
+
+	target, err := url.Parse(hook.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return fmt.Errorf("url must be an absolute http or https url")
+	}
+
+	if hook.Secret == "" {
+		return fmt.Errorf("a secret is required, to sign the deliveries")
+	}
+
+	if hook.Filter == nil {
+		hook.Filter = map[string][]string{}
+	}
+
+	for param := range hook.Filter {
+		if param == "_limit" || param == "_offset" {
+			return fmt.Errorf("%s is not supported in a webhook filter", param)
+		}
+	}
+
+	if _, _, err := queryWhereClauses(hook.Filter); err != nil {
+		if err, ok := err.(hostdb.ErrorResponse); ok {
+			return fmt.Errorf("invalid filter: %s", err.Message)
+		}
+		return fmt.Errorf("invalid filter: %v", err)
+	}
+
+	if len(hook.Events) < 1 {
+		hook.Events = append([]string{}, recordEventTypes...)
+	}
+
+	supported := webhook{Events: recordEventTypes}
+	for _, event := range hook.Events {
+		if !supported.subscribes(event) {
+			return fmt.Errorf("unsupported event '%s'; events may be %v", event, recordEventTypes)
+		}
+	}
+
+	return nil
+
+}
+
+// whether the webhook wants a kind of event
+func (hook webhook) subscribes(event string) bool {
+
+	for _, subscribed := range hook.Events {
+		if subscribed == event {
+			return true
+		}
+	}
+
+	return false
+
+}
+
+// the webhook, as shown to admins; the secret is never shown
+func (hook webhook) redacted() webhook {
+
+	hook.Secret = ""
+
+	return hook
+
+}
+
+// queue the deliveries of an event to the webhooks which subscribe to it, for each of the records which match their filters
+func queueWebhookDeliveries(event string, records []hostdb.Record) {
+
+	if len(records) < 1 {
+		return
+	}
+
+	hooks, err := getMariadbWebhooks()
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+
+	now := time.Now().UTC()
+
+	var deliveries []webhookDelivery
+
+	// hooks with the same filter share the matching, like event streams do
+	batch := newEventBatch(make([]recordEvent, 0, len(records)))
+	for _, record := range records {
+		batch.events = append(batch.events, recordEvent{Event: event, Record: record})
+	}
+
+	for _, hook := range hooks {
+		if hook.Disabled || !hook.subscribes(event) {
+			continue
+		}
+
+		where, _, err := queryWhereClauses(hook.Filter)
+		if err != nil {
+			log.Println(fmt.Sprintf("webhook %s has an invalid filter: %v", hook.ID, err))
+			continue
+		}
+
+		matched, err := batch.match(where)
+		if err != nil {
+			log.Println(err.Error())
+			continue
+		}
+
+		for i, record := range records {
+			if !matched[i] {
+				continue
+			}
+
+			delivery, err := newWebhookDelivery(hook, event, record, now)
+			if err != nil {
+				log.Println(err.Error())
+				continue
+			}
+
+			deliveries = append(deliveries, delivery)
+		}
+	}
+
+	if len(deliveries) < 1 {
+		return
+	}
+
+	for start := 0; start < len(deliveries); start += defaultBulkBatchSize {
+		end := start + defaultBulkBatchSize
+		if end > len(deliveries) {
+			end = len(deliveries)
+		}
+
+		if err := saveMariadbWebhookDeliveries(deliveries[start:end]); err != nil {
+			log.Println(err.Error())
+		}
+	}
+
+	if webhookSender != nil {
+		select {
+		case webhookSender.wake <- struct{}{}:
+		default:
+		}
+	}
+
+}
+
+// prepare the delivery of an event for a record
+func newWebhookDelivery(hook webhook, event string, record hostdb.Record, now time.Time) (webhookDelivery, error) {
+
+	delivery := webhookDelivery{
+		ID:          getUUID("dlv"),
+		WebhookID:   hook.ID,
+		Event:       event,
+		RecordID:    record.ID,
+		Status:      deliveryPending,
+		NextAttempt: now.Format(storedTimestampFormat),
+		Created:     now.Format(storedTimestampFormat),
+	}
+
+	record.Timestamp = rfc3339Timestamp(record.Timestamp)
+
+	payload, err := json.Marshal(webhookPayload{
+		Delivery:  delivery.ID,
+		Event:     event,
+		Timestamp: now.Format(time.RFC3339),
+		Record:    record,
+	})
+	if err != nil {
+		return webhookDelivery{}, err
+	}
+
+	delivery.Payload = payload
+
+	return delivery, nil
+
+}
+
+func (w *webhookRunner) run() {
+
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+
+	for {
+		w.sendDue()
+
+		select {
+		case <-ticker.C:
+		case <-w.wake:
+		}
+	}
+
+}
+
+// send every delivery which is due
+func (w *webhookRunner) sendDue() {
+
+	hooks := map[string]webhook{}
+
+	for {
+		now := time.Now().UTC()
+
+		due, err := getMariadbDueWebhookDeliveries(now.Format(storedTimestampFormat), webhookSendBatchSize)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+
+		for _, delivery := range due {
+			// claim it, so that no other sender sends it at the same time
+			claimed, err := claimMariadbWebhookDelivery(delivery, now.Add(webhookLease).Format(storedTimestampFormat))
+			if err != nil {
+				log.Println(err.Error())
+				return
+			}
+			if !claimed {
+				continue
+			}
+			delivery.Attempts++
+
+			hook, ok := hooks[delivery.WebhookID]
+			if !ok {
+				if hook, err = getMariadbWebhook(delivery.WebhookID); err != nil {
+					log.Println(err.Error())
+					return
+				}
+				hooks[delivery.WebhookID] = hook
+			}
+
+			w.send(hook, &delivery)
+
+			if err := saveMariadbWebhookDelivery(delivery); err != nil {
+				log.Println(err.Error())
+			}
+		}
+
+		if len(due) < webhookSendBatchSize {
+			break
+		}
+	}
+
+}
+
+// how long the history of finished deliveries is kept
+func webhookRetention() time.Duration {
+
+	if retention := serverConfig.API.V0.Webhooks.Retention; retention > 0 {
+		return retention
+	}
+
+	return defaultWebhookRetention
+
+}
+
+// make one attempt at a delivery, and record the outcome on it
+func (w *webhookRunner) send(hook webhook, delivery *webhookDelivery) {
+
+	err := w.post(hook, delivery)
+	if err == nil {
+		delivery.Status = deliverySucceeded
+		delivery.Error = ""
+		delivery.NextAttempt = ""
+		delivery.Delivered = time.Now().UTC().Format(storedTimestampFormat)
+		return
+	}
+
+	delivery.Error = err.Error()
+	if len(delivery.Error) > 1024 {
+		delivery.Error = delivery.Error[:1024]
+	}
+
+	maxAttempts := serverConfig.API.V0.Webhooks.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = defaultWebhookMaxAttempts
+	}
+
+	if hook.ID == "" || hook.Disabled || delivery.Attempts >= maxAttempts {
+		delivery.Status = deliveryFailed
+		delivery.NextAttempt = ""
+		return
+	}
+
+	delivery.NextAttempt = time.Now().Add(webhookBackoff(delivery.Attempts)).UTC().Format(storedTimestampFormat)
+
+}
+
+// post a delivery to its webhook, signed with the webhook's secret
+func (w *webhookRunner) post(hook webhook, delivery *webhookDelivery) error {
+
+	if hook.ID == "" {
+		return fmt.Errorf("webhook %s no longer exists", delivery.WebhookID)
+	}
+
+	if hook.Disabled {
+		return fmt.Errorf("webhook %s is disabled", hook.ID)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", fmt.Sprintf("HostDB/%s", appVersion))
+	req.Header.Set("X-HostDB-Event", delivery.Event)
+	req.Header.Set("X-HostDB-Delivery", delivery.ID)
+	req.Header.Set("X-HostDB-Signature", webhookSignature(hook.Secret, delivery.Payload))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		delivery.StatusCode = 0
+		return err
+	}
+	defer func() {
+		// a subscriber's misbehaviour is no reason to take the server down
+		if err := resp.Body.Close(); err != nil {
+			log.Println(err.Error())
+		}
+	}()
+
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<20))
+
+	delivery.StatusCode = resp.StatusCode
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("the webhook responded with %s", resp.Status)
+	}
+
+	return nil
+
+}
+
+// the signature of a delivery's body; the receiver computes the same HMAC with the shared secret, and compares them
+func webhookSignature(secret string, payload []byte) string {
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+}
+
+// how long to wait before retrying a delivery, after a number of failed attempts
+func webhookBackoff(attempts int) time.Duration {
+
+	delay := webhookRetryDelay
+	for i := 1; i < attempts && delay < webhookMaxRetryDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > webhookMaxRetryDelay {
+		delay = webhookMaxRetryDelay
+	}
+
+	return delay
+
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookSignature(t *testing.T) {
+
+	// RFC 4231, test case 2
+	assert.Equal(t,
+		"sha256=5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843",
+		webhookSignature("Jefe", []byte("what do ya want for nothing?")),
+	)
+
+}
+
+func TestWebhookBackoff(t *testing.T) {
+
+	assert.Equal(t, webhookRetryDelay, webhookBackoff(1), "first retry")
+	assert.Equal(t, 2*webhookRetryDelay, webhookBackoff(2), "second retry")
+	assert.Equal(t, 4*webhookRetryDelay, webhookBackoff(3), "third retry")
+	assert.Equal(t, webhookMaxRetryDelay, webhookBackoff(20), "capped")
+
+}
+
+func TestValidateWebhook(t *testing.T) {
+
+	hook := webhook{URL: "https://tickets.pdxfixit.com/hooks/hostdb", Secret: "s3cret"}
+	if assert.NoError(t, validateWebhook(&hook)) {
+		assert.Equal(t, recordEventTypes, hook.Events, "all events by default")
+		assert.NotNil(t, hook.Filter, "empty filter")
+	}
+
+	hook = webhook{URL: "https://tickets.pdxfixit.com/", Secret: "s3cret", Filter: map[string][]string{"type": {"openstack"}}, Events: []string{recordEventCreate}}
+	assert.NoError(t, validateWebhook(&hook), "filter and events")
+
+	for name, invalid := range map[string]webhook{
+		"relative url":  {URL: "/hooks", Secret: "s3cret"},
+		"ftp url":       {URL: "ftp://tickets.pdxfixit.com/", Secret: "s3cret"},
+		"no secret":     {URL: "https://tickets.pdxfixit.com/"},
+		"bad event":     {URL: "https://tickets.pdxfixit.com/", Secret: "s3cret", Events: []string{"rename"}},
+		"bad param":     {URL: "https://tickets.pdxfixit.com/", Secret: "s3cret", Filter: map[string][]string{"colour": {"blue"}}},
+		"limited param": {URL: "https://tickets.pdxfixit.com/", Secret: "s3cret", Filter: map[string][]string{"_limit": {"1"}}},
+	} {
+		invalid := invalid
+		assert.Error(t, validateWebhook(&invalid), name)
+	}
+
+}
+
+func TestWebhookSend(t *testing.T) {
+
+	var status int
+	var received *http.Request
+	var body []byte
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	runner := &webhookRunner{client: &http.Client{Timeout: time.Second}}
+	hook := webhook{ID: "whk-test", URL: server.URL, Secret: "s3cret"}
+	payload := json.RawMessage(`{"event":"create"}`)
+
+	// success
+	status = http.StatusNoContent
+	delivery := webhookDelivery{ID: "dlv-1", WebhookID: hook.ID, Event: recordEventCreate, Payload: payload, Status: deliveryPending, Attempts: 1}
+	runner.send(hook, &delivery)
+
+	assert.Equal(t, deliverySucceeded, delivery.Status, "succeeded")
+	assert.Equal(t, http.StatusNoContent, delivery.StatusCode, "status code")
+	assert.NotEmpty(t, delivery.Delivered, "delivered")
+	assert.Equal(t, webhookSignature("s3cret", payload), received.Header.Get("X-HostDB-Signature"), "signature")
+	assert.Equal(t, recordEventCreate, received.Header.Get("X-HostDB-Event"), "event")
+	assert.Equal(t, "dlv-1", received.Header.Get("X-HostDB-Delivery"), "delivery")
+	assert.Equal(t, string(payload), string(body), "body")
+
+	// a failure is retried later
+	status = http.StatusServiceUnavailable
+	delivery = webhookDelivery{ID: "dlv-2", WebhookID: hook.ID, Payload: payload, Status: deliveryPending, Attempts: 1}
+	runner.send(hook, &delivery)
+
+	assert.Equal(t, deliveryPending, delivery.Status, "pending")
+	assert.Equal(t, http.StatusServiceUnavailable, delivery.StatusCode, "failed status code")
+	assert.Contains(t, delivery.Error, "503", "error")
+	assert.NotEmpty(t, delivery.NextAttempt, "next attempt")
+
+	// until it runs out of attempts
+	delivery.Attempts = defaultWebhookMaxAttempts
+	runner.send(hook, &delivery)
+	assert.Equal(t, deliveryFailed, delivery.Status, "failed")
+	assert.Empty(t, delivery.NextAttempt, "no next attempt")
+
+	// a deleted webhook isn't retried
+	delivery = webhookDelivery{ID: "dlv-3", WebhookID: "whk-gone", Payload: payload, Status: deliveryPending, Attempts: 1}
+	runner.send(webhook{}, &delivery)
+	assert.Equal(t, deliveryFailed, delivery.Status, "deleted webhook")
+
+}